@@ -0,0 +1,602 @@
+// Command xbasic runs QBasic-compatible BASIC programs.
+//
+// Usage:
+//
+//	xbasic [flags] [program.bas [arg ...]]
+//	xbasic debug [-explicit] [-dialect name] [-I dir] program.bas
+//	xbasic dap [-listen addr]
+//	xbasic lsp
+//	xbasic fmt [-w] [-d] [file.bas ...]
+//	xbasic vet [-json] [-dialect name] [-I dir] [file.bas ...]
+//
+// When no program file is given and standard input is a terminal, xbasic
+// starts an interactive prompt. Otherwise, or when the file is "-", the
+// program source is read from standard input. Arguments after the program
+// file are passed to it through COMMAND$, and END n or SYSTEM n sets the
+// exit status. The debug command runs a
+// program under the interactive debugger, and the dap command serves the
+// Debug Adapter Protocol for editors on stdio or a TCP address. The lsp
+// command serves the Language Server Protocol on stdio, the fmt command
+// formats source files, and the vet command reports likely mistakes.
+//
+// The run, debug and vet commands expand $INCLUDE metacommands and load
+// IMPORTed libraries. The -I flag adds a directory to search for these
+// files after the directory of the including file.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/dap"
+	"github.com/xbasic/xbasic/internal/debugger"
+	"github.com/xbasic/xbasic/internal/format"
+	"github.com/xbasic/xbasic/internal/include"
+	"github.com/xbasic/xbasic/internal/interpreter"
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/lsp"
+	"github.com/xbasic/xbasic/internal/module"
+	"github.com/xbasic/xbasic/internal/parser"
+	"github.com/xbasic/xbasic/internal/repl"
+	"github.com/xbasic/xbasic/internal/screen"
+	"github.com/xbasic/xbasic/internal/vet"
+	"golang.org/x/term"
+)
+
+const version = "0.1.0"
+
+// Process exit codes
+const (
+	exitOK           = 0
+	exitRuntimeError = 1
+	exitVetProblems  = 1
+	exitSyntaxError  = 2
+	exitUsage        = 64
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "debug":
+			return runDebug(args[1:])
+		case "dap":
+			return runDAP(args[1:])
+		case "lsp":
+			return runLSP(args[1:])
+		case "fmt":
+			return runFmt(args[1:])
+		case "vet":
+			return runVet(args[1:])
+		}
+	}
+
+	fs := flag.NewFlagSet("xbasic", flag.ContinueOnError)
+	showVersion := fs.Bool("version", false, "print version and exit")
+	useVM := fs.Bool("vm", false, "run on the bytecode VM")
+	explicit := fs.Bool("explicit", false, "require variables to be declared, as with OPTION EXPLICIT")
+	dialect := dialectFlag(fs)
+	includePath := includeFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: xbasic [flags] [program.bas [arg ...]]\n")
+		fmt.Fprintf(fs.Output(), "       xbasic debug [-explicit] [-dialect name] [-I dir] program.bas\n")
+		fmt.Fprintf(fs.Output(), "       xbasic dap [-listen addr]\n")
+		fmt.Fprintf(fs.Output(), "       xbasic lsp\n")
+		fmt.Fprintf(fs.Output(), "       xbasic fmt [-w] [-d] [file.bas ...]\n")
+		fmt.Fprintf(fs.Output(), "       xbasic vet [-json] [-dialect name] [-I dir] [file.bas ...]\n\n")
+		fmt.Fprintf(fs.Output(), "Runs a BASIC program. Without a file, starts an interactive prompt on a\n")
+		fmt.Fprintf(fs.Output(), "terminal and otherwise reads the program from stdin.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if *showVersion {
+		fmt.Println("xbasic", version)
+		return exitOK
+	}
+
+	if fs.NArg() == 0 && isTerminal(os.Stdin) {
+		return runREPL()
+	}
+
+	filename := "-"
+	if fs.NArg() > 0 {
+		filename = fs.Arg(0)
+	}
+
+	src, err := loadSource(filename, *includePath)
+	if err != nil {
+		return sourceError(err)
+	}
+	filename = src.Name
+
+	l := lexer.New(src.Text)
+	l.SetDialect(*dialect)
+	p := parser.New(l)
+	p.SetExplicit(*explicit)
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		for _, msg := range errs {
+			fmt.Fprintln(os.Stderr, diagnostic(src, msg))
+		}
+		return exitSyntaxError
+	}
+	if err := module.Link(program, src, *includePath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSyntaxError
+	}
+
+	interp := interpreter.New(program)
+	var bc *interpreter.Bytecode
+	if *useVM {
+		// Report what the VM cannot run, so the two engines are never
+		// silently swapped
+		if bc, err = interp.Compile(); err != nil {
+			fmt.Fprintln(os.Stderr, diagnostic(src, err.Error()))
+			return exitSyntaxError
+		}
+	}
+	programArgs := []string{filename}
+	if fs.NArg() > 1 {
+		programArgs = append(programArgs, fs.Args()[1:]...)
+	}
+	interp.SetArgs(programArgs)
+
+	if isTerminal(os.Stdout) {
+		scr, err := screen.New()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+			return exitRuntimeError
+		}
+		interp.SetScreen(scr)
+		interp.SetInput(scr.ReadLine)
+		if isTerminal(os.Stderr) {
+			// the screen owns the terminal, so errors are shown on it
+			interp.SetStderr(writerFunc(func(p []byte) (int, error) {
+				scr.Print(string(p))
+				return len(p), nil
+			}))
+		}
+
+		err = execute(interp, bc)
+		if err != nil {
+			scr.Print("\n" + err.Error() + "\n")
+		}
+		scr.Print("\nPress any key to continue")
+		scr.WaitKey()
+		scr.Close()
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: runtime error: %v\n", filename, err)
+			return exitRuntimeError
+		}
+		return interp.ExitCode()
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	in := bufio.NewReader(os.Stdin)
+
+	interp.SetStdin(in)
+	// commands read standard input itself rather than through the buffer
+	interp.SetShell(interpreter.OSShell{Stdin: os.Stdin})
+	interp.SetOutput(func(s string) {
+		out.WriteString(s)
+	})
+	// flush first so that output and errors sent to one place stay in order
+	interp.SetStderr(writerFunc(func(p []byte) (int, error) {
+		out.Flush()
+		return os.Stderr.Write(p)
+	}))
+	interp.SetInput(func(prompt string) string {
+		out.WriteString(prompt)
+		out.Flush()
+		return readLine(in)
+	})
+
+	if err := execute(interp, bc); err != nil {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "%s: runtime error: %v\n", filename, err)
+		return exitRuntimeError
+	}
+	return interp.ExitCode()
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// execute runs the program on the VM if it was compiled to bc, otherwise on
+// the tree walker
+func execute(interp *interpreter.Interpreter, bc *interpreter.Bytecode) error {
+	if bc != nil {
+		return interp.RunBytecode(bc)
+	}
+	return interp.Run()
+}
+
+// runDebug runs a program under the debugger. Debugger commands and the
+// program's INPUT share standard input.
+func runDebug(args []string) int {
+	fs := flag.NewFlagSet("xbasic debug", flag.ContinueOnError)
+	explicit := fs.Bool("explicit", false, "require variables to be declared, as with OPTION EXPLICIT")
+	dialect := dialectFlag(fs)
+	includePath := includeFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: xbasic debug [-explicit] [-dialect name] [-I dir] program.bas\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	filename := fs.Arg(0)
+
+	src, err := loadSource(filename, *includePath)
+	if err != nil {
+		return sourceError(err)
+	}
+	filename = src.Name
+
+	l := lexer.New(src.Text)
+	l.SetDialect(*dialect)
+	p := parser.New(l)
+	p.SetExplicit(*explicit)
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		for _, msg := range errs {
+			fmt.Fprintln(os.Stderr, diagnostic(src, msg))
+		}
+		return exitSyntaxError
+	}
+	if err := module.Link(program, src, *includePath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSyntaxError
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	interp := interpreter.New(program)
+	interp.SetStdin(in)
+	interp.SetShell(interpreter.OSShell{Stdin: os.Stdin})
+	interp.SetOutput(func(s string) {
+		os.Stdout.WriteString(s)
+	})
+	interp.SetInput(func(prompt string) string {
+		os.Stdout.WriteString(prompt)
+		return readLine(in)
+	})
+
+	d := debugger.New(interp, program, src.Text, in, os.Stdout)
+	if err := d.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: runtime error: %v\n", filename, err)
+		return exitRuntimeError
+	}
+	return exitOK
+}
+
+// runDAP serves the Debug Adapter Protocol on stdio, or to the first
+// client that connects to the listen address
+func runDAP(args []string) int {
+	fs := flag.NewFlagSet("xbasic dap", flag.ContinueOnError)
+	listen := fs.String("listen", "", "serve one client on this TCP `address` instead of stdio")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	var in io.Reader = os.Stdin
+	var out io.Writer = os.Stdout
+	if *listen != "" {
+		ln, err := net.Listen("tcp", *listen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+			return exitUsage
+		}
+		fmt.Fprintf(os.Stderr, "xbasic: DAP server listening on %s\n", ln.Addr())
+		conn, err := ln.Accept()
+		ln.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+			return exitRuntimeError
+		}
+		defer conn.Close()
+		in, out = conn, conn
+	}
+
+	if err := dap.NewServer(in, out).Serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+		return exitRuntimeError
+	}
+	return exitOK
+}
+
+// runLSP serves the Language Server Protocol on stdio
+func runLSP(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "Usage: xbasic lsp")
+		return exitUsage
+	}
+	if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+		return exitRuntimeError
+	}
+	return exitOK
+}
+
+// runFmt formats source files, or stdin when no files are given
+func runFmt(args []string) int {
+	fs := flag.NewFlagSet("xbasic fmt", flag.ContinueOnError)
+	write := fs.Bool("w", false, "write the result to the source file instead of stdout")
+	diff := fs.Bool("d", false, "print diffs instead of the formatted source")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	if fs.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "xbasic: cannot use -w with standard input")
+			return exitUsage
+		}
+		return formatFile("-", false, *diff)
+	}
+
+	status := exitOK
+	for _, filename := range fs.Args() {
+		if code := formatFile(filename, *write, *diff); code != exitOK {
+			status = code
+		}
+	}
+	return status
+}
+
+// formatFile formats one file, writing it back, printing a diff or
+// printing the result
+func formatFile(filename string, write, diff bool) int {
+	source, err := readSource(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+		return exitUsage
+	}
+	name := filename
+	if filename == "-" {
+		name = "<stdin>"
+	}
+
+	formatted, err := format.Source([]byte(source))
+	if err != nil {
+		if serr, ok := err.(*format.SyntaxError); ok {
+			for _, msg := range serr.Errors {
+				fmt.Fprintln(os.Stderr, diagnostic(include.New(name, source), msg))
+			}
+			return exitSyntaxError
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return exitRuntimeError
+	}
+
+	switch {
+	case diff:
+		os.Stdout.Write(format.Diff(name+".orig", name, []byte(source), formatted))
+	case write:
+		if string(formatted) != source {
+			info, err := os.Stat(filename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+				return exitRuntimeError
+			}
+			if err := os.WriteFile(filename, formatted, info.Mode().Perm()); err != nil {
+				fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+				return exitRuntimeError
+			}
+		}
+	default:
+		os.Stdout.Write(formatted)
+	}
+	return exitOK
+}
+
+// vetDiagnostic is a vet.Diagnostic in the -json output of xbasic vet
+type vetDiagnostic struct {
+	File string `json:"file"`
+	vet.Diagnostic
+}
+
+// dialectFlag adds the -dialect flag, which selects the BASIC dialect the
+// program is written in
+func dialectFlag(fs *flag.FlagSet) *lexer.Dialect {
+	d := lexer.QBasic
+	fs.Func("dialect", "source `dialect`: qbasic or gwbasic (default qbasic)", func(name string) error {
+		var ok bool
+		if d, ok = lexer.ParseDialect(name); !ok {
+			return fmt.Errorf("unknown dialect %q", name)
+		}
+		return nil
+	})
+	return &d
+}
+
+// runVet reports likely mistakes in source files, or stdin when no files
+// are given
+func runVet(args []string) int {
+	fs := flag.NewFlagSet("xbasic vet", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print problems as a JSON array")
+	dialect := dialectFlag(fs)
+	includePath := includeFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	status := exitOK
+	found := []vetDiagnostic{}
+	for _, filename := range files {
+		src, err := loadSource(filename, *includePath)
+		if err != nil {
+			if code := sourceError(err); code == exitUsage {
+				return code
+			}
+			status = exitSyntaxError
+			continue
+		}
+
+		l := lexer.New(src.Text)
+		l.SetDialect(*dialect)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		if errs := p.Errors(); len(errs) > 0 {
+			for _, msg := range errs {
+				fmt.Fprintln(os.Stderr, diagnostic(src, msg))
+			}
+			status = exitSyntaxError
+			continue
+		}
+		if err := module.Link(program, src, *includePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = exitSyntaxError
+			continue
+		}
+
+		for _, d := range vet.Check(program) {
+			at := src.Origin(d.Line)
+			d.Line = at.Line
+			found = append(found, vetDiagnostic{File: at.File, Diagnostic: d})
+		}
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(found, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, d := range found {
+			fmt.Printf("%s:%d: %s\n", d.File, d.Line, d.Message)
+		}
+	}
+	if status == exitOK && len(found) > 0 {
+		status = exitVetProblems
+	}
+	return status
+}
+
+// runREPL runs the interactive prompt, using Ctrl+C to stop the running
+// program rather than xbasic itself
+func runREPL() int {
+	r := repl.New(os.Stdin, os.Stdout)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		for range interrupts {
+			r.Interrupt()
+		}
+	}()
+
+	if err := r.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+		return exitRuntimeError
+	}
+	return exitOK
+}
+
+// readSource reads the program text from a file, or from stdin for "-"
+func readSource(filename string) (string, error) {
+	if filename == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		return string(data), err
+	}
+	data, err := os.ReadFile(filename)
+	return string(data), err
+}
+
+// loadSource reads a program, from stdin for "-", and expands its
+// $INCLUDE metacommands
+func loadSource(filename string, path []string) (*include.Source, error) {
+	text, err := readSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	if filename == "-" {
+		filename = "<stdin>"
+	}
+	return include.Expand(filename, text, path)
+}
+
+// sourceError reports an error from loadSource and returns the exit code:
+// a syntax error for a bad $INCLUDE, otherwise a usage error
+func sourceError(err error) int {
+	if _, ok := err.(*include.Error); ok {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSyntaxError
+	}
+	fmt.Fprintf(os.Stderr, "xbasic: %v\n", err)
+	return exitUsage
+}
+
+// includeFlag adds the -I flag, which may be repeated to add directories
+// to the $INCLUDE search path
+func includeFlag(fs *flag.FlagSet) *[]string {
+	var path []string
+	fs.Func("I", "search `dir` for $INCLUDE and IMPORT files (repeatable)", func(dir string) error {
+		path = append(path, dir)
+		return nil
+	})
+	return &path
+}
+
+// readLine reads one line of input without its line terminator
+func readLine(r *bufio.Reader) string {
+	line, _ := r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
+}
+
+// diagnostic rewrites a parser error ("line N: message") as "file:N:
+// message", naming the file and line the source line was included from
+func diagnostic(src *include.Source, msg string) string {
+	var line int
+	if n, _ := fmt.Sscanf(msg, "line %d:", &line); n == 1 {
+		if _, rest, ok := strings.Cut(msg, ": "); ok {
+			at := src.Origin(line)
+			return fmt.Sprintf("%s:%d: %s", at.File, at.Line, rest)
+		}
+	}
+	return src.Name + ": " + msg
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
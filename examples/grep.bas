@@ -1,12 +1,21 @@
 #!/usr/local/bin/xbasic
 ' Simple grep: filter lines containing a pattern
-' Usage: echo -e "hello\nfoo\nHELLO\nbar" | ./grep.bas
-'        (reads pattern from first line, then filters remaining lines)
+' Usage: printf "hello\nfoo\nHELLO\nbar\n" | ./grep.bas foo
+'        echo -e "hello\nfoo\nHELLO\nbar" | ./grep.bas
+'        (without an argument, reads the pattern from the first line)
+' Exits with status 1 when no line matches, like grep
 
-LINE INPUT #0, pattern$
+IF _COMMANDCOUNT > 0 THEN
+    pattern$ = COMMAND$(1)
+ELSE
+    LINE INPUT #0, pattern$
+END IF
+found = 0
 DO WHILE NOT EOF(0)
     LINE INPUT #0, line$
     IF INSTR(line$, pattern$) > 0 THEN
         PRINT line$
+        found = found + 1
     END IF
 LOOP
+IF found = 0 THEN SYSTEM 1
@@ -2,7 +2,10 @@ package ast
 
 import (
 	"bytes"
+	"reflect"
 	"strings"
+
+	"github.com/xbasic/xbasic/internal/lexer"
 )
 
 // DataType represents BASIC data types
@@ -15,6 +18,7 @@ const (
 	TypeSingle           // !
 	TypeDouble           // #
 	TypeString           // $
+	TypeRecord           // user-defined TYPE
 )
 
 func (dt DataType) String() string {
@@ -29,6 +33,8 @@ func (dt DataType) String() string {
 		return "DOUBLE"
 	case TypeString:
 		return "STRING"
+	case TypeRecord:
+		return "RECORD"
 	default:
 		return "UNKNOWN"
 	}
@@ -88,6 +94,47 @@ type Expression interface {
 	expressionNode()
 }
 
+// SourceLine returns the source line recorded in the Line field of a
+// statement or expression, or 0 for nodes that do not record one
+func SourceLine(n Node) int {
+	v := reflect.Indirect(reflect.ValueOf(n))
+	if v.Kind() == reflect.Struct {
+		if f := v.FieldByName("Line"); f.IsValid() && f.Kind() == reflect.Int {
+			return int(f.Int())
+		}
+	}
+	return 0
+}
+
+// Targets returns the variables and array elements a statement assigns to
+func Targets(n Node) []Expression {
+	switch s := n.(type) {
+	case *LetStmt:
+		return []Expression{s.Name}
+	case *InputStmt:
+		return s.Variables
+	case *ReadStmt:
+		return s.Variables
+	case *InputFileStmt:
+		return s.Variables
+	case *LineInputStmt:
+		return []Expression{s.Variable}
+	case *LineInputFileStmt:
+		return []Expression{s.Variable}
+	case *SwapStmt:
+		return []Expression{s.Var1, s.Var2}
+	case *FieldStmt:
+		targets := make([]Expression, len(s.Fields))
+		for i, f := range s.Fields {
+			targets[i] = f.Variable
+		}
+		return targets
+	case *JustifyStmt:
+		return []Expression{s.Name}
+	}
+	return nil
+}
+
 // Program is the root node of every AST
 type Program struct {
 	Statements  []Statement
@@ -96,6 +143,10 @@ type Program struct {
 	DataItems   []Expression              // collected DATA items
 	Subs        map[string]*SubStatement  // SUB definitions
 	Functions   map[string]*FuncStatement // FUNCTION definitions
+	Types       map[string]*TypeStmt      // user-defined TYPE definitions
+	DefFns      map[string]*DefFnStmt     // DEF FN functions
+	Explicit    bool                      // variables must be declared (OPTION EXPLICIT)
+	Dialect     lexer.Dialect             // BASIC dialect the program is written in
 }
 
 func (p *Program) TokenLiteral() string {
@@ -123,6 +174,8 @@ func NewProgram() *Program {
 		DataItems:   []Expression{},
 		Subs:        make(map[string]*SubStatement),
 		Functions:   make(map[string]*FuncStatement),
+		Types:       make(map[string]*TypeStmt),
+		DefFns:      make(map[string]*DefFnStmt),
 	}
 }
 
@@ -130,7 +183,9 @@ func NewProgram() *Program {
 type Parameter struct {
 	Name     string
 	DataType DataType
-	ByVal    bool // if false, ByRef (default in QBasic)
+	TypeName string // user-defined type name when DataType is TypeRecord
+	ByVal    bool   // if false, ByRef (default in QBasic)
+	Array    bool   // declared as name(), receives a whole array
 }
 
 func (p *Parameter) String() string {
@@ -139,18 +194,24 @@ func (p *Parameter) String() string {
 		out.WriteString("BYVAL ")
 	}
 	out.WriteString(p.Name)
+	if p.Array {
+		out.WriteString("()")
+	}
 	if p.DataType != TypeUnknown {
 		out.WriteString(" AS ")
-		out.WriteString(p.DataType.String())
+		out.WriteString(typeString(p.DataType, p.TypeName, nil))
 	}
 	return out.String()
 }
 
 // DimVariable represents a variable in a DIM statement
 type DimVariable struct {
-	Name       string
-	Dimensions []Expression // nil for scalar, expressions for array bounds
-	DataType   DataType
+	Name         string
+	Dimensions   []Expression // nil for scalar, expressions for array bounds
+	Array        bool         // an array, possibly without bounds as in STATIC a()
+	DataType     DataType
+	TypeName     string     // user-defined type name when DataType is TypeRecord
+	StringLength Expression // n in STRING * n, nil for variable-length strings
 }
 
 func (dv *DimVariable) String() string {
@@ -164,14 +225,27 @@ func (dv *DimVariable) String() string {
 		}
 		out.WriteString(strings.Join(dims, ", "))
 		out.WriteString(")")
+	} else if dv.Array {
+		out.WriteString("()")
 	}
 	if dv.DataType != TypeUnknown {
 		out.WriteString(" AS ")
-		out.WriteString(dv.DataType.String())
+		out.WriteString(typeString(dv.DataType, dv.TypeName, dv.StringLength))
 	}
 	return out.String()
 }
 
+// typeString formats the type in an AS clause
+func typeString(dt DataType, typeName string, strLen Expression) string {
+	if dt == TypeRecord {
+		return typeName
+	}
+	if dt == TypeString && strLen != nil {
+		return "STRING * " + strLen.String()
+	}
+	return dt.String()
+}
+
 // PrintItem represents an item in a PRINT statement
 type PrintItem struct {
 	Expression Expression
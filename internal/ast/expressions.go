@@ -10,6 +10,7 @@ import (
 type IntegerLiteral struct {
 	Line  int
 	Value int64
+	Type  DataType // INTEGER, LONG or DOUBLE by its suffix or size
 }
 
 func (il *IntegerLiteral) expressionNode()      {}
@@ -20,6 +21,7 @@ func (il *IntegerLiteral) String() string       { return fmt.Sprintf("%d", il.Va
 type FloatLiteral struct {
 	Line  int
 	Value float64
+	Type  DataType // SINGLE or DOUBLE by its suffix or digits
 }
 
 func (fl *FloatLiteral) expressionNode()      {}
@@ -142,3 +144,16 @@ func (ge *GroupedExpr) TokenLiteral() string { return "(" }
 func (ge *GroupedExpr) String() string {
 	return "(" + ge.Expression.String() + ")"
 }
+
+// FieldAccess represents access to a field of a record (emp.name)
+type FieldAccess struct {
+	Line   int
+	Record Expression
+	Field  string
+}
+
+func (fa *FieldAccess) expressionNode()      {}
+func (fa *FieldAccess) TokenLiteral() string { return "." }
+func (fa *FieldAccess) String() string {
+	return fa.Record.String() + "." + fa.Field
+}
@@ -98,15 +98,21 @@ type DimStmt struct {
 }
 
 func (ds *DimStmt) statementNode()       {}
-func (ds *DimStmt) TokenLiteral() string { return "DIM" }
+func (ds *DimStmt) TokenLiteral() string {
+	if ds.Static && !ds.Shared {
+		return "STATIC"
+	}
+	return "DIM"
+}
 func (ds *DimStmt) String() string {
 	var out bytes.Buffer
-	out.WriteString("DIM ")
-	if ds.Shared {
-		out.WriteString("SHARED ")
-	}
-	if ds.Static {
+	switch {
+	case ds.Shared:
+		out.WriteString("DIM SHARED ")
+	case ds.Static:
 		out.WriteString("STATIC ")
+	default:
+		out.WriteString("DIM ")
 	}
 	vars := make([]string, len(ds.Variables))
 	for i, v := range ds.Variables {
@@ -116,6 +122,40 @@ func (ds *DimStmt) String() string {
 	return out.String()
 }
 
+// SharedStmt represents SHARED inside a SUB or FUNCTION, which gives the
+// procedure access to module-level variables
+type SharedStmt struct {
+	Line      int
+	Variables []SharedVariable
+}
+
+// SharedVariable is one name in a SHARED statement
+type SharedVariable struct {
+	Name     string
+	Array    bool // written with empty parentheses
+	DataType DataType
+	TypeName string // user-defined TYPE name when DataType is TypeRecord
+}
+
+func (ss *SharedStmt) statementNode()       {}
+func (ss *SharedStmt) TokenLiteral() string { return "SHARED" }
+func (ss *SharedStmt) String() string {
+	vars := make([]string, len(ss.Variables))
+	for i, v := range ss.Variables {
+		vars[i] = v.Name
+		if v.Array {
+			vars[i] += "()"
+		}
+		switch {
+		case v.TypeName != "":
+			vars[i] += " AS " + v.TypeName
+		case v.DataType != TypeUnknown:
+			vars[i] += " AS " + v.DataType.String()
+		}
+	}
+	return "SHARED " + strings.Join(vars, ", ")
+}
+
 // IfStmt represents IF/THEN/ELSE/END IF
 type IfStmt struct {
 	Line        int
@@ -134,14 +174,10 @@ func (is *IfStmt) String() string {
 	out.WriteString(" THEN")
 	if is.SingleLine {
 		out.WriteString(" ")
-		for _, s := range is.Consequence {
-			out.WriteString(s.String())
-		}
+		out.WriteString(joinStatements(is.Consequence))
 		if len(is.Alternative) > 0 {
 			out.WriteString(" ELSE ")
-			for _, s := range is.Alternative {
-				out.WriteString(s.String())
-			}
+			out.WriteString(joinStatements(is.Alternative))
 		}
 	} else {
 		out.WriteString("\n")
@@ -163,6 +199,15 @@ func (is *IfStmt) String() string {
 	return out.String()
 }
 
+// joinStatements writes statements as a colon-separated list
+func joinStatements(stmts []Statement) string {
+	strs := make([]string, len(stmts))
+	for i, s := range stmts {
+		strs[i] = s.String()
+	}
+	return strings.Join(strs, " : ")
+}
+
 // ForStmt represents FOR/NEXT loop
 type ForStmt struct {
 	Line     int
@@ -171,6 +216,7 @@ type ForStmt struct {
 	End      Expression
 	Step     Expression // nil means step 1
 	Body     []Statement
+	NextVar  *Identifier // variable named after NEXT, nil if omitted
 }
 
 func (fs *ForStmt) statementNode()       {}
@@ -349,6 +395,7 @@ type SubStatement struct {
 	Parameters []Parameter
 	Body       []Statement
 	Static     bool
+	Library    string // file of the IMPORTed library defining it, if any
 }
 
 func (ss *SubStatement) statementNode()       {}
@@ -385,6 +432,7 @@ type FuncStatement struct {
 	ReturnType DataType
 	Body       []Statement
 	Static     bool
+	Library    string // file of the IMPORTed library defining it, if any
 }
 
 func (fs *FuncStatement) statementNode()       {}
@@ -413,6 +461,39 @@ func (fs *FuncStatement) String() string {
 	return out.String()
 }
 
+// TypeStmt represents a user-defined TYPE ... END TYPE definition
+type TypeStmt struct {
+	Line   int
+	Name   string
+	Fields []TypeField
+}
+
+// TypeField represents a field in a TYPE definition
+type TypeField struct {
+	Name         string
+	DataType     DataType
+	TypeName     string     // nested user-defined type when DataType is TypeRecord
+	StringLength Expression // n in STRING * n
+}
+
+func (ts *TypeStmt) statementNode()       {}
+func (ts *TypeStmt) TokenLiteral() string { return "TYPE" }
+func (ts *TypeStmt) String() string {
+	var out bytes.Buffer
+	out.WriteString("TYPE ")
+	out.WriteString(ts.Name)
+	out.WriteString("\n")
+	for _, f := range ts.Fields {
+		out.WriteString("  ")
+		out.WriteString(f.Name)
+		out.WriteString(" AS ")
+		out.WriteString(typeString(f.DataType, f.TypeName, f.StringLength))
+		out.WriteString("\n")
+	}
+	out.WriteString("END TYPE")
+	return out.String()
+}
+
 // DataStmt represents DATA statement
 type DataStmt struct {
 	Line   int
@@ -533,12 +614,34 @@ func (ss *ScreenStmt) String() string {
 
 // EndStmt represents END statement
 type EndStmt struct {
-	Line int
+	Line   int
+	System bool       // written as SYSTEM
+	Code   Expression // exit code, nil for 0
 }
 
-func (es *EndStmt) statementNode()       {}
-func (es *EndStmt) TokenLiteral() string { return "END" }
-func (es *EndStmt) String() string       { return "END" }
+func (es *EndStmt) statementNode() {}
+func (es *EndStmt) TokenLiteral() string {
+	if es.System {
+		return "SYSTEM"
+	}
+	return "END"
+}
+func (es *EndStmt) String() string {
+	if es.Code != nil {
+		return es.TokenLiteral() + " " + es.Code.String()
+	}
+	return es.TokenLiteral()
+}
+
+// OptionStmt represents OPTION EXPLICIT
+type OptionStmt struct {
+	Line   int
+	Option string // "EXPLICIT"
+}
+
+func (os *OptionStmt) statementNode()       {}
+func (os *OptionStmt) TokenLiteral() string { return "OPTION" }
+func (os *OptionStmt) String() string       { return "OPTION " + os.Option }
 
 // RemStmt represents REM (comment) statement
 type RemStmt struct {
@@ -682,6 +785,10 @@ func (os *OpenStmt) String() string {
 	out.WriteString(os.Mode)
 	out.WriteString(" AS #")
 	out.WriteString(os.FileNum.String())
+	if os.RecLen != nil {
+		out.WriteString(" LEN = ")
+		out.WriteString(os.RecLen.String())
+	}
 	return out.String()
 }
 
@@ -707,6 +814,63 @@ func (cs *CloseStmt) String() string {
 	return out.String()
 }
 
+// FileCommandStmt represents KILL, MKDIR, RMDIR, CHDIR or FILES with its
+// file or directory argument
+type FileCommandStmt struct {
+	Line    int
+	Command string     // "KILL", "MKDIR", "RMDIR", "CHDIR" or "FILES"
+	Path    Expression // nil for FILES without a file spec
+}
+
+func (fc *FileCommandStmt) statementNode()       {}
+func (fc *FileCommandStmt) TokenLiteral() string { return fc.Command }
+func (fc *FileCommandStmt) String() string {
+	if fc.Path != nil {
+		return fc.Command + " " + fc.Path.String()
+	}
+	return fc.Command
+}
+
+// NameStmt represents NAME old AS new, which renames a file or directory
+type NameStmt struct {
+	Line    int
+	OldName Expression
+	NewName Expression
+}
+
+func (ns *NameStmt) statementNode()       {}
+func (ns *NameStmt) TokenLiteral() string { return "NAME" }
+func (ns *NameStmt) String() string {
+	return "NAME " + ns.OldName.String() + " AS " + ns.NewName.String()
+}
+
+// ShellStmt represents SHELL [command], which runs a command in the
+// operating system's shell
+type ShellStmt struct {
+	Line    int
+	Command Expression // nil for an interactive shell
+}
+
+func (ss *ShellStmt) statementNode()       {}
+func (ss *ShellStmt) TokenLiteral() string { return "SHELL" }
+func (ss *ShellStmt) String() string {
+	if ss.Command != nil {
+		return "SHELL " + ss.Command.String()
+	}
+	return "SHELL"
+}
+
+// EnvironStmt represents ENVIRON "name=value", which sets an environment
+// variable for the program and the commands it runs
+type EnvironStmt struct {
+	Line    int
+	Setting Expression
+}
+
+func (es *EnvironStmt) statementNode()       {}
+func (es *EnvironStmt) TokenLiteral() string { return "ENVIRON" }
+func (es *EnvironStmt) String() string       { return "ENVIRON " + es.Setting.String() }
+
 // PrintFileStmt represents PRINT #n statement
 type PrintFileStmt struct {
 	Line      int
@@ -734,6 +898,34 @@ func (pf *PrintFileStmt) String() string {
 	return out.String()
 }
 
+// WriteStmt represents WRITE [#n,] statement. FileNum is nil when writing
+// to the screen.
+type WriteStmt struct {
+	Line    int
+	FileNum Expression
+	Items   []Expression
+}
+
+func (ws *WriteStmt) statementNode()       {}
+func (ws *WriteStmt) TokenLiteral() string { return "WRITE" }
+func (ws *WriteStmt) String() string {
+	var out bytes.Buffer
+	out.WriteString("WRITE")
+	if ws.FileNum != nil {
+		out.WriteString(" #" + ws.FileNum.String())
+		if len(ws.Items) > 0 {
+			out.WriteString(",")
+		}
+	}
+	for i, item := range ws.Items {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString(" " + item.String())
+	}
+	return out.String()
+}
+
 // InputFileStmt represents INPUT #n statement
 type InputFileStmt struct {
 	Line      int
@@ -830,6 +1022,45 @@ func (og *OnGosubStmt) String() string {
 	return out.String()
 }
 
+// OnErrorStmt represents ON ERROR GOTO label (Target "0" disables trapping)
+type OnErrorStmt struct {
+	Line   int
+	Target string
+}
+
+func (oe *OnErrorStmt) statementNode()       {}
+func (oe *OnErrorStmt) TokenLiteral() string { return "ON" }
+func (oe *OnErrorStmt) String() string       { return "ON ERROR GOTO " + oe.Target }
+
+// ResumeStmt represents RESUME, RESUME NEXT or RESUME label
+type ResumeStmt struct {
+	Line   int
+	Next   bool
+	Target string // empty (or "0") to retry the failing statement
+}
+
+func (rs *ResumeStmt) statementNode()       {}
+func (rs *ResumeStmt) TokenLiteral() string { return "RESUME" }
+func (rs *ResumeStmt) String() string {
+	switch {
+	case rs.Next:
+		return "RESUME NEXT"
+	case rs.Target != "":
+		return "RESUME " + rs.Target
+	}
+	return "RESUME"
+}
+
+// ErrorStmt represents ERROR n, which raises run-time error n
+type ErrorStmt struct {
+	Line int
+	Code Expression
+}
+
+func (es *ErrorStmt) statementNode()       {}
+func (es *ErrorStmt) TokenLiteral() string { return "ERROR" }
+func (es *ErrorStmt) String() string       { return "ERROR " + es.Code.String() }
+
 // GetStmt represents GET #n, position, variable (binary file I/O)
 type GetStmt struct {
 	Line     int
@@ -841,16 +1072,7 @@ type GetStmt struct {
 func (gs *GetStmt) statementNode()       {}
 func (gs *GetStmt) TokenLiteral() string { return "GET" }
 func (gs *GetStmt) String() string {
-	var out bytes.Buffer
-	out.WriteString("GET #")
-	out.WriteString(gs.FileNum.String())
-	if gs.Position != nil {
-		out.WriteString(", ")
-		out.WriteString(gs.Position.String())
-	}
-	out.WriteString(", ")
-	out.WriteString(gs.Variable.String())
-	return out.String()
+	return recordIOString("GET", gs.FileNum, gs.Position, gs.Variable)
 }
 
 // PutStmt represents PUT #n, position, variable (binary file I/O)
@@ -864,18 +1086,70 @@ type PutStmt struct {
 func (ps *PutStmt) statementNode()       {}
 func (ps *PutStmt) TokenLiteral() string { return "PUT" }
 func (ps *PutStmt) String() string {
+	return recordIOString("PUT", ps.FileNum, ps.Position, ps.Variable)
+}
+
+// recordIOString formats GET or PUT, either of whose position and variable
+// may be left out
+func recordIOString(keyword string, fileNum, position, variable Expression) string {
 	var out bytes.Buffer
-	out.WriteString("PUT #")
-	out.WriteString(ps.FileNum.String())
-	if ps.Position != nil {
+	out.WriteString(keyword + " #" + fileNum.String())
+	if position != nil || variable != nil {
 		out.WriteString(", ")
-		out.WriteString(ps.Position.String())
 	}
-	out.WriteString(", ")
-	out.WriteString(ps.Variable.String())
+	if position != nil {
+		out.WriteString(position.String())
+	}
+	if variable != nil {
+		out.WriteString(", " + variable.String())
+	}
+	return out.String()
+}
+
+// FieldStmt represents FIELD #n, width AS var$, ... which maps string
+// variables onto the record buffer of a RANDOM file
+type FieldStmt struct {
+	Line    int
+	FileNum Expression
+	Fields  []FieldSpec
+}
+
+// FieldSpec is one width AS var$ of a FIELD statement
+type FieldSpec struct {
+	Width    Expression
+	Variable Expression
+}
+
+func (fs *FieldStmt) statementNode()       {}
+func (fs *FieldStmt) TokenLiteral() string { return "FIELD" }
+func (fs *FieldStmt) String() string {
+	var out bytes.Buffer
+	out.WriteString("FIELD #" + fs.FileNum.String())
+	for _, f := range fs.Fields {
+		out.WriteString(", " + f.Width.String() + " AS " + f.Variable.String())
+	}
 	return out.String()
 }
 
+// JustifyStmt represents LSET or RSET var$ = value
+type JustifyStmt struct {
+	Line  int
+	Right bool // RSET
+	Name  Expression
+	Value Expression
+}
+
+func (js *JustifyStmt) statementNode() {}
+func (js *JustifyStmt) TokenLiteral() string {
+	if js.Right {
+		return "RSET"
+	}
+	return "LSET"
+}
+func (js *JustifyStmt) String() string {
+	return js.TokenLiteral() + " " + js.Name.String() + " = " + js.Value.String()
+}
+
 // SeekStmt represents SEEK #n, position
 type SeekStmt struct {
 	Line     int
@@ -1031,3 +1305,119 @@ func (pu *PrintUsingStmt) String() string {
 }
 
 // LineInputFileStmt already exists, but adding for completeness
+
+// DefFnStmt represents DEF FNname(parameters) = expression
+type DefFnStmt struct {
+	Line       int
+	Name       string // including the FN prefix
+	Parameters []Parameter
+	Body       Expression
+}
+
+func (df *DefFnStmt) statementNode()       {}
+func (df *DefFnStmt) TokenLiteral() string { return "DEF" }
+func (df *DefFnStmt) String() string {
+	var out bytes.Buffer
+	out.WriteString("DEF ")
+	out.WriteString(df.Name)
+	if len(df.Parameters) > 0 {
+		params := make([]string, len(df.Parameters))
+		for i, p := range df.Parameters {
+			params[i] = p.String()
+		}
+		out.WriteString("(" + strings.Join(params, ", ") + ")")
+	}
+	out.WriteString(" = ")
+	out.WriteString(df.Body.String())
+	return out.String()
+}
+
+// DefTypeStmt represents DEFINT, DEFLNG, DEFSNG, DEFDBL or DEFSTR, which
+// set the type of names without a suffix by their first letter
+type DefTypeStmt struct {
+	Line     int
+	DataType DataType
+	Ranges   []LetterRange
+}
+
+// LetterRange is a range of first letters such as A-Z
+type LetterRange struct {
+	From, To byte // upper case
+}
+
+// defTypeKeywords are the DEFtype statements by the type they set
+var defTypeKeywords = map[DataType]string{
+	TypeInteger: "DEFINT",
+	TypeLong:    "DEFLNG",
+	TypeSingle:  "DEFSNG",
+	TypeDouble:  "DEFDBL",
+	TypeString:  "DEFSTR",
+}
+
+func (dt *DefTypeStmt) statementNode()       {}
+func (dt *DefTypeStmt) TokenLiteral() string { return defTypeKeywords[dt.DataType] }
+func (dt *DefTypeStmt) String() string {
+	ranges := make([]string, len(dt.Ranges))
+	for i, r := range dt.Ranges {
+		ranges[i] = string(r.From)
+		if r.To != r.From {
+			ranges[i] += "-" + string(r.To)
+		}
+	}
+	return dt.TokenLiteral() + " " + strings.Join(ranges, ", ")
+}
+
+// EraseStmt represents ERASE array, ...
+type EraseStmt struct {
+	Line   int
+	Arrays []string
+}
+
+func (es *EraseStmt) statementNode()       {}
+func (es *EraseStmt) TokenLiteral() string { return "ERASE" }
+func (es *EraseStmt) String() string       { return "ERASE " + strings.Join(es.Arrays, ", ") }
+
+// DeclareStmt represents DECLARE SUB or DECLARE FUNCTION, the prototype of
+// a procedure defined in the program or in an imported library
+type DeclareStmt struct {
+	Line       int
+	Function   bool // FUNCTION rather than SUB
+	Name       string
+	Parameters []Parameter
+	HasParams  bool // a parameter list was given, so it is checked
+}
+
+func (ds *DeclareStmt) statementNode()       {}
+func (ds *DeclareStmt) TokenLiteral() string { return "DECLARE" }
+func (ds *DeclareStmt) String() string {
+	var out bytes.Buffer
+	out.WriteString("DECLARE ")
+	if ds.Function {
+		out.WriteString("FUNCTION ")
+	} else {
+		out.WriteString("SUB ")
+	}
+	out.WriteString(ds.Name)
+	if ds.HasParams {
+		params := make([]string, len(ds.Parameters))
+		for i, p := range ds.Parameters {
+			params[i] = p.String()
+		}
+		out.WriteString("(" + strings.Join(params, ", ") + ")")
+	}
+	return out.String()
+}
+
+// ImportStmt represents IMPORT "file" AS name, which makes the SUBs and
+// FUNCTIONs of a library available as name.procedure
+type ImportStmt struct {
+	Line int
+	Path string
+	Name string
+}
+
+func (is *ImportStmt) statementNode()       {}
+func (is *ImportStmt) TokenLiteral() string { return "IMPORT" }
+func (is *ImportStmt) String() string {
+	return "IMPORT \"" + is.Path + "\" AS " + is.Name
+}
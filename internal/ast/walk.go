@@ -0,0 +1,221 @@
+package ast
+
+import "reflect"
+
+// Inspect traverses the tree rooted at node in source order, calling f for
+// every statement and expression. If f returns false, the children of that
+// node are skipped.
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || isNilNode(node) || !f(node) {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		inspectStatements(n.Statements, f)
+
+	// Statements
+	case *LetStmt:
+		Inspect(n.Name, f)
+		Inspect(n.Value, f)
+	case *PrintStmt:
+		inspectPrintItems(n.Items, f)
+	case *InputStmt:
+		inspectExpressions(n.Variables, f)
+	case *DimStmt:
+		inspectDimVariables(n.Variables, f)
+	case *RedimStmt:
+		inspectDimVariables(n.Variables, f)
+	case *IfStmt:
+		Inspect(n.Condition, f)
+		inspectStatements(n.Consequence, f)
+		inspectStatements(n.Alternative, f)
+	case *ForStmt:
+		Inspect(n.Variable, f)
+		Inspect(n.Start, f)
+		Inspect(n.End, f)
+		Inspect(n.Step, f)
+		inspectStatements(n.Body, f)
+	case *WhileStmt:
+		Inspect(n.Condition, f)
+		inspectStatements(n.Body, f)
+	case *DoLoopStmt:
+		if n.ConditionPos == "PRE" {
+			Inspect(n.Condition, f)
+		}
+		inspectStatements(n.Body, f)
+		if n.ConditionPos != "PRE" {
+			Inspect(n.Condition, f)
+		}
+	case *SelectCaseStmt:
+		Inspect(n.Expression, f)
+		for _, c := range n.Cases {
+			for _, v := range c.Values {
+				Inspect(v.Value, f)
+				Inspect(v.EndValue, f)
+			}
+			inspectStatements(c.Body, f)
+		}
+		inspectStatements(n.CaseElse, f)
+	case *ReturnStmt:
+		Inspect(n.Value, f)
+	case *EndStmt:
+		Inspect(n.Code, f)
+	case *SubStatement:
+		inspectStatements(n.Body, f)
+	case *FuncStatement:
+		inspectStatements(n.Body, f)
+	case *DefFnStmt:
+		Inspect(n.Body, f)
+	case *TypeStmt:
+		for _, field := range n.Fields {
+			Inspect(field.StringLength, f)
+		}
+	case *DataStmt:
+		inspectExpressions(n.Values, f)
+	case *ReadStmt:
+		inspectExpressions(n.Variables, f)
+	case *LocateStmt:
+		Inspect(n.Row, f)
+		Inspect(n.Column, f)
+	case *ColorStmt:
+		Inspect(n.Foreground, f)
+		Inspect(n.Background, f)
+	case *ScreenStmt:
+		Inspect(n.Mode, f)
+	case *CallStmt:
+		inspectExpressions(n.Arguments, f)
+	case *SubCallStmt:
+		inspectExpressions(n.Arguments, f)
+	case *SleepStmt:
+		Inspect(n.Seconds, f)
+	case *SwapStmt:
+		Inspect(n.Var1, f)
+		Inspect(n.Var2, f)
+	case *RandomizeStmt:
+		Inspect(n.Seed, f)
+	case *ConstStmt:
+		Inspect(n.Value, f)
+	case *OpenStmt:
+		Inspect(n.Filename, f)
+		Inspect(n.FileNum, f)
+		Inspect(n.RecLen, f)
+	case *CloseStmt:
+		inspectExpressions(n.FileNums, f)
+	case *FileCommandStmt:
+		Inspect(n.Path, f)
+	case *NameStmt:
+		Inspect(n.OldName, f)
+		Inspect(n.NewName, f)
+	case *ShellStmt:
+		Inspect(n.Command, f)
+	case *EnvironStmt:
+		Inspect(n.Setting, f)
+	case *PrintFileStmt:
+		Inspect(n.FileNum, f)
+		inspectPrintItems(n.Items, f)
+	case *WriteStmt:
+		Inspect(n.FileNum, f)
+		inspectExpressions(n.Items, f)
+	case *InputFileStmt:
+		Inspect(n.FileNum, f)
+		inspectExpressions(n.Variables, f)
+	case *LineInputStmt:
+		Inspect(n.Variable, f)
+	case *LineInputFileStmt:
+		Inspect(n.FileNum, f)
+		Inspect(n.Variable, f)
+	case *OnGotoStmt:
+		Inspect(n.Expression, f)
+	case *OnGosubStmt:
+		Inspect(n.Expression, f)
+	case *ErrorStmt:
+		Inspect(n.Code, f)
+	case *GetStmt:
+		Inspect(n.FileNum, f)
+		Inspect(n.Position, f)
+		Inspect(n.Variable, f)
+	case *PutStmt:
+		Inspect(n.FileNum, f)
+		Inspect(n.Position, f)
+		Inspect(n.Variable, f)
+	case *SeekStmt:
+		Inspect(n.FileNum, f)
+		Inspect(n.Position, f)
+	case *FieldStmt:
+		Inspect(n.FileNum, f)
+		for _, field := range n.Fields {
+			Inspect(field.Width, f)
+			Inspect(field.Variable, f)
+		}
+	case *JustifyStmt:
+		Inspect(n.Name, f)
+		Inspect(n.Value, f)
+	case *PsetStmt:
+		Inspect(n.X, f)
+		Inspect(n.Y, f)
+		Inspect(n.Color, f)
+	case *LineGraphicsStmt:
+		Inspect(n.X1, f)
+		Inspect(n.Y1, f)
+		Inspect(n.X2, f)
+		Inspect(n.Y2, f)
+		Inspect(n.Color, f)
+	case *CircleStmt:
+		Inspect(n.X, f)
+		Inspect(n.Y, f)
+		Inspect(n.Radius, f)
+		Inspect(n.Color, f)
+	case *PrintUsingStmt:
+		Inspect(n.FileNum, f)
+		Inspect(n.Format, f)
+		inspectPrintItems(n.Items, f)
+
+	// Expressions
+	case *ArrayAccess:
+		inspectExpressions(n.Indices, f)
+	case *BinaryExpr:
+		Inspect(n.Left, f)
+		Inspect(n.Right, f)
+	case *UnaryExpr:
+		Inspect(n.Right, f)
+	case *CallExpr:
+		inspectExpressions(n.Arguments, f)
+	case *GroupedExpr:
+		Inspect(n.Expression, f)
+	case *FieldAccess:
+		Inspect(n.Record, f)
+	}
+}
+
+func inspectStatements(stmts []Statement, f func(Node) bool) {
+	for _, stmt := range stmts {
+		Inspect(stmt, f)
+	}
+}
+
+func inspectExpressions(exprs []Expression, f func(Node) bool) {
+	for _, expr := range exprs {
+		Inspect(expr, f)
+	}
+}
+
+func inspectPrintItems(items []PrintItem, f func(Node) bool) {
+	for _, item := range items {
+		Inspect(item.Expression, f)
+	}
+}
+
+func inspectDimVariables(vars []DimVariable, f func(Node) bool) {
+	for _, v := range vars {
+		inspectExpressions(v.Dimensions, f)
+		Inspect(v.StringLength, f)
+	}
+}
+
+// isNilNode reports whether node is a nil pointer, as left by a parse error
+// or an optional *Identifier field
+func isNilNode(node Node) bool {
+	v := reflect.ValueOf(node)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
@@ -0,0 +1,191 @@
+package builtins
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// Binary conversions between numbers and the strings that hold them in
+// a record buffer. Numbers are stored little-endian, as QBasic stores them;
+// MKSMBF$, MKDMBF$, CVSMBF and CVDMBF use the Microsoft Binary Format of
+// earlier BASICs instead of IEEE floats.
+
+func (r *Registry) fnMki(args []Value) (Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("MKI$ requires 1 argument")
+	}
+	v := math.RoundToEven(args[0].ToFloat())
+	if v < math.MinInt16 || v > math.MaxInt16 {
+		return nil, errorf(6, "overflow")
+	}
+	return &StringValue{Val: string(binary.LittleEndian.AppendUint16(nil, uint16(int16(v))))}, nil
+}
+
+func (r *Registry) fnMkl(args []Value) (Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("MKL$ requires 1 argument")
+	}
+	v := math.RoundToEven(args[0].ToFloat())
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return nil, errorf(6, "overflow")
+	}
+	return &StringValue{Val: string(binary.LittleEndian.AppendUint32(nil, uint32(int32(v))))}, nil
+}
+
+func (r *Registry) fnMks(args []Value) (Value, error) {
+	f, err := singleArg("MKS$", args)
+	if err != nil {
+		return nil, err
+	}
+	return &StringValue{Val: string(binary.LittleEndian.AppendUint32(nil, math.Float32bits(f)))}, nil
+}
+
+func (r *Registry) fnMkd(args []Value) (Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("MKD$ requires 1 argument")
+	}
+	return &StringValue{Val: string(binary.LittleEndian.AppendUint64(nil, math.Float64bits(args[0].ToFloat())))}, nil
+}
+
+func (r *Registry) fnMksmbf(args []Value) (Value, error) {
+	f, err := singleArg("MKSMBF$", args)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := toMBF(float64(f), 24)
+	if !ok {
+		return nil, errorf(6, "overflow")
+	}
+	return &StringValue{Val: string(binary.LittleEndian.AppendUint32(nil, uint32(m>>32)))}, nil
+}
+
+func (r *Registry) fnMkdmbf(args []Value) (Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("MKDMBF$ requires 1 argument")
+	}
+	m, ok := toMBF(args[0].ToFloat(), 56)
+	if !ok {
+		return nil, errorf(6, "overflow")
+	}
+	return &StringValue{Val: string(binary.LittleEndian.AppendUint64(nil, m))}, nil
+}
+
+func (r *Registry) fnCvi(args []Value) (Value, error) {
+	b, err := bytesArg("CVI", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return &IntegerValue{Val: int16(binary.LittleEndian.Uint16(b))}, nil
+}
+
+func (r *Registry) fnCvl(args []Value) (Value, error) {
+	b, err := bytesArg("CVL", args, 4)
+	if err != nil {
+		return nil, err
+	}
+	return &LongValue{Val: int32(binary.LittleEndian.Uint32(b))}, nil
+}
+
+func (r *Registry) fnCvs(args []Value) (Value, error) {
+	b, err := bytesArg("CVS", args, 4)
+	if err != nil {
+		return nil, err
+	}
+	return &SingleValue{Val: math.Float32frombits(binary.LittleEndian.Uint32(b))}, nil
+}
+
+func (r *Registry) fnCvd(args []Value) (Value, error) {
+	b, err := bytesArg("CVD", args, 8)
+	if err != nil {
+		return nil, err
+	}
+	return &DoubleValue{Val: math.Float64frombits(binary.LittleEndian.Uint64(b))}, nil
+}
+
+func (r *Registry) fnCvsmbf(args []Value) (Value, error) {
+	b, err := bytesArg("CVSMBF", args, 4)
+	if err != nil {
+		return nil, err
+	}
+	return &SingleValue{Val: float32(fromMBF(uint64(binary.LittleEndian.Uint32(b))<<32, 24))}, nil
+}
+
+func (r *Registry) fnCvdmbf(args []Value) (Value, error) {
+	b, err := bytesArg("CVDMBF", args, 8)
+	if err != nil {
+		return nil, err
+	}
+	return &DoubleValue{Val: fromMBF(binary.LittleEndian.Uint64(b), 56)}, nil
+}
+
+// singleArg returns the argument of an MK function that stores a SINGLE
+func singleArg(name string, args []Value) (float32, error) {
+	if len(args) < 1 {
+		return 0, fmt.Errorf("%s requires 1 argument", name)
+	}
+	f := args[0].ToFloat()
+	if math.Abs(f) > math.MaxFloat32 {
+		return 0, errorf(6, "overflow")
+	}
+	return float32(f), nil
+}
+
+// bytesArg returns the first n bytes of the string argument of a CV
+// function
+func bytesArg(name string, args []Value, n int) ([]byte, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("%s requires 1 argument", name)
+	}
+	if args[0].Type() != ast.TypeString {
+		return nil, errorf(13, "type mismatch: %s needs a string", name)
+	}
+	s := args[0].ToString()
+	if len(s) < n {
+		return nil, errorf(5, "illegal function call: %s needs %d bytes", name, n)
+	}
+	return []byte(s[:n]), nil
+}
+
+// toMBF converts f to Microsoft Binary Format with a mantissa of bits
+// bits, 24 for a single and 56 for a double, which hold any float32 or
+// float64 mantissa exactly. The result is placed in the top bytes of a
+// uint64. The exponent byte comes first, biased by 128 for a mantissa
+// between 0.5 and 1, then the sign bit in place of the mantissa's leading
+// 1. Numbers too small for the format become 0; ok is false for numbers
+// too large.
+func toMBF(f float64, bits int) (m uint64, ok bool) {
+	if f == 0 {
+		return 0, true
+	}
+	frac, exp := math.Frexp(math.Abs(f))
+	if exp+128 > 255 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, false
+	}
+	if exp+128 < 1 {
+		return 0, true
+	}
+	mant := uint64(math.Ldexp(frac, bits))
+	m = uint64(exp+128)<<56 | mant&(1<<(bits-1)-1)<<(56-bits)
+	if f < 0 {
+		m |= 1 << 55
+	}
+	return m, true
+}
+
+// fromMBF converts a number in Microsoft Binary Format, laid out as toMBF
+// returns it, to a float
+func fromMBF(m uint64, bits int) float64 {
+	exp := int(m >> 56)
+	if exp == 0 {
+		return 0
+	}
+	mant := m>>(56-bits)&(1<<(bits-1)-1) | 1<<(bits-1)
+	f := math.Ldexp(float64(mant), exp-128-bits)
+	if m&(1<<55) != 0 {
+		return -f
+	}
+	return f
+}
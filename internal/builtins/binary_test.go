@@ -0,0 +1,73 @@
+package builtins
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBinaryConversions(t *testing.T) {
+	tests := []struct {
+		mk, cv string
+		val    Value
+		bytes  string
+	}{
+		{"MKI$", "CVI", &IntegerValue{Val: 1}, "\x01\x00"},
+		{"MKI$", "CVI", &IntegerValue{Val: -2}, "\xfe\xff"},
+		{"MKL$", "CVL", &LongValue{Val: -1}, "\xff\xff\xff\xff"},
+		{"MKL$", "CVL", &LongValue{Val: 65536}, "\x00\x00\x01\x00"},
+		{"MKS$", "CVS", &SingleValue{Val: 1}, "\x00\x00\x80\x3f"},
+		{"MKS$", "CVS", &SingleValue{Val: -0.1}, "\xcd\xcc\xcc\xbd"},
+		{"MKD$", "CVD", &DoubleValue{Val: 1}, "\x00\x00\x00\x00\x00\x00\xf0\x3f"},
+		{"MKD$", "CVD", &DoubleValue{Val: 0.1}, "\x9a\x99\x99\x99\x99\x99\xb9\x3f"},
+		{"MKSMBF$", "CVSMBF", &SingleValue{Val: 1}, "\x00\x00\x00\x81"},
+		{"MKSMBF$", "CVSMBF", &SingleValue{Val: 0.5}, "\x00\x00\x00\x80"},
+		{"MKSMBF$", "CVSMBF", &SingleValue{Val: -1}, "\x00\x00\x80\x81"},
+		{"MKSMBF$", "CVSMBF", &SingleValue{Val: 10}, "\x00\x00\x20\x84"},
+		{"MKSMBF$", "CVSMBF", &SingleValue{Val: 0.1}, "\xcd\xcc\x4c\x7d"},
+		{"MKSMBF$", "CVSMBF", &SingleValue{Val: 0}, "\x00\x00\x00\x00"},
+		{"MKDMBF$", "CVDMBF", &DoubleValue{Val: 1}, "\x00\x00\x00\x00\x00\x00\x00\x81"},
+		{"MKDMBF$", "CVDMBF", &DoubleValue{Val: -2.5}, "\x00\x00\x00\x00\x00\x00\xa0\x82"},
+	}
+	r := NewRegistry()
+	for _, tt := range tests {
+		s, err := r.Call(tt.mk, []Value{tt.val})
+		if err != nil {
+			t.Errorf("%s(%v): %v", tt.mk, tt.val, err)
+			continue
+		}
+		if s.ToString() != tt.bytes {
+			t.Errorf("%s(%v) = % x, want % x", tt.mk, tt.val, s.ToString(), tt.bytes)
+		}
+		back, err := r.Call(tt.cv, []Value{s})
+		if err != nil {
+			t.Errorf("%s(%s(%v)): %v", tt.cv, tt.mk, tt.val, err)
+			continue
+		}
+		if back.Type() != tt.val.Type() || back.ToFloat() != tt.val.ToFloat() {
+			t.Errorf("%s(%s(%v)) = %v, want %v", tt.cv, tt.mk, tt.val, back, tt.val)
+		}
+	}
+}
+
+func TestBinaryConversionErrors(t *testing.T) {
+	tests := []struct {
+		fn   string
+		arg  Value
+		code int
+	}{
+		{"MKI$", &LongValue{Val: 32768}, 6},
+		{"MKL$", &DoubleValue{Val: 3e9}, 6},
+		{"MKSMBF$", &DoubleValue{Val: 1e39}, 6},
+		{"MKDMBF$", &DoubleValue{Val: 1e40}, 6},
+		{"CVI", &StringValue{Val: "\x01"}, 5},
+		{"CVD", &IntegerValue{Val: 1}, 13},
+	}
+	r := NewRegistry()
+	for _, tt := range tests {
+		_, err := r.Call(tt.fn, []Value{tt.arg})
+		var rerr *Error
+		if !errors.As(err, &rerr) || rerr.Code != tt.code {
+			t.Errorf("%s(%v) returned %v, want error %d", tt.fn, tt.arg, err, tt.code)
+		}
+	}
+}
@@ -45,21 +45,39 @@ func (v *LongValue) ToString() string   { return fmt.Sprintf("%d", v.Val) }
 type SingleValue struct{ Val float32 }
 
 func (v *SingleValue) Type() ast.DataType { return ast.TypeSingle }
-func (v *SingleValue) String() string     { return fmt.Sprintf("%g", v.Val) }
+func (v *SingleValue) String() string     { return FormatFloat(float64(v.Val), 7) }
 func (v *SingleValue) ToFloat() float64   { return float64(v.Val) }
 func (v *SingleValue) ToInt() int64       { return int64(v.Val) }
 func (v *SingleValue) ToBool() bool       { return v.Val != 0 }
-func (v *SingleValue) ToString() string   { return fmt.Sprintf("%g", v.Val) }
+func (v *SingleValue) ToString() string   { return FormatFloat(float64(v.Val), 7) }
 
 // DoubleValue represents a double-precision float
 type DoubleValue struct{ Val float64 }
 
 func (v *DoubleValue) Type() ast.DataType { return ast.TypeDouble }
-func (v *DoubleValue) String() string     { return fmt.Sprintf("%g", v.Val) }
+func (v *DoubleValue) String() string     { return FormatFloat(v.Val, 16) }
 func (v *DoubleValue) ToFloat() float64   { return v.Val }
 func (v *DoubleValue) ToInt() int64       { return int64(v.Val) }
 func (v *DoubleValue) ToBool() bool       { return v.Val != 0 }
-func (v *DoubleValue) ToString() string   { return fmt.Sprintf("%g", v.Val) }
+func (v *DoubleValue) ToString() string   { return FormatFloat(v.Val, 16) }
+
+// FormatFloat formats a number as PRINT and STR$ show it, rounded to
+// digits significant digits: 7 for SINGLE and 16 for DOUBLE
+func FormatFloat(f float64, digits int) string {
+	if f == math.Trunc(f) && math.Abs(f) < math.Pow10(digits) {
+		return fmt.Sprintf("%d", int64(f))
+	}
+	return strconv.FormatFloat(f, 'G', digits, 64)
+}
+
+// floatResult returns the result of a math function as a DOUBLE when its
+// argument is one, and as a SINGLE otherwise
+func floatResult(arg Value, f float64) Value {
+	if arg.Type() == ast.TypeDouble {
+		return &DoubleValue{Val: f}
+	}
+	return &SingleValue{Val: float32(f)}
+}
 
 // StringValue represents a string
 type StringValue struct{ Val string }
@@ -83,6 +101,8 @@ type BuiltinFunc func(args []Value) (Value, error)
 // Registry holds all built-in functions
 type Registry struct {
 	functions map[string]BuiltinFunc
+	host      map[string]*hostFunc
+	subs      map[string]*hostFunc
 	rng       *rand.Rand
 }
 
@@ -90,14 +110,19 @@ type Registry struct {
 func NewRegistry() *Registry {
 	r := &Registry{
 		functions: make(map[string]BuiltinFunc),
+		host:      make(map[string]*hostFunc),
+		subs:      make(map[string]*hostFunc),
 		rng:       rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 	r.registerAll()
 	return r
 }
 
-// Call invokes a built-in function
+// Call invokes a host or built-in function
 func (r *Registry) Call(name string, args []Value) (Value, error) {
+	if h, ok := r.host[name]; ok {
+		return h.call(args)
+	}
 	fn, ok := r.functions[name]
 	if !ok {
 		return nil, fmt.Errorf("unknown function: %s", name)
@@ -171,6 +196,20 @@ func (r *Registry) registerAll() {
 	r.functions["ROUND"] = r.fnRound
 	r.functions["_PI"] = r.fnPi
 	r.functions["PI"] = r.fnPi // alias without underscore
+
+	// Binary conversions
+	r.functions["MKI$"] = r.fnMki
+	r.functions["MKL$"] = r.fnMkl
+	r.functions["MKS$"] = r.fnMks
+	r.functions["MKD$"] = r.fnMkd
+	r.functions["MKSMBF$"] = r.fnMksmbf
+	r.functions["MKDMBF$"] = r.fnMkdmbf
+	r.functions["CVI"] = r.fnCvi
+	r.functions["CVL"] = r.fnCvl
+	r.functions["CVS"] = r.fnCvs
+	r.functions["CVD"] = r.fnCvd
+	r.functions["CVSMBF"] = r.fnCvsmbf
+	r.functions["CVDMBF"] = r.fnCvdmbf
 }
 
 // String functions
@@ -396,7 +435,25 @@ func (r *Registry) fnAbs(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("ABS requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Abs(args[0].ToFloat())}, nil
+	switch v := args[0].(type) {
+	case *IntegerValue:
+		if v.Val == math.MinInt16 {
+			return nil, errorf(6, "overflow")
+		}
+		if v.Val < 0 {
+			return &IntegerValue{Val: -v.Val}, nil
+		}
+		return v, nil
+	case *LongValue:
+		if v.Val == math.MinInt32 {
+			return nil, errorf(6, "overflow")
+		}
+		if v.Val < 0 {
+			return &LongValue{Val: -v.Val}, nil
+		}
+		return v, nil
+	}
+	return floatResult(args[0], math.Abs(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnSgn(args []Value) (Value, error) {
@@ -416,14 +473,22 @@ func (r *Registry) fnInt(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("INT requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Floor(args[0].ToFloat())}, nil
+	switch args[0].Type() {
+	case ast.TypeInteger, ast.TypeLong:
+		return args[0], nil
+	}
+	return floatResult(args[0], math.Floor(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnFix(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("FIX requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Trunc(args[0].ToFloat())}, nil
+	switch args[0].Type() {
+	case ast.TypeInteger, ast.TypeLong:
+		return args[0], nil
+	}
+	return floatResult(args[0], math.Trunc(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnSqr(args []Value) (Value, error) {
@@ -434,35 +499,35 @@ func (r *Registry) fnSqr(args []Value) (Value, error) {
 	if v < 0 {
 		return nil, fmt.Errorf("illegal function call")
 	}
-	return &DoubleValue{Val: math.Sqrt(v)}, nil
+	return floatResult(args[0], math.Sqrt(v)), nil
 }
 
 func (r *Registry) fnSin(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("SIN requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Sin(args[0].ToFloat())}, nil
+	return floatResult(args[0], math.Sin(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnCos(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("COS requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Cos(args[0].ToFloat())}, nil
+	return floatResult(args[0], math.Cos(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnTan(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("TAN requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Tan(args[0].ToFloat())}, nil
+	return floatResult(args[0], math.Tan(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnAtn(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("ATN requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Atan(args[0].ToFloat())}, nil
+	return floatResult(args[0], math.Atan(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnLog(args []Value) (Value, error) {
@@ -473,14 +538,14 @@ func (r *Registry) fnLog(args []Value) (Value, error) {
 	if v <= 0 {
 		return nil, fmt.Errorf("illegal function call")
 	}
-	return &DoubleValue{Val: math.Log(v)}, nil
+	return floatResult(args[0], math.Log(v)), nil
 }
 
 func (r *Registry) fnExp(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("EXP requires 1 argument")
 	}
-	return &DoubleValue{Val: math.Exp(args[0].ToFloat())}, nil
+	return floatResult(args[0], math.Exp(args[0].ToFloat())), nil
 }
 
 func (r *Registry) fnRnd(args []Value) (Value, error) {
@@ -521,17 +586,23 @@ func (r *Registry) fnCInt(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("CINT requires 1 argument")
 	}
-	v := args[0].ToFloat()
 	// Round to nearest, ties to even (banker's rounding)
-	return &IntegerValue{Val: int16(math.RoundToEven(v))}, nil
+	v := math.RoundToEven(args[0].ToFloat())
+	if v < math.MinInt16 || v > math.MaxInt16 {
+		return nil, errorf(6, "overflow")
+	}
+	return &IntegerValue{Val: int16(v)}, nil
 }
 
 func (r *Registry) fnCLng(args []Value) (Value, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("CLNG requires 1 argument")
 	}
-	v := args[0].ToFloat()
-	return &LongValue{Val: int32(math.RoundToEven(v))}, nil
+	v := math.RoundToEven(args[0].ToFloat())
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return nil, errorf(6, "overflow")
+	}
+	return &LongValue{Val: int32(v)}, nil
 }
 
 func (r *Registry) fnCSng(args []Value) (Value, error) {
@@ -0,0 +1,208 @@
+package builtins
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// Error is a run-time error raised by a built-in or host function that
+// carries a QBasic error number other than 5 (Illegal function call)
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string { return e.Msg }
+
+func errorf(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// HostSubFunc is the signature for SUBs provided by the host application
+type HostSubFunc func(args []Value) error
+
+// hostFunc is a function or SUB registered by the host application
+type hostFunc struct {
+	name   string
+	params []ast.DataType
+	result ast.DataType // TypeUnknown for SUBs
+	fn     BuiltinFunc
+	sub    HostSubFunc
+}
+
+// RegisterFunction registers a host function callable from BASIC. Arguments
+// are checked against params and converted to the declared types before fn
+// is called; the value fn returns is converted to result. If name has a type
+// suffix it must agree with result.
+func (r *Registry) RegisterFunction(name string, params []ast.DataType, result ast.DataType, fn BuiltinFunc) error {
+	name = strings.ToUpper(name)
+	if err := checkHostName(name, params); err != nil {
+		return err
+	}
+	if result == ast.TypeUnknown {
+		return fmt.Errorf("function %s: missing result type", name)
+	}
+	if t := ast.DataTypeFromSuffix(name[len(name)-1:]); t != ast.TypeUnknown && t != result {
+		return fmt.Errorf("function %s: suffix does not match result type %s", name, result)
+	}
+	if fn == nil {
+		return fmt.Errorf("function %s: nil implementation", name)
+	}
+	if _, ok := r.subs[name]; ok {
+		return fmt.Errorf("duplicate definition: %s", name)
+	}
+
+	r.host[name] = &hostFunc{name: name, params: params, result: result, fn: fn}
+	return nil
+}
+
+// RegisterSub registers a host SUB callable from BASIC with CALL or as a
+// statement. Arguments are checked and converted as for RegisterFunction.
+func (r *Registry) RegisterSub(name string, params []ast.DataType, fn HostSubFunc) error {
+	name = strings.ToUpper(name)
+	if err := checkHostName(name, params); err != nil {
+		return err
+	}
+	if fn == nil {
+		return fmt.Errorf("SUB %s: nil implementation", name)
+	}
+	if _, ok := r.host[name]; ok {
+		return fmt.Errorf("duplicate definition: %s", name)
+	}
+
+	r.subs[name] = &hostFunc{name: name, params: params, sub: fn}
+	return nil
+}
+
+// IsHostFunction reports whether name is a function registered by the host
+func (r *Registry) IsHostFunction(name string) bool {
+	_, ok := r.host[strings.ToUpper(name)]
+	return ok
+}
+
+// Has reports whether name is a built-in or host function
+func (r *Registry) Has(name string) bool {
+	name = strings.ToUpper(name)
+	_, builtin := r.functions[name]
+	_, host := r.host[name]
+	return builtin || host
+}
+
+// HasSub reports whether name is a host SUB
+func (r *Registry) HasSub(name string) bool {
+	_, ok := r.subs[strings.ToUpper(name)]
+	return ok
+}
+
+// CallSub invokes a host SUB
+func (r *Registry) CallSub(name string, args []Value) error {
+	h, ok := r.subs[strings.ToUpper(name)]
+	if !ok {
+		return fmt.Errorf("undefined SUB: %s", name)
+	}
+	args, err := h.convertArgs(args)
+	if err != nil {
+		return err
+	}
+	return h.sub(args)
+}
+
+// Names returns the names of all built-in and host functions in sorted order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.functions)+len(r.host))
+	for name := range r.functions {
+		names = append(names, name)
+	}
+	for name := range r.host {
+		if _, ok := r.functions[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *hostFunc) call(args []Value) (Value, error) {
+	args, err := h.convertArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	result, err := h.fn(args)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil || (result.Type() == ast.TypeString) != (h.result == ast.TypeString) {
+		return nil, errorf(13, "type mismatch: %s returned %s", h.name, resultTypeName(result))
+	}
+	return convertValue(result, h.result)
+}
+
+// convertArgs checks the argument count and types and converts each
+// argument to its declared parameter type
+func (h *hostFunc) convertArgs(args []Value) ([]Value, error) {
+	if len(args) != len(h.params) {
+		return nil, fmt.Errorf("argument-count mismatch: %s expects %d argument(s), got %d", h.name, len(h.params), len(args))
+	}
+	converted := make([]Value, len(args))
+	for idx, arg := range args {
+		want := h.params[idx]
+		if (arg.Type() == ast.TypeString) != (want == ast.TypeString) {
+			return nil, errorf(13, "type mismatch: argument %d of %s must be %s", idx+1, h.name, want)
+		}
+		val, err := convertValue(arg, want)
+		if err != nil {
+			return nil, err
+		}
+		converted[idx] = val
+	}
+	return converted, nil
+}
+
+func checkHostName(name string, params []ast.DataType) error {
+	if name == "" {
+		return fmt.Errorf("missing name")
+	}
+	for idx, dt := range params {
+		if dt == ast.TypeUnknown {
+			return fmt.Errorf("%s: parameter %d has no type", name, idx+1)
+		}
+	}
+	return nil
+}
+
+// convertValue converts a value to the given type, rounding and range
+// checking integers the way CINT and CLNG do
+func convertValue(v Value, dt ast.DataType) (Value, error) {
+	switch dt {
+	case ast.TypeInteger:
+		f := math.RoundToEven(v.ToFloat())
+		if f < math.MinInt16 || f > math.MaxInt16 {
+			return nil, errorf(6, "overflow")
+		}
+		return &IntegerValue{Val: int16(f)}, nil
+	case ast.TypeLong:
+		f := math.RoundToEven(v.ToFloat())
+		if f < math.MinInt32 || f > math.MaxInt32 {
+			return nil, errorf(6, "overflow")
+		}
+		return &LongValue{Val: int32(f)}, nil
+	case ast.TypeSingle:
+		return &SingleValue{Val: float32(v.ToFloat())}, nil
+	case ast.TypeDouble:
+		return &DoubleValue{Val: v.ToFloat()}, nil
+	case ast.TypeString:
+		return &StringValue{Val: v.ToString()}, nil
+	}
+	return v, nil
+}
+
+func resultTypeName(v Value) string {
+	if v == nil {
+		return "no value"
+	}
+	return v.Type().String()
+}
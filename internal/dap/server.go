@@ -0,0 +1,675 @@
+// Package dap implements a Debug Adapter Protocol server, letting editors
+// such as VS Code debug BASIC programs run by the tree-walking interpreter.
+//
+// The server reads requests from an io.Reader and writes responses and
+// events to an io.Writer, so it can be driven over stdio, a network
+// connection or, in tests, a pair of pipes. It debugs a single program on a
+// single thread.
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/debugger"
+	"github.com/xbasic/xbasic/internal/include"
+	"github.com/xbasic/xbasic/internal/interpreter"
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/module"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+// threadID is the ID of the only thread
+const threadID = 1
+
+// Server is a debug adapter for one session
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	wmu sync.Mutex // serialises writes to out
+	seq int
+
+	// Guarded by mu, shared with the goroutine running the program
+	mu          sync.Mutex
+	interp      *interpreter.Interpreter
+	program     *ast.Program
+	source      *include.Source // the program with its $INCLUDEs expanded
+	statements  []ast.Statement // statements of source, not of libraries
+	breakpoints map[ast.Statement]bool
+	stepper     debugger.Stepper
+	entry       bool // next pause is the entry pause
+	launched    bool
+	configured  bool
+	running     bool
+	stopped     bool
+	pause       bool               // pause at the next statement
+	cancel      context.CancelFunc // stops the program
+
+	resume chan bool           // sent when a stopped program continues; true quits
+	done   chan struct{}       // closed when the program ends
+	frames []frameInfo         // stack of the current pause
+	refs   []func() []variable // variable containers of the current pause
+}
+
+// frameInfo is a stack frame of the paused program
+type frameInfo struct {
+	name string
+	at   include.Origin // file and line
+	env  *interpreter.Environment
+}
+
+// NewServer creates a server that reads requests from in and writes
+// responses and events to out
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:          bufio.NewReader(in),
+		out:         out,
+		breakpoints: make(map[ast.Statement]bool),
+		resume:      make(chan bool, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// Serve handles requests until the client disconnects or closes the input
+func (s *Server) Serve() error {
+	for {
+		body, err := readMessage(s.in)
+		if err != nil {
+			s.stop()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.stop()
+			return fmt.Errorf("dap: %v", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+
+		respBody, err := s.handle(&req)
+		s.respond(&req, respBody, err)
+		switch req.Command {
+		case "initialize":
+			// Breakpoints can be set once the program is loaded, so
+			// initialized is only sent after launch
+		case "launch":
+			if err == nil {
+				s.sendEvent("initialized", nil)
+			}
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+// handle runs a request and returns the body of its response
+func (s *Server) handle(req *request) (any, error) {
+	switch req.Command {
+	case "initialize":
+		return capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsEvaluateForHovers:        true,
+			SupportsTerminateRequest:         true,
+		}, nil
+	case "launch":
+		var args launchArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		if err := s.launch(&args); err != nil {
+			return nil, err
+		}
+		s.start()
+		return nil, nil
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.setBreakpoints(&args), nil
+	case "setExceptionBreakpoints":
+		return map[string]any{"breakpoints": []breakpoint{}}, nil
+	case "configurationDone":
+		s.mu.Lock()
+		s.configured = true
+		s.mu.Unlock()
+		s.start()
+		return nil, nil
+	case "threads":
+		return map[string]any{"threads": []thread{{ID: threadID, Name: "main"}}}, nil
+	case "stackTrace":
+		var args stackTraceArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.stackTrace(&args)
+	case "scopes":
+		var args scopesArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.scopes(&args)
+	case "variables":
+		var args variablesArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.variables(&args)
+	case "evaluate":
+		var args evaluateArguments
+		if err := decode(req, &args); err != nil {
+			return nil, err
+		}
+		return s.evaluate(&args)
+	case "continue":
+		return map[string]any{"allThreadsContinued": true}, s.continueWith(debugger.ModeContinue)
+	case "next":
+		return nil, s.continueWith(debugger.ModeNext)
+	case "stepIn":
+		return nil, s.continueWith(debugger.ModeStep)
+	case "stepOut":
+		return nil, s.continueWith(debugger.ModeFinish)
+	case "pause":
+		s.mu.Lock()
+		s.pause = true
+		s.mu.Unlock()
+		return nil, nil
+	case "terminate", "disconnect":
+		s.stop()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+func decode(req *request, args any) error {
+	if len(req.Arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(req.Arguments, args); err != nil {
+		return fmt.Errorf("bad %s arguments: %v", req.Command, err)
+	}
+	return nil
+}
+
+// launch loads and parses the program. It starts running once the client
+// has finished configuring breakpoints.
+func (s *Server) launch(args *launchArguments) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.launched {
+		return errors.New("a program is already running")
+	}
+	if args.Program == "" {
+		return errors.New("no program given")
+	}
+
+	text, err := os.ReadFile(args.Program)
+	if err != nil {
+		return err
+	}
+	src, err := include.Expand(args.Program, string(text), args.IncludePath)
+	if err != nil {
+		return err
+	}
+	p := parser.New(lexer.New(src.Text))
+	program := p.ParseProgram()
+	if errs := p.ErrorList(); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for k, err := range errs {
+			at := src.Origin(err.Line)
+			msgs[k] = fmt.Sprintf("%s:%d: %s", at.File, at.Line, err.Message)
+		}
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	// Breakpoints are set in the program's own files, not in libraries
+	statements := debugger.Statements(program)
+	if err := module.Link(program, src, args.IncludePath); err != nil {
+		return err
+	}
+
+	interp := interpreter.New(program)
+	ctx, cancel := context.WithCancel(context.Background())
+	interp.SetContext(ctx)
+	input := bufio.NewReader(strings.NewReader(args.Input))
+	interp.SetStdin(input)
+	interp.SetOutput(func(text string) {
+		s.sendEvent("output", map[string]any{"category": "stdout", "output": text})
+	})
+	interp.SetInput(func(prompt string) string {
+		s.sendEvent("output", map[string]any{"category": "stdout", "output": prompt})
+		line, _ := input.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	})
+	if !args.NoDebug {
+		interp.SetDebugHook(s.hook)
+	}
+
+	s.interp, s.cancel = interp, cancel
+	s.program, s.source, s.statements = program, src, statements
+	s.stepper.Mode = debugger.ModeContinue
+	if args.StopOnEntry {
+		s.stepper.Mode, s.entry = debugger.ModeStep, true
+	}
+	s.launched = true
+	return nil
+}
+
+// start runs the program in the background once it is launched and
+// configured
+func (s *Server) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.launched || !s.configured || s.running {
+		return
+	}
+	s.running = true
+
+	go func() {
+		err := s.interp.Run()
+		exitCode := 0
+		if err != nil && !errors.Is(err, debugger.ErrQuit) && !errors.Is(err, context.Canceled) {
+			s.sendEvent("output", map[string]any{"category": "stderr", "output": "runtime error: " + err.Error() + "\n"})
+			exitCode = 1
+		}
+		s.interp.Reset()
+		s.sendEvent("exited", map[string]any{"exitCode": exitCode})
+		s.sendEvent("terminated", nil)
+		close(s.done)
+	}()
+}
+
+// stop ends the program, if it is running, and waits for it to finish
+func (s *Server) stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.cancel()
+	if s.stopped {
+		s.stopped = false
+		s.resume <- true
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+// setBreakpoints replaces the breakpoints of a source file, the program
+// or a file it includes. Each line is moved to the next one with code on
+// it.
+func (s *Server) setBreakpoints(args *setBreakpointsArguments) map[string]any {
+	lines := args.Lines
+	if args.Breakpoints != nil {
+		lines = lines[:0:0]
+		for _, bp := range args.Breakpoints {
+			lines = append(lines, bp.Line)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]breakpoint, len(lines))
+	var stmts []ast.Statement // statements of the file, in order
+	if s.launched {
+		for _, stmt := range s.statements {
+			if samePath(args.Source.Path, s.source.Origin(ast.SourceLine(stmt)).File) {
+				stmts = append(stmts, stmt)
+			}
+		}
+	}
+	if len(stmts) == 0 {
+		for k, line := range lines {
+			result[k] = breakpoint{Line: line, Message: "not part of the launched program"}
+		}
+		return map[string]any{"breakpoints": result}
+	}
+
+	for _, stmt := range stmts {
+		delete(s.breakpoints, stmt)
+	}
+	for k, line := range lines {
+		var found ast.Statement
+		for _, stmt := range stmts {
+			if s.source.Origin(ast.SourceLine(stmt)).Line >= line {
+				found = stmt
+				break
+			}
+		}
+		if found == nil {
+			result[k] = breakpoint{Line: line, Message: "no code at or after this line"}
+			continue
+		}
+		s.breakpoints[found] = true
+		result[k] = breakpoint{Verified: true, Line: s.source.Origin(ast.SourceLine(found)).Line}
+	}
+	return map[string]any{"breakpoints": result}
+}
+
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// origin returns the file and line of a line of the procedure name, or of
+// the main program for ""
+func (s *Server) origin(name string, line int) include.Origin {
+	key := strings.ToUpper(name)
+	if sub, ok := s.program.Subs[key]; ok && sub.Library != "" {
+		return include.Origin{File: sub.Library, Line: line}
+	}
+	if fn, ok := s.program.Functions[key]; ok && fn.Library != "" {
+		return include.Origin{File: fn.Library, Line: line}
+	}
+	return s.source.Origin(line)
+}
+
+// hook is the interpreter's debug hook. When the program should pause it
+// reports a stopped event and waits for a request that resumes it.
+func (s *Server) hook(stmt ast.Statement) error {
+	if !debugger.Executable(stmt) {
+		return nil
+	}
+
+	s.mu.Lock()
+	depth := len(s.interp.CallStack())
+	var reason string
+	switch {
+	case s.entry:
+		reason = "entry"
+	case s.breakpoints[stmt]:
+		reason = "breakpoint"
+	case s.pause:
+		reason = "pause"
+	case s.stepper.ShouldStop(stmt, depth):
+		reason = "step"
+	default:
+		s.mu.Unlock()
+		return nil
+	}
+	s.entry, s.pause = false, false
+	s.stepper.Pause(stmt, depth)
+	s.frames = s.stack()
+	s.refs = nil
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.sendEvent("stopped", map[string]any{
+		"reason":            reason,
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	})
+	if quit := <-s.resume; quit {
+		return debugger.ErrQuit
+	}
+	return nil
+}
+
+// continueWith resumes a stopped program in the given stepping mode
+func (s *Server) continueWith(mode debugger.Mode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return errors.New("the program is not stopped")
+	}
+	s.stepper.Mode = mode
+	s.stopped = false
+	s.resume <- false
+	return nil
+}
+
+// stack builds the frames of the paused program, innermost first. Each
+// SUB or FUNCTION frame records the environment of its caller.
+func (s *Server) stack() []frameInfo {
+	calls := s.interp.CallStack()
+	name := procedureName(calls)
+	frames := []frameInfo{{
+		name: name,
+		at:   s.origin(name, s.stepper.Line()),
+		env:  s.interp.Scope(),
+	}}
+	env := s.interp.Scope()
+	for k := len(calls) - 1; k >= 0; k-- {
+		if calls[k].LocalEnv != nil {
+			env = calls[k].LocalEnv
+		}
+		name := procedureName(calls[:k])
+		frames = append(frames, frameInfo{
+			name: name,
+			at:   s.origin(name, calls[k].Line),
+			env:  env,
+		})
+	}
+	return frames
+}
+
+// procedureName names the SUB or FUNCTION running at the top of calls
+func procedureName(calls []interpreter.CallFrame) string {
+	for k := len(calls) - 1; k >= 0; k-- {
+		if calls[k].Type != "GOSUB" {
+			return calls[k].FuncName
+		}
+	}
+	return "main"
+}
+
+func (s *Server) stackTrace(args *stackTraceArguments) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return nil, errors.New("the program is not stopped")
+	}
+
+	frames := make([]stackFrame, 0, len(s.frames))
+	for k, f := range s.frames {
+		path, err := filepath.Abs(f.at.File)
+		if err != nil {
+			path = f.at.File
+		}
+		src := &source{Name: filepath.Base(path), Path: path}
+		frames = append(frames, stackFrame{ID: k + 1, Name: f.name, Source: src, Line: f.at.Line, Column: 1})
+	}
+	total := len(frames)
+	if args.StartFrame > 0 {
+		frames = frames[min(args.StartFrame, len(frames)):]
+	}
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+	return map[string]any{"stackFrames": frames, "totalFrames": total}, nil
+}
+
+func (s *Server) scopes(args *scopesArguments) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return nil, errors.New("the program is not stopped")
+	}
+	if args.FrameID < 1 || args.FrameID > len(s.frames) {
+		return nil, fmt.Errorf("unknown frame %d", args.FrameID)
+	}
+
+	env := s.frames[args.FrameID-1].env
+	globals := s.interp.Globals()
+	var scopes []scope
+	if env != globals {
+		scopes = append(scopes, scope{Name: "Locals", VariablesReference: s.reference(envVariables(env, s.reference))})
+	}
+	scopes = append(scopes, scope{Name: "Globals", VariablesReference: s.reference(envVariables(globals, s.reference))})
+	return map[string]any{"scopes": scopes}, nil
+}
+
+func (s *Server) variables(args *variablesArguments) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return nil, errors.New("the program is not stopped")
+	}
+	if args.VariablesReference < 1 || args.VariablesReference > len(s.refs) {
+		return nil, fmt.Errorf("unknown variables reference %d", args.VariablesReference)
+	}
+
+	vars := s.refs[args.VariablesReference-1]()
+	if args.Start > 0 {
+		vars = vars[min(args.Start, len(vars)):]
+	}
+	if args.Count > 0 && args.Count < len(vars) {
+		vars = vars[:args.Count]
+	}
+	return map[string]any{"variables": vars}, nil
+}
+
+func (s *Server) evaluate(args *evaluateArguments) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return nil, errors.New("the program is not stopped")
+	}
+
+	expr, err := debugger.ParseExpression(args.Expression)
+	if err != nil {
+		return nil, err
+	}
+	if ident, ok := expr.(*ast.Identifier); ok {
+		if _, isVar := s.interp.GetVariable(ident.Name); !isVar {
+			if arr, ok := s.interp.GetArray(ident.Name); ok {
+				v := arrayVariable(ident.Name, arr, s.reference)
+				return map[string]any{"result": v.Value, "variablesReference": v.VariablesReference}, nil
+			}
+		}
+	}
+	val, err := s.interp.Evaluate(expr)
+	if err != nil {
+		return nil, err
+	}
+	v := valueVariable(args.Expression, val, s.reference)
+	return map[string]any{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference}, nil
+}
+
+// reference registers a container of variables and returns its
+// variablesReference. References are valid until the program resumes.
+func (s *Server) reference(children func() []variable) int {
+	s.refs = append(s.refs, children)
+	return len(s.refs)
+}
+
+// envVariables lists the constants, variables and arrays of a scope
+func envVariables(env *interpreter.Environment, ref func(func() []variable) int) func() []variable {
+	return func() []variable {
+		var vars []variable
+		for name, val := range env.Constants() {
+			v := valueVariable(name, val, ref)
+			v.Type = "CONST " + v.Type
+			vars = append(vars, v)
+		}
+		for name, val := range env.Variables() {
+			vars = append(vars, valueVariable(name, val, ref))
+		}
+		for name, arr := range env.Arrays() {
+			vars = append(vars, arrayVariable(name, arr, ref))
+		}
+		sort.Slice(vars, func(a, b int) bool { return vars[a].Name < vars[b].Name })
+		return vars
+	}
+}
+
+// valueVariable describes a value; records can be expanded into fields
+func valueVariable(name string, val interpreter.Value, ref func(func() []variable) int) variable {
+	v := variable{Name: name, Value: debugger.FormatValue(val), Type: val.Type().String()}
+	if rec, ok := val.(*interpreter.RecordValue); ok {
+		v.Type = rec.Def.Name
+		v.VariablesReference = ref(func() []variable {
+			fields := make([]variable, len(rec.Fields))
+			for k, f := range rec.Fields {
+				fields[k] = valueVariable(rec.Def.Fields[k].Name, f, ref)
+			}
+			return fields
+		})
+	}
+	return v
+}
+
+// arrayVariable describes an array, which can be expanded into elements
+func arrayVariable(name string, arr *interpreter.Array, ref func(func() []variable) int) variable {
+	bounds := make([]string, len(arr.Dimensions))
+	for k, dim := range arr.Dimensions {
+		bounds[k] = fmt.Sprintf("%d TO %d", dim.Lower, dim.Upper)
+	}
+	return variable{
+		Name:  name,
+		Value: fmt.Sprintf("%s(%s)", arr.DataType, strings.Join(bounds, ", ")),
+		Type:  "array",
+		VariablesReference: ref(func() []variable {
+			elems := make([]variable, len(arr.Data))
+			subs := make([]int, len(arr.Dimensions))
+			for k, dim := range arr.Dimensions {
+				subs[k] = dim.Lower
+			}
+			for n, val := range arr.Data {
+				idx := make([]string, len(subs))
+				for k, sub := range subs {
+					idx[k] = fmt.Sprint(sub)
+				}
+				elems[n] = valueVariable("("+strings.Join(idx, ", ")+")", val, ref)
+
+				// Advance the subscripts, last dimension fastest
+				for k := len(subs) - 1; k >= 0; k-- {
+					subs[k]++
+					if subs[k] <= arr.Dimensions[k].Upper {
+						break
+					}
+					subs[k] = arr.Dimensions[k].Lower
+				}
+			}
+			return elems
+		}),
+		IndexedVariables: len(arr.Data),
+	}
+}
+
+func (s *Server) respond(req *request, body any, err error) {
+	resp := &response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    err == nil,
+		Command:    req.Command,
+		Body:       body,
+	}
+	if err != nil {
+		resp.Message = err.Error()
+		resp.Body = nil
+	}
+	s.send(resp, &resp.Seq)
+}
+
+func (s *Server) sendEvent(name string, body any) {
+	ev := &event{Type: "event", Event: name, Body: body}
+	s.send(ev, &ev.Seq)
+}
+
+// send numbers and writes a message. Write errors end the session when
+// Serve next reads.
+func (s *Server) send(msg any, seq *int) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	*seq = s.seq
+	writeMessage(s.out, msg)
+}
@@ -0,0 +1,274 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// message is any message sent by the server
+type message struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Command    string          `json:"command"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client is a scripted DAP client talking to a Server over pipes
+type client struct {
+	t       *testing.T
+	in      io.WriteCloser
+	out     *bufio.Reader
+	seq     int
+	pending []message // messages read while waiting for another
+	done    chan error
+}
+
+func newClient(t *testing.T) *client {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := &client{t: t, in: inW, out: bufio.NewReader(outR), done: make(chan error, 1)}
+	go func() {
+		err := NewServer(inR, outW).Serve()
+		outW.Close()
+		c.done <- err
+	}()
+	t.Cleanup(func() {
+		inW.Close()
+		go io.Copy(io.Discard, outR)
+		<-c.done
+	})
+	return c
+}
+
+// request sends a request and returns the body of its response, which must
+// succeed
+func (c *client) request(command string, args any) json.RawMessage {
+	c.t.Helper()
+	c.seq++
+	req := map[string]any{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+	if err := writeMessage(c.in, req); err != nil {
+		c.t.Fatalf("%s: %v", command, err)
+	}
+	resp := c.wait(func(m message) bool { return m.Type == "response" && m.RequestSeq == c.seq })
+	if !resp.Success || resp.Command != command {
+		c.t.Fatalf("%s failed: %s", command, resp.Message)
+	}
+	return resp.Body
+}
+
+// event waits for the named event and returns its body
+func (c *client) event(name string) json.RawMessage {
+	c.t.Helper()
+	return c.wait(func(m message) bool { return m.Type == "event" && m.Event == name }).Body
+}
+
+// wait returns the first message, read earlier or now, that match accepts
+func (c *client) wait(match func(message) bool) message {
+	c.t.Helper()
+	for k, m := range c.pending {
+		if match(m) {
+			c.pending = append(c.pending[:k], c.pending[k+1:]...)
+			return m
+		}
+	}
+
+	for {
+		body, err := readMessage(c.out)
+		if err != nil {
+			c.t.Fatalf("reading from the server: %v", err)
+		}
+		var m message
+		if err := json.Unmarshal(body, &m); err != nil {
+			c.t.Fatalf("bad message %s: %v", body, err)
+		}
+		if match(m) {
+			return m
+		}
+		c.pending = append(c.pending, m)
+	}
+}
+
+// stoppedAt waits for a stopped event and returns its reason and the line
+// of the top stack frame
+func (c *client) stoppedAt() (string, int) {
+	c.t.Helper()
+	var stopped struct {
+		Reason string `json:"reason"`
+	}
+	decodeBody(c.t, c.event("stopped"), &stopped)
+	var trace struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	decodeBody(c.t, c.request("stackTrace", map[string]any{"threadId": threadID}), &trace)
+	if len(trace.StackFrames) == 0 {
+		c.t.Fatal("stopped with no stack frames")
+	}
+	return stopped.Reason, trace.StackFrames[0].Line
+}
+
+func decodeBody(t *testing.T, body json.RawMessage, v any) {
+	t.Helper()
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("bad body %s: %v", body, err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.bas")
+	src := `x = 1
+CALL Inc(x)
+PRINT x
+END
+SUB Inc (n)
+  n = n + 1
+END SUB
+`
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(t)
+	var caps capabilities
+	decodeBody(t, c.request("initialize", map[string]any{"adapterID": "xbasic"}), &caps)
+	if !caps.SupportsConfigurationDoneRequest {
+		t.Error("configurationDone is not supported")
+	}
+
+	c.request("launch", map[string]any{"program": path})
+	c.event("initialized")
+
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	decodeBody(t, c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": path},
+		"breakpoints": []map[string]any{{"line": 1}},
+	}), &bps)
+	if len(bps.Breakpoints) != 1 || !bps.Breakpoints[0].Verified || bps.Breakpoints[0].Line != 1 {
+		t.Fatalf("setBreakpoints = %+v, want line 1 verified", bps.Breakpoints)
+	}
+
+	c.request("configurationDone", nil)
+	if reason, line := c.stoppedAt(); reason != "breakpoint" || line != 1 {
+		t.Fatalf("stopped for %s at line %d, want breakpoint at line 1", reason, line)
+	}
+
+	// Step over x = 1 and look at x
+	c.request("next", map[string]any{"threadId": threadID})
+	if reason, line := c.stoppedAt(); reason != "step" || line != 2 {
+		t.Fatalf("next stopped for %s at line %d, want step at line 2", reason, line)
+	}
+	var scopes struct {
+		Scopes []scope `json:"scopes"`
+	}
+	decodeBody(t, c.request("scopes", map[string]any{"frameId": 1}), &scopes)
+	if len(scopes.Scopes) != 1 || scopes.Scopes[0].Name != "Globals" {
+		t.Fatalf("scopes = %+v, want Globals only", scopes.Scopes)
+	}
+	var vars struct {
+		Variables []variable `json:"variables"`
+	}
+	decodeBody(t, c.request("variables", map[string]any{"variablesReference": scopes.Scopes[0].VariablesReference}), &vars)
+	if len(vars.Variables) != 1 || vars.Variables[0].Name != "X" || vars.Variables[0].Value != "1" {
+		t.Fatalf("variables = %+v, want X = 1", vars.Variables)
+	}
+
+	c.request("stepIn", map[string]any{"threadId": threadID})
+	if reason, line := c.stoppedAt(); reason != "step" || line != 6 {
+		t.Fatalf("stepIn stopped for %s at line %d, want step at line 6", reason, line)
+	}
+
+	c.request("stepOut", map[string]any{"threadId": threadID})
+	if reason, line := c.stoppedAt(); reason != "step" || line != 3 {
+		t.Fatalf("stepOut stopped for %s at line %d, want step at line 3", reason, line)
+	}
+
+	c.request("continue", map[string]any{"threadId": threadID})
+	var output struct {
+		Output string `json:"output"`
+	}
+	decodeBody(t, c.event("output"), &output)
+	if output.Output != " 2\n" {
+		t.Errorf("program printed %q, want \" 2\\n\"", output.Output)
+	}
+	var exited struct {
+		ExitCode int `json:"exitCode"`
+	}
+	decodeBody(t, c.event("exited"), &exited)
+	if exited.ExitCode != 0 {
+		t.Errorf("exit code %d, want 0", exited.ExitCode)
+	}
+	c.event("terminated")
+	c.request("disconnect", nil)
+}
+
+func TestLaunchIncludeAndImport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.bas":  "'$INCLUDE: 'common.bi'\nIMPORT \"lib.bas\" AS Lib\nCALL Lib.Show(Twice(n))\n",
+		"common.bi": "n = 2\nFUNCTION Twice (x)\n  Twice = x * 2\nEND FUNCTION\n",
+		"lib.bas":   "SUB Show (x)\n  PRINT x\nEND SUB\n",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	main, common := filepath.Join(dir, "main.bas"), filepath.Join(dir, "common.bi")
+
+	c := newClient(t)
+	c.request("initialize", map[string]any{"adapterID": "xbasic"})
+	c.request("launch", map[string]any{"program": main})
+	c.event("initialized")
+
+	// Line 3 of the included file is inside Twice
+	var bps struct {
+		Breakpoints []breakpoint `json:"breakpoints"`
+	}
+	decodeBody(t, c.request("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": common},
+		"breakpoints": []map[string]any{{"line": 3}},
+	}), &bps)
+	if len(bps.Breakpoints) != 1 || !bps.Breakpoints[0].Verified || bps.Breakpoints[0].Line != 3 {
+		t.Fatalf("setBreakpoints = %+v, want line 3 verified", bps.Breakpoints)
+	}
+
+	c.request("configurationDone", nil)
+	c.event("stopped")
+	var trace struct {
+		StackFrames []stackFrame `json:"stackFrames"`
+	}
+	decodeBody(t, c.request("stackTrace", map[string]any{"threadId": threadID}), &trace)
+	if len(trace.StackFrames) != 2 {
+		t.Fatalf("stack = %+v, want Twice and main", trace.StackFrames)
+	}
+	for k, want := range []struct {
+		path string
+		line int
+	}{{common, 3}, {main, 3}} {
+		if f := trace.StackFrames[k]; f.Source == nil || f.Source.Path != want.path || f.Line != want.line {
+			t.Errorf("frame %d at %+v line %d, want %s:%d", k, f.Source, f.Line, want.path, want.line)
+		}
+	}
+
+	c.request("continue", map[string]any{"threadId": threadID})
+	var output struct {
+		Output string `json:"output"`
+	}
+	decodeBody(t, c.event("output"), &output)
+	if output.Output != " 4\n" {
+		t.Errorf("program printed %q, want \" 4\\n\"", output.Output)
+	}
+	c.event("terminated")
+	c.request("disconnect", nil)
+}
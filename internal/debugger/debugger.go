@@ -0,0 +1,427 @@
+// Package debugger implements an interactive source-level debugger for BASIC
+// programs run by the tree-walking interpreter.
+package debugger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/interpreter"
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+// ErrQuit is returned by the debug hook when the user quits the debugger
+var ErrQuit = errors.New("debugger: quit")
+
+// Debugger runs a program under interactive control. Commands are read
+// from the same input as the program's INPUT statements.
+type Debugger struct {
+	interp  *interpreter.Interpreter
+	program *ast.Program
+	source  []string
+	in      *bufio.Reader
+	out     io.Writer
+
+	statements  []ast.Statement       // executable statements in source order
+	breakpoints map[ast.Statement]int // statement -> source line
+
+	stepper Stepper
+	last    string // last stepping command, repeated by an empty line
+}
+
+// New creates a debugger for a parsed program. The interpreter's input
+// should read from in so that commands and INPUT do not compete for it.
+func New(interp *interpreter.Interpreter, program *ast.Program, source string, in *bufio.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		interp:      interp,
+		program:     program,
+		source:      strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n"),
+		in:          in,
+		out:         out,
+		statements:  Statements(program),
+		breakpoints: make(map[ast.Statement]int),
+	}
+}
+
+// Run runs the program, pausing before its first statement. Quitting the
+// debugger is not an error.
+func (d *Debugger) Run() error {
+	d.stepper.Mode = ModeStep
+	d.interp.SetDebugHook(d.hook)
+	defer d.interp.SetDebugHook(nil)
+
+	err := d.interp.Run()
+	if errors.Is(err, ErrQuit) {
+		return nil
+	}
+	if err == nil {
+		fmt.Fprintln(d.out, "Program finished")
+	}
+	return err
+}
+
+// hook is the interpreter's debug hook. It decides whether to pause before
+// stmt and, if so, reads commands until one resumes the program.
+func (d *Debugger) hook(stmt ast.Statement) error {
+	if !Executable(stmt) {
+		return nil
+	}
+	depth := len(d.interp.CallStack())
+	_, isBreak := d.breakpoints[stmt]
+	if !isBreak && !d.stepper.ShouldStop(stmt, depth) {
+		return nil
+	}
+
+	line := ast.SourceLine(stmt)
+	if isBreak {
+		fmt.Fprintf(d.out, "Breakpoint at line %d\n", line)
+	}
+	d.stepper.Pause(stmt, depth)
+	d.showLine(line)
+	return d.commands()
+}
+
+// commands reads and runs debugger commands until one resumes the program.
+// An empty line repeats the last stepping command.
+func (d *Debugger) commands() error {
+	for {
+		fmt.Fprint(d.out, "(debug) ")
+		input, err := d.in.ReadString('\n')
+		if err != nil && input == "" {
+			fmt.Fprintln(d.out)
+			return ErrQuit
+		}
+		input = strings.TrimSpace(input)
+		if input == "" {
+			input = d.last
+		}
+		cmd, arg, _ := strings.Cut(input, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch strings.ToLower(cmd) {
+		case "":
+		case "s", "step":
+			d.stepper.Mode, d.last = ModeStep, cmd
+			return nil
+		case "n", "next":
+			d.stepper.Mode, d.last = ModeNext, cmd
+			return nil
+		case "finish", "out":
+			if d.stepper.Depth() == 0 {
+				fmt.Fprintln(d.out, "Not inside a SUB, FUNCTION or GOSUB")
+				continue
+			}
+			d.stepper.Mode, d.last = ModeFinish, cmd
+			return nil
+		case "c", "continue":
+			d.stepper.Mode, d.last = ModeContinue, cmd
+			return nil
+		case "b", "break":
+			d.setBreakpoint(arg)
+		case "clear", "delete":
+			d.clearBreakpoint(arg)
+		case "p", "print":
+			d.print(arg)
+		case "set":
+			d.set(arg)
+		case "bt", "backtrace", "where":
+			d.backtrace()
+		case "l", "list":
+			d.list(arg)
+		case "q", "quit":
+			return ErrQuit
+		case "h", "help", "?":
+			fmt.Fprint(d.out, help)
+		default:
+			fmt.Fprintf(d.out, "Unknown command %q; type help for a list of commands\n", cmd)
+		}
+	}
+}
+
+const help = `Commands:
+  break [line|label|sub]  set a breakpoint, or list breakpoints
+  clear [line|label|sub]  remove a breakpoint, or all of them
+  step (s)                run to the next line, entering SUB and FUNCTION calls
+  next (n)                run to the next line, stepping over calls
+  finish (out)            run until the current SUB, FUNCTION or GOSUB returns
+  continue (c)            run until the next breakpoint
+  print (p) expr[, ...]   show the value of expressions or whole arrays
+  set var = expr          assign a variable or array element
+  backtrace (bt)          show the active calls
+  list (l) [line]         show the source around a line
+  quit (q)                stop the program and exit
+`
+
+// resolve finds the statement a breakpoint location refers to. A number is
+// a BASIC line number if the program has one, otherwise a source line; a
+// name is a label or a SUB or FUNCTION.
+func (d *Debugger) resolve(loc string) (ast.Statement, error) {
+	if n, err := strconv.Atoi(loc); err == nil {
+		if idx, ok := d.program.LineNumbers[n]; ok {
+			return d.after(d.program.Statements[idx], loc)
+		}
+		if stmt := StatementAt(d.statements, n); stmt != nil {
+			return stmt, nil
+		}
+		return nil, fmt.Errorf("no code at or after line %d", n)
+	}
+
+	name := strings.ToUpper(loc)
+	if idx, ok := d.program.Labels[name]; ok {
+		return d.after(d.program.Statements[idx], loc)
+	}
+	for _, stmt := range d.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.SubStatement:
+			if strings.EqualFold(s.Name, name) {
+				return d.after(s, loc)
+			}
+		case *ast.FuncStatement:
+			if strings.EqualFold(s.Name, name) {
+				return d.after(s, loc)
+			}
+		}
+	}
+	return nil, fmt.Errorf("no line, label, SUB or FUNCTION %s", loc)
+}
+
+// after returns the first executable statement that follows marker in the
+// source
+func (d *Debugger) after(marker ast.Statement, loc string) (ast.Statement, error) {
+	line := ast.SourceLine(marker)
+	for _, stmt := range d.statements {
+		if stmt == marker {
+			continue
+		}
+		if ast.SourceLine(stmt) >= line {
+			return stmt, nil
+		}
+	}
+	return nil, fmt.Errorf("no code after %s", loc)
+}
+
+func (d *Debugger) setBreakpoint(loc string) {
+	if loc == "" {
+		d.listBreakpoints()
+		return
+	}
+	stmt, err := d.resolve(loc)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	line := ast.SourceLine(stmt)
+	d.breakpoints[stmt] = line
+	fmt.Fprintf(d.out, "Breakpoint set at line %d\n", line)
+}
+
+func (d *Debugger) clearBreakpoint(loc string) {
+	if loc == "" {
+		d.breakpoints = make(map[ast.Statement]int)
+		fmt.Fprintln(d.out, "All breakpoints cleared")
+		return
+	}
+	stmt, err := d.resolve(loc)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	if _, ok := d.breakpoints[stmt]; !ok {
+		fmt.Fprintf(d.out, "No breakpoint at line %d\n", ast.SourceLine(stmt))
+		return
+	}
+	delete(d.breakpoints, stmt)
+	fmt.Fprintf(d.out, "Breakpoint cleared at line %d\n", ast.SourceLine(stmt))
+}
+
+func (d *Debugger) listBreakpoints() {
+	if len(d.breakpoints) == 0 {
+		fmt.Fprintln(d.out, "No breakpoints")
+		return
+	}
+	lines := make([]int, 0, len(d.breakpoints))
+	for _, line := range d.breakpoints {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	for _, line := range lines {
+		fmt.Fprintf(d.out, "  line %d: %s\n", line, d.sourceLine(line))
+	}
+}
+
+// print evaluates a PRINT-style list of expressions. A bare array name
+// shows every element of the array.
+func (d *Debugger) print(args string) {
+	if args == "" {
+		fmt.Fprintln(d.out, "Usage: print expr[, expr ...]")
+		return
+	}
+	stmt, err := parseStatement("PRINT " + args)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	ps, ok := stmt.(*ast.PrintStmt)
+	if !ok {
+		fmt.Fprintln(d.out, "Usage: print expr[, expr ...]")
+		return
+	}
+
+	for _, item := range ps.Items {
+		if item.Expression == nil {
+			continue
+		}
+		if ident, ok := item.Expression.(*ast.Identifier); ok {
+			if _, isVar := d.interp.GetVariable(ident.Name); !isVar {
+				if arr, ok := d.interp.GetArray(ident.Name); ok {
+					d.printArray(ident.Name, arr)
+					continue
+				}
+			}
+		}
+		val, err := d.interp.Evaluate(item.Expression)
+		if err != nil {
+			fmt.Fprintln(d.out, err)
+			continue
+		}
+		fmt.Fprintf(d.out, "%s = %s\n", item.Expression.String(), FormatValue(val))
+	}
+}
+
+// printArray shows each element of arr with its subscripts
+func (d *Debugger) printArray(name string, arr *interpreter.Array) {
+	subs := make([]int, len(arr.Dimensions))
+	for k, dim := range arr.Dimensions {
+		subs[k] = dim.Lower
+	}
+	for _, val := range arr.Data {
+		idx := make([]string, len(subs))
+		for k, s := range subs {
+			idx[k] = strconv.Itoa(s)
+		}
+		fmt.Fprintf(d.out, "%s(%s) = %s\n", name, strings.Join(idx, ", "), FormatValue(val))
+
+		// Advance the subscripts, last dimension fastest, matching the
+		// layout of Array.Data
+		for k := len(subs) - 1; k >= 0; k-- {
+			subs[k]++
+			if subs[k] <= arr.Dimensions[k].Upper {
+				break
+			}
+			subs[k] = arr.Dimensions[k].Lower
+		}
+	}
+}
+
+// set runs an assignment in the scope of the paused statement
+func (d *Debugger) set(args string) {
+	stmt, err := parseStatement("LET " + args)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	if _, ok := stmt.(*ast.LetStmt); !ok {
+		fmt.Fprintln(d.out, "Usage: set var = expr")
+		return
+	}
+	if err := d.interp.Execute(stmt); err != nil {
+		fmt.Fprintln(d.out, err)
+	}
+}
+
+// backtrace shows the call stack, innermost call first
+func (d *Debugger) backtrace() {
+	frames := d.interp.CallStack()
+	fmt.Fprintf(d.out, "#0  line %d\n", d.stepper.Line())
+	for k := len(frames) - 1; k >= 0; k-- {
+		f := frames[k]
+		name := f.Type
+		if f.FuncName != "" {
+			name += " " + f.FuncName
+		}
+		fmt.Fprintf(d.out, "#%d  %s called from line %d\n", len(frames)-k, name, f.Line)
+	}
+}
+
+// list shows the source around a line, by default the paused one
+func (d *Debugger) list(arg string) {
+	center := d.stepper.Line()
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Fprintln(d.out, "Usage: list [line]")
+			return
+		}
+		center = n
+	}
+	from := max(center-5, 1)
+	to := min(center+5, len(d.source))
+	for n := from; n <= to; n++ {
+		marker := "  "
+		if n == d.stepper.Line() {
+			marker = "=>"
+		}
+		fmt.Fprintf(d.out, "%s %4d  %s\n", marker, n, d.sourceLine(n))
+	}
+}
+
+// showLine prints the source line the program is paused at
+func (d *Debugger) showLine(line int) {
+	fmt.Fprintf(d.out, "%d: %s\n", line, strings.TrimSpace(d.sourceLine(line)))
+}
+
+func (d *Debugger) sourceLine(n int) string {
+	if n < 1 || n > len(d.source) {
+		return ""
+	}
+	return d.source[n-1]
+}
+
+// parseStatement parses a single statement typed at the prompt
+func parseStatement(src string) (ast.Statement, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return nil, errors.New(errs[0])
+	}
+	if len(program.Statements) != 1 {
+		return nil, fmt.Errorf("expected a single statement")
+	}
+	return program.Statements[0], nil
+}
+
+// ParseExpression parses an expression typed by the user
+func ParseExpression(src string) (ast.Expression, error) {
+	stmt, err := parseStatement("PRINT " + src)
+	if err != nil {
+		return nil, err
+	}
+	ps, ok := stmt.(*ast.PrintStmt)
+	if !ok || len(ps.Items) != 1 || ps.Items[0].Expression == nil {
+		return nil, fmt.Errorf("not an expression: %s", src)
+	}
+	return ps.Items[0].Expression, nil
+}
+
+// FormatValue shows a value as a literal: strings quoted, records with
+// their fields
+func FormatValue(val interpreter.Value) string {
+	switch v := val.(type) {
+	case *interpreter.StringValue:
+		return strconv.Quote(v.Val)
+	case *interpreter.RecordValue:
+		fields := make([]string, len(v.Fields))
+		for k, f := range v.Fields {
+			fields[k] = v.Def.Fields[k].Name + ": " + FormatValue(f)
+		}
+		return v.Def.Name + " {" + strings.Join(fields, ", ") + "}"
+	}
+	return val.String()
+}
@@ -0,0 +1,123 @@
+package debugger
+
+import "github.com/xbasic/xbasic/internal/ast"
+
+// Mode says when a running program should next pause
+type Mode int
+
+const (
+	ModeStep     Mode = iota // at the next line, entering calls
+	ModeNext                 // at the next line of the same or an outer procedure
+	ModeFinish               // after the current procedure returns
+	ModeContinue             // only at breakpoints
+)
+
+// Stepper remembers where a program last paused and decides, from the
+// current Mode, where it pauses next
+type Stepper struct {
+	Mode Mode
+
+	stmt  ast.Statement
+	line  int
+	depth int
+}
+
+// ShouldStop reports whether the program should pause before stmt, which
+// runs at the given call depth
+func (s *Stepper) ShouldStop(stmt ast.Statement, depth int) bool {
+	// Reaching the paused statement again, as in a loop on one line,
+	// counts as a new line
+	moved := ast.SourceLine(stmt) != s.line || stmt == s.stmt
+
+	switch s.Mode {
+	case ModeStep:
+		return moved || depth != s.depth
+	case ModeNext:
+		return depth < s.depth || depth == s.depth && moved
+	case ModeFinish:
+		return depth < s.depth
+	}
+	return false
+}
+
+// Pause records that the program paused before stmt
+func (s *Stepper) Pause(stmt ast.Statement, depth int) {
+	s.stmt, s.line, s.depth = stmt, ast.SourceLine(stmt), depth
+}
+
+// Line returns the source line of the last pause
+func (s *Stepper) Line() int {
+	return s.line
+}
+
+// Depth returns the call depth of the last pause
+func (s *Stepper) Depth() int {
+	return s.depth
+}
+
+// Statements returns the executable statements of a program, including
+// those nested in blocks and procedures, in source order
+func Statements(program *ast.Program) []ast.Statement {
+	var stmts []ast.Statement
+	var collect func(body []ast.Statement)
+	collect = func(body []ast.Statement) {
+		for _, stmt := range body {
+			if Executable(stmt) {
+				stmts = append(stmts, stmt)
+			}
+			for _, nested := range children(stmt) {
+				collect(nested)
+			}
+		}
+	}
+	collect(program.Statements)
+	return stmts
+}
+
+// StatementAt returns the first statement of stmts on or after a source
+// line, or nil
+func StatementAt(stmts []ast.Statement, line int) ast.Statement {
+	for _, stmt := range stmts {
+		if ast.SourceLine(stmt) >= line {
+			return stmt
+		}
+	}
+	return nil
+}
+
+// children returns the statement lists nested in stmt
+func children(stmt ast.Statement) [][]ast.Statement {
+	switch s := stmt.(type) {
+	case *ast.IfStmt:
+		return [][]ast.Statement{s.Consequence, s.Alternative}
+	case *ast.ForStmt:
+		return [][]ast.Statement{s.Body}
+	case *ast.WhileStmt:
+		return [][]ast.Statement{s.Body}
+	case *ast.DoLoopStmt:
+		return [][]ast.Statement{s.Body}
+	case *ast.SelectCaseStmt:
+		var bodies [][]ast.Statement
+		for _, c := range s.Cases {
+			bodies = append(bodies, c.Body)
+		}
+		return append(bodies, s.CaseElse)
+	case *ast.SubStatement:
+		return [][]ast.Statement{s.Body}
+	case *ast.FuncStatement:
+		return [][]ast.Statement{s.Body}
+	}
+	return nil
+}
+
+// Executable reports whether a program can pause at stmt. Markers and
+// declarations do nothing when they are reached.
+func Executable(stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.LineNumberStmt, *ast.LabelStmt, *ast.RemStmt, *ast.DataStmt,
+		*ast.SubStatement, *ast.FuncStatement, *ast.TypeStmt, *ast.OptionStmt,
+		*ast.SharedStmt:
+		return false
+	}
+	return true
+}
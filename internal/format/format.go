@@ -0,0 +1,401 @@
+// Package format lays out BASIC source in a canonical style: keywords in
+// upper case, block bodies indented by four spaces, single spaces around
+// operators and after separators, and at most one blank line in a row.
+//
+// Formatting works on the tokens of each line, so comments, DATA items and
+// the spelling of literals are kept exactly as written. The result is
+// checked by parsing it again and comparing the program's String() form
+// with the original's.
+package format
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+const indentUnit = "    "
+
+// SyntaxError reports that the source does not parse, so it was not
+// formatted
+type SyntaxError struct {
+	Errors []string // parser messages, "line N: message"
+}
+
+func (e *SyntaxError) Error() string {
+	return strings.Join(e.Errors, "\n")
+}
+
+// errChanged means formatting would change the meaning of the program.
+// It indicates a bug in the formatter.
+var errChanged = errors.New("format: formatting would change the program")
+
+// Source formats a BASIC program
+func Source(src []byte) ([]byte, error) {
+	original, err := parse(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	out := layout(string(src))
+
+	formatted, err := parse(out)
+	if err != nil || formatted != original {
+		return nil, errChanged
+	}
+	return []byte(out), nil
+}
+
+// parse returns the String() form of a program, or its syntax errors
+func parse(src string) (string, error) {
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return "", &SyntaxError{Errors: errs}
+	}
+	return program.String(), nil
+}
+
+// token is a lexer token with the exact source text it was read from
+type token struct {
+	lexer.Token
+	text  string
+	space bool // preceded by white space in the source
+}
+
+// layout formats the source line by line
+func layout(src string) string {
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	byLine := make([][]token, len(lines)+1)
+	for _, tok := range lexer.Tokenize(src) {
+		if tok.Type == lexer.TOKEN_NEWLINE || tok.Type == lexer.TOKEN_EOF {
+			continue
+		}
+		if tok.Line >= 1 && tok.Line <= len(lines) {
+			byLine[tok.Line] = append(byLine[tok.Line], token{Token: tok})
+		}
+	}
+
+	var out strings.Builder
+	if strings.HasPrefix(src, "#!") {
+		// The lexer skips a shebang line
+		out.WriteString(strings.TrimRight(lines[0], " \t\r") + "\n")
+		lines[0] = ""
+	}
+
+	level := 0
+	blank := false
+	for n, line := range lines {
+		toks := byLine[n+1]
+		if len(toks) == 0 {
+			blank = out.Len() > 0
+			continue
+		}
+		if blank {
+			out.WriteString("\n")
+			blank = false
+		}
+
+		sourceText(line, toks)
+		indent, next := indentation(toks, level)
+		out.WriteString(strings.TrimRight(formatLine(toks, indent), " "))
+		out.WriteString("\n")
+		level = next
+	}
+	return out.String()
+}
+
+// sourceText fills in the text of each token from the source line: the
+// characters from its column up to the next token. Comments and DATA run
+// to the end of the line.
+func sourceText(line string, toks []token) {
+	for k := range toks {
+		start := min(max(toks[k].Column-1, 0), len(line))
+		end := len(line)
+		if k+1 < len(toks) && toks[k].Type != lexer.TOKEN_REM && toks[k].Type != lexer.TOKEN_DATA {
+			end = min(max(toks[k+1].Column-1, start), len(line))
+		}
+		toks[k].text = strings.TrimRight(line[start:end], " \t\r")
+		toks[k].space = start > 0 && (line[start-1] == ' ' || line[start-1] == '\t')
+	}
+}
+
+// indentation works out the indent level of a line and of the line after
+// it, from the statements that open and close blocks
+func indentation(toks []token, level int) (indent, next int) {
+	first := true
+	next = level
+	for _, stmt := range statements(toks) {
+		before, after := blockEffect(stmt, toks)
+		if first {
+			level = max(level+before, 0)
+			next = level
+			first = false
+		} else {
+			next += before
+		}
+		next = max(next+after, 0)
+	}
+	return level, next
+}
+
+// statements returns the first token of each statement on a line, skipping
+// any line number or label
+func statements(toks []token) [][]token {
+	start := 0
+	if len(toks) > 0 && toks[0].Type == lexer.TOKEN_LINE_NUMBER {
+		start = 1
+	}
+	if isLabel(toks[start:]) {
+		start += 2
+	}
+
+	var stmts [][]token
+	for k := start; k < len(toks); k++ {
+		if k == start || toks[k-1].Type == lexer.TOKEN_COLON {
+			stmts = append(stmts, toks[k:])
+		}
+		if toks[k].Type == lexer.TOKEN_DATA || toks[k].Type == lexer.TOKEN_REM {
+			break
+		}
+	}
+	return stmts
+}
+
+// isLabel reports whether a statement starts with a "name:" label
+func isLabel(toks []token) bool {
+	return len(toks) >= 2 && toks[0].Type == lexer.TOKEN_IDENT && toks[1].Type == lexer.TOKEN_COLON
+}
+
+// blockEffect returns how a statement changes the indent level before and
+// after it. A CASE sits one level inside its SELECT and its body two.
+func blockEffect(stmt, line []token) (before, after int) {
+	switch stmt[0].Type {
+	case lexer.TOKEN_FOR, lexer.TOKEN_WHILE, lexer.TOKEN_DO, lexer.TOKEN_SUB, lexer.TOKEN_FUNCTION, lexer.TOKEN_TYPE:
+		return 0, 1
+	case lexer.TOKEN_NEXT:
+		// NEXT i, j closes two loops
+		n := 1
+		for _, tok := range stmt[1:] {
+			if tok.Type == lexer.TOKEN_COLON {
+				break
+			}
+			if tok.Type == lexer.TOKEN_COMMA {
+				n++
+			}
+		}
+		return -n, 0
+	case lexer.TOKEN_WEND, lexer.TOKEN_LOOP:
+		return -1, 0
+	case lexer.TOKEN_SELECT:
+		return 0, 2
+	case lexer.TOKEN_CASE:
+		return -1, 1
+	case lexer.TOKEN_ELSE, lexer.TOKEN_ELSEIF:
+		return -1, 1
+	case lexer.TOKEN_IF:
+		if blockIf(line) {
+			return 0, 1
+		}
+	case lexer.TOKEN_END:
+		if len(stmt) > 1 {
+			switch stmt[1].Type {
+			case lexer.TOKEN_SELECT:
+				return -2, 0
+			case lexer.TOKEN_IF, lexer.TOKEN_SUB, lexer.TOKEN_FUNCTION, lexer.TOKEN_TYPE:
+				return -1, 0
+			}
+		}
+	}
+	return 0, 0
+}
+
+// blockIf reports whether a line ends with THEN, opening a block IF
+func blockIf(line []token) bool {
+	for k := len(line) - 1; k >= 0; k-- {
+		if line[k].Type == lexer.TOKEN_REM {
+			continue
+		}
+		return line[k].Type == lexer.TOKEN_THEN
+	}
+	return false
+}
+
+// formatLine writes the tokens of a line with normalised spacing
+func formatLine(toks []token, indent int) string {
+	var out strings.Builder
+	k := 0
+	if toks[0].Type == lexer.TOKEN_LINE_NUMBER {
+		out.WriteString(toks[0].text)
+		out.WriteString(" ")
+		k = 1
+	}
+	if isLabel(toks[k:]) {
+		// Labels stay at the left margin
+		out.WriteString(toks[k].text + ":")
+		k += 2
+		if k < len(toks) {
+			out.WriteString(" ")
+		}
+	} else {
+		out.WriteString(strings.Repeat(indentUnit, indent))
+	}
+
+	stmtStart := k
+	for ; k < len(toks); k++ {
+		tok := toks[k]
+		if k > stmtStart && spaceBefore(toks, k, stmtStart) {
+			out.WriteString(" ")
+		}
+
+		switch tok.Type {
+		case lexer.TOKEN_DATA:
+			// DATA items are kept as written
+			out.WriteString("DATA")
+			if rest := strings.TrimSpace(tok.text[len("DATA"):]); rest != "" {
+				out.WriteString(" " + rest)
+			}
+			return out.String()
+		case lexer.TOKEN_REM:
+			if strings.HasPrefix(tok.text, "'") {
+				out.WriteString(tok.text)
+			} else {
+				out.WriteString("REM" + tok.text[len("REM"):])
+			}
+			return out.String()
+		case lexer.TOKEN_PRINT:
+			out.WriteString("PRINT") // also spelt ?
+		case lexer.TOKEN_COLON:
+			out.WriteString(":")
+			stmtStart = k + 1
+			if k+1 < len(toks) {
+				out.WriteString(" ")
+			}
+			continue
+		default:
+			// EXPLICIT is a word only after OPTION
+			if isKeyword(tok) || k > 0 && toks[k-1].Type == lexer.TOKEN_OPTION || isCaseIs(toks, k, stmtStart) {
+				out.WriteString(strings.ToUpper(tok.text))
+			} else {
+				out.WriteString(tok.text)
+			}
+		}
+	}
+	return out.String()
+}
+
+// isKeyword reports whether a token is a reserved word
+func isKeyword(tok token) bool {
+	switch tok.Type {
+	case lexer.TOKEN_IDENT, lexer.TOKEN_INTEGER, lexer.TOKEN_FLOAT, lexer.TOKEN_STRING, lexer.TOKEN_LINE_NUMBER, lexer.TOKEN_ILLEGAL:
+		return false
+	}
+	return tok.text != "" && strings.ToUpper(tok.text) != strings.ToLower(tok.text)
+}
+
+// isCaseIs reports whether toks[k] is the IS of CASE IS > value, which the
+// lexer reads as a name
+func isCaseIs(toks []token, k, stmtStart int) bool {
+	if toks[stmtStart].Type != lexer.TOKEN_CASE || toks[k].Type != lexer.TOKEN_IDENT ||
+		!strings.EqualFold(toks[k].text, "IS") {
+		return false
+	}
+	prev := toks[k-1].Type
+	return prev == lexer.TOKEN_CASE || prev == lexer.TOKEN_COMMA
+}
+
+// isOperator reports whether a token is an arithmetic, relational or
+// logical operator
+func isOperator(t lexer.TokenType) bool {
+	switch t {
+	case lexer.TOKEN_PLUS, lexer.TOKEN_MINUS, lexer.TOKEN_ASTERISK, lexer.TOKEN_SLASH, lexer.TOKEN_BACKSLASH,
+		lexer.TOKEN_CARET, lexer.TOKEN_MOD, lexer.TOKEN_EQ, lexer.TOKEN_NE, lexer.TOKEN_LT, lexer.TOKEN_GT,
+		lexer.TOKEN_LE, lexer.TOKEN_GE, lexer.TOKEN_AND, lexer.TOKEN_OR, lexer.TOKEN_NOT, lexer.TOKEN_XOR,
+		lexer.TOKEN_EQV, lexer.TOKEN_IMP:
+		return true
+	}
+	return false
+}
+
+// isUnary reports whether the + or - at toks[k] is a sign rather than a
+// binary operator: it does not follow an operand
+func isUnary(toks []token, k, stmtStart int) bool {
+	t := toks[k].Type
+	if t != lexer.TOKEN_PLUS && t != lexer.TOKEN_MINUS {
+		return false
+	}
+	if k == stmtStart {
+		return true
+	}
+	switch prev := toks[k-1]; prev.Type {
+	case lexer.TOKEN_IDENT, lexer.TOKEN_INTEGER, lexer.TOKEN_FLOAT, lexer.TOKEN_STRING, lexer.TOKEN_RPAREN:
+		return false
+	default:
+		return isOperator(prev.Type) || isKeyword(prev) || prev.Type == lexer.TOKEN_LPAREN ||
+			prev.Type == lexer.TOKEN_COMMA || prev.Type == lexer.TOKEN_SEMICOLON || prev.Type == lexer.TOKEN_HASH
+	}
+}
+
+// spaceBefore decides whether toks[k] is preceded by a space
+func spaceBefore(toks []token, k, stmtStart int) bool {
+	prev, cur := toks[k-1], toks[k]
+
+	switch cur.Type {
+	case lexer.TOKEN_COMMA, lexer.TOKEN_SEMICOLON, lexer.TOKEN_RPAREN, lexer.TOKEN_COLON, lexer.TOKEN_DOT:
+		return false
+	case lexer.TOKEN_REM:
+		return true
+	}
+	switch prev.Type {
+	case lexer.TOKEN_LPAREN, lexer.TOKEN_DOT, lexer.TOKEN_HASH:
+		return false
+	case lexer.TOKEN_COMMA, lexer.TOKEN_SEMICOLON:
+		return true
+	}
+
+	// The - in LINE (x1, y1)-(x2, y2) joins the two points
+	if toks[stmtStart].Type == lexer.TOKEN_LINE {
+		if cur.Type == lexer.TOKEN_MINUS && prev.Type == lexer.TOKEN_RPAREN {
+			return false
+		}
+		if prev.Type == lexer.TOKEN_MINUS && k >= 2 && toks[k-2].Type == lexer.TOKEN_RPAREN {
+			return false
+		}
+	}
+
+	// The - in DEFINT A-Z joins the letters of a range
+	switch toks[stmtStart].Type {
+	case lexer.TOKEN_DEFINT, lexer.TOKEN_DEFLNG, lexer.TOKEN_DEFSNG, lexer.TOKEN_DEFDBL, lexer.TOKEN_DEFSTR:
+		if cur.Type == lexer.TOKEN_MINUS || prev.Type == lexer.TOKEN_MINUS {
+			return false
+		}
+	}
+
+	if isUnary(toks, k-1, stmtStart) {
+		return false
+	}
+	if isOperator(cur.Type) || isOperator(prev.Type) {
+		return true
+	}
+	if cur.Type == lexer.TOKEN_LPAREN && prev.Type == lexer.TOKEN_IDENT {
+		// Procedure headers are written "SUB Name (params)", where the
+		// name of a library procedure is Library.Name
+		name := stmtStart + 1
+		switch toks[stmtStart].Type {
+		case lexer.TOKEN_DECLARE:
+			name++
+		case lexer.TOKEN_SUB, lexer.TOKEN_FUNCTION:
+		default:
+			return false
+		}
+		for j := name + 1; j < k; j++ {
+			if toks[j].Type != lexer.TOKEN_DOT && toks[j].Type != lexer.TOKEN_IDENT {
+				return false
+			}
+		}
+		return k > name
+	}
+	return cur.space
+}
@@ -0,0 +1,66 @@
+package format
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestIdempotent checks that formatting a formatted example program leaves
+// it unchanged
+func TestIdempotent(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "examples", "*.bas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no example programs found")
+	}
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			once, err := Source(src)
+			var syntaxErr *SyntaxError
+			if errors.As(err, &syntaxErr) {
+				t.Skip("not a valid program")
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			twice, err := Source(once)
+			if err != nil {
+				t.Fatalf("formatted program: %v", err)
+			}
+			if string(twice) != string(once) {
+				t.Errorf("formatting again changed the program:\n%s", Diff("once", "twice", once, twice))
+			}
+		})
+	}
+}
+
+func TestCaseIs(t *testing.T) {
+	src := "select case x\ncase is > 10, 1 to 2\nend select\n"
+	want := "SELECT CASE x\n    CASE IS > 10, 1 TO 2\nEND SELECT\n"
+	got, err := Source([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTrailingComments(t *testing.T) {
+	src := "print x 'note\nif x then print 1 'c\nprint \"a\"; rem semi\nprint 'bare\nfoo 1, 2 ' call\n"
+	want := "PRINT x 'note\nIF x THEN PRINT 1 'c\nPRINT \"a\"; REM semi\nPRINT 'bare\nfoo 1, 2 ' call\n"
+	got, err := Source([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
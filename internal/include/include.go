@@ -0,0 +1,157 @@
+// Package include expands the $INCLUDE metacommand, which inserts the text
+// of another source file after the comment that names it:
+//
+//	'$INCLUDE: 'common.bi'
+//	REM $INCLUDE: 'common.bi'
+//
+// A relative file name is looked up in the directory of the including file
+// and then in each directory of the search path. The expanded source
+// remembers which file and line each of its lines came from, so that
+// diagnostics can point at the original text.
+package include
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// metacommand matches an $INCLUDE comment on a line of its own, which may
+// start with a line number
+var metacommand = regexp.MustCompile(`(?i)^\s*(?:\d+\s+)?(?:'|REM\s)\s*\$INCLUDE\s*:\s*'([^']*)'`)
+
+// Origin is the file and line a line of expanded source was read from
+type Origin struct {
+	File string
+	Line int
+}
+
+// Source is program text with its $INCLUDE metacommands expanded
+type Source struct {
+	Name  string // name of the main file
+	Text  string
+	lines []Origin // origin of each line of Text
+}
+
+// New returns the text of a single file, without expanding it
+func New(name, text string) *Source {
+	return &Source{Name: name, Text: text}
+}
+
+// Origin returns the file and line that line n of the text came from. A
+// line past the end of expanded text, such as the end of input, comes from
+// the last line.
+func (s *Source) Origin(n int) Origin {
+	switch {
+	case n >= 1 && n <= len(s.lines):
+		return s.lines[n-1]
+	case n > len(s.lines) && len(s.lines) > 0:
+		return s.lines[len(s.lines)-1]
+	}
+	return Origin{File: s.Name, Line: n}
+}
+
+// Error reports a metacommand that cannot be expanded
+type Error struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// Expand returns the text of the file name with every $INCLUDE expanded,
+// recursively. Including a file that is already being included is an
+// error.
+func Expand(name, text string, path []string) (*Source, error) {
+	e := &expander{
+		path:   path,
+		src:    &Source{Name: name},
+		active: make(map[string]bool),
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		e.active[abs] = true
+	}
+	e.chain = []string{name}
+	if err := e.expand(name, text); err != nil {
+		return nil, err
+	}
+	e.src.Text = strings.Join(e.text, "\n") + "\n"
+	return e.src, nil
+}
+
+type expander struct {
+	path   []string
+	src    *Source
+	text   []string
+	active map[string]bool // absolute paths of the files being expanded
+	chain  []string        // the same files, as named, outermost first
+}
+
+func (e *expander) expand(name, text string) error {
+	lines := strings.Split(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for k, line := range lines {
+		e.text = append(e.text, line)
+		e.src.lines = append(e.src.lines, Origin{File: name, Line: k + 1})
+
+		m := metacommand.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		file, ok := Find(name, strings.TrimSpace(m[1]), e.path)
+		if !ok {
+			return &Error{File: name, Line: k + 1, Message: fmt.Sprintf("cannot find include file %q", m[1])}
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			abs = file
+		}
+		if e.active[abs] {
+			cycle := strings.Join(append(e.chain, file), " includes ")
+			return &Error{File: name, Line: k + 1, Message: "include cycle: " + cycle}
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return &Error{File: name, Line: k + 1, Message: err.Error()}
+		}
+
+		e.active[abs] = true
+		e.chain = append(e.chain, file)
+		if err := e.expand(file, string(data)); err != nil {
+			return err
+		}
+		delete(e.active, abs)
+		e.chain = e.chain[:len(e.chain)-1]
+	}
+	return nil
+}
+
+// Find looks for the file name referred to from the file from: in the
+// directory of from, then in each directory of path
+func Find(from, name string, path []string) (string, bool) {
+	if filepath.IsAbs(name) {
+		return name, isFile(name)
+	}
+	candidates := []string{filepath.Join(filepath.Dir(from), name)}
+	for _, dir := range path {
+		candidates = append(candidates, filepath.Join(dir, name))
+	}
+	for _, file := range candidates {
+		if isFile(file) {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,42 @@
+package include
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOrigin(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.bas")
+	inc := filepath.Join(dir, "common.bi")
+	if err := os.WriteFile(inc, []byte("CONST A = 1\nCONST B = 2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	text := "PRINT 1\n'$INCLUDE: 'common.bi'\nPRINT A\nPRINT B\nPRINT (\n"
+	src, err := Expand(main, text, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line int
+		want Origin
+	}{
+		{1, Origin{main, 1}},
+		{2, Origin{main, 2}},
+		{3, Origin{inc, 1}},
+		{4, Origin{inc, 2}},
+		{5, Origin{main, 3}},
+		{7, Origin{main, 5}},
+		// A syntax error at the end of input is reported on the line
+		// after the last one
+		{8, Origin{main, 5}},
+		{100, Origin{main, 5}},
+	}
+	for _, tt := range tests {
+		if got := src.Origin(tt.line); got != tt.want {
+			t.Errorf("Origin(%d) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
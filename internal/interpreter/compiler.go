@@ -0,0 +1,1272 @@
+package interpreter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/lexer"
+)
+
+// UnsupportedError reports a construct the bytecode compiler does not
+// handle. Programs that use one must run on the tree walker.
+type UnsupportedError struct {
+	Line int
+	What string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("line %d: %s is not supported by the VM", e.Line, e.What)
+}
+
+// Bytecode is a program compiled for the VM
+type Bytecode struct {
+	Code   []Instr
+	Consts []Value
+	Data   []Value // DATA items in program order
+	module *scope
+	procs  []*procedure
+}
+
+// String returns a disassembly of the bytecode
+func (bc *Bytecode) String() string {
+	var out strings.Builder
+	entries := make(map[int]string)
+	for _, p := range bc.procs {
+		entries[p.entry] = p.name
+	}
+	for pc, in := range bc.Code {
+		if name, ok := entries[pc]; ok {
+			fmt.Fprintf(&out, "%s:\n", name)
+		}
+		fmt.Fprintf(&out, "%5d  %s", pc, in)
+		if (in.Op == OpConst || in.Op == OpCallBuiltin || in.Op == OpCallHostSub) && int(in.A) < len(bc.Consts) {
+			fmt.Fprintf(&out, "\t; %s", bc.Consts[in.A])
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
+
+// scope assigns slots to the variables and arrays of the module or of a
+// procedure. Names are upper-cased and keep their type suffix.
+type scope struct {
+	vars       []string
+	varTypes   []ast.DataType
+	varIndex   map[string]int
+	arrays     []string
+	arrayIndex map[string]int
+}
+
+func newScope() *scope {
+	return &scope{
+		varIndex:   make(map[string]int),
+		arrayIndex: make(map[string]int),
+	}
+}
+
+// variable returns the slot of a variable, allocating it on first use
+func (sc *scope) variable(name string) int {
+	name = strings.ToUpper(name)
+	if slot, ok := sc.varIndex[name]; ok {
+		return slot
+	}
+	slot := len(sc.vars)
+	sc.vars = append(sc.vars, name)
+	sc.varTypes = append(sc.varTypes, (*Environment)(nil).inferType(name))
+	sc.varIndex[name] = slot
+	return slot
+}
+
+// temp allocates a hidden slot for loop bounds and SELECT CASE values.
+// Its type is unknown, so values are stored in it unconverted.
+func (sc *scope) temp() int {
+	sc.vars = append(sc.vars, "")
+	sc.varTypes = append(sc.varTypes, ast.TypeUnknown)
+	return len(sc.vars) - 1
+}
+
+// array returns the slot of an array, allocating it on first use
+func (sc *scope) array(name string) int {
+	name = strings.ToUpper(name)
+	if slot, ok := sc.arrayIndex[name]; ok {
+		return slot
+	}
+	slot := len(sc.arrays)
+	sc.arrays = append(sc.arrays, name)
+	sc.arrayIndex[name] = slot
+	return slot
+}
+
+// procedure is a compiled SUB or FUNCTION
+type procedure struct {
+	name       string
+	entry      int
+	scope      *scope
+	params     []int // slots of the parameters
+	paramTypes []ast.DataType
+	byRef      []bool // parameters passed by reference that the body may assign
+	arrayParam bool
+	isFunc     bool
+	result     int // slot of the function result
+	resultType ast.DataType
+	shared     map[string]bool // names in the procedure's SHARED statements
+	locals     map[string]bool // names the procedure declares with DIM
+}
+
+// loopContext collects the EXIT jumps of an enclosing loop or procedure
+type loopContext struct {
+	kind  string // "FOR", "WHILE", "DO", "SUB" or "FUNCTION"
+	exits []int
+}
+
+// labelJump is a GOTO or GOSUB whose target is patched after compilation
+type labelJump struct {
+	pc     int
+	target string
+	line   int
+}
+
+type compiler struct {
+	i          *Interpreter
+	bc         *Bytecode
+	scope      *scope
+	proc       *procedure // nil while compiling module-level code
+	procIndex  map[string]int
+	arrayNames map[string]bool
+	constNames map[string]bool
+	shared     map[string]bool // names declared with DIM SHARED
+	names      map[string]int  // constant pool index of function and SUB names
+	loops      []*loopContext
+	jumps      []labelJump
+	stmtAddr   []int
+}
+
+// Compile translates the program to bytecode for RunBytecode. It returns
+// an *UnsupportedError if the program uses statements the VM does not
+// handle yet.
+func (i *Interpreter) Compile() (*Bytecode, error) {
+	c := &compiler{
+		i:          i,
+		bc:         &Bytecode{module: newScope()},
+		procIndex:  make(map[string]int),
+		arrayNames: make(map[string]bool),
+		constNames: make(map[string]bool),
+		shared:     make(map[string]bool),
+		names:      make(map[string]int),
+	}
+	c.scope = c.bc.module
+	stmts := i.program.Statements
+
+	// Arrays and procedures are known before any code is compiled, as
+	// a(1) is an element access if a is dimensioned anywhere
+	walkStatements(stmts, func(s ast.Statement) {
+		switch s := s.(type) {
+		case *ast.DimStmt:
+			for _, v := range s.Variables {
+				if v.Array {
+					c.arrayNames[strings.ToUpper(v.Name)] = true
+				}
+				if s.Shared {
+					c.shared[strings.ToUpper(v.Name)] = true
+				}
+			}
+		case *ast.RedimStmt:
+			for _, v := range s.Variables {
+				c.arrayNames[strings.ToUpper(v.Name)] = true
+			}
+		}
+	})
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.SubStatement:
+			if i.program.Subs[strings.ToUpper(s.Name)] == s {
+				c.declareProc(s.Name, s.Parameters, s.Body, false, ast.TypeUnknown)
+			}
+		case *ast.FuncStatement:
+			if i.program.Functions[strings.ToUpper(s.Name)] == s {
+				c.declareProc(s.Name, s.Parameters, s.Body, true, s.ReturnType)
+			}
+		}
+	}
+
+	for _, v := range i.program.DataItems {
+		val, ok := constValue(v)
+		if !ok {
+			return nil, &UnsupportedError{Line: ast.SourceLine(v), What: "non-literal DATA"}
+		}
+		c.bc.Data = append(c.bc.Data, val)
+	}
+
+	c.stmtAddr = make([]int, len(stmts)+1)
+	for idx, stmt := range stmts {
+		c.stmtAddr[idx] = len(c.bc.Code)
+		if err := c.statement(stmt); err != nil {
+			return nil, err
+		}
+	}
+	c.stmtAddr[len(stmts)] = len(c.bc.Code)
+	c.emit(OpEnd, 0, 0)
+
+	for _, stmt := range stmts {
+		var err error
+		switch s := stmt.(type) {
+		case *ast.SubStatement:
+			if i.program.Subs[strings.ToUpper(s.Name)] == s {
+				err = c.procBody(s.Name, s.Line, s.Static, s.Body)
+			}
+		case *ast.FuncStatement:
+			if i.program.Functions[strings.ToUpper(s.Name)] == s {
+				err = c.procBody(s.Name, s.Line, s.Static, s.Body)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, j := range c.jumps {
+		idx, ok := i.labelIndex(j.target)
+		if !ok {
+			return nil, &UnsupportedError{Line: j.line, What: jumpInto(i.labelsIn(stmts), stmts, j.target)}
+		}
+		c.bc.Code[j.pc].A = int32(c.stmtAddr[idx])
+	}
+
+	return c.bc, nil
+}
+
+// declareProc allocates a procedure and the slots of its parameters
+func (c *compiler) declareProc(name string, params []ast.Parameter, body []ast.Statement, isFunc bool, resultType ast.DataType) {
+	p := &procedure{name: strings.ToUpper(name), scope: newScope(), isFunc: isFunc, resultType: resultType}
+	assigned := c.assignedNames(body)
+	for _, param := range params {
+		slot := p.scope.variable(param.Name)
+		if param.DataType != ast.TypeUnknown {
+			p.scope.varTypes[slot] = param.DataType
+		}
+		p.params = append(p.params, slot)
+		p.paramTypes = append(p.paramTypes, param.DataType)
+		p.byRef = append(p.byRef, !param.ByVal && assigned[strings.ToUpper(param.Name)])
+		p.arrayParam = p.arrayParam || param.Array
+	}
+	if isFunc {
+		p.result = p.scope.variable(name)
+		if resultType != ast.TypeUnknown {
+			p.scope.varTypes[p.result] = resultType
+		}
+	}
+	c.procIndex[p.name] = len(c.bc.procs)
+	c.bc.procs = append(c.bc.procs, p)
+}
+
+// jumpInto describes a GOTO or GOSUB target that is not a module-level
+// statement: one inside a loop or other block, or an undefined one
+func jumpInto(labels map[string]labelPos, stmts []ast.Statement, target string) string {
+	pos, ok := labels[labelKey(target)]
+	if !ok || !pos.nested {
+		return "jump to undefined label " + target
+	}
+	switch s := stmts[pos.index].(type) {
+	case *ast.ForStmt, *ast.WhileStmt, *ast.DoLoopStmt:
+		return "jump into a " + s.TokenLiteral() + " loop at " + target
+	case *ast.IfStmt:
+		return "jump into an IF block at " + target
+	case *ast.SelectCaseStmt:
+		return "jump into a SELECT CASE block at " + target
+	default:
+		return "jump into a block at " + target
+	}
+}
+
+// procBody compiles the body of a procedure declared by declareProc, which
+// starts on line
+func (c *compiler) procBody(name string, line int, static bool, body []ast.Statement) error {
+	p := c.bc.procs[c.procIndex[strings.ToUpper(name)]]
+	for _, param := range p.paramTypes {
+		if param == ast.TypeRecord {
+			return &UnsupportedError{Line: line, What: "record parameter in " + p.name}
+		}
+	}
+	if static {
+		return &UnsupportedError{Line: line, What: "STATIC procedure " + p.name}
+	}
+	if p.arrayParam {
+		return &UnsupportedError{Line: line, What: "array parameter in " + p.name}
+	}
+
+	p.shared, p.locals = make(map[string]bool), make(map[string]bool)
+	for _, stmt := range body {
+		if s, ok := stmt.(*ast.SharedStmt); ok {
+			for _, v := range s.Variables {
+				p.shared[strings.ToUpper(v.Name)] = true
+			}
+		}
+	}
+	walkStatements(body, func(s ast.Statement) {
+		if d, ok := s.(*ast.DimStmt); ok && !d.Shared {
+			for _, v := range d.Variables {
+				p.locals[strings.ToUpper(v.Name)] = true
+			}
+		}
+	})
+
+	c.proc, c.scope = p, p.scope
+	defer func() { c.proc, c.scope = nil, c.bc.module }()
+
+	p.entry = len(c.bc.Code)
+	kind := "SUB"
+	if p.isFunc {
+		kind = "FUNCTION"
+	}
+	ctx := c.pushLoop(kind)
+	if err := c.block(body); err != nil {
+		return err
+	}
+	c.popLoop(ctx)
+	c.emit(OpReturn, 0, 0)
+	return nil
+}
+
+func (c *compiler) emit(op Opcode, a, b int) int {
+	c.bc.Code = append(c.bc.Code, Instr{Op: op, A: int32(a), B: int32(b)})
+	return len(c.bc.Code) - 1
+}
+
+// patch points the jump at pc to the current end of the code
+func (c *compiler) patch(pc int) {
+	c.bc.Code[pc].A = int32(len(c.bc.Code))
+}
+
+func (c *compiler) constant(v Value) int {
+	c.bc.Consts = append(c.bc.Consts, v)
+	return len(c.bc.Consts) - 1
+}
+
+// name returns the constant pool index of a function or SUB name
+func (c *compiler) name(s string) int {
+	if idx, ok := c.names[s]; ok {
+		return idx
+	}
+	idx := c.constant(&StringValue{Val: s})
+	c.names[s] = idx
+	return idx
+}
+
+func (c *compiler) pushLoop(kind string) *loopContext {
+	ctx := &loopContext{kind: kind}
+	c.loops = append(c.loops, ctx)
+	return ctx
+}
+
+// popLoop ends a loop, pointing its EXIT jumps at the current position
+func (c *compiler) popLoop(ctx *loopContext) {
+	for _, pc := range ctx.exits {
+		c.patch(pc)
+	}
+	c.loops = c.loops[:len(c.loops)-1]
+}
+
+// global reports whether name refers to the module scope: everywhere in
+// module-level code, and in a procedure for CONSTs and shared variables
+// it does not declare itself
+func (c *compiler) global(name string) bool {
+	if c.proc == nil {
+		return true
+	}
+	name = strings.ToUpper(name)
+	if c.proc.locals[name] {
+		return false
+	}
+	return c.constNames[name] || c.shared[name] || c.proc.shared[name]
+}
+
+func (c *compiler) loadVar(name string) {
+	if c.global(name) {
+		c.emit(OpLoadGlobal, c.bc.module.variable(name), 0)
+	} else {
+		c.emit(OpLoadLocal, c.scope.variable(name), 0)
+	}
+}
+
+func (c *compiler) storeVar(name string) {
+	if c.global(name) {
+		c.emit(OpStoreGlobal, c.bc.module.variable(name), 0)
+	} else {
+		c.emit(OpStoreLocal, c.scope.variable(name), 0)
+	}
+}
+
+// varType returns the type of a variable, and with typ sets it
+func (c *compiler) varType(name string, typ ...ast.DataType) ast.DataType {
+	sc := c.scope
+	if c.global(name) {
+		sc = c.bc.module
+	}
+	slot := sc.variable(name)
+	if len(typ) > 0 {
+		sc.varTypes[slot] = typ[0]
+	}
+	return sc.varTypes[slot]
+}
+
+func (c *compiler) loadTemp(slot int) {
+	if c.proc == nil {
+		c.emit(OpLoadGlobal, slot, 0)
+	} else {
+		c.emit(OpLoadLocal, slot, 0)
+	}
+}
+
+func (c *compiler) storeTemp(slot int) {
+	if c.proc == nil {
+		c.emit(OpStoreGlobal, slot, 0)
+	} else {
+		c.emit(OpStoreLocal, slot, 0)
+	}
+}
+
+// arrayRef returns the array operand for name in the current scope
+func (c *compiler) arrayRef(name string) int {
+	if c.global(name) {
+		return c.bc.module.array(name)
+	}
+	slot := c.scope.array(name)
+	return -(slot + 1)
+}
+
+func (c *compiler) block(stmts []ast.Statement) error {
+	for _, stmt := range stmts {
+		if err := c.statement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compiler) statement(stmt ast.Statement) error {
+	switch s := stmt.(type) {
+	case *ast.LineNumberStmt, *ast.LabelStmt, *ast.RemStmt, *ast.DataStmt, *ast.TypeStmt, *ast.OptionStmt,
+		*ast.SharedStmt, *ast.DefTypeStmt, *ast.DeclareStmt, *ast.ImportStmt:
+		return nil
+
+	case *ast.SubStatement, *ast.FuncStatement:
+		// Procedures are compiled after the module code
+		if c.proc != nil {
+			return &UnsupportedError{Line: ast.SourceLine(stmt), What: "nested procedure"}
+		}
+		return nil
+
+	case *ast.LetStmt:
+		return c.assign(s.Line, s.Name, func() error { return c.expression(s.Value) })
+
+	case *ast.PrintStmt:
+		return c.print(s.Items, s.NoNewline, 0)
+
+	case *ast.PrintFileStmt:
+		// The file number stays on the stack below the items
+		if err := c.expression(s.FileNum); err != nil {
+			return err
+		}
+		return c.print(s.Items, s.NoNewline, 1)
+
+	case *ast.WriteStmt:
+		// The file number stays on the stack below the items
+		toFile := 0
+		if s.FileNum != nil {
+			if err := c.expression(s.FileNum); err != nil {
+				return err
+			}
+			toFile = 1
+		}
+		for n, item := range s.Items {
+			if err := c.expression(item); err != nil {
+				return err
+			}
+			c.emit(OpWrite, min(n, 1), 0)
+		}
+		c.emit(OpPrintEnd, 1, toFile)
+		return nil
+
+	case *ast.PrintUsingStmt:
+		format := c.scope.temp()
+		if err := c.expression(s.Format); err != nil {
+			return err
+		}
+		c.storeTemp(format)
+		for _, item := range s.Items {
+			if item.Expression != nil {
+				if err := c.expression(item.Expression); err != nil {
+					return err
+				}
+				c.loadTemp(format)
+				c.emit(OpPrintUsing, 0, 0)
+			}
+		}
+		toFile := 0
+		if s.FileNum != nil {
+			if err := c.expression(s.FileNum); err != nil {
+				return err
+			}
+			toFile = 1
+		}
+		newline := 1
+		if s.NoNewline {
+			newline = 0
+		}
+		c.emit(OpPrintEnd, newline, toFile)
+		return nil
+
+	case *ast.ClsStmt:
+		c.emit(OpCls, 0, 0)
+		return nil
+
+	case *ast.OpenStmt:
+		if err := c.expression(s.Filename); err != nil {
+			return err
+		}
+		if err := c.expression(s.FileNum); err != nil {
+			return err
+		}
+		hasRecLen := 0
+		if s.RecLen != nil {
+			if err := c.expression(s.RecLen); err != nil {
+				return err
+			}
+			hasRecLen = 1
+		}
+		c.emit(OpOpen, c.name(s.Mode), hasRecLen)
+		return nil
+
+	case *ast.CloseStmt:
+		if err := c.expressions(s.FileNums); err != nil {
+			return err
+		}
+		c.emit(OpClose, 0, len(s.FileNums))
+		return nil
+
+	case *ast.LineInputStmt:
+		if _, ok := s.Variable.(*ast.Identifier); !ok {
+			return &UnsupportedError{Line: s.Line, What: "LINE INPUT into " + s.Variable.String()}
+		}
+		prompt := ""
+		if s.Prompt != nil {
+			prompt = s.Prompt.Value
+		}
+		return c.assign(s.Line, s.Variable, func() error {
+			c.emit(OpLineInput, c.name(prompt), 0)
+			return nil
+		})
+
+	case *ast.LineInputFileStmt:
+		if _, ok := s.Variable.(*ast.Identifier); !ok {
+			return &UnsupportedError{Line: s.Line, What: "LINE INPUT # into " + s.Variable.String()}
+		}
+		return c.assign(s.Line, s.Variable, func() error {
+			if err := c.expression(s.FileNum); err != nil {
+				return err
+			}
+			c.emit(OpLineInputFile, 0, 0)
+			return nil
+		})
+
+	case *ast.DimStmt:
+		if s.Static && c.proc != nil {
+			return &UnsupportedError{Line: s.Line, What: "STATIC variable"}
+		}
+		return c.dim(s)
+
+	case *ast.IfStmt:
+		if err := c.expression(s.Condition); err != nil {
+			return err
+		}
+		jumpElse := c.emit(OpJumpIfFalse, 0, 0)
+		if err := c.block(s.Consequence); err != nil {
+			return err
+		}
+		if len(s.Alternative) == 0 {
+			c.patch(jumpElse)
+			return nil
+		}
+		jumpEnd := c.emit(OpJump, 0, 0)
+		c.patch(jumpElse)
+		if err := c.block(s.Alternative); err != nil {
+			return err
+		}
+		c.patch(jumpEnd)
+		return nil
+
+	case *ast.ForStmt:
+		return c.forLoop(s)
+
+	case *ast.WhileStmt:
+		ctx := c.pushLoop("WHILE")
+		top := len(c.bc.Code)
+		if err := c.expression(s.Condition); err != nil {
+			return err
+		}
+		ctx.exits = append(ctx.exits, c.emit(OpJumpIfFalse, 0, 0))
+		if err := c.block(s.Body); err != nil {
+			return err
+		}
+		c.emit(OpJump, top, 0)
+		c.popLoop(ctx)
+		return nil
+
+	case *ast.DoLoopStmt:
+		return c.doLoop(s)
+
+	case *ast.SelectCaseStmt:
+		return c.selectCase(s)
+
+	case *ast.GotoStmt:
+		if c.proc != nil {
+			return &UnsupportedError{Line: s.Line, What: "GOTO inside a procedure"}
+		}
+		c.jumps = append(c.jumps, labelJump{pc: c.emit(OpJump, 0, 0), target: s.Target, line: s.Line})
+		return nil
+
+	case *ast.GosubStmt:
+		if c.proc != nil {
+			return &UnsupportedError{Line: s.Line, What: "GOSUB inside a procedure"}
+		}
+		c.jumps = append(c.jumps, labelJump{pc: c.emit(OpGosub, 0, 0), target: s.Target, line: s.Line})
+		return nil
+
+	case *ast.ReturnStmt:
+		if c.proc != nil || s.Value != nil {
+			return &UnsupportedError{Line: s.Line, What: "RETURN inside a procedure"}
+		}
+		c.emit(OpReturnGosub, 0, 0)
+		return nil
+
+	case *ast.ExitStmt:
+		for k := len(c.loops) - 1; k >= 0; k-- {
+			if c.loops[k].kind == s.ExitType {
+				c.loops[k].exits = append(c.loops[k].exits, c.emit(OpJump, 0, 0))
+				return nil
+			}
+		}
+		return &UnsupportedError{Line: s.Line, What: "EXIT " + s.ExitType + " outside its block"}
+
+	case *ast.CallStmt:
+		return c.callSub(s.Line, s.Name, s.Arguments)
+
+	case *ast.SubCallStmt:
+		return c.callSub(s.Line, s.Name, s.Arguments)
+
+	case *ast.ReadStmt:
+		for _, v := range s.Variables {
+			if err := c.assign(s.Line, v, func() error {
+				c.emit(OpRead, 0, 0)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case *ast.RestoreStmt:
+		if s.Target == "" {
+			c.emit(OpRestore, 0, 0)
+			return nil
+		}
+		lineNum, ok := parseLineNumber(s.Target)
+		idx, found := c.i.program.LineNumbers[lineNum]
+		if !ok || !found {
+			return &UnsupportedError{Line: s.Line, What: "RESTORE " + s.Target}
+		}
+		count := 0
+		for _, stmt := range c.i.program.Statements[:idx] {
+			if data, ok := stmt.(*ast.DataStmt); ok {
+				count += len(data.Values)
+			}
+		}
+		c.emit(OpRestore, count, 0)
+		return nil
+
+	case *ast.SwapStmt:
+		id1, ok1 := s.Var1.(*ast.Identifier)
+		id2, ok2 := s.Var2.(*ast.Identifier)
+		if !ok1 || !ok2 {
+			return &UnsupportedError{Line: s.Line, What: "SWAP of array elements"}
+		}
+		c.loadVar(id1.Name)
+		c.loadVar(id2.Name)
+		c.storeVar(id1.Name)
+		c.storeVar(id2.Name)
+		return nil
+
+	case *ast.RandomizeStmt:
+		if s.Seed == nil {
+			c.emit(OpRandomize, 0, 0)
+			return nil
+		}
+		if err := c.expression(s.Seed); err != nil {
+			return err
+		}
+		c.emit(OpRandomize, 1, 0)
+		return nil
+
+	case *ast.ConstStmt:
+		if c.proc != nil {
+			return &UnsupportedError{Line: s.Line, What: "CONST inside a procedure"}
+		}
+		if err := c.expression(s.Value); err != nil {
+			return err
+		}
+		c.constNames[strings.ToUpper(s.Name)] = true
+		c.emit(OpDefConst, c.scope.variable(s.Name), 0)
+		return nil
+
+	case *ast.EndStmt:
+		if s.Code == nil {
+			c.emit(OpEnd, 0, 0)
+			return nil
+		}
+		if err := c.expression(s.Code); err != nil {
+			return err
+		}
+		c.emit(OpEnd, 1, 0)
+		return nil
+	}
+
+	return &UnsupportedError{Line: ast.SourceLine(stmt), What: stmt.TokenLiteral() + " statement"}
+}
+
+// print compiles the items of PRINT or PRINT #, which writes to a file
+// number already on the stack when toFile is 1
+func (c *compiler) print(items []ast.PrintItem, noNewline bool, toFile int) error {
+	for _, item := range items {
+		if item.Expression != nil {
+			if err := c.expression(item.Expression); err != nil {
+				return err
+			}
+			c.emit(OpPrint, 0, 0)
+		}
+		if item.Separator == "," {
+			c.emit(OpPrintComma, 0, 0)
+		}
+	}
+	newline := 1
+	if noNewline {
+		newline = 0
+	}
+	c.emit(OpPrintEnd, newline, toFile)
+	return nil
+}
+
+// assign compiles a store of the value produced by value into target, which
+// is a variable or array element. The value is produced before subscripts
+// are evaluated, as in the tree walker.
+func (c *compiler) assign(line int, target ast.Expression, value func() error) error {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		name := strings.ToUpper(t.Name)
+		if c.arrayNames[name] {
+			return &UnsupportedError{Line: line, What: "assignment to array " + t.Name + " without subscripts"}
+		}
+		if err := value(); err != nil {
+			return err
+		}
+		c.storeVar(name)
+		return nil
+
+	case *ast.ArrayAccess:
+		if err := c.dimmed(line, t.Name); err != nil {
+			return err
+		}
+		return c.storeElem(t.Name, t.Indices, value)
+
+	case *ast.CallExpr:
+		if !c.arrayNames[strings.ToUpper(t.Function)] {
+			return &UnsupportedError{Line: line, What: "assignment to " + t.Function}
+		}
+		return c.storeElem(t.Function, t.Arguments, value)
+	}
+	return &UnsupportedError{Line: line, What: fmt.Sprintf("assignment to %s", target)}
+}
+
+func (c *compiler) storeElem(name string, indices []ast.Expression, value func() error) error {
+	if err := value(); err != nil {
+		return err
+	}
+	for _, idx := range indices {
+		if err := c.expression(idx); err != nil {
+			return err
+		}
+	}
+	c.emit(OpStoreElem, c.arrayRef(name), len(indices))
+	return nil
+}
+
+func (c *compiler) dim(s *ast.DimStmt) error {
+	for _, v := range s.Variables {
+		if v.DataType == ast.TypeRecord {
+			return &UnsupportedError{Line: s.Line, What: "DIM AS " + v.TypeName}
+		}
+		if v.StringLength != nil {
+			return &UnsupportedError{Line: s.Line, What: "DIM AS STRING * " + v.StringLength.String()}
+		}
+		dt := v.DataType
+		if dt == ast.TypeUnknown {
+			dt = (*Environment)(nil).inferType(strings.ToUpper(v.Name))
+		}
+		if v.Array && len(v.Dimensions) == 0 {
+			// Dimensioned by a later DIM or REDIM
+			continue
+		}
+		if len(v.Dimensions) == 0 {
+			c.varType(v.Name, dt)
+			c.emit(OpConst, c.constant(DefaultValue(dt)), 0)
+			c.storeVar(v.Name)
+			continue
+		}
+		// The element type travels as a default value below the bounds
+		c.emit(OpConst, c.constant(DefaultValue(dt)), 0)
+		for _, d := range v.Dimensions {
+			if err := c.expression(d); err != nil {
+				return err
+			}
+		}
+		c.emit(OpDim, c.arrayRef(v.Name), len(v.Dimensions))
+	}
+	return nil
+}
+
+// forLoop compiles FOR...NEXT. As in the tree walker, the counter is
+// advanced from its value at the top of each iteration.
+func (c *compiler) forLoop(s *ast.ForStmt) error {
+	name := s.Variable.Name
+	end, step, curr := c.scope.temp(), c.scope.temp(), c.scope.temp()
+
+	if err := c.expression(s.Start); err != nil {
+		return err
+	}
+	c.storeVar(name)
+	dt := c.varType(name)
+	if err := c.expression(s.End); err != nil {
+		return err
+	}
+	c.emit(OpForInit, int(dt), 0)
+	c.storeTemp(end)
+	if s.Step != nil {
+		if err := c.expression(s.Step); err != nil {
+			return err
+		}
+	} else {
+		c.emit(OpConst, c.constant(&IntegerValue{Val: 1}), 0)
+	}
+	c.emit(OpForInit, int(dt), 0)
+	c.storeTemp(step)
+
+	ctx := c.pushLoop("FOR")
+	top := len(c.bc.Code)
+	c.loadVar(name)
+	c.storeTemp(curr)
+	c.loadTemp(curr)
+	c.loadTemp(end)
+	c.loadTemp(step)
+	ctx.exits = append(ctx.exits, c.emit(OpForTest, 0, 0))
+	if err := c.block(s.Body); err != nil {
+		return err
+	}
+	c.loadTemp(curr)
+	c.loadTemp(step)
+	c.emit(OpForStep, 0, 0)
+	c.storeVar(name)
+	c.emit(OpJump, top, 0)
+	c.popLoop(ctx)
+	return nil
+}
+
+func (c *compiler) doLoop(s *ast.DoLoopStmt) error {
+	ctx := c.pushLoop("DO")
+	top := len(c.bc.Code)
+
+	// test jumps out of the loop when the condition says so
+	test := func() error {
+		if err := c.expression(s.Condition); err != nil {
+			return err
+		}
+		op := OpJumpIfFalse
+		if s.ConditionType == "UNTIL" {
+			op = OpJumpIfTrue
+		}
+		ctx.exits = append(ctx.exits, c.emit(op, 0, 0))
+		return nil
+	}
+
+	if s.ConditionPos == "PRE" && s.Condition != nil {
+		if err := test(); err != nil {
+			return err
+		}
+	}
+	if err := c.block(s.Body); err != nil {
+		return err
+	}
+	if s.ConditionPos == "POST" && s.Condition != nil {
+		if err := test(); err != nil {
+			return err
+		}
+	}
+	c.emit(OpJump, top, 0)
+	c.popLoop(ctx)
+	return nil
+}
+
+func (c *compiler) selectCase(s *ast.SelectCaseStmt) error {
+	test := c.scope.temp()
+	if err := c.expression(s.Expression); err != nil {
+		return err
+	}
+	c.storeTemp(test)
+
+	var ends []int
+	for _, clause := range s.Cases {
+		var matches []int
+		for _, cv := range clause.Values {
+			c.loadTemp(test)
+			switch cv.Type {
+			case "SINGLE", "IS":
+				op := "="
+				if cv.Type == "IS" {
+					op = cv.Operator
+				}
+				idx := operatorIndex(caseOperators, op)
+				if idx < 0 {
+					return &UnsupportedError{Line: s.Line, What: "CASE IS " + op}
+				}
+				if err := c.expression(cv.Value); err != nil {
+					return err
+				}
+				c.emit(OpCaseIs, idx, 0)
+			case "RANGE":
+				if err := c.expression(cv.Value); err != nil {
+					return err
+				}
+				if err := c.expression(cv.EndValue); err != nil {
+					return err
+				}
+				c.emit(OpCaseRange, 0, 0)
+			default:
+				return &UnsupportedError{Line: s.Line, What: "CASE " + cv.Type}
+			}
+			matches = append(matches, c.emit(OpJumpIfTrue, 0, 0))
+		}
+		next := c.emit(OpJump, 0, 0)
+		for _, pc := range matches {
+			c.patch(pc)
+		}
+		if err := c.block(clause.Body); err != nil {
+			return err
+		}
+		ends = append(ends, c.emit(OpJump, 0, 0))
+		c.patch(next)
+	}
+	if err := c.block(s.CaseElse); err != nil {
+		return err
+	}
+	for _, pc := range ends {
+		c.patch(pc)
+	}
+	return nil
+}
+
+func (c *compiler) callSub(line int, name string, args []ast.Expression) error {
+	name = strings.ToUpper(name)
+	if idx, ok := c.procIndex[name]; ok && !c.bc.procs[idx].isFunc {
+		if err := c.byRefArgs(line, c.bc.procs[idx], args); err != nil {
+			return err
+		}
+	}
+	if err := c.expressions(args); err != nil {
+		return err
+	}
+	if idx, ok := c.procIndex[name]; ok && !c.bc.procs[idx].isFunc {
+		c.emit(OpCall, idx, len(args))
+		return nil
+	}
+	if c.i.builtins.HasSub(name) {
+		c.emit(OpCallHostSub, c.name(name), len(args))
+		return nil
+	}
+	return &UnsupportedError{Line: line, What: "call of undefined SUB " + name}
+}
+
+func (c *compiler) expressions(exprs []ast.Expression) error {
+	for _, e := range exprs {
+		if err := c.expression(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compiler) expression(expr ast.Expression) error {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral:
+		val, _ := constValue(e)
+		c.emit(OpConst, c.constant(val), 0)
+		return nil
+
+	case *ast.Identifier:
+		name := strings.ToUpper(e.Name)
+		switch name {
+		case "RND", "TIMER", "DATE$", "TIME$", "INKEY$", "_PI", "PI":
+			c.emit(OpCallBuiltin, c.name(name), 0)
+			return nil
+		case "FREEFILE":
+			c.emit(OpFreeFile, 0, 0)
+			return nil
+		case "DIR$", "COMMAND$", "_COMMANDCOUNT":
+			c.emit(OpSysFunc, c.name(name), 0)
+			return nil
+		case "ERR", "ERL":
+			return &UnsupportedError{Line: e.Line, What: name}
+		}
+		if c.i.builtins.IsHostFunction(name) {
+			c.emit(OpCallBuiltin, c.name(name), 0)
+			return nil
+		}
+		// A FUNCTION's name is its return value in its own body, and a
+		// call anywhere else
+		if idx, ok := c.procIndex[name]; ok && c.bc.procs[idx].isFunc && c.bc.procs[idx] != c.proc {
+			c.emit(OpCall, idx, 0)
+			return nil
+		}
+		c.loadVar(name)
+		return nil
+
+	case *ast.ArrayAccess:
+		if err := c.dimmed(e.Line, e.Name); err != nil {
+			return err
+		}
+		if err := c.expressions(e.Indices); err != nil {
+			return err
+		}
+		c.emit(OpLoadElem, c.arrayRef(e.Name), len(e.Indices))
+		return nil
+
+	case *ast.BinaryExpr:
+		idx := operatorIndex(binaryOperators, e.Operator)
+		if idx < 0 {
+			return &UnsupportedError{Line: e.Line, What: "operator " + e.Operator}
+		}
+		if err := c.expression(e.Left); err != nil {
+			return err
+		}
+		if err := c.expression(e.Right); err != nil {
+			return err
+		}
+		c.emit(OpBinary, idx, 0)
+		return nil
+
+	case *ast.UnaryExpr:
+		idx := operatorIndex(unaryOperators, e.Operator)
+		if idx < 0 {
+			return &UnsupportedError{Line: e.Line, What: "operator " + e.Operator}
+		}
+		if err := c.expression(e.Right); err != nil {
+			return err
+		}
+		c.emit(OpUnary, idx, 0)
+		return nil
+
+	case *ast.CallExpr:
+		return c.call(e)
+
+	case *ast.GroupedExpr:
+		return c.expression(e.Expression)
+	}
+
+	return &UnsupportedError{Line: ast.SourceLine(expr), What: fmt.Sprintf("expression %s", expr)}
+}
+
+// call compiles an array element access, a FUNCTION call or a built-in
+// function call, in the order the tree walker resolves them
+func (c *compiler) call(e *ast.CallExpr) error {
+	name := strings.ToUpper(e.Function)
+	if c.arrayNames[name] {
+		if err := c.expressions(e.Arguments); err != nil {
+			return err
+		}
+		c.emit(OpLoadElem, c.arrayRef(name), len(e.Arguments))
+		return nil
+	}
+
+	if idx, ok := c.procIndex[name]; ok && c.bc.procs[idx].isFunc {
+		if err := c.byRefArgs(e.Line, c.bc.procs[idx], e.Arguments); err != nil {
+			return err
+		}
+		if err := c.expressions(e.Arguments); err != nil {
+			return err
+		}
+		c.emit(OpCall, idx, len(e.Arguments))
+		return nil
+	}
+
+	switch name {
+	case "EOF", "LOF", "LOC":
+		if len(e.Arguments) != 1 {
+			return &UnsupportedError{Line: e.Line, What: name + " without 1 argument"}
+		}
+		if err := c.expression(e.Arguments[0]); err != nil {
+			return err
+		}
+		c.emit(OpFileFunc, c.name(name), 0)
+		return nil
+	case "FREEFILE":
+		c.emit(OpFreeFile, 0, 0)
+		return nil
+	}
+	if systemFunctions[name] {
+		if err := c.expressions(e.Arguments); err != nil {
+			return err
+		}
+		c.emit(OpSysFunc, c.name(name), len(e.Arguments))
+		return nil
+	}
+	if !c.i.builtins.Has(name) {
+		if err := c.dimmed(e.Line, name); err != nil {
+			return err
+		}
+	}
+	if err := c.expressions(e.Arguments); err != nil {
+		return err
+	}
+	c.emit(OpCallBuiltin, c.name(name), len(e.Arguments))
+	return nil
+}
+
+// dimmed rejects an array without a DIM in GW-BASIC, where the tree
+// walker creates it on first use
+func (c *compiler) dimmed(line int, name string) error {
+	if c.i.program.Dialect == lexer.GWBASIC && !c.arrayNames[strings.ToUpper(name)] {
+		return &UnsupportedError{Line: line, What: "array " + name + " without DIM"}
+	}
+	return nil
+}
+
+// byRefArgs rejects a call that passes a variable or array element to a
+// parameter the procedure may assign, as the VM passes arguments by value
+func (c *compiler) byRefArgs(line int, p *procedure, args []ast.Expression) error {
+	for idx, arg := range args {
+		if idx >= len(p.byRef) || !p.byRef[idx] {
+			continue
+		}
+		switch a := arg.(type) {
+		case *ast.Identifier:
+			if c.constNames[strings.ToUpper(a.Name)] {
+				continue
+			}
+		case *ast.ArrayAccess:
+		case *ast.CallExpr:
+			if !c.arrayNames[strings.ToUpper(a.Function)] {
+				continue
+			}
+		default:
+			continue
+		}
+		return &UnsupportedError{Line: line, What: "BYREF argument " + arg.String()}
+	}
+	return nil
+}
+
+// assignedNames returns the variables that statements may assign,
+// counting any variable passed to a SUB or FUNCTION of the program
+func (c *compiler) assignedNames(stmts []ast.Statement) map[string]bool {
+	names := make(map[string]bool)
+	target := func(expr ast.Expression) {
+		if id, ok := expr.(*ast.Identifier); ok && id != nil {
+			names[strings.ToUpper(id.Name)] = true
+		}
+	}
+	targets := func(exprs []ast.Expression) {
+		for _, expr := range exprs {
+			target(expr)
+		}
+	}
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch s := n.(type) {
+			case *ast.LetStmt:
+				target(s.Name)
+			case *ast.ForStmt:
+				target(s.Variable)
+			case *ast.InputStmt:
+				targets(s.Variables)
+			case *ast.ReadStmt:
+				targets(s.Variables)
+			case *ast.InputFileStmt:
+				targets(s.Variables)
+			case *ast.LineInputStmt:
+				target(s.Variable)
+			case *ast.LineInputFileStmt:
+				target(s.Variable)
+			case *ast.SwapStmt:
+				target(s.Var1)
+				target(s.Var2)
+			case *ast.GetStmt:
+				target(s.Variable)
+			case *ast.CallStmt:
+				targets(s.Arguments)
+			case *ast.SubCallStmt:
+				targets(s.Arguments)
+			case *ast.CallExpr:
+				if _, ok := c.i.program.Functions[strings.ToUpper(s.Function)]; ok {
+					targets(s.Arguments)
+				}
+			}
+			return true
+		})
+	}
+	return names
+}
+
+// constValue returns the value of a literal, or of a negated literal
+func constValue(expr ast.Expression) (Value, bool) {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral:
+		return literalValue(e.Type, float64(e.Value)), true
+	case *ast.FloatLiteral:
+		return literalValue(e.Type, e.Value), true
+	case *ast.StringLiteral:
+		return &StringValue{Val: e.Value}, true
+	case *ast.UnaryExpr:
+		if v, ok := constValue(e.Right); ok {
+			if r, err := unaryOp(e.Operator, v); err == nil {
+				return r, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// walkStatements calls fn for each statement, including those nested in
+// blocks and procedure bodies
+func walkStatements(stmts []ast.Statement, fn func(ast.Statement)) {
+	for _, stmt := range stmts {
+		fn(stmt)
+		switch s := stmt.(type) {
+		case *ast.IfStmt:
+			walkStatements(s.Consequence, fn)
+			walkStatements(s.Alternative, fn)
+		case *ast.ForStmt:
+			walkStatements(s.Body, fn)
+		case *ast.WhileStmt:
+			walkStatements(s.Body, fn)
+		case *ast.DoLoopStmt:
+			walkStatements(s.Body, fn)
+		case *ast.SelectCaseStmt:
+			for _, clause := range s.Cases {
+				walkStatements(clause.Body, fn)
+			}
+			walkStatements(s.CaseElse, fn)
+		case *ast.SubStatement:
+			walkStatements(s.Body, fn)
+		case *ast.FuncStatement:
+			walkStatements(s.Body, fn)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package interpreter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+func (i *Interpreter) executeWriteStatement(s *ast.WriteStmt) error {
+	var fh *FileHandle
+	if s.FileNum != nil {
+		fileNumVal, err := i.evaluate(s.FileNum)
+		if err != nil {
+			return err
+		}
+		if fh, err = i.outputFile(int(fileNumVal.ToInt())); err != nil {
+			return err
+		}
+	}
+
+	var line strings.Builder
+	for n, item := range s.Items {
+		val, err := i.evaluate(item)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			line.WriteString(",")
+		}
+		line.WriteString(writeValue(val))
+	}
+	line.WriteString("\n")
+
+	if fh == nil {
+		i.print(line.String())
+		return nil
+	}
+	_, err := io.WriteString(fh.File, line.String())
+	return err
+}
+
+// writeValue formats a value as WRITE writes it: strings in double quotes,
+// with any quote inside doubled, and numbers without the leading space of
+// PRINT, in as many digits as reading them back exactly takes
+func writeValue(val Value) string {
+	switch v := val.(type) {
+	case *StringValue:
+		return `"` + strings.ReplaceAll(v.Val, `"`, `""`) + `"`
+	case *SingleValue:
+		return exactFloat(float64(v.Val), 32)
+	case *DoubleValue:
+		return exactFloat(v.Val, 64)
+	}
+	return val.String()
+}
+
+// exactFloat formats a float of the given bit size in the fewest digits
+// that convert back to the same value
+func exactFloat(f float64, bitSize int) string {
+	if f == float64(int64(f)) && f > -1e15 && f < 1e15 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'G', -1, bitSize)
+}
+
+// readField reads the next field for INPUT # from r and consumes the comma
+// or line break after it. Leading spaces are skipped, and for a number
+// blank lines too. A field starting with a double quote runs to the
+// closing quote, so it may hold commas and line breaks, and a doubled quote
+// inside it stands for one quote; any text between the closing quote and
+// the delimiter is ignored. Other fields run to a comma or the end of the
+// line, and a number also ends at a space. io.EOF is returned when no field
+// is left.
+func readField(r *bufio.Reader, numeric bool) (string, error) {
+	ch, err := r.ReadByte()
+	for err == nil && (ch == ' ' || ch == '\t' || numeric && (ch == '\r' || ch == '\n')) {
+		ch, err = r.ReadByte()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var field strings.Builder
+	if ch == '"' {
+		for {
+			ch, err = r.ReadByte()
+			if err == io.EOF {
+				return field.String(), nil
+			} else if err != nil {
+				return "", err
+			}
+			if ch == '"' {
+				if next, err := r.ReadByte(); err == nil && next == '"' {
+					field.WriteByte('"')
+					continue
+				} else if err == nil {
+					r.UnreadByte()
+				}
+				break
+			}
+			field.WriteByte(ch)
+		}
+		return field.String(), skipField(r, false)
+	}
+
+	for {
+		switch {
+		case ch == ',':
+			return strings.TrimRight(field.String(), " \t"), nil
+		case ch == '\r' || ch == '\n':
+			return strings.TrimRight(field.String(), " \t"), endLine(r, ch)
+		case numeric && (ch == ' ' || ch == '\t'):
+			return field.String(), skipField(r, true)
+		}
+		field.WriteByte(ch)
+		ch, err = r.ReadByte()
+		if err == io.EOF {
+			return strings.TrimRight(field.String(), " \t"), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// skipField consumes the rest of a field up to and including its
+// delimiter. With spaces set only spaces may come before the delimiter;
+// anything else is left for the next field.
+func skipField(r *bufio.Reader, spaces bool) error {
+	for {
+		ch, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case ch == ',':
+			return nil
+		case ch == '\r' || ch == '\n':
+			return endLine(r, ch)
+		case spaces && ch != ' ' && ch != '\t':
+			return r.UnreadByte()
+		}
+	}
+}
+
+// endLine consumes the LF of a CR LF line break whose CR has been read
+func endLine(r *bufio.Reader, ch byte) error {
+	if ch != '\r' {
+		return nil
+	}
+	next, err := r.ReadByte()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if next != '\n' {
+		return r.UnreadByte()
+	}
+	return nil
+}
+
+// inputNumber converts a field read by INPUT to a number. A D exponent,
+// as in QBasic's double-precision output, is accepted; other text reads as
+// its numeric prefix, or 0.
+func inputNumber(text string) Value {
+	text = strings.TrimSpace(text)
+	if text != "" && strings.ContainsRune("+-.0123456789", rune(text[0])) {
+		if f, err := strconv.ParseFloat(strings.NewReplacer("D", "E", "d", "e").Replace(text), 64); err == nil {
+			return &DoubleValue{Val: f}
+		}
+	}
+	var f float64
+	fmt.Sscanf(text, "%f", &f)
+	return &DoubleValue{Val: f}
+}
+
+// inputType returns the type of a variable, array element or record field
+// read by INPUT
+func (i *Interpreter) inputType(target ast.Expression) (ast.DataType, error) {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		return i.env.typeOf(t.Name), nil
+	case *ast.CallExpr:
+		arr, ok := i.array(t.Function, len(t.Arguments))
+		if !ok {
+			return 0, errorf(ErrSubscriptOutOfRange, "array %s not defined", t.Function)
+		}
+		return arr.DataType, nil
+	case *ast.FieldAccess:
+		rec, idx, err := i.resolveField(t)
+		if err != nil {
+			return 0, err
+		}
+		return rec.Def.Fields[idx].DataType, nil
+	}
+	return ast.TypeString, nil
+}
+
+// assignInput assigns a field read by INPUT to a target of type typ,
+// converting it to a number unless typ is a string
+func (i *Interpreter) assignInput(target ast.Expression, typ ast.DataType, text string) error {
+	var val Value = &StringValue{Val: text}
+	if typ != ast.TypeString {
+		val = inputNumber(text)
+	}
+
+	switch t := target.(type) {
+	case *ast.Identifier:
+		return i.env.Assign(t.Name, val)
+	case *ast.CallExpr:
+		arr, _ := i.array(t.Function, len(t.Arguments))
+		subscripts, err := i.evaluateSubscripts(t.Arguments)
+		if err != nil {
+			return err
+		}
+		return arr.Set(subscripts, val)
+	case *ast.FieldAccess:
+		return i.inputField(t, text)
+	}
+	return nil
+}
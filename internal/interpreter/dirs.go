@@ -0,0 +1,276 @@
+package interpreter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// path resolves a file name against the directory set by CHDIR
+func (i *Interpreter) path(name string) string {
+	if i.dir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(i.dir, name)
+}
+
+func (i *Interpreter) executeFileCommandStatement(s *ast.FileCommandStmt) error {
+	name := ""
+	if s.Path != nil {
+		val, err := i.evaluate(s.Path)
+		if err != nil {
+			return err
+		}
+		if val.Type() != ast.TypeString {
+			return errorf(ErrTypeMismatch, "type mismatch: %s needs a file name", s.Command)
+		}
+		name = val.ToString()
+		if name == "" {
+			return errorf(ErrBadFileName, "bad file name")
+		}
+	}
+
+	switch s.Command {
+	case "KILL":
+		return i.kill(name)
+	case "MKDIR":
+		if err := i.fs.Mkdir(i.path(name), 0755); err != nil {
+			return pathError(name, err)
+		}
+	case "RMDIR":
+		info, err := i.fs.Stat(i.path(name))
+		if err != nil {
+			return pathError(name, err)
+		}
+		if !info.IsDir() {
+			return errorf(ErrPathNotFound, "path not found: %s", name)
+		}
+		if err := i.fs.Remove(i.path(name)); err != nil {
+			return pathError(name, err)
+		}
+	case "CHDIR":
+		info, err := i.fs.Stat(i.path(name))
+		if err != nil || !info.IsDir() {
+			return errorf(ErrPathNotFound, "path not found: %s", name)
+		}
+		i.dir = filepath.Clean(i.path(name))
+	case "FILES":
+		return i.listFiles(name)
+	}
+	return nil
+}
+
+func (i *Interpreter) executeNameStatement(s *ast.NameStmt) error {
+	oldVal, err := i.evaluate(s.OldName)
+	if err != nil {
+		return err
+	}
+	newVal, err := i.evaluate(s.NewName)
+	if err != nil {
+		return err
+	}
+	if oldVal.Type() != ast.TypeString || newVal.Type() != ast.TypeString {
+		return errorf(ErrTypeMismatch, "type mismatch: NAME needs file names")
+	}
+
+	oldName, newName := oldVal.ToString(), newVal.ToString()
+	if _, err := i.fs.Stat(i.path(oldName)); err != nil {
+		return fileError(oldName, err)
+	}
+	if _, err := i.fs.Stat(i.path(newName)); err == nil {
+		return errorf(ErrFileAlreadyExists, "file already exists: %s", newName)
+	}
+	if err := i.fs.Rename(i.path(oldName), i.path(newName)); err != nil {
+		return fileError(newName, err)
+	}
+	return nil
+}
+
+// kill deletes the files matching spec. Directories are never deleted.
+func (i *Interpreter) kill(spec string) error {
+	dir, entries, err := i.findFiles(spec)
+	if err != nil {
+		return err
+	}
+	killed := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		if err := i.fs.Remove(i.path(name)); err != nil {
+			return fileError(name, err)
+		}
+		killed++
+	}
+	if killed == 0 {
+		return errorf(ErrFileNotFound, "file not found: %s", spec)
+	}
+	return nil
+}
+
+// listFiles prints the directory being listed and the names matching spec
+// in 18-column zones, as FILES does. A spec naming a directory lists all
+// of it.
+func (i *Interpreter) listFiles(spec string) error {
+	if spec == "" {
+		spec = "*"
+	} else if info, err := i.fs.Stat(i.path(spec)); err == nil && info.IsDir() {
+		spec = filepath.Join(spec, "*")
+	}
+	dir, entries, err := i.findFiles(spec)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errorf(ErrFileNotFound, "file not found: %s", spec)
+	}
+
+	header := i.path(dir)
+	if abs, err := filepath.Abs(header); err == nil {
+		header = abs
+	}
+	var out strings.Builder
+	out.WriteString(header + "\n")
+	col := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += string(filepath.Separator)
+		}
+		if col > 0 {
+			zone := (col/18 + 1) * 18
+			if zone+len(name) > 80 {
+				out.WriteString("\n")
+				col = 0
+			} else {
+				out.WriteString(strings.Repeat(" ", zone-col))
+				col = zone
+			}
+		}
+		out.WriteString(name)
+		col += len(name)
+	}
+	out.WriteString("\n")
+	i.print(out.String())
+	return nil
+}
+
+// findFiles returns the directory part of spec and the entries of that
+// directory whose names match the rest of it. The wildcards * and ? match
+// any run of characters and any one character; *.* matches every name,
+// with or without an extension.
+func (i *Interpreter) findFiles(spec string) (string, []os.DirEntry, error) {
+	dir, pattern := filepath.Split(spec)
+	if dir == "" {
+		dir = "."
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		info, err := i.fs.Stat(i.path(spec))
+		if err != nil {
+			if _, dirErr := i.fs.Stat(i.path(dir)); dirErr != nil {
+				return "", nil, pathError(dir, dirErr)
+			}
+			return dir, nil, nil
+		}
+		return dir, []os.DirEntry{fileEntry{info}}, nil
+	}
+
+	all, err := i.fs.ReadDir(i.path(dir))
+	if err != nil {
+		return "", nil, pathError(dir, err)
+	}
+	if pattern == "*.*" {
+		pattern = "*"
+	}
+	var entries []os.DirEntry
+	for _, entry := range all {
+		if wildcardMatch(pattern, entry.Name()) {
+			entries = append(entries, entry)
+		}
+	}
+	return dir, entries, nil
+}
+
+// wildcardMatch reports whether name matches a pattern of * and ? wildcards
+func wildcardMatch(pattern, name string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for k := len(name); k >= 0; k-- {
+				if wildcardMatch(pattern[1:], name[k:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+		default:
+			if name == "" || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return name == ""
+}
+
+// fileEntry presents the FileInfo of a file named without wildcards as a
+// directory entry
+type fileEntry struct {
+	os.FileInfo
+}
+
+func (fe fileEntry) Type() os.FileMode          { return fe.Mode().Type() }
+func (fe fileEntry) Info() (os.FileInfo, error) { return fe.FileInfo, nil }
+
+// dirFunction evaluates DIR$, _FILEEXISTS or _DIREXISTS.
+// DIR$(spec) returns the first file matching spec, and DIR$ or DIR$("")
+// each following one, with "" after the last.
+func (i *Interpreter) dirFunction(name string, args []Value) (Value, error) {
+	if len(args) > 1 || name != "DIR$" && len(args) != 1 {
+		return nil, fmt.Errorf("%s requires 1 argument", name)
+	}
+	spec := ""
+	if len(args) == 1 {
+		if args[0].Type() != ast.TypeString {
+			return nil, errorf(ErrTypeMismatch, "type mismatch: %s needs a file name", name)
+		}
+		spec = args[0].ToString()
+	}
+
+	switch name {
+	case "_FILEEXISTS", "_DIREXISTS":
+		info, err := i.fs.Stat(i.path(spec))
+		if err == nil && info.IsDir() == (name == "_DIREXISTS") {
+			return &IntegerValue{Val: -1}, nil
+		}
+		return &IntegerValue{Val: 0}, nil
+	}
+
+	if spec != "" {
+		_, entries, err := i.findFiles(spec)
+		if err != nil {
+			return nil, err
+		}
+		i.dirNames = []string{}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				i.dirNames = append(i.dirNames, entry.Name())
+			}
+		}
+	} else if i.dirNames == nil {
+		return nil, errorf(ErrIllegalFunctionCall, "DIR$ without a file spec")
+	}
+	if len(i.dirNames) == 0 {
+		return &StringValue{Val: ""}, nil
+	}
+	next := i.dirNames[0]
+	i.dirNames = i.dirNames[1:]
+	return &StringValue{Val: next}, nil
+}
@@ -1,19 +1,39 @@
 package interpreter
 
 import (
-	"fmt"
 	"strings"
 
 	"github.com/xbasic/xbasic/internal/ast"
 )
 
-// Environment manages variable scopes
+// Environment manages variable scopes. A SUB or FUNCTION scope encloses
+// the module scope, but sees only the module's CONSTs and the variables
+// shared with it through DIM SHARED or SHARED.
 type Environment struct {
 	variables map[string]Value
 	arrays    map[string]*Array
 	constants map[string]Value
-	parent    *Environment // for SUB/FUNCTION scope
-	shared    *Environment // module-level shared variables
+	parent    *Environment          // module scope, for SUB/FUNCTION scope
+	shared    map[string]bool       // DIM SHARED names at module level, SHARED names in a procedure
+	statics   *Environment          // STATIC variables that persist between calls
+	static    bool                  // scope persists between calls
+	refs      map[string]*reference // BYREF parameters
+	aliases   map[string]arrayAlias // array parameters
+	lengths   map[string]int        // lengths of STRING * n variables
+}
+
+// reference binds a BYREF parameter to the caller's variable, array
+// element or record field
+type reference struct {
+	get   func() Value
+	set   func(Value)
+	owner *Environment // scope holding a variable, nil for elements and fields
+}
+
+// arrayAlias binds an array parameter to the caller's array
+type arrayAlias struct {
+	env  *Environment
+	name string
 }
 
 // NewEnvironment creates a new global environment
@@ -22,6 +42,10 @@ func NewEnvironment() *Environment {
 		variables: make(map[string]Value),
 		arrays:    make(map[string]*Array),
 		constants: make(map[string]Value),
+		shared:    make(map[string]bool),
+		refs:      make(map[string]*reference),
+		aliases:   make(map[string]arrayAlias),
+		lengths:   make(map[string]int),
 	}
 }
 
@@ -29,10 +53,46 @@ func NewEnvironment() *Environment {
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.parent = outer
-	env.shared = outer
 	return env
 }
 
+// Share makes a module-level variable or array visible in this scope
+func (e *Environment) Share(name string) {
+	e.shared[strings.ToUpper(name)] = true
+}
+
+// sees reports whether a name not defined locally resolves to the
+// enclosing scope
+func (e *Environment) sees(name string) bool {
+	if e.parent == nil {
+		return false
+	}
+	if _, ok := e.parent.constants[name]; ok {
+		return true
+	}
+	return e.shared[name] || e.parent.shared[name]
+}
+
+// isConst reports whether name is a constant visible in this scope
+func (e *Environment) isConst(name string) bool {
+	name = strings.ToUpper(name)
+	if _, ok := e.constants[name]; ok {
+		return true
+	}
+	if _, ok := e.refs[name]; ok || e.has(name) {
+		return false
+	}
+	return e.sees(name) && e.parent.isConst(name)
+}
+
+// has reports whether a variable or array is defined in this scope itself
+func (e *Environment) has(name string) bool {
+	name = strings.ToUpper(name)
+	_, isVar := e.variables[name]
+	_, isArray := e.arrays[name]
+	return isVar || isArray
+}
+
 // Get retrieves a variable value
 func (e *Environment) Get(name string) (Value, bool) {
 	name = strings.ToUpper(name)
@@ -42,13 +102,23 @@ func (e *Environment) Get(name string) (Value, bool) {
 		return val, true
 	}
 
+	if r, ok := e.refs[name]; ok {
+		return r.get(), true
+	}
+
+	if e.statics != nil {
+		if val, ok := e.statics.variables[name]; ok {
+			return val, true
+		}
+	}
+
 	// Check local variables
 	if val, ok := e.variables[name]; ok {
 		return val, true
 	}
 
-	// Check parent scope
-	if e.parent != nil {
+	// Check module scope
+	if e.sees(name) {
 		return e.parent.Get(name)
 	}
 
@@ -64,20 +134,109 @@ func (e *Environment) Set(name string, val Value) {
 		return
 	}
 
-	// If variable exists in parent and we're in local scope, create local copy
+	if r, ok := e.refs[name]; ok {
+		r.set(val)
+		return
+	}
+	if e.statics != nil {
+		if _, ok := e.statics.variables[name]; ok {
+			e.statics.store(name, val)
+			return
+		}
+	}
+	if _, ok := e.variables[name]; !ok && e.sees(name) {
+		e.parent.Set(name, val)
+		return
+	}
+	e.store(name, val)
+}
+
+// store sets a variable of this scope, padding or truncating the value of
+// a fixed-length string to its length
+func (e *Environment) store(name string, val Value) {
+	if n := e.lengths[name]; n > 0 {
+		val = &StringValue{Val: fixedString(val.ToString(), n)}
+	}
+	e.variables[name] = val
+}
+
+// Assign sets a variable, converting the value to the variable's type
+func (e *Environment) Assign(name string, val Value) error {
+	name = strings.ToUpper(name)
+	val, err := CoerceValue(val, e.typeOf(name))
+	if err != nil {
+		return err
+	}
+	e.Set(name, val)
+	return nil
+}
+
+// typeOf returns the type of a variable: that of its value once it has
+// one, which DIM ... AS gives it, otherwise the type of its suffix
+func (e *Environment) typeOf(name string) ast.DataType {
+	if val, ok := e.Get(name); ok {
+		return val.Type()
+	}
+	return e.inferType(name)
+}
+
+// Declare creates a variable in this scope, hiding any shared module
+// variable of the same name
+func (e *Environment) Declare(name string, val Value) {
+	name = strings.ToUpper(name)
+	delete(e.refs, name)
+	delete(e.lengths, name)
 	e.variables[name] = val
 }
 
-// SetShared stores a variable in the shared (module-level) scope
-func (e *Environment) SetShared(name string, val Value) {
+// declareFixed creates a STRING * n variable in this scope, holding n
+// spaces
+func (e *Environment) declareFixed(name string, n int) {
+	e.Declare(name, &StringValue{Val: strings.Repeat(" ", n)})
+	e.lengths[strings.ToUpper(name)] = n
+}
+
+// bind makes name a BYREF parameter for the caller's storage
+func (e *Environment) bind(name string, ref *reference) {
+	name = strings.ToUpper(name)
+	delete(e.variables, name)
+	e.refs[name] = ref
+}
+
+// reference returns a reference to the variable name as seen from e,
+// creating the variable if it does not exist
+func (e *Environment) reference(name string) *reference {
 	name = strings.ToUpper(name)
-	if e.shared != nil {
-		e.shared.variables[name] = val
-	} else {
-		e.variables[name] = val
+	if r, ok := e.refs[name]; ok {
+		return r
+	}
+
+	owner := e
+	if e.statics != nil {
+		if _, ok := e.statics.variables[name]; ok {
+			owner = e.statics
+		}
+	}
+	if _, ok := owner.variables[name]; !ok {
+		if e.sees(name) {
+			return e.parent.reference(name)
+		}
+		e.variables[name] = DefaultValue(e.inferType(name))
+	}
+	return &reference{
+		get:   func() Value { return owner.variables[name] },
+		set:   func(val Value) { owner.store(name, val) },
+		owner: owner,
 	}
 }
 
+// alias makes name an array parameter for the array called target in env
+func (e *Environment) alias(name string, env *Environment, target string) {
+	name = strings.ToUpper(name)
+	delete(e.arrays, name)
+	e.aliases[name] = arrayAlias{env: env, name: strings.ToUpper(target)}
+}
+
 // GetOrCreate gets an existing variable or creates a new one with default value
 func (e *Environment) GetOrCreate(name string, dt ast.DataType) Value {
 	name = strings.ToUpper(name)
@@ -124,7 +283,7 @@ func (e *Environment) DefineConst(name string, val Value) error {
 	name = strings.ToUpper(name)
 
 	if _, ok := e.constants[name]; ok {
-		return fmt.Errorf("constant %s already defined", name)
+		return errorf(ErrDuplicateDefinition, "constant %s already defined", name)
 	}
 
 	e.constants[name] = val
@@ -139,7 +298,17 @@ func (e *Environment) GetArray(name string) (*Array, bool) {
 		return arr, true
 	}
 
-	if e.parent != nil {
+	if a, ok := e.aliases[name]; ok {
+		return a.env.GetArray(a.name)
+	}
+
+	if e.statics != nil {
+		if arr, ok := e.statics.arrays[name]; ok {
+			return arr, true
+		}
+	}
+
+	if e.sees(name) {
 		return e.parent.GetArray(name)
 	}
 
@@ -156,15 +325,96 @@ func (e *Environment) SetArray(name string, arr *Array) {
 func (e *Environment) DeclareArray(name string, dt ast.DataType, dims []int) *Array {
 	name = strings.ToUpper(name)
 
-	// Convert dims to ArrayDimension (0 to dims[i])
+	arr := NewArray(dt, upperBounds(dims))
+	delete(e.aliases, name)
+	e.arrays[name] = arr
+	return arr
+}
+
+// removeArray deletes the array name from the scope holding it
+func (e *Environment) removeArray(name string) {
+	env, key := e.arrayScope(name)
+	delete(env.arrays, key)
+}
+
+// arrayScope returns the scope holding the array name as seen from e and
+// its name there, or e itself if there is none, so that REDIM resizes a
+// shared, STATIC or parameter array where it lives
+func (e *Environment) arrayScope(name string) (*Environment, string) {
+	name = strings.ToUpper(name)
+	if _, ok := e.arrays[name]; ok {
+		return e, name
+	}
+	if a, ok := e.aliases[name]; ok {
+		return a.env.arrayScope(a.name)
+	}
+	if e.statics != nil {
+		if _, ok := e.statics.arrays[name]; ok {
+			return e.statics, name
+		}
+	}
+	if e.sees(name) {
+		if _, ok := e.parent.arrays[name]; ok {
+			return e.parent, name
+		}
+	}
+	return e, name
+}
+
+// Variables returns the variables defined in this scope, including its
+// STATIC variables and parameters but not those of enclosing scopes
+func (e *Environment) Variables() map[string]Value {
+	vars := make(map[string]Value, len(e.variables))
+	if e.statics != nil {
+		for name, val := range e.statics.variables {
+			vars[name] = val
+		}
+	}
+	for name, val := range e.variables {
+		vars[name] = val
+	}
+	for name, r := range e.refs {
+		vars[name] = r.get()
+	}
+	return vars
+}
+
+// Arrays returns the arrays declared in this scope, including its STATIC
+// arrays and array parameters
+func (e *Environment) Arrays() map[string]*Array {
+	arrs := make(map[string]*Array, len(e.arrays))
+	if e.statics != nil {
+		for name, arr := range e.statics.arrays {
+			arrs[name] = arr
+		}
+	}
+	for name, arr := range e.arrays {
+		arrs[name] = arr
+	}
+	for name, a := range e.aliases {
+		if arr, ok := a.env.GetArray(a.name); ok {
+			arrs[name] = arr
+		}
+	}
+	return arrs
+}
+
+// Constants returns the constants defined in this scope
+func (e *Environment) Constants() map[string]Value {
+	consts := make(map[string]Value, len(e.constants))
+	for name, val := range e.constants {
+		consts[name] = val
+	}
+	return consts
+}
+
+// upperBounds converts DIM upper bounds to ArrayDimensions (0 to dims[i])
+func upperBounds(dims []int) []ArrayDimension {
 	adims := make([]ArrayDimension, len(dims))
 	for i, d := range dims {
 		adims[i] = ArrayDimension{Lower: 0, Upper: d}
 	}
-
-	arr := NewArray(dt, adims)
-	e.arrays[name] = arr
-	return arr
+	return adims
 }
 
 // ExecutionState tracks program execution
@@ -184,7 +434,8 @@ type CallFrame struct {
 	ReturnIndex int          // statement index to return to
 	LocalEnv    *Environment // local variables
 	Type        string       // "GOSUB", "SUB", or "FUNCTION"
-	FuncName    string       // function name (for assigning return value)
+	FuncName    string       // SUB or FUNCTION name
+	Line        int          // source line of the call
 }
 
 // ForFrame tracks FOR loop state
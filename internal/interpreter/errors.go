@@ -0,0 +1,301 @@
+package interpreter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/builtins"
+)
+
+// QBasic run-time error numbers
+const (
+	ErrReturnWithoutGosub  = 3
+	ErrOutOfData           = 4
+	ErrIllegalFunctionCall = 5
+	ErrOverflow            = 6
+	ErrLabelNotDefined     = 8
+	ErrSubscriptOutOfRange = 9
+	ErrDuplicateDefinition = 10
+	ErrDivisionByZero      = 11
+	ErrTypeMismatch        = 13
+	ErrNoResume            = 19
+	ErrResumeWithoutError  = 20
+	ErrSubNotDefined       = 35
+	ErrFieldOverflow       = 50
+	ErrBadFileNameOrNumber = 52
+	ErrFileNotFound        = 53
+	ErrBadFileMode         = 54
+	ErrFileAlreadyOpen     = 55
+	ErrFileAlreadyExists   = 58
+	ErrBadRecordLength     = 59
+	ErrInputPastEnd        = 62
+	ErrBadRecordNumber     = 63
+	ErrBadFileName         = 64
+	ErrAdvancedFeature     = 73
+	ErrPathFileAccess      = 75
+	ErrPathNotFound        = 76
+)
+
+// errorMessages holds the standard QBasic text for each error number
+var errorMessages = map[int]string{
+	1:  "NEXT without FOR",
+	2:  "Syntax error",
+	3:  "RETURN without GOSUB",
+	4:  "Out of DATA",
+	5:  "Illegal function call",
+	6:  "Overflow",
+	7:  "Out of memory",
+	8:  "Label not defined",
+	9:  "Subscript out of range",
+	10: "Duplicate definition",
+	11: "Division by zero",
+	13: "Type mismatch",
+	14: "Out of string space",
+	16: "String formula too complex",
+	19: "No RESUME",
+	20: "RESUME without error",
+	35: "Subprogram not defined",
+	50: "FIELD overflow",
+	51: "Internal error",
+	52: "Bad file name or number",
+	53: "File not found",
+	54: "Bad file mode",
+	55: "File already open",
+	57: "Device I/O error",
+	58: "File already exists",
+	59: "Bad record length",
+	61: "Disk full",
+	62: "Input past end of file",
+	63: "Bad record number",
+	64: "Bad file name",
+	67: "Too many files",
+	70: "Permission denied",
+	73: "Advanced feature unavailable",
+	75: "Path/File access error",
+	76: "Path not found",
+}
+
+// ErrorMessage returns the standard message for a QBasic error number
+func ErrorMessage(code int) string {
+	if msg, ok := errorMessages[code]; ok {
+		return msg
+	}
+	return "Unprintable error"
+}
+
+// RuntimeError is a run-time error carrying a QBasic error number, which
+// ON ERROR handlers can inspect through ERR
+type RuntimeError struct {
+	Code int
+	Msg  string
+}
+
+func (e *RuntimeError) Error() string {
+	return e.Msg
+}
+
+// newError creates a RuntimeError with the standard message for code
+func newError(code int) *RuntimeError {
+	return &RuntimeError{Code: code, Msg: ErrorMessage(code)}
+}
+
+// errorf creates a RuntimeError with a formatted message
+func errorf(code int, format string, args ...interface{}) *RuntimeError {
+	return &RuntimeError{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// fileError converts an error from the FileSystem into a RuntimeError
+func fileError(name string, err error) *RuntimeError {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return errorf(ErrFileNotFound, "file not found: %s", name)
+	case errors.Is(err, fs.ErrPermission):
+		return errorf(ErrPathFileAccess, "path/file access error: %s", name)
+	case errors.Is(err, fs.ErrInvalid):
+		return errorf(ErrBadFileName, "bad file name: %s", name)
+	}
+	return errorf(ErrPathFileAccess, "cannot open file %s: %v", name, err)
+}
+
+// pathError converts an error from a directory operation into a
+// RuntimeError. A missing directory is "Path not found" and any other
+// failure, such as a directory that exists or is not empty, is "Path/File
+// access error".
+func pathError(name string, err error) *RuntimeError {
+	if errors.Is(err, fs.ErrNotExist) {
+		return errorf(ErrPathNotFound, "path not found: %s", name)
+	}
+	return errorf(ErrPathFileAccess, "path/file access error: %s", name)
+}
+
+// toRuntimeError gives any error raised while executing a statement a
+// QBasic error number. Errors from built-in and host functions default to
+// "Illegal function call".
+func toRuntimeError(err error) *RuntimeError {
+	var rt *RuntimeError
+	if errors.As(err, &rt) {
+		return rt
+	}
+	var be *builtins.Error
+	if errors.As(err, &be) {
+		return &RuntimeError{Code: be.Code, Msg: be.Msg}
+	}
+	return &RuntimeError{Code: ErrIllegalFunctionCall, Msg: err.Error()}
+}
+
+// resumeSignal is returned by RESUME to end the running error handler
+type resumeSignal struct {
+	next   bool   // RESUME NEXT
+	target string // label or line number for RESUME label
+}
+
+func (r *resumeSignal) Error() string { return "RESUME without error" }
+
+// jumpSignal unwinds execution to the statement list holding target, which
+// continues there
+type jumpSignal struct {
+	target string
+}
+
+func (j *jumpSignal) Error() string { return "jump" }
+
+// returnSignal unwinds execution to the GOSUB being returned from
+type returnSignal struct{}
+
+func (r *returnSignal) Error() string { return "RETURN" }
+
+// endSignal unwinds execution out of the program after END
+type endSignal struct{}
+
+func (e *endSignal) Error() string { return "END" }
+
+// hookError carries an error returned by the debug hook out of the program
+type hookError struct {
+	err error
+}
+
+func (h *hookError) Error() string { return h.err.Error() }
+func (h *hookError) Unwrap() error { return h.err }
+
+// isControlFlow reports whether err is a control-flow signal or a
+// cancellation rather than a run-time error that ON ERROR can trap
+func isControlFlow(err error) bool {
+	switch err.(type) {
+	case *ExitError, *resumeSignal, *jumpSignal, *returnSignal, *endSignal, *hookError:
+		return true
+	}
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// labelIndex returns the statement index of a line number or label
+func (i *Interpreter) labelIndex(target string) (int, bool) {
+	target = strings.ToUpper(target)
+	if lineNum, ok := parseLineNumber(target); ok {
+		if idx, ok := i.program.LineNumbers[lineNum]; ok {
+			return idx, true
+		}
+	}
+	idx, ok := i.program.Labels[target]
+	return idx, ok
+}
+
+// trapError runs the ON ERROR handler for an error raised by stmt and then
+// continues as directed by RESUME. The handler runs at module level; an
+// error inside the handler is fatal.
+func (i *Interpreter) trapError(stmt ast.Statement, rt *RuntimeError) error {
+	if _, ok := i.labelIndex(i.onError); !ok {
+		err := errorf(ErrLabelNotDefined, "undefined label or line number: %s", i.onError)
+		i.onError = ""
+		return err
+	}
+
+	i.errCode, i.errLine, i.handling = rt.Code, i.lineNum, rt
+	savedEnv, savedUnit := i.env, i.unit
+	for i.env.parent != nil {
+		i.env = i.env.parent
+	}
+	i.unit = i.program.Statements
+
+	resume, err := i.runHandler()
+	i.handling = nil
+	if err != nil {
+		i.onError = ""
+		return err
+	}
+	if resume == nil {
+		// Stopped inside the handler
+		return nil
+	}
+
+	i.errCode = 0
+	i.env, i.unit = savedEnv, savedUnit
+	switch {
+	case resume.next:
+		return nil
+	case resume.target != "":
+		return &jumpSignal{target: resume.target}
+	}
+	return i.executeStatement(stmt)
+}
+
+// runHandler executes the module statements from the ON ERROR target until
+// RESUME
+func (i *Interpreter) runHandler() (*resumeSignal, error) {
+	err := i.runStatements(i.program.Statements, i.onError)
+	if resume, ok := err.(*resumeSignal); ok {
+		return resume, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !i.state.Running {
+		return nil, nil
+	}
+	return nil, newError(ErrNoResume)
+}
+
+func (i *Interpreter) executeOnErrorStatement(s *ast.OnErrorStmt) error {
+	if s.Target == "0" {
+		i.onError = ""
+		if i.handling != nil {
+			// ON ERROR GOTO 0 inside a handler reports the trapped error
+			return i.handling
+		}
+		return nil
+	}
+	if _, ok := i.labelIndex(s.Target); !ok {
+		return errorf(ErrLabelNotDefined, "undefined label or line number: %s", s.Target)
+	}
+	i.onError = s.Target
+	return nil
+}
+
+func (i *Interpreter) executeResumeStatement(s *ast.ResumeStmt) error {
+	if i.handling == nil {
+		return newError(ErrResumeWithoutError)
+	}
+	resume := &resumeSignal{next: s.Next}
+	if s.Target != "" && s.Target != "0" {
+		if _, ok := i.labelIndex(s.Target); !ok {
+			return errorf(ErrLabelNotDefined, "undefined label or line number: %s", s.Target)
+		}
+		resume.target = s.Target
+	}
+	return resume
+}
+
+func (i *Interpreter) executeErrorStatement(s *ast.ErrorStmt) error {
+	val, err := i.evaluate(s.Code)
+	if err != nil {
+		return err
+	}
+	code := int(val.ToInt())
+	if code < 1 || code > 255 {
+		return newError(ErrIllegalFunctionCall)
+	}
+	return newError(code)
+}
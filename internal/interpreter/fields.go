@@ -0,0 +1,158 @@
+package interpreter
+
+import (
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// fieldVar is a string variable that FIELD maps onto part of a record
+// buffer. val is the value the variable was last given from the buffer:
+// once the program assigns the variable anything else, as with LET, it no
+// longer refers to the buffer.
+type fieldVar struct {
+	ref    *reference
+	val    *StringValue
+	offset int
+	width  int
+}
+
+// bound reports whether the variable still refers to the buffer
+func (fv *fieldVar) bound() bool {
+	return fv.ref.get() == Value(fv.val)
+}
+
+// set gives the variable its part of buf
+func (fv *fieldVar) set(buf []byte) {
+	fv.val = &StringValue{Val: string(buf[fv.offset : fv.offset+fv.width])}
+	fv.ref.set(fv.val)
+}
+
+// loadFields gives the field variables of a RANDOM file the record just
+// read into its buffer
+func (fh *FileHandle) loadFields() {
+	for idx := range fh.fields {
+		if fv := &fh.fields[idx]; fv.bound() {
+			fv.set(fh.buffer)
+		}
+	}
+}
+
+// seekRecord moves to the record of a RANDOM file, or the byte of a BINARY
+// one, given to GET or PUT. Without a position the next one is used.
+func (i *Interpreter) seekRecord(fh *FileHandle, position ast.Expression) error {
+	if position == nil {
+		return nil
+	}
+	posVal, err := i.evaluate(position)
+	if err != nil {
+		return err
+	}
+	pos := posVal.ToInt() - 1 // QBasic positions are 1-based
+	if pos < 0 {
+		return errorf(ErrBadRecordNumber, "bad record number")
+	}
+	if fh.Mode == "RANDOM" {
+		pos *= int64(fh.RecLen)
+	}
+	_, err = fh.File.Seek(pos, 0)
+	return err
+}
+
+func (i *Interpreter) executeFieldStatement(s *ast.FieldStmt) error {
+	fileNumVal, err := i.evaluate(s.FileNum)
+	if err != nil {
+		return err
+	}
+	fileNum := int(fileNumVal.ToInt())
+	fh, exists := i.files[fileNum]
+	if !exists {
+		return errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
+	}
+	if fh.Mode != "RANDOM" {
+		return errorf(ErrBadFileMode, "file #%d not open for random access", fileNum)
+	}
+
+	// Variables since assigned something else no longer need their place
+	fields := fh.fields[:0]
+	for _, fv := range fh.fields {
+		if fv.bound() {
+			fields = append(fields, fv)
+		}
+	}
+	fh.fields = fields
+
+	offset := 0
+	for _, f := range s.Fields {
+		widthVal, err := i.evaluate(f.Width)
+		if err != nil {
+			return err
+		}
+		width := int(widthVal.ToInt())
+		if width < 0 {
+			return errorf(ErrIllegalFunctionCall, "illegal function call: FIELD width %d", width)
+		}
+		if offset+width > len(fh.buffer) {
+			return errorf(ErrFieldOverflow, "FIELD overflow: record length is %d", fh.RecLen)
+		}
+		id, ok := f.Variable.(*ast.Identifier)
+		if !ok || i.env.typeOf(id.Name) != ast.TypeString {
+			return errorf(ErrTypeMismatch, "type mismatch: FIELD needs a string variable, not %s", f.Variable)
+		}
+
+		fv := fieldVar{ref: i.env.reference(id.Name), offset: offset, width: width}
+		fv.set(fh.buffer)
+		fh.fields = append(fh.fields, fv)
+		offset += width
+	}
+	return nil
+}
+
+// executeJustifyStatement runs LSET or RSET, which pad a string with
+// spaces or cut it to the length of the variable, or of its field for a
+// field variable, which also moves it into the record buffer
+func (i *Interpreter) executeJustifyStatement(s *ast.JustifyStmt) error {
+	val, err := i.evaluate(s.Value)
+	if err != nil {
+		return err
+	}
+	old, err := i.evaluate(s.Name)
+	if err != nil {
+		return err
+	}
+	if val.Type() != ast.TypeString || old.Type() != ast.TypeString {
+		return errorf(ErrTypeMismatch, "type mismatch: %s needs strings", s.TokenLiteral())
+	}
+
+	if fh, fv := i.fieldOf(old); fv != nil {
+		copy(fh.buffer[fv.offset:], justify(val.ToString(), fv.width, s.Right))
+		fv.set(fh.buffer)
+		return nil
+	}
+	return i.assignInput(s.Name, ast.TypeString, justify(val.ToString(), len(old.ToString()), s.Right))
+}
+
+// fieldOf returns the file and field a variable's value comes from, if it
+// is a field variable
+func (i *Interpreter) fieldOf(val Value) (*FileHandle, *fieldVar) {
+	for _, fh := range i.files {
+		for idx := range fh.fields {
+			if fv := &fh.fields[idx]; Value(fv.val) == val && fv.bound() {
+				return fh, fv
+			}
+		}
+	}
+	return nil, nil
+}
+
+// justify pads s with spaces to width, on the right or with right set on
+// the left, or cuts it to width
+func justify(s string, width int, right bool) string {
+	if len(s) >= width {
+		return s[:width]
+	}
+	if right {
+		return strings.Repeat(" ", width-len(s)) + s
+	}
+	return s + strings.Repeat(" ", width-len(s))
+}
@@ -0,0 +1,125 @@
+package interpreter
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// FileSystem abstracts the file operations used by OPEN and by the file
+// and directory statements such as KILL, NAME and MKDIR
+type FileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Remove(name string) error
+	Rename(oldName, newName string) error
+	Mkdir(name string, perm os.FileMode) error
+}
+
+// File is an open file returned by a FileSystem
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// OSFileSystem is the FileSystem backed by the host operating system
+type OSFileSystem struct{}
+
+// OpenFile opens a file on the host filesystem
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Stat describes a file on the host filesystem
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// ReadDir lists a host directory sorted by name
+func (OSFileSystem) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// Remove deletes a file or empty directory on the host filesystem
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Rename renames a file or directory on the host filesystem
+func (OSFileSystem) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+// Mkdir creates a directory on the host filesystem
+func (OSFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+var errNotSeekable error = errorf(ErrBadFileMode, "bad file mode")
+
+// streamFile adapts a plain reader or writer (such as an injected stdin)
+// to the File interface. Seeking and Stat are not supported.
+type streamFile struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (sf *streamFile) Read(p []byte) (int, error) {
+	if sf.r == nil {
+		return 0, errNotSeekable
+	}
+	return sf.r.Read(p)
+}
+
+func (sf *streamFile) Write(p []byte) (int, error) {
+	if sf.w == nil {
+		return 0, errNotSeekable
+	}
+	return sf.w.Write(p)
+}
+
+func (sf *streamFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errNotSeekable
+}
+
+func (sf *streamFile) Close() error {
+	return nil
+}
+
+func (sf *streamFile) Stat() (os.FileInfo, error) {
+	return nil, errNotSeekable
+}
+
+// openDevice opens one of the device names for the program's standard
+// streams: CONS:, SCRN: and /dev/stdout write where PRINT does, /dev/stderr
+// writes to the error stream, and KYBD: and /dev/stdin read what file #0
+// reads. ok is false for any other name.
+func (i *Interpreter) openDevice(name, mode string) (fh *FileHandle, ok bool, err error) {
+	fh = &FileHandle{Name: name, Mode: mode}
+	switch strings.ToUpper(name) {
+	case "CONS:", "SCRN:", "/DEV/STDOUT":
+		fh.File = &streamFile{w: printWriter{i}}
+	case "/DEV/STDERR":
+		fh.File = &streamFile{w: i.stderr}
+	case "KYBD:", "/DEV/STDIN":
+		if mode != "INPUT" {
+			return nil, true, errorf(ErrBadFileMode, "bad file mode: %s is input only", name)
+		}
+		fh.File, fh.Reader = &streamFile{r: i.stdinRaw}, i.stdinReader()
+		return fh, true, nil
+	default:
+		return nil, false, nil
+	}
+	if mode != "OUTPUT" && mode != "APPEND" {
+		return nil, true, errorf(ErrBadFileMode, "bad file mode: %s is output only", name)
+	}
+	return fh, true, nil
+}
@@ -2,14 +2,19 @@ package interpreter
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/xbasic/xbasic/internal/ast"
 	"github.com/xbasic/xbasic/internal/builtins"
+	"github.com/xbasic/xbasic/internal/lexer"
 )
 
 // Interpreter executes BASIC programs
@@ -23,6 +28,33 @@ type Interpreter struct {
 	builtins *builtins.Registry
 	files    map[int]*FileHandle
 	graphics *GraphicsBuffer
+	fs       FileSystem
+	dir      string   // directory set by CHDIR, empty for the working directory
+	dirNames []string // names DIR$ has still to return
+	shell    Shell
+	args     []string // program name and arguments read by COMMAND$
+	osEnv    []string // environment read by ENVIRON$, nil until first used
+	exitCode int      // set by END n and SYSTEM n
+	stdin    *bufio.Reader
+	stdinRaw io.Reader
+	stderr   io.Writer // written by the /dev/stderr device
+	ctx      context.Context
+	steps    int
+	types    map[string]*RecordType
+	statics  map[string]*Environment // persistent scopes of procedures, by name
+	labels   map[*ast.Statement]map[string]labelPos
+	preset   map[string]bool // module variables set by SetVariable, which DIM keeps
+
+	unit []ast.Statement // body of the running module or procedure
+
+	onError  string        // ON ERROR GOTO target, empty when trapping is off
+	handling *RuntimeError // error whose handler is running
+	errCode  int           // ERR
+	errLine  int           // ERL
+	lineNum  int           // last line number executed
+
+	current   ast.Statement             // statement being executed
+	debugHook func(ast.Statement) error // called before each statement
 }
 
 // Screen interface for display operations
@@ -42,10 +74,13 @@ type Screen interface {
 type FileHandle struct {
 	Name     string
 	Mode     string
-	File     *os.File
+	File     File
 	Reader   *bufio.Reader
-	RecLen   int  // Record length for RANDOM mode
+	RecLen   int // Record length for RANDOM mode
 	Position int64
+
+	buffer []byte     // record buffer of a RANDOM file
+	fields []fieldVar // variables FIELD maps onto the buffer
 }
 
 // GraphicsBuffer represents a text-mode graphics buffer
@@ -63,6 +98,14 @@ func New(program *ast.Program) *Interpreter {
 		state:    NewExecutionState(),
 		builtins: builtins.NewRegistry(),
 		files:    make(map[int]*FileHandle),
+		fs:       OSFileSystem{},
+		shell:    OSShell{},
+		stdinRaw: os.Stdin,
+		stderr:   os.Stderr,
+		types:    make(map[string]*RecordType),
+		statics:  make(map[string]*Environment),
+		labels:   make(map[*ast.Statement]map[string]labelPos),
+		preset:   make(map[string]bool),
 	}
 }
 
@@ -81,22 +124,156 @@ func (i *Interpreter) SetScreen(s Screen) {
 	i.screen = s
 }
 
+// SetStdin sets the reader used for file #0 and, when no input callback
+// is set, for INPUT and LINE INPUT. Passing a *bufio.Reader lets the caller
+// share buffered input with the interpreter.
+func (i *Interpreter) SetStdin(r io.Reader) {
+	i.stdinRaw = r
+	i.stdin = nil
+}
+
+// SetStderr sets the writer behind the /dev/stderr device
+func (i *Interpreter) SetStderr(w io.Writer) {
+	i.stderr = w
+}
+
+// SetFileSystem sets the filesystem used by OPEN and the file statements
+func (i *Interpreter) SetFileSystem(fs FileSystem) {
+	i.fs = fs
+}
+
+// SetShell sets the shell used by SHELL. With nil, SHELL fails with
+// "Advanced feature unavailable".
+func (i *Interpreter) SetShell(sh Shell) {
+	i.shell = sh
+}
+
+// SetArgs sets the program name and arguments read by COMMAND$ and
+// _COMMANDCOUNT
+func (i *Interpreter) SetArgs(args []string) {
+	i.args = args
+}
+
+// SetEnviron sets the environment read by ENVIRON$ and passed to SHELL
+// commands, as "name=value" strings. It defaults to the process's own.
+func (i *Interpreter) SetEnviron(env []string) {
+	i.osEnv = append([]string{}, env...)
+}
+
+// ExitCode returns the exit code set by END n or SYSTEM n in the last run
+func (i *Interpreter) ExitCode() int {
+	return i.exitCode
+}
+
+// SetContext sets a context whose cancellation stops the running program
+func (i *Interpreter) SetContext(ctx context.Context) {
+	i.ctx = ctx
+}
+
+// RegisterFunction makes a host Go function callable from BASIC.
+// See builtins.Registry.RegisterFunction.
+func (i *Interpreter) RegisterFunction(name string, params []ast.DataType, result ast.DataType, fn builtins.BuiltinFunc) error {
+	return i.builtins.RegisterFunction(name, params, result, fn)
+}
+
+// RegisterSub makes a host Go function callable from BASIC as a SUB
+func (i *Interpreter) RegisterSub(name string, params []ast.DataType, fn builtins.HostSubFunc) error {
+	return i.builtins.RegisterSub(name, params, fn)
+}
+
+// SetDebugHook sets a function called before each statement is executed,
+// including statements inside blocks and SUB and FUNCTION bodies. The hook
+// may block to pause the program; an error it returns stops the program
+// and is returned by Run. Debugging is only supported by the tree walker.
+func (i *Interpreter) SetDebugHook(hook func(stmt ast.Statement) error) {
+	i.debugHook = hook
+}
+
+// CallStack returns the active GOSUB, SUB and FUNCTION frames, innermost
+// last
+func (i *Interpreter) CallStack() []CallFrame {
+	return append([]CallFrame(nil), i.state.CallStack...)
+}
+
+// Evaluate evaluates an expression in the current scope
+func (i *Interpreter) Evaluate(expr ast.Expression) (Value, error) {
+	return i.evaluate(expr)
+}
+
+// Execute runs a single statement in the current scope
+func (i *Interpreter) Execute(stmt ast.Statement) error {
+	err := i.dispatchStatement(stmt)
+	if _, ok := err.(*endSignal); ok {
+		return nil
+	}
+	return err
+}
+
+// GetArray returns an array visible in the current scope
+func (i *Interpreter) GetArray(name string) (*Array, bool) {
+	return i.env.GetArray(name)
+}
+
+// Scope returns the environment of the statement being executed: the
+// SUB or FUNCTION's locals inside a call, otherwise the module scope
+func (i *Interpreter) Scope() *Environment {
+	return i.env
+}
+
+// Globals returns the module-level environment
+func (i *Interpreter) Globals() *Environment {
+	env := i.env
+	for env.parent != nil {
+		env = env.parent
+	}
+	return env
+}
+
+// SetVariable assigns a module-level variable before or between runs. A
+// later DIM of the variable at module level converts the value to the
+// declared type instead of resetting it.
+func (i *Interpreter) SetVariable(name string, val Value) {
+	i.env.Set(name, val)
+	i.preset[strings.ToUpper(name)] = true
+}
+
+// GetVariable returns the value of a module-level variable
+func (i *Interpreter) GetVariable(name string) (Value, bool) {
+	return i.env.Get(name)
+}
+
 // Run executes the program
 func (i *Interpreter) Run() error {
-	i.state.Running = true
-	i.state.ProgramCounter = 0
+	return i.RunFrom(0)
+}
 
-	// Initialize stdin as file handle 0
-	i.files[0] = &FileHandle{
-		Name:   "STDIN",
-		Mode:   "INPUT",
-		File:   os.Stdin,
-		Reader: bufio.NewReader(os.Stdin),
-	}
+// RunFrom executes the program starting at a top-level statement index,
+// keeping the current variables. The REPL uses it for statements typed in
+// immediate mode.
+func (i *Interpreter) RunFrom(start int) error {
+	i.begin()
+	i.state.ProgramCounter = start
 
+	entry := ""
 	for i.state.Running && i.state.ProgramCounter < len(i.program.Statements) {
 		stmt := i.program.Statements[i.state.ProgramCounter]
-		err := i.executeStatement(stmt)
+		var err error
+		if entry != "" {
+			err, entry = i.enterStatement(stmt, entry), ""
+		} else {
+			err = i.executeStatement(stmt)
+		}
+		if jump, ok := err.(*jumpSignal); ok {
+			pos := i.labelsIn(i.program.Statements)[labelKey(jump.target)]
+			i.state.ProgramCounter = pos.index
+			if pos.nested {
+				entry = jump.target
+			}
+			continue
+		}
+		if _, ok := err.(*endSignal); ok {
+			break
+		}
 		if err != nil {
 			return err
 		}
@@ -106,22 +283,106 @@ func (i *Interpreter) Run() error {
 	return nil
 }
 
+// begin prepares the interpreter to run the program from the start
+func (i *Interpreter) begin() {
+	i.state.Running = true
+	i.state.ProgramCounter = 0
+	i.exitCode = 0
+	i.state.CallStack = i.state.CallStack[:0]
+	i.unit = i.program.Statements
+
+	// Initialize stdin as file handle 0
+	i.files[0] = &FileHandle{
+		Name:   "STDIN",
+		Mode:   "INPUT",
+		File:   i.stdinFile(),
+		Reader: i.stdinReader(),
+	}
+}
+
 // Stop stops the running program
 func (i *Interpreter) Stop() {
 	i.state.Running = false
 }
 
-// Reset resets the interpreter state
+// Reset clears all variables, closes open files and resets the
+// execution state
 func (i *Interpreter) Reset() {
+	i.closeAllFiles()
 	i.env = NewEnvironment()
+	i.statics = make(map[string]*Environment)
 	i.state = NewExecutionState()
 	i.files = make(map[int]*FileHandle)
+	i.onError, i.handling, i.errCode, i.errLine, i.lineNum = "", nil, 0, 0, 0
+}
+
+// SetProgram replaces the program while keeping variables, so that a
+// program edited at the REPL can be continued
+func (i *Interpreter) SetProgram(program *ast.Program) {
+	i.program = program
+	i.types = make(map[string]*RecordType)
+	i.labels = make(map[*ast.Statement]map[string]labelPos)
+}
+
+// stdinReader returns the buffered reader shared by file #0 and INPUT
+func (i *Interpreter) stdinReader() *bufio.Reader {
+	if i.stdin == nil {
+		if br, ok := i.stdinRaw.(*bufio.Reader); ok {
+			i.stdin = br
+		} else {
+			i.stdin = bufio.NewReader(i.stdinRaw)
+		}
+	}
+	return i.stdin
+}
+
+// stdinFile returns the File backing file #0
+func (i *Interpreter) stdinFile() File {
+	if f, ok := i.stdinRaw.(*os.File); ok {
+		return f
+	}
+	return &streamFile{r: i.stdinRaw}
+}
+
+// checkContext reports cancellation of the run context. It is polled
+// every 1024 statements to keep the check off the hot path.
+func (i *Interpreter) checkContext() error {
+	if i.ctx == nil {
+		return nil
+	}
+	i.steps++
+	if i.steps&1023 != 0 {
+		return nil
+	}
+	return i.ctx.Err()
 }
 
+// executeStatement runs a statement, passing any run-time error it raises
+// to the active ON ERROR handler
 func (i *Interpreter) executeStatement(stmt ast.Statement) error {
+	i.current = stmt
+	if i.debugHook != nil {
+		if err := i.debugHook(stmt); err != nil {
+			return &hookError{err: err}
+		}
+	}
+
+	err := i.dispatchStatement(stmt)
+	if err == nil || i.onError == "" || i.handling != nil || isControlFlow(err) {
+		return err
+	}
+	return i.trapError(stmt, toRuntimeError(err))
+}
+
+func (i *Interpreter) dispatchStatement(stmt ast.Statement) error {
+	if err := i.checkContext(); err != nil {
+		return err
+	}
+
 	switch s := stmt.(type) {
 	case *ast.LineNumberStmt:
-		// Line numbers are markers, nothing to execute
+		// Line numbers are markers; ERL reports the last one passed
+		i.lineNum = s.Number
 		return nil
 
 	case *ast.LabelStmt:
@@ -144,13 +405,13 @@ func (i *Interpreter) executeStatement(stmt ast.Statement) error {
 		return i.executeIfStatement(s)
 
 	case *ast.ForStmt:
-		return i.executeForStatement(s)
+		return i.executeForStatement(s, "")
 
 	case *ast.WhileStmt:
-		return i.executeWhileStatement(s)
+		return i.executeWhileStatement(s, "")
 
 	case *ast.DoLoopStmt:
-		return i.executeDoLoopStatement(s)
+		return i.executeDoLoopStatement(s, "")
 
 	case *ast.SelectCaseStmt:
 		return i.executeSelectCaseStatement(s)
@@ -167,13 +428,25 @@ func (i *Interpreter) executeStatement(stmt ast.Statement) error {
 	case *ast.ExitStmt:
 		return i.executeExitStatement(s)
 
-	case *ast.SubStatement:
-		// Skip SUB definitions during normal execution
-		return i.skipSubDefinition()
+	case *ast.SubStatement, *ast.FuncStatement, *ast.DefFnStmt:
+		// Procedures run only when called
+		return nil
+
+	case *ast.DefTypeStmt:
+		// DEFtype statements are applied to names at parse time
+		return nil
+
+	case *ast.DeclareStmt, *ast.ImportStmt:
+		// Prototypes are checked, and libraries added to the program,
+		// before it runs
+		return nil
+
+	case *ast.EraseStmt:
+		return i.executeEraseStatement(s)
 
-	case *ast.FuncStatement:
-		// Skip FUNCTION definitions during normal execution
-		return i.skipFunctionDefinition()
+	case *ast.TypeStmt:
+		// TYPE definitions are collected at parse time
+		return nil
 
 	case *ast.CallStmt:
 		return i.executeCallStatement(s)
@@ -204,13 +477,20 @@ func (i *Interpreter) executeStatement(stmt ast.Statement) error {
 		return i.executeScreenStatement(s)
 
 	case *ast.EndStmt:
-		i.state.Running = false
-		return nil
+		return i.executeEndStatement(s)
 
 	case *ast.RemStmt:
 		// Comments are ignored
 		return nil
 
+	case *ast.OptionStmt:
+		// Declarations were checked by the parser
+		return nil
+
+	case *ast.SharedStmt:
+		// Shared names are bound when the procedure is called
+		return nil
+
 	case *ast.SleepStmt:
 		return i.executeSleepStatement(s)
 
@@ -232,9 +512,30 @@ func (i *Interpreter) executeStatement(stmt ast.Statement) error {
 	case *ast.CloseStmt:
 		return i.executeCloseStatement(s)
 
+	case *ast.FileCommandStmt:
+		return i.executeFileCommandStatement(s)
+
+	case *ast.NameStmt:
+		return i.executeNameStatement(s)
+
+	case *ast.ShellStmt:
+		return i.executeShellStatement(s)
+
+	case *ast.EnvironStmt:
+		return i.executeEnvironStatement(s)
+
 	case *ast.PrintFileStmt:
 		return i.executePrintFileStatement(s)
 
+	case *ast.WriteStmt:
+		return i.executeWriteStatement(s)
+
+	case *ast.FieldStmt:
+		return i.executeFieldStatement(s)
+
+	case *ast.JustifyStmt:
+		return i.executeJustifyStatement(s)
+
 	case *ast.InputFileStmt:
 		return i.executeInputFileStatement(s)
 
@@ -247,6 +548,15 @@ func (i *Interpreter) executeStatement(stmt ast.Statement) error {
 	case *ast.OnGosubStmt:
 		return i.executeOnGosubStatement(s)
 
+	case *ast.OnErrorStmt:
+		return i.executeOnErrorStatement(s)
+
+	case *ast.ResumeStmt:
+		return i.executeResumeStatement(s)
+
+	case *ast.ErrorStmt:
+		return i.executeErrorStatement(s)
+
 	case *ast.LineInputFileStmt:
 		return i.executeLineInputFileStatement(s)
 
@@ -293,32 +603,68 @@ func (i *Interpreter) executeLetStatement(s *ast.LetStmt) error {
 			_ = arr
 			return fmt.Errorf("array %s requires subscripts", target.Name)
 		}
+		old, ok := i.env.Get(target.Name)
+		value, err = assignRecord(old, value)
+		if err != nil {
+			return err
+		}
+		// As Assign, converting to the type of the value just looked up
+		dt := i.env.inferType(target.Name)
+		if ok {
+			dt = old.Type()
+		}
+		if value, err = CoerceValue(value, dt); err != nil {
+			return err
+		}
 		i.env.Set(target.Name, value)
 
 	case *ast.ArrayAccess:
-		arr, ok := i.env.GetArray(target.Name)
+		arr, ok := i.array(target.Name, len(target.Indices))
 		if !ok {
-			return fmt.Errorf("array %s not defined", target.Name)
+			return errorf(ErrSubscriptOutOfRange, "array %s not defined", target.Name)
 		}
 		subscripts, err := i.evaluateSubscripts(target.Indices)
 		if err != nil {
 			return err
 		}
+		old, err := arr.Get(subscripts)
+		if err != nil {
+			return err
+		}
+		value, err = assignRecord(old, value)
+		if err != nil {
+			return err
+		}
 		return arr.Set(subscripts, value)
 
 	case *ast.CallExpr:
 		// Could be array access disguised as function call
-		arr, ok := i.env.GetArray(target.Function)
+		arr, ok := i.array(target.Function, len(target.Arguments))
 		if ok {
 			subscripts, err := i.evaluateSubscripts(target.Arguments)
 			if err != nil {
 				return err
 			}
+			old, err := arr.Get(subscripts)
+			if err != nil {
+				return err
+			}
+			value, err = assignRecord(old, value)
+			if err != nil {
+				return err
+			}
 			return arr.Set(subscripts, value)
 		}
 		// Otherwise it's an error
 		return fmt.Errorf("cannot assign to function call")
 
+	case *ast.FieldAccess:
+		rec, idx, err := i.resolveField(target)
+		if err != nil {
+			return err
+		}
+		return rec.SetField(idx, value)
+
 	default:
 		return fmt.Errorf("invalid assignment target: %T", s.Name)
 	}
@@ -326,6 +672,22 @@ func (i *Interpreter) executeLetStatement(s *ast.LetStmt) error {
 	return nil
 }
 
+// assignRecord checks an assignment involving records. Records are copied
+// on assignment and may only be assigned to variables of the same TYPE.
+func assignRecord(old, value Value) (Value, error) {
+	oldRec, oldIsRec := old.(*RecordValue)
+	newRec, newIsRec := value.(*RecordValue)
+	switch {
+	case !oldIsRec && !newIsRec:
+		return value, nil
+	case oldIsRec && newIsRec && oldRec.Def == newRec.Def:
+		return newRec.Clone(), nil
+	case old == nil && newIsRec:
+		return newRec.Clone(), nil
+	}
+	return nil, errorf(ErrTypeMismatch, "type mismatch")
+}
+
 func (i *Interpreter) executePrintStatement(s *ast.PrintStmt) error {
 	var output strings.Builder
 	col := 0
@@ -377,49 +739,62 @@ func (i *Interpreter) executeInputStatement(s *ast.InputStmt) error {
 		if idx >= len(values) {
 			break
 		}
-
-		inputVal := strings.TrimSpace(values[idx])
-		var val Value
-
-		switch target := v.(type) {
-		case *ast.Identifier:
-			dt := i.env.inferType(target.Name)
-			if dt == ast.TypeString {
-				val = &StringValue{Val: inputVal}
-			} else {
-				// Try to parse as number
-				var f float64
-				fmt.Sscanf(inputVal, "%f", &f)
-				val = CoerceValue(&DoubleValue{Val: f}, dt)
-			}
-			i.env.Set(target.Name, val)
-
-		case *ast.CallExpr:
-			// Array element
-			arr, ok := i.env.GetArray(target.Function)
-			if !ok {
-				return fmt.Errorf("array %s not defined", target.Function)
-			}
-			subscripts, err := i.evaluateSubscripts(target.Arguments)
-			if err != nil {
-				return err
-			}
-			if arr.DataType == ast.TypeString {
-				val = &StringValue{Val: inputVal}
-			} else {
-				var f float64
-				fmt.Sscanf(inputVal, "%f", &f)
-				val = CoerceValue(&DoubleValue{Val: f}, arr.DataType)
-			}
-			arr.Set(subscripts, val)
+		typ, err := i.inputType(v)
+		if err != nil {
+			return err
+		}
+		if err := i.assignInput(v, typ, strings.TrimSpace(values[idx])); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// inputField assigns text read by INPUT to a record field, parsing it as a
+// number unless the field is a string
+func (i *Interpreter) inputField(fa *ast.FieldAccess, text string) error {
+	rec, idx, err := i.resolveField(fa)
+	if err != nil {
+		return err
+	}
+	if rec.Def.Fields[idx].DataType == ast.TypeString {
+		return rec.SetField(idx, &StringValue{Val: text})
+	}
+	return rec.SetField(idx, inputNumber(text))
+}
+
 func (i *Interpreter) executeDimStatement(s *ast.DimStmt) error {
+	// DIM SHARED declares in the module scope, STATIC in the procedure's
+	// persistent scope
+	scope := i.env
+	if s.Shared {
+		scope = i.Globals()
+	} else if s.Static && scope.statics != nil {
+		scope = scope.statics
+	}
+
 	for _, v := range s.Variables {
+		env := scope
+		if s.Shared {
+			env.Share(v.Name)
+		} else if !s.Static && i.staticArray(v) {
+			// DIM of an array declared STATIC dimensions it there
+			env = i.env.statics
+		} else if env.static && env.has(v.Name) {
+			// Declared by an earlier call
+			continue
+		}
+		if v.Array && len(v.Dimensions) == 0 {
+			// STATIC a() declares the array, which DIM or REDIM
+			// dimensions later
+			dt := v.DataType
+			if dt == ast.TypeUnknown {
+				dt = env.inferType(v.Name)
+			}
+			env.DeclareArray(v.Name, dt, nil)
+			continue
+		}
 		if len(v.Dimensions) > 0 {
 			// Array declaration
 			dims := make([]int, len(v.Dimensions))
@@ -430,23 +805,61 @@ func (i *Interpreter) executeDimStatement(s *ast.DimStmt) error {
 				}
 				dims[idx] = int(dimVal.ToInt())
 			}
+			if v.DataType == ast.TypeRecord {
+				if err := i.declareRecord(env, v, dims); err != nil {
+					return err
+				}
+				continue
+			}
+			if v.StringLength != nil {
+				if _, err := i.declareFixedString(env, v, dims); err != nil {
+					return err
+				}
+				continue
+			}
 			dt := v.DataType
 			if dt == ast.TypeUnknown {
-				dt = i.env.inferType(v.Name)
+				dt = env.inferType(v.Name)
+			}
+			env.DeclareArray(v.Name, dt, dims)
+		} else if v.DataType == ast.TypeRecord {
+			if err := i.declareRecord(env, v, nil); err != nil {
+				return err
+			}
+		} else if v.StringLength != nil {
+			if _, err := i.declareFixedString(env, v, nil); err != nil {
+				return err
 			}
-			i.env.DeclareArray(v.Name, dt, dims)
 		} else {
 			// Scalar variable declaration
 			dt := v.DataType
 			if dt == ast.TypeUnknown {
-				dt = i.env.inferType(v.Name)
+				dt = env.inferType(v.Name)
+			}
+			val := DefaultValue(dt)
+			if old, ok := env.variables[strings.ToUpper(v.Name)]; ok && env == i.Globals() && i.preset[strings.ToUpper(v.Name)] {
+				// Keep a value given by the host before the run
+				var err error
+				if val, err = CoerceValue(old, dt); err != nil {
+					return err
+				}
 			}
-			i.env.Set(v.Name, DefaultValue(dt))
+			env.Declare(v.Name, val)
 		}
 	}
 	return nil
 }
 
+// staticArray reports whether DIM v dimensions an array that the
+// procedure declared with STATIC a()
+func (i *Interpreter) staticArray(v ast.DimVariable) bool {
+	if len(v.Dimensions) == 0 || i.env.statics == nil {
+		return false
+	}
+	_, ok := i.env.statics.arrays[strings.ToUpper(v.Name)]
+	return ok
+}
+
 func (i *Interpreter) executeIfStatement(s *ast.IfStmt) error {
 	cond, err := i.evaluate(s.Condition)
 	if err != nil {
@@ -454,42 +867,45 @@ func (i *Interpreter) executeIfStatement(s *ast.IfStmt) error {
 	}
 
 	if cond.ToBool() {
-		for _, stmt := range s.Consequence {
-			if err := i.executeStatement(stmt); err != nil {
-				return err
-			}
-		}
-	} else if len(s.Alternative) > 0 {
-		for _, stmt := range s.Alternative {
-			if err := i.executeStatement(stmt); err != nil {
-				return err
-			}
-		}
+		return i.runStatements(s.Consequence, "")
 	}
-
-	return nil
+	return i.runStatements(s.Alternative, "")
 }
 
-func (i *Interpreter) executeForStatement(s *ast.ForStmt) error {
+// executeForStatement runs a FOR loop. A jump to entry, a label inside the
+// body, enters the loop without initializing the variable. The limit and
+// step are converted to the type of the counter, so an INTEGER or LONG
+// loop counts in integer arithmetic.
+func (i *Interpreter) executeForStatement(s *ast.ForStmt, entry string) error {
+	dt := i.env.typeOf(s.Variable.Name)
+
 	// Initialize loop variable
-	startVal, err := i.evaluate(s.Start)
-	if err != nil {
-		return err
+	if entry == "" {
+		startVal, err := i.evaluate(s.Start)
+		if err != nil {
+			return err
+		}
+		if err := i.env.Assign(s.Variable.Name, startVal); err != nil {
+			return err
+		}
 	}
-	i.env.Set(s.Variable.Name, startVal)
 
 	endVal, err := i.evaluate(s.End)
 	if err != nil {
 		return err
 	}
+	if endVal, err = CoerceValue(endVal, dt); err != nil {
+		return err
+	}
 
-	stepVal := &DoubleValue{Val: 1}
+	var stepVal Value = &IntegerValue{Val: 1}
 	if s.Step != nil {
-		sv, err := i.evaluate(s.Step)
-		if err != nil {
+		if stepVal, err = i.evaluate(s.Step); err != nil {
 			return err
 		}
-		stepVal = &DoubleValue{Val: sv.ToFloat()}
+	}
+	if stepVal, err = CoerceValue(stepVal, dt); err != nil {
+		return err
 	}
 
 	// Determine step direction
@@ -500,65 +916,82 @@ func (i *Interpreter) executeForStatement(s *ast.ForStmt) error {
 
 	// Execute loop
 	for {
-		// Check termination condition
-		currVal := i.env.GetOrCreate(s.Variable.Name, ast.TypeDouble)
-		curr := currVal.ToFloat()
-		end := endVal.ToFloat()
-
-		if stepSign > 0 && curr > end {
-			break
+		if err := i.checkContext(); err != nil {
+			return err
 		}
-		if stepSign < 0 && curr < end {
-			break
+
+		// Check termination condition
+		currVal := i.env.GetOrCreate(s.Variable.Name, dt)
+		if entry == "" {
+			cmp := Compare(currVal, endVal)
+			if stepSign > 0 && cmp > 0 {
+				break
+			}
+			if stepSign < 0 && cmp < 0 {
+				break
+			}
 		}
 
 		// Execute body
-		for _, stmt := range s.Body {
-			if err := i.executeStatement(stmt); err != nil {
-				// Check for EXIT FOR
-				if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "FOR" {
-					return nil
-				}
-				return err
+		if err := i.runStatements(s.Body, entry); err != nil {
+			// Check for EXIT FOR
+			if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "FOR" {
+				return nil
 			}
+			return err
 		}
+		entry = ""
 
 		// Increment loop variable
-		newVal := curr + stepVal.ToFloat()
-		i.env.Set(s.Variable.Name, &DoubleValue{Val: newVal})
+		newVal, err := binaryOp("+", currVal, stepVal)
+		if err != nil {
+			return err
+		}
+		if err := i.env.Assign(s.Variable.Name, newVal); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (i *Interpreter) executeWhileStatement(s *ast.WhileStmt) error {
+func (i *Interpreter) executeWhileStatement(s *ast.WhileStmt, entry string) error {
 	for {
-		cond, err := i.evaluate(s.Condition)
-		if err != nil {
+		if err := i.checkContext(); err != nil {
 			return err
 		}
 
-		if !cond.ToBool() {
-			break
+		if entry == "" {
+			cond, err := i.evaluate(s.Condition)
+			if err != nil {
+				return err
+			}
+
+			if !cond.ToBool() {
+				break
+			}
 		}
 
-		for _, stmt := range s.Body {
-			if err := i.executeStatement(stmt); err != nil {
-				if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "WHILE" {
-					return nil
-				}
-				return err
+		if err := i.runStatements(s.Body, entry); err != nil {
+			if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "WHILE" {
+				return nil
 			}
+			return err
 		}
+		entry = ""
 	}
 
 	return nil
 }
 
-func (i *Interpreter) executeDoLoopStatement(s *ast.DoLoopStmt) error {
+func (i *Interpreter) executeDoLoopStatement(s *ast.DoLoopStmt, entry string) error {
 	for {
+		if err := i.checkContext(); err != nil {
+			return err
+		}
+
 		// Pre-condition
-		if s.ConditionPos == "PRE" && s.Condition != nil {
+		if s.ConditionPos == "PRE" && s.Condition != nil && entry == "" {
 			cond, err := i.evaluate(s.Condition)
 			if err != nil {
 				return err
@@ -572,14 +1005,13 @@ func (i *Interpreter) executeDoLoopStatement(s *ast.DoLoopStmt) error {
 		}
 
 		// Execute body
-		for _, stmt := range s.Body {
-			if err := i.executeStatement(stmt); err != nil {
-				if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "DO" {
-					return nil
-				}
-				return err
+		if err := i.runStatements(s.Body, entry); err != nil {
+			if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "DO" {
+				return nil
 			}
+			return err
 		}
+		entry = ""
 
 		// Post-condition
 		if s.ConditionPos == "POST" && s.Condition != nil {
@@ -666,101 +1098,177 @@ func (i *Interpreter) executeSelectCaseStatement(s *ast.SelectCaseStmt) error {
 		}
 
 		if matched {
-			for _, stmt := range caseClause.Body {
-				if err := i.executeStatement(stmt); err != nil {
-					return err
-				}
-			}
-			return nil
+			return i.runStatements(caseClause.Body, "")
 		}
 	}
 
 	// Execute CASE ELSE if no match
-	for _, stmt := range s.CaseElse {
-		if err := i.executeStatement(stmt); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return i.runStatements(s.CaseElse, "")
 }
 
 func (i *Interpreter) executeGotoStatement(s *ast.GotoStmt) error {
-	target := strings.ToUpper(s.Target)
-
-	// Try as line number first
-	if lineNum, ok := parseLineNumber(target); ok {
-		if idx, ok := i.program.LineNumbers[lineNum]; ok {
-			i.state.ProgramCounter = idx - 1 // -1 because it will be incremented
-			return nil
-		}
+	if _, ok := i.labelsIn(i.unit)[labelKey(s.Target)]; !ok {
+		return errorf(ErrLabelNotDefined, "undefined label or line number: %s", s.Target)
 	}
-
-	// Try as label
-	if idx, ok := i.program.Labels[target]; ok {
-		i.state.ProgramCounter = idx - 1
-		return nil
-	}
-
-	return fmt.Errorf("undefined label or line number: %s", s.Target)
+	return &jumpSignal{target: s.Target}
 }
 
+// executeGosubStatement runs the subroutine at the target until RETURN
 func (i *Interpreter) executeGosubStatement(s *ast.GosubStmt) error {
-	target := strings.ToUpper(s.Target)
+	if _, ok := i.labelsIn(i.unit)[labelKey(s.Target)]; !ok {
+		return errorf(ErrLabelNotDefined, "undefined label or line number: %s", s.Target)
+	}
 
 	// Push return address
 	frame := CallFrame{
 		ReturnIndex: i.state.ProgramCounter,
 		Type:        "GOSUB",
+		Line:        ast.SourceLine(s),
 	}
 	i.state.PushCall(frame)
+	caller := i.current
 
-	// Jump to target
-	if lineNum, ok := parseLineNumber(target); ok {
-		if idx, ok := i.program.LineNumbers[lineNum]; ok {
-			i.state.ProgramCounter = idx - 1
-			return nil
+	err := i.runStatements(i.unit, s.Target)
+	i.current = caller
+	if _, ok := err.(*returnSignal); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The subroutine ran off the end of the module or procedure
+	for k := len(i.state.CallStack) - 1; k >= 0; k-- {
+		if kind := i.state.CallStack[k].Type; kind != "GOSUB" {
+			return &ExitError{ExitType: kind}
 		}
 	}
+	i.state.Running = false
+	return &endSignal{}
+}
 
-	if idx, ok := i.program.Labels[target]; ok {
-		i.state.ProgramCounter = idx - 1
-		return nil
+func (i *Interpreter) executeReturnStatement(s *ast.ReturnStmt) error {
+	// Only a GOSUB can be returned from; SUB and FUNCTION frames belong
+	// to the procedure being executed
+	stack := i.state.CallStack
+	if len(stack) == 0 || stack[len(stack)-1].Type != "GOSUB" {
+		return errorf(ErrReturnWithoutGosub, "RETURN without GOSUB")
 	}
+	i.state.PopCall()
+	return &returnSignal{}
+}
 
-	return fmt.Errorf("undefined label or line number: %s", s.Target)
+// labelPos locates a label or line number in a statement list
+type labelPos struct {
+	index  int  // statement holding the label
+	nested bool // the label is inside a block of that statement
 }
 
-func (i *Interpreter) executeReturnStatement(s *ast.ReturnStmt) error {
-	frame, ok := i.state.PopCall()
-	if !ok {
-		return fmt.Errorf("RETURN without GOSUB")
+// labelKey normalizes a GOTO target so that line numbers such as 010 and
+// 10 match
+func labelKey(target string) string {
+	if n, ok := parseLineNumber(target); ok {
+		return strconv.Itoa(n)
 	}
+	return strings.ToUpper(target)
+}
 
-	if frame.Type == "GOSUB" {
-		i.state.ProgramCounter = frame.ReturnIndex
+// labelsIn returns the labels and line numbers in stmts, including those
+// nested in blocks but not in SUB or FUNCTION definitions
+func (i *Interpreter) labelsIn(stmts []ast.Statement) map[string]labelPos {
+	if len(stmts) == 0 {
 		return nil
 	}
+	if labels, ok := i.labels[&stmts[0]]; ok {
+		return labels
+	}
+
+	labels := make(map[string]labelPos)
+	for idx, stmt := range stmts {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			var key string
+			switch n := n.(type) {
+			case *ast.SubStatement, *ast.FuncStatement:
+				return false
+			case *ast.LineNumberStmt:
+				key = strconv.Itoa(n.Number)
+			case *ast.LabelStmt:
+				key = strings.ToUpper(n.Name)
+			default:
+				return true
+			}
+			if _, ok := labels[key]; !ok {
+				labels[key] = labelPos{index: idx, nested: n != stmt}
+			}
+			return true
+		})
+	}
+	i.labels[&stmts[0]] = labels
+	return labels
+}
+
+// runStatements executes a block, starting at the label or line number
+// target if it is not empty. A jump to a label in the block continues
+// there; any other jump is returned for an enclosing block to take.
+func (i *Interpreter) runStatements(stmts []ast.Statement, target string) error {
+	pc, entry := 0, target
+	for i.state.Running && pc < len(stmts) {
+		if entry != "" {
+			pos := i.labelsIn(stmts)[labelKey(entry)]
+			pc = pos.index
+			if !pos.nested {
+				entry = ""
+			}
+		}
 
-	// RETURN from SUB/FUNCTION
-	if s.Value != nil && frame.Type == "FUNCTION" {
-		val, err := i.evaluate(s.Value)
+		var err error
+		if entry != "" {
+			err, entry = i.enterStatement(stmts[pc], entry), ""
+		} else {
+			err = i.executeStatement(stmts[pc])
+		}
+		if jump, ok := err.(*jumpSignal); ok {
+			if _, ok := i.labelsIn(stmts)[labelKey(jump.target)]; ok {
+				entry = jump.target
+				continue
+			}
+		}
 		if err != nil {
 			return err
 		}
-		// Restore parent environment and set function result
-		if frame.LocalEnv != nil && frame.LocalEnv.parent != nil {
-			i.env = frame.LocalEnv.parent
-		}
-		i.env.Set(frame.FuncName, val)
-	} else if frame.LocalEnv != nil && frame.LocalEnv.parent != nil {
-		i.env = frame.LocalEnv.parent
+		pc++
 	}
-
-	i.state.ProgramCounter = frame.ReturnIndex
 	return nil
 }
 
+// enterStatement runs a block statement from the label or line number
+// target inside it, as for a GOTO into the block
+func (i *Interpreter) enterStatement(stmt ast.Statement, target string) error {
+	i.current = stmt
+	key := labelKey(target)
+	switch s := stmt.(type) {
+	case *ast.IfStmt:
+		if _, ok := i.labelsIn(s.Consequence)[key]; ok {
+			return i.runStatements(s.Consequence, target)
+		}
+		return i.runStatements(s.Alternative, target)
+	case *ast.ForStmt:
+		return i.executeForStatement(s, target)
+	case *ast.WhileStmt:
+		return i.executeWhileStatement(s, target)
+	case *ast.DoLoopStmt:
+		return i.executeDoLoopStatement(s, target)
+	case *ast.SelectCaseStmt:
+		for _, c := range s.Cases {
+			if _, ok := i.labelsIn(c.Body)[key]; ok {
+				return i.runStatements(c.Body, target)
+			}
+		}
+		return i.runStatements(s.CaseElse, target)
+	}
+	return i.executeStatement(stmt)
+}
+
 // ExitError signals an EXIT statement
 type ExitError struct {
 	ExitType string
@@ -774,39 +1282,6 @@ func (i *Interpreter) executeExitStatement(s *ast.ExitStmt) error {
 	return &ExitError{ExitType: s.ExitType}
 }
 
-func (i *Interpreter) skipSubDefinition() error {
-	// Skip until END SUB
-	for i.state.ProgramCounter < len(i.program.Statements)-1 {
-		i.state.ProgramCounter++
-		stmt := i.program.Statements[i.state.ProgramCounter]
-		if _, ok := stmt.(*ast.EndStmt); ok {
-			break
-		}
-		// Check for END SUB marker
-		if end, ok := stmt.(*ast.SubStatement); ok {
-			_ = end
-			break
-		}
-	}
-	return nil
-}
-
-func (i *Interpreter) skipFunctionDefinition() error {
-	// Skip until END FUNCTION
-	for i.state.ProgramCounter < len(i.program.Statements)-1 {
-		i.state.ProgramCounter++
-		stmt := i.program.Statements[i.state.ProgramCounter]
-		if _, ok := stmt.(*ast.EndStmt); ok {
-			break
-		}
-		if end, ok := stmt.(*ast.FuncStatement); ok {
-			_ = end
-			break
-		}
-	}
-	return nil
-}
-
 func (i *Interpreter) executeCallStatement(s *ast.CallStmt) error {
 	return i.callSub(s.Name, s.Arguments)
 }
@@ -820,29 +1295,18 @@ func (i *Interpreter) callSub(name string, args []ast.Expression) error {
 
 	sub, ok := i.program.Subs[name]
 	if !ok {
-		return fmt.Errorf("undefined SUB: %s", name)
-	}
-
-	// Evaluate arguments
-	argVals := make([]Value, len(args))
-	for idx, arg := range args {
-		val, err := i.evaluate(arg)
-		if err != nil {
-			return err
+		if i.builtins.HasSub(name) {
+			return i.callHostSub(name, args)
 		}
-		argVals[idx] = val
+		return errorf(ErrSubNotDefined, "undefined SUB: %s", name)
 	}
 
 	// Create local environment
-	localEnv := NewEnclosedEnvironment(i.env)
+	localEnv := i.procedureEnv(sub.Name, sub.Static, sub.Body)
 
 	// Bind parameters
-	for idx, param := range sub.Parameters {
-		if idx < len(argVals) {
-			localEnv.Set(param.Name, argVals[idx])
-		} else {
-			localEnv.Set(param.Name, DefaultValue(param.DataType))
-		}
+	if err := i.bindParameters(localEnv, sub.Parameters, args); err != nil {
+		return err
 	}
 
 	// Save current state
@@ -850,35 +1314,45 @@ func (i *Interpreter) callSub(name string, args []ast.Expression) error {
 		ReturnIndex: i.state.ProgramCounter,
 		LocalEnv:    i.env,
 		Type:        "SUB",
+		FuncName:    sub.Name,
+		Line:        ast.SourceLine(i.current),
 	}
+	depth := len(i.state.CallStack)
 	i.state.PushCall(frame)
+	caller, unit := i.current, i.unit
 
 	// Switch to local environment
-	i.env = localEnv
+	i.env, i.unit = localEnv, sub.Body
 
 	// Execute SUB body
-	for _, stmt := range sub.Body {
-		if err := i.executeStatement(stmt); err != nil {
-			if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "SUB" {
-				break
-			}
-			return err
-		}
-	}
+	err := i.runStatements(sub.Body, "")
 
-	// Restore environment
-	popFrame, _ := i.state.PopCall()
-	if popFrame.LocalEnv != nil {
-		i.env = popFrame.LocalEnv
+	// Restore environment, dropping any GOSUB left by EXIT SUB
+	i.state.CallStack = i.state.CallStack[:depth]
+	i.env, i.current, i.unit = frame.LocalEnv, caller, unit
+	if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "SUB" {
+		return nil
 	}
+	return err
+}
 
-	return nil
+// callHostSub calls a SUB registered by the host application
+func (i *Interpreter) callHostSub(name string, args []ast.Expression) error {
+	argVals := make([]builtins.Value, len(args))
+	for idx, arg := range args {
+		val, err := i.evaluate(arg)
+		if err != nil {
+			return err
+		}
+		argVals[idx] = valueToBuiltin(val)
+	}
+	return i.builtins.CallSub(name, argVals)
 }
 
 func (i *Interpreter) executeReadStatement(s *ast.ReadStmt) error {
 	for _, v := range s.Variables {
 		if i.state.DataPointer >= len(i.program.DataItems) {
-			return fmt.Errorf("out of DATA")
+			return errorf(ErrOutOfData, "out of DATA")
 		}
 
 		dataVal, err := i.evaluate(i.program.DataItems[i.state.DataPointer])
@@ -889,23 +1363,45 @@ func (i *Interpreter) executeReadStatement(s *ast.ReadStmt) error {
 
 		switch target := v.(type) {
 		case *ast.Identifier:
-			i.env.Set(target.Name, dataVal)
+			dataVal = readValue(dataVal, i.env.typeOf(target.Name))
+			if err := i.env.Assign(target.Name, dataVal); err != nil {
+				return err
+			}
 		case *ast.CallExpr:
-			arr, ok := i.env.GetArray(target.Function)
+			arr, ok := i.array(target.Function, len(target.Arguments))
 			if !ok {
-				return fmt.Errorf("array %s not defined", target.Function)
+				return errorf(ErrSubscriptOutOfRange, "array %s not defined", target.Function)
 			}
 			subscripts, err := i.evaluateSubscripts(target.Arguments)
 			if err != nil {
 				return err
 			}
-			arr.Set(subscripts, dataVal)
+			if err := arr.Set(subscripts, readValue(dataVal, arr.DataType)); err != nil {
+				return err
+			}
+		case *ast.FieldAccess:
+			rec, idx, err := i.resolveField(target)
+			if err != nil {
+				return err
+			}
+			if err := rec.SetField(idx, readValue(dataVal, rec.Def.Fields[idx].DataType)); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+// readValue converts a DATA item read into a variable of type dt. DATA
+// items are text, so a number may be read into a string variable.
+func readValue(val Value, dt ast.DataType) Value {
+	if dt == ast.TypeString && val.Type() != ast.TypeString {
+		return &StringValue{Val: val.ToString()}
+	}
+	return val
+}
+
 func (i *Interpreter) executeRestoreStatement(s *ast.RestoreStmt) error {
 	if s.Target == "" {
 		i.state.DataPointer = 0
@@ -929,7 +1425,7 @@ func (i *Interpreter) executeRestoreStatement(s *ast.RestoreStmt) error {
 		}
 	}
 
-	return fmt.Errorf("undefined label or line number: %s", s.Target)
+	return errorf(ErrLabelNotDefined, "undefined label or line number: %s", s.Target)
 }
 
 func (i *Interpreter) executeClsStatement() error {
@@ -1057,52 +1553,71 @@ func (i *Interpreter) executeOpenStatement(s *ast.OpenStmt) error {
 	if err != nil {
 		return err
 	}
-	fileNum := int(fileNumVal.ToInt())
+	recLen := 128 // default record length
+	if s.RecLen != nil {
+		val, err := i.evaluate(s.RecLen)
+		if err != nil {
+			return err
+		}
+		recLen = int(val.ToInt())
+	}
+
+	return i.openFile(filename.ToString(), int(fileNumVal.ToInt()), s.Mode, recLen)
+}
 
+// openFile opens a file as #fileNum. It is shared by the tree walker and
+// the VM.
+func (i *Interpreter) openFile(filename string, fileNum int, mode string, recLen int) error {
 	if _, exists := i.files[fileNum]; exists {
-		return fmt.Errorf("file #%d already open", fileNum)
+		return errorf(ErrFileAlreadyOpen, "file #%d already open", fileNum)
 	}
 
-	var file *os.File
-	mode := strings.ToUpper(s.Mode)
+	mode = strings.ToUpper(mode)
+	if mode == "RANDOM" && (recLen < 1 || recLen > 32767) {
+		return errorf(ErrBadRecordLength, "bad record length: %d", recLen)
+	}
+	if fh, ok, err := i.openDevice(filename, mode); ok {
+		if err != nil {
+			return err
+		}
+		i.files[fileNum] = fh
+		return nil
+	}
 
+	var file File
+	var err error
+	path := i.path(filename)
 	switch mode {
 	case "INPUT":
-		file, err = os.Open(filename.ToString())
+		file, err = i.fs.OpenFile(path, os.O_RDONLY, 0)
 	case "OUTPUT":
-		file, err = os.Create(filename.ToString())
+		file, err = i.fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	case "APPEND":
-		file, err = os.OpenFile(filename.ToString(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		file, err = i.fs.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	case "BINARY":
-		file, err = os.OpenFile(filename.ToString(), os.O_RDWR|os.O_CREATE, 0644)
+		file, err = i.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	case "RANDOM":
-		file, err = os.OpenFile(filename.ToString(), os.O_RDWR|os.O_CREATE, 0644)
+		file, err = i.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 	default:
-		return fmt.Errorf("invalid file mode: %s", mode)
+		return errorf(ErrBadFileMode, "invalid file mode: %s", mode)
 	}
 
 	if err != nil {
-		return fmt.Errorf("cannot open file: %v", err)
+		return fileError(filename, err)
 	}
 
 	fh := &FileHandle{
-		Name:   filename.ToString(),
+		Name:   filename,
 		Mode:   mode,
 		File:   file,
-		RecLen: 128, // default record length
+		RecLen: recLen,
 	}
 
 	if mode == "INPUT" {
 		fh.Reader = bufio.NewReader(file)
 	}
-
-	// Handle record length for RANDOM mode
-	if s.RecLen != nil {
-		recLen, err := i.evaluate(s.RecLen)
-		if err != nil {
-			return err
-		}
-		fh.RecLen = int(recLen.ToInt())
+	if mode == "RANDOM" {
+		fh.buffer = make([]byte, recLen)
 	}
 
 	i.files[fileNum] = fh
@@ -1111,13 +1626,7 @@ func (i *Interpreter) executeOpenStatement(s *ast.OpenStmt) error {
 
 func (i *Interpreter) executeCloseStatement(s *ast.CloseStmt) error {
 	if len(s.FileNums) == 0 {
-		// Close all files
-		for num, fh := range i.files {
-			if fh.File != nil {
-				fh.File.Close()
-			}
-			delete(i.files, num)
-		}
+		i.closeAllFiles()
 		return nil
 	}
 
@@ -1126,18 +1635,38 @@ func (i *Interpreter) executeCloseStatement(s *ast.CloseStmt) error {
 		if err != nil {
 			return err
 		}
-		fileNum := int(fileNumVal.ToInt())
+		if err := i.closeFile(int(fileNumVal.ToInt())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		fh, exists := i.files[fileNum]
-		if !exists {
-			return fmt.Errorf("file #%d not open", fileNum)
+// closeFile closes file #fileNum
+func (i *Interpreter) closeFile(fileNum int) error {
+	fh, exists := i.files[fileNum]
+	if !exists {
+		return errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
+	}
+	if fh.File != nil {
+		fh.File.Close()
+	}
+	delete(i.files, fileNum)
+	return nil
+}
+
+// closeAllFiles closes every file opened by the program. File #0 is
+// standard input and stays open.
+func (i *Interpreter) closeAllFiles() {
+	for num, fh := range i.files {
+		if num == 0 {
+			continue
 		}
 		if fh.File != nil {
 			fh.File.Close()
 		}
-		delete(i.files, fileNum)
+		delete(i.files, num)
 	}
-	return nil
 }
 
 func (i *Interpreter) executePrintFileStatement(s *ast.PrintFileStmt) error {
@@ -1145,14 +1674,9 @@ func (i *Interpreter) executePrintFileStatement(s *ast.PrintFileStmt) error {
 	if err != nil {
 		return err
 	}
-	fileNum := int(fileNumVal.ToInt())
-
-	fh, exists := i.files[fileNum]
-	if !exists {
-		return fmt.Errorf("file #%d not open", fileNum)
-	}
-	if fh.Mode != "OUTPUT" && fh.Mode != "APPEND" && fh.Mode != "BINARY" && fh.Mode != "RANDOM" {
-		return fmt.Errorf("file #%d not open for output", fileNum)
+	fh, err := i.outputFile(int(fileNumVal.ToInt()))
+	if err != nil {
+		return err
 	}
 
 	var output strings.Builder
@@ -1184,10 +1708,22 @@ func (i *Interpreter) executePrintFileStatement(s *ast.PrintFileStmt) error {
 		output.WriteString("\n")
 	}
 
-	_, err = fh.File.WriteString(output.String())
+	_, err = io.WriteString(fh.File, output.String())
 	return err
 }
 
+// outputFile returns file #fileNum, which must be open for output
+func (i *Interpreter) outputFile(fileNum int) (*FileHandle, error) {
+	fh, exists := i.files[fileNum]
+	if !exists {
+		return nil, errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
+	}
+	if fh.Mode != "OUTPUT" && fh.Mode != "APPEND" && fh.Mode != "BINARY" && fh.Mode != "RANDOM" {
+		return nil, errorf(ErrBadFileMode, "file #%d not open for output", fileNum)
+	}
+	return fh, nil
+}
+
 func (i *Interpreter) executeInputFileStatement(s *ast.InputFileStmt) error {
 	fileNumVal, err := i.evaluate(s.FileNum)
 	if err != nil {
@@ -1197,10 +1733,10 @@ func (i *Interpreter) executeInputFileStatement(s *ast.InputFileStmt) error {
 
 	fh, exists := i.files[fileNum]
 	if !exists {
-		return fmt.Errorf("file #%d not open", fileNum)
+		return errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
 	}
 	if fh.Mode != "INPUT" && fh.Mode != "BINARY" && fh.Mode != "RANDOM" {
-		return fmt.Errorf("file #%d not open for input", fileNum)
+		return errorf(ErrBadFileMode, "file #%d not open for input", fileNum)
 	}
 
 	// Create reader if needed
@@ -1209,80 +1745,19 @@ func (i *Interpreter) executeInputFileStatement(s *ast.InputFileStmt) error {
 	}
 
 	for _, v := range s.Variables {
-		// Read value from file (comma or newline delimited)
-		var inputVal string
-		var ch byte
-
-		// Skip leading whitespace
-		for {
-			ch, err = fh.Reader.ReadByte()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			if ch != ' ' && ch != '\t' {
-				fh.Reader.UnreadByte()
-				break
-			}
+		typ, err := i.inputType(v)
+		if err != nil {
+			return err
 		}
-
-		// Read until delimiter
-		for {
-			ch, err = fh.Reader.ReadByte()
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			if ch == ',' || ch == '\n' || ch == '\r' {
-				if ch == '\r' {
-					// Skip LF after CR
-					nextCh, err := fh.Reader.ReadByte()
-					if err == nil && nextCh != '\n' {
-						fh.Reader.UnreadByte()
-					}
-				}
-				break
-			}
-			inputVal += string(ch)
+		text, err := readField(fh.Reader, typ != ast.TypeString)
+		if err == io.EOF {
+			return errorf(ErrInputPastEnd, "input past end of file #%d", fileNum)
 		}
-
-		inputVal = strings.TrimSpace(inputVal)
-
-		switch target := v.(type) {
-		case *ast.Identifier:
-			dt := i.env.inferType(target.Name)
-			var val Value
-			if dt == ast.TypeString {
-				val = &StringValue{Val: inputVal}
-			} else {
-				var f float64
-				fmt.Sscanf(inputVal, "%f", &f)
-				val = CoerceValue(&DoubleValue{Val: f}, dt)
-			}
-			i.env.Set(target.Name, val)
-
-		case *ast.CallExpr:
-			arr, ok := i.env.GetArray(target.Function)
-			if !ok {
-				return fmt.Errorf("array %s not defined", target.Function)
-			}
-			subscripts, err := i.evaluateSubscripts(target.Arguments)
-			if err != nil {
-				return err
-			}
-			var val Value
-			if arr.DataType == ast.TypeString {
-				val = &StringValue{Val: inputVal}
-			} else {
-				var f float64
-				fmt.Sscanf(inputVal, "%f", &f)
-				val = CoerceValue(&DoubleValue{Val: f}, arr.DataType)
-			}
-			arr.Set(subscripts, val)
+		if err != nil {
+			return err
+		}
+		if err := i.assignInput(v, typ, text); err != nil {
+			return err
 		}
 	}
 
@@ -1297,8 +1772,11 @@ func (i *Interpreter) executeLineInputStatement(s *ast.LineInputStmt) error {
 
 	inputStr := i.getInput(prompt)
 
-	if id, ok := s.Variable.(*ast.Identifier); ok {
-		i.env.Set(id.Name, &StringValue{Val: inputStr})
+	switch target := s.Variable.(type) {
+	case *ast.Identifier:
+		i.env.Set(target.Name, &StringValue{Val: inputStr})
+	case *ast.FieldAccess:
+		return i.inputField(target, inputStr)
 	}
 
 	return nil
@@ -1341,10 +1819,10 @@ func (i *Interpreter) executeOnGosubStatement(s *ast.OnGosubStmt) error {
 func (i *Interpreter) evaluate(expr ast.Expression) (Value, error) {
 	switch e := expr.(type) {
 	case *ast.IntegerLiteral:
-		return &LongValue{Val: int32(e.Value)}, nil
+		return literalValue(e.Type, float64(e.Value)), nil
 
 	case *ast.FloatLiteral:
-		return &DoubleValue{Val: e.Value}, nil
+		return literalValue(e.Type, e.Value), nil
 
 	case *ast.StringLiteral:
 		return &StringValue{Val: e.Value}, nil
@@ -1362,6 +1840,25 @@ func (i *Interpreter) evaluate(expr ast.Expression) (Value, error) {
 			return builtinToValue(result), nil
 		case "FREEFILE":
 			return &IntegerValue{Val: int16(i.GetNextFreeFile())}, nil
+		case "DIR$", "COMMAND$", "_COMMANDCOUNT":
+			return i.systemFunction(name, nil)
+		case "ERR":
+			return &IntegerValue{Val: int16(i.errCode)}, nil
+		case "ERL":
+			return &LongValue{Val: int32(i.errLine)}, nil
+		}
+		if i.builtins.IsHostFunction(name) {
+			result, err := i.builtins.Call(name, nil)
+			if err != nil {
+				return nil, err
+			}
+			return builtinToValue(result), nil
+		}
+		if fn, ok := i.program.DefFns[name]; ok {
+			return i.callDefFn(fn, nil)
+		}
+		if fn, ok := i.functionCall(name); ok {
+			return i.callFunction(fn, nil)
 		}
 		val, ok := i.env.Get(e.Name)
 		if !ok {
@@ -1371,9 +1868,9 @@ func (i *Interpreter) evaluate(expr ast.Expression) (Value, error) {
 		return val, nil
 
 	case *ast.ArrayAccess:
-		arr, ok := i.env.GetArray(e.Name)
+		arr, ok := i.array(e.Name, len(e.Indices))
 		if !ok {
-			return nil, fmt.Errorf("array %s not defined", e.Name)
+			return nil, errorf(ErrSubscriptOutOfRange, "array %s not defined", e.Name)
 		}
 		subscripts, err := i.evaluateSubscripts(e.Indices)
 		if err != nil {
@@ -1393,6 +1890,9 @@ func (i *Interpreter) evaluate(expr ast.Expression) (Value, error) {
 	case *ast.GroupedExpr:
 		return i.evaluate(e.Expression)
 
+	case *ast.FieldAccess:
+		return i.evaluateFieldAccess(e)
+
 	default:
 		return nil, fmt.Errorf("unknown expression type: %T", expr)
 	}
@@ -1409,8 +1909,17 @@ func (i *Interpreter) evaluateBinaryExpr(e *ast.BinaryExpr) (Value, error) {
 		return nil, err
 	}
 
+	return binaryOp(e.Operator, left, right)
+}
+
+// binaryOp applies a binary operator to two values. It is shared by the
+// tree walker and the VM. As in QBasic, + - and * work in the wider type
+// of their operands, / and ^ in SINGLE unless an operand is DOUBLE, and
+// \, MOD and the logical operators in INTEGER or LONG. A result too large
+// for its type is an Overflow.
+func binaryOp(op string, left, right Value) (Value, error) {
 	// String concatenation
-	if e.Operator == "+" && (left.Type() == ast.TypeString || right.Type() == ast.TypeString) {
+	if op == "+" && (left.Type() == ast.TypeString || right.Type() == ast.TypeString) {
 		return &StringValue{Val: left.ToString() + right.ToString()}, nil
 	}
 
@@ -1419,7 +1928,7 @@ func (i *Interpreter) evaluateBinaryExpr(e *ast.BinaryExpr) (Value, error) {
 		ls := left.(*StringValue).Val
 		rs := right.(*StringValue).Val
 
-		switch e.Operator {
+		switch op {
 		case "=":
 			return boolToValue(ls == rs), nil
 		case "<>":
@@ -1433,82 +1942,190 @@ func (i *Interpreter) evaluateBinaryExpr(e *ast.BinaryExpr) (Value, error) {
 		case ">=":
 			return boolToValue(ls >= rs), nil
 		default:
-			return nil, fmt.Errorf("invalid operator %s for strings", e.Operator)
+			return nil, fmt.Errorf("invalid operator %s for strings", op)
 		}
 	}
+	if left.Type() == ast.TypeString || right.Type() == ast.TypeString {
+		return nil, errorf(ErrTypeMismatch, "type mismatch: %s %s %s", left.Type(), op, right.Type())
+	}
 
 	// Numeric operations
-	lf := left.ToFloat()
-	rf := right.ToFloat()
-
-	switch e.Operator {
-	case "+":
-		return &DoubleValue{Val: lf + rf}, nil
-	case "-":
-		return &DoubleValue{Val: lf - rf}, nil
-	case "*":
-		return &DoubleValue{Val: lf * rf}, nil
-	case "/":
-		if rf == 0 {
-			return nil, fmt.Errorf("division by zero")
+	t := PromoteType(left.Type(), right.Type())
+
+	switch op {
+	case "+", "-", "*":
+		if t == ast.TypeInteger || t == ast.TypeLong {
+			l, r := left.ToInt(), right.ToInt()
+			switch op {
+			case "+":
+				return integerResult(l+r, t)
+			case "-":
+				return integerResult(l-r, t)
+			}
+			return integerResult(l*r, t)
 		}
-		return &DoubleValue{Val: lf / rf}, nil
-	case "\\":
+		l, r := left.ToFloat(), right.ToFloat()
+		switch op {
+		case "+":
+			return floatResult(l+r, t)
+		case "-":
+			return floatResult(l-r, t)
+		}
+		return floatResult(l*r, t)
+	case "/":
+		rf := right.ToFloat()
 		if rf == 0 {
-			return nil, fmt.Errorf("division by zero")
+			return nil, errorf(ErrDivisionByZero, "division by zero")
 		}
-		return &LongValue{Val: int32(int64(lf) / int64(rf))}, nil
+		return floatResult(left.ToFloat()/rf, PromoteType(t, ast.TypeSingle))
 	case "^":
-		return &DoubleValue{Val: pow(lf, rf)}, nil
-	case "MOD":
-		if rf == 0 {
-			return nil, fmt.Errorf("division by zero")
+		lf, rf := left.ToFloat(), right.ToFloat()
+		if lf == 0 && rf < 0 {
+			return nil, errorf(ErrDivisionByZero, "division by zero")
 		}
-		return &LongValue{Val: int32(int64(lf) % int64(rf))}, nil
+		f := math.Pow(lf, rf)
+		if math.IsNaN(f) {
+			return nil, errorf(ErrIllegalFunctionCall, "illegal function call: %s ^ %s", left, right)
+		}
+		return floatResult(f, PromoteType(t, ast.TypeSingle))
 	case "=":
-		return boolToValue(lf == rf), nil
+		return boolToValue(left.ToFloat() == right.ToFloat()), nil
 	case "<>":
-		return boolToValue(lf != rf), nil
+		return boolToValue(left.ToFloat() != right.ToFloat()), nil
 	case "<":
-		return boolToValue(lf < rf), nil
+		return boolToValue(left.ToFloat() < right.ToFloat()), nil
 	case ">":
-		return boolToValue(lf > rf), nil
+		return boolToValue(left.ToFloat() > right.ToFloat()), nil
 	case "<=":
-		return boolToValue(lf <= rf), nil
+		return boolToValue(left.ToFloat() <= right.ToFloat()), nil
 	case ">=":
-		return boolToValue(lf >= rf), nil
+		return boolToValue(left.ToFloat() >= right.ToFloat()), nil
+	}
+
+	l, lt, err := integerOperand(left)
+	if err != nil {
+		return nil, err
+	}
+	r, rt, err := integerOperand(right)
+	if err != nil {
+		return nil, err
+	}
+	t = PromoteType(lt, rt)
+
+	switch op {
+	case "\\":
+		if r == 0 {
+			return nil, errorf(ErrDivisionByZero, "division by zero")
+		}
+		return integerResult(l/r, t)
+	case "MOD":
+		if r == 0 {
+			return nil, errorf(ErrDivisionByZero, "division by zero")
+		}
+		return integerResult(l%r, t)
 	case "AND":
-		return &LongValue{Val: int32(int64(lf) & int64(rf))}, nil
+		return integerResult(l&r, t)
 	case "OR":
-		return &LongValue{Val: int32(int64(lf) | int64(rf))}, nil
+		return integerResult(l|r, t)
 	case "XOR":
-		return &LongValue{Val: int32(int64(lf) ^ int64(rf))}, nil
+		return integerResult(l^r, t)
 	case "EQV":
-		return &LongValue{Val: int32(^(int64(lf) ^ int64(rf)))}, nil
+		return integerResult(^(l ^ r), t)
 	case "IMP":
-		return &LongValue{Val: int32(^int64(lf) | int64(rf))}, nil
+		return integerResult(^l|r, t)
 	default:
-		return nil, fmt.Errorf("unknown operator: %s", e.Operator)
+		return nil, fmt.Errorf("unknown operator: %s", op)
 	}
 }
 
-func (i *Interpreter) evaluateUnaryExpr(e *ast.UnaryExpr) (Value, error) {
-	right, err := i.evaluate(e.Right)
-	if err != nil {
-		return nil, err
+// integerOperand rounds an operand of \, MOD or a logical operator to a
+// whole number and returns the type, INTEGER or LONG, that holds it
+func integerOperand(v Value) (int64, ast.DataType, error) {
+	switch x := v.(type) {
+	case *IntegerValue:
+		return int64(x.Val), ast.TypeInteger, nil
+	case *LongValue:
+		return int64(x.Val), ast.TypeLong, nil
+	case *StringValue:
+		return 0, 0, errorf(ErrTypeMismatch, "type mismatch: %s is not a number", strconv.Quote(x.Val))
+	}
+	f := math.RoundToEven(v.ToFloat())
+	switch {
+	case f >= math.MinInt16 && f <= math.MaxInt16:
+		return int64(f), ast.TypeInteger, nil
+	case f >= math.MinInt32 && f <= math.MaxInt32:
+		return int64(f), ast.TypeLong, nil
 	}
+	return 0, 0, errorf(ErrOverflow, "overflow")
+}
 
-	switch e.Operator {
-	case "-":
-		return &DoubleValue{Val: -right.ToFloat()}, nil
-	case "NOT":
-		return &LongValue{Val: int32(^int64(right.ToInt()))}, nil
-	default:
-		return nil, fmt.Errorf("unknown unary operator: %s", e.Operator)
+// integerResult returns n as an INTEGER or LONG, or an Overflow if it does
+// not fit
+func integerResult(n int64, t ast.DataType) (Value, error) {
+	if t == ast.TypeInteger {
+		if n < math.MinInt16 || n > math.MaxInt16 {
+			return nil, errorf(ErrOverflow, "overflow")
+		}
+		return &IntegerValue{Val: int16(n)}, nil
 	}
+	if n < math.MinInt32 || n > math.MaxInt32 {
+		return nil, errorf(ErrOverflow, "overflow")
+	}
+	return &LongValue{Val: int32(n)}, nil
 }
 
-func (i *Interpreter) evaluateCallExpr(e *ast.CallExpr) (Value, error) {
+// floatResult returns f as a SINGLE or DOUBLE, or an Overflow if it does
+// not fit
+func floatResult(f float64, t ast.DataType) (Value, error) {
+	if t == ast.TypeSingle {
+		if math.Abs(f) > math.MaxFloat32 {
+			return nil, errorf(ErrOverflow, "overflow")
+		}
+		return &SingleValue{Val: float32(f)}, nil
+	}
+	if math.IsInf(f, 0) {
+		return nil, errorf(ErrOverflow, "overflow")
+	}
+	return &DoubleValue{Val: f}, nil
+}
+
+func (i *Interpreter) evaluateUnaryExpr(e *ast.UnaryExpr) (Value, error) {
+	right, err := i.evaluate(e.Right)
+	if err != nil {
+		return nil, err
+	}
+
+	return unaryOp(e.Operator, right)
+}
+
+// unaryOp applies a unary operator to a value. Negation keeps the type of
+// its operand.
+func unaryOp(op string, right Value) (Value, error) {
+	switch op {
+	case "-":
+		switch v := right.(type) {
+		case *IntegerValue:
+			return integerResult(-int64(v.Val), ast.TypeInteger)
+		case *LongValue:
+			return integerResult(-int64(v.Val), ast.TypeLong)
+		case *SingleValue:
+			return &SingleValue{Val: -v.Val}, nil
+		case *StringValue:
+			return nil, errorf(ErrTypeMismatch, "type mismatch: cannot negate a string")
+		}
+		return &DoubleValue{Val: -right.ToFloat()}, nil
+	case "NOT":
+		n, t, err := integerOperand(right)
+		if err != nil {
+			return nil, err
+		}
+		return integerResult(^n, t)
+	default:
+		return nil, fmt.Errorf("unknown unary operator: %s", op)
+	}
+}
+
+func (i *Interpreter) evaluateCallExpr(e *ast.CallExpr) (Value, error) {
 	name := strings.ToUpper(e.Function)
 
 	// Check if it's an array access
@@ -1524,74 +2141,63 @@ func (i *Interpreter) evaluateCallExpr(e *ast.CallExpr) (Value, error) {
 	if fn, ok := i.program.Functions[name]; ok {
 		return i.callFunction(fn, e.Arguments)
 	}
+	if fn, ok := i.program.DefFns[name]; ok {
+		return i.callDefFn(fn, e.Arguments)
+	}
 
 	// Handle file I/O functions that need interpreter access
 	switch name {
-	case "EOF":
+	case "EOF", "LOF", "LOC":
 		if len(e.Arguments) < 1 {
-			return nil, fmt.Errorf("EOF requires 1 argument")
+			return nil, fmt.Errorf("%s requires 1 argument", name)
 		}
 		fileNumVal, err := i.evaluate(e.Arguments[0])
 		if err != nil {
 			return nil, err
 		}
-		fileNum := int(fileNumVal.ToInt())
-		fh, exists := i.files[fileNum]
-		if !exists {
-			return nil, fmt.Errorf("file #%d not open", fileNum)
-		}
-		// Check if at end of file
-		if fh.Reader != nil {
-			_, err := fh.Reader.Peek(1)
-			if err == io.EOF {
-				return &IntegerValue{Val: -1}, nil // TRUE
+		return i.fileFunction(name, int(fileNumVal.ToInt()))
+
+	case "FREEFILE":
+		return &IntegerValue{Val: int16(i.GetNextFreeFile())}, nil
+
+	case "LEN":
+		// LEN of a record is its size in bytes
+		if len(e.Arguments) == 1 {
+			val, err := i.evaluate(e.Arguments[0])
+			if err != nil {
+				return nil, err
+			}
+			if rec, ok := val.(*RecordValue); ok {
+				return &LongValue{Val: int32(rec.Def.Size())}, nil
+			}
+			result, err := i.builtins.Call(name, []builtins.Value{valueToBuiltin(val)})
+			if err != nil {
+				return nil, err
 			}
+			return builtinToValue(result), nil
 		}
-		return &IntegerValue{Val: 0}, nil // FALSE
+	}
 
-	case "LOF":
-		if len(e.Arguments) < 1 {
-			return nil, fmt.Errorf("LOF requires 1 argument")
-		}
-		fileNumVal, err := i.evaluate(e.Arguments[0])
-		if err != nil {
-			return nil, err
-		}
-		fileNum := int(fileNumVal.ToInt())
-		fh, exists := i.files[fileNum]
-		if !exists {
-			return nil, fmt.Errorf("file #%d not open", fileNum)
-		}
-		info, err := fh.File.Stat()
-		if err != nil {
-			return nil, err
+	if systemFunctions[name] {
+		args := make([]Value, len(e.Arguments))
+		for idx, arg := range e.Arguments {
+			val, err := i.evaluate(arg)
+			if err != nil {
+				return nil, err
+			}
+			args[idx] = val
 		}
-		return &LongValue{Val: int32(info.Size())}, nil
+		return i.systemFunction(name, args)
+	}
 
-	case "LOC":
-		if len(e.Arguments) < 1 {
-			return nil, fmt.Errorf("LOC requires 1 argument")
-		}
-		fileNumVal, err := i.evaluate(e.Arguments[0])
-		if err != nil {
-			return nil, err
-		}
-		fileNum := int(fileNumVal.ToInt())
-		fh, exists := i.files[fileNum]
-		if !exists {
-			return nil, fmt.Errorf("file #%d not open", fileNum)
-		}
-		pos, err := fh.File.Seek(0, 1) // Get current position
-		if err != nil {
-			return nil, err
-		}
-		if fh.Mode == "RANDOM" {
-			return &LongValue{Val: int32(pos / int64(fh.RecLen))}, nil
+	if !i.builtins.Has(name) {
+		if arr, ok := i.array(name, len(e.Arguments)); ok {
+			subscripts, err := i.evaluateSubscripts(e.Arguments)
+			if err != nil {
+				return nil, err
+			}
+			return arr.Get(subscripts)
 		}
-		return &LongValue{Val: int32(pos)}, nil
-
-	case "FREEFILE":
-		return &IntegerValue{Val: int16(i.GetNextFreeFile())}, nil
 	}
 
 	// Evaluate arguments
@@ -1612,45 +2218,73 @@ func (i *Interpreter) evaluateCallExpr(e *ast.CallExpr) (Value, error) {
 	return builtinToValue(result), nil
 }
 
-func (i *Interpreter) callFunction(fn *ast.FuncStatement, args []ast.Expression) (Value, error) {
-	// Evaluate arguments
-	argVals := make([]Value, len(args))
-	for idx, arg := range args {
-		val, err := i.evaluate(arg)
+// fileFunction evaluates EOF, LOF or LOC for file #fileNum
+func (i *Interpreter) fileFunction(name string, fileNum int) (Value, error) {
+	fh, exists := i.files[fileNum]
+	if !exists {
+		return nil, errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
+	}
+
+	switch name {
+	case "EOF":
+		// Check if at end of file
+		if fh.Reader != nil {
+			_, err := fh.Reader.Peek(1)
+			if err == io.EOF {
+				return &IntegerValue{Val: -1}, nil // TRUE
+			}
+		}
+		return &IntegerValue{Val: 0}, nil // FALSE
+
+	case "LOF":
+		info, err := fh.File.Stat()
 		if err != nil {
 			return nil, err
 		}
-		argVals[idx] = val
+		return &LongValue{Val: int32(info.Size())}, nil
 	}
 
+	pos, err := fh.File.Seek(0, 1) // Get current position
+	if err != nil {
+		return nil, err
+	}
+	if fh.Mode == "RANDOM" {
+		return &LongValue{Val: int32(pos / int64(fh.RecLen))}, nil
+	}
+	return &LongValue{Val: int32(pos)}, nil
+}
+
+func (i *Interpreter) callFunction(fn *ast.FuncStatement, args []ast.Expression) (Value, error) {
 	// Create local environment
-	localEnv := NewEnclosedEnvironment(i.env)
+	localEnv := i.procedureEnv(fn.Name, fn.Static, fn.Body)
 
 	// Bind parameters
-	for idx, param := range fn.Parameters {
-		if idx < len(argVals) {
-			localEnv.Set(param.Name, argVals[idx])
-		} else {
-			localEnv.Set(param.Name, DefaultValue(param.DataType))
-		}
+	if err := i.bindParameters(localEnv, fn.Parameters, args); err != nil {
+		return nil, err
 	}
 
 	// Initialize return variable (function name)
-	localEnv.Set(fn.Name, DefaultValue(fn.ReturnType))
+	localEnv.Declare(fn.Name, DefaultValue(fn.ReturnType))
 
 	// Save current environment
-	savedEnv := i.env
-	i.env = localEnv
+	savedEnv, caller, unit := i.env, i.current, i.unit
+	depth := len(i.state.CallStack)
+	i.state.PushCall(CallFrame{
+		ReturnIndex: i.state.ProgramCounter,
+		LocalEnv:    savedEnv,
+		Type:        "FUNCTION",
+		FuncName:    fn.Name,
+		Line:        ast.SourceLine(caller),
+	})
+	i.env, i.unit = localEnv, fn.Body
 
 	// Execute function body
-	for _, stmt := range fn.Body {
-		if err := i.executeStatement(stmt); err != nil {
-			if exitErr, ok := err.(*ExitError); ok && exitErr.ExitType == "FUNCTION" {
-				break
-			}
-			i.env = savedEnv
-			return nil, err
-		}
+	err := i.runStatements(fn.Body, "")
+	i.state.CallStack = i.state.CallStack[:depth]
+	i.current, i.unit = caller, unit
+	if exitErr, ok := err.(*ExitError); err != nil && !(ok && exitErr.ExitType == "FUNCTION") {
+		i.env = savedEnv
+		return nil, err
 	}
 
 	// Get return value
@@ -1665,6 +2299,306 @@ func (i *Interpreter) callFunction(fn *ast.FuncStatement, args []ast.Expression)
 	return retVal, nil
 }
 
+// functionCall returns the FUNCTION a name without arguments calls. In the
+// body of the FUNCTION itself the name is its return value instead.
+func (i *Interpreter) functionCall(name string) (*ast.FuncStatement, bool) {
+	fn, ok := i.program.Functions[name]
+	if !ok {
+		return nil, false
+	}
+	calls := i.state.CallStack
+	for k := len(calls) - 1; k >= 0; k-- {
+		if calls[k].Type != "GOSUB" {
+			return fn, calls[k].Type != "FUNCTION" || !strings.EqualFold(calls[k].FuncName, fn.Name)
+		}
+	}
+	return fn, true
+}
+
+// procedureEnv returns the scope for a call of a SUB or FUNCTION. It
+// encloses the module scope, never the caller's, and keeps the variables
+// of a STATIC procedure, or declared STATIC, from one call to the next.
+func (i *Interpreter) procedureEnv(name string, static bool, body []ast.Statement) *Environment {
+	name = strings.ToUpper(name)
+	persistent, ok := i.statics[name]
+	if !ok {
+		persistent = NewEnclosedEnvironment(i.Globals())
+		persistent.static = true
+		i.statics[name] = persistent
+	}
+
+	env := persistent
+	if !static {
+		env = NewEnclosedEnvironment(i.Globals())
+		env.statics = persistent
+	}
+	for _, stmt := range body {
+		if s, ok := stmt.(*ast.SharedStmt); ok {
+			for _, v := range s.Variables {
+				env.Share(v.Name)
+			}
+		}
+	}
+	return env
+}
+
+// callDefFn evaluates a DEF FN function. Its parameters are passed by
+// value and local to the call; any other name is a module variable.
+func (i *Interpreter) callDefFn(fn *ast.DefFnStmt, args []ast.Expression) (Value, error) {
+	env := NewEnclosedEnvironment(i.Globals())
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		switch e := n.(type) {
+		case *ast.Identifier:
+			env.Share(e.Name)
+		case *ast.ArrayAccess:
+			env.Share(e.Name)
+		case *ast.CallExpr:
+			env.Share(e.Function)
+		}
+		return true
+	})
+
+	for idx, param := range fn.Parameters {
+		dt := param.DataType
+		if dt == ast.TypeUnknown {
+			dt = env.inferType(param.Name)
+		}
+		val := DefaultValue(dt)
+		if idx < len(args) {
+			var err error
+			if val, err = i.evaluate(args[idx]); err != nil {
+				return nil, err
+			}
+			if val, err = CoerceValue(val, dt); err != nil {
+				return nil, err
+			}
+		}
+		env.Declare(param.Name, val)
+	}
+
+	saved := i.env
+	i.env = env
+	val, err := i.evaluate(fn.Body)
+	i.env = saved
+	if err != nil {
+		return nil, err
+	}
+	return CoerceValue(val, env.inferType(fn.Name))
+}
+
+// array returns the array name for an access with dims subscripts. In
+// GW-BASIC an array used without DIM is created with subscripts up to 10.
+func (i *Interpreter) array(name string, dims int) (*Array, bool) {
+	if arr, ok := i.env.GetArray(name); ok {
+		return arr, true
+	}
+	if i.program.Dialect != lexer.GWBASIC || dims == 0 {
+		return nil, false
+	}
+	bounds := make([]int, dims)
+	for k := range bounds {
+		bounds[k] = 10
+	}
+	return i.env.DeclareArray(name, i.env.inferType(name), bounds), true
+}
+
+// executeEraseStatement resets the elements of arrays to zero or empty
+// strings. GW-BASIC frees the arrays instead, so that DIM can size them
+// again.
+func (i *Interpreter) executeEraseStatement(s *ast.EraseStmt) error {
+	for _, name := range s.Arrays {
+		arr, ok := i.env.GetArray(name)
+		if !ok {
+			return errorf(ErrIllegalFunctionCall, "array %s not defined", name)
+		}
+		if i.program.Dialect == lexer.GWBASIC {
+			i.env.removeArray(name)
+			continue
+		}
+		for k := range arr.Data {
+			if arr.Record != nil {
+				arr.Data[k] = NewRecord(arr.Record)
+			} else if arr.Length > 0 {
+				arr.Data[k] = &StringValue{Val: strings.Repeat(" ", arr.Length)}
+			} else {
+				arr.Data[k] = DefaultValue(arr.DataType)
+			}
+		}
+	}
+	return nil
+}
+
+// bindParameters binds the arguments of a call in the caller's scope to
+// the parameters in env. As in QBasic, a variable, array element or record
+// field is passed by reference unless the parameter is BYVAL, the
+// argument is in parentheses or it is a number of another type than the
+// parameter's; anything else is passed by value. A string cannot be passed
+// to a numeric parameter, nor a number to a string one.
+func (i *Interpreter) bindParameters(env *Environment, params []ast.Parameter, args []ast.Expression) error {
+	// All arguments are resolved before any is bound, as env may be the
+	// caller's own scope when a STATIC procedure calls itself
+	type binding struct {
+		ref   *reference
+		owner *Environment // scope and name of an array argument
+		array string
+		val   Value
+	}
+	bindings := make([]binding, len(params))
+	for idx, param := range params {
+		b := &bindings[idx]
+		if idx >= len(args) {
+			b.val = DefaultValue(param.DataType)
+			if param.DataType == ast.TypeRecord {
+				rt, err := i.recordType(param.TypeName)
+				if err != nil {
+					return err
+				}
+				b.val = NewRecord(rt)
+			}
+			continue
+		}
+		arg := args[idx]
+
+		if param.Array {
+			call, ok := arg.(*ast.CallExpr)
+			if ok && len(call.Arguments) == 0 {
+				if _, ok := i.env.GetArray(call.Function); ok {
+					b.owner, b.array = i.env.arrayScope(call.Function)
+					continue
+				}
+			}
+			return errorf(ErrTypeMismatch, "parameter type mismatch: %s() must be passed an array", param.Name)
+		}
+
+		if !param.ByVal {
+			ref, err := i.reference(arg)
+			if err != nil {
+				return err
+			}
+			if ref != nil && ref.owner != env {
+				b.val = ref.get()
+				dt := paramType(env, param)
+				if (b.val.Type() == ast.TypeString) != (dt == ast.TypeString) {
+					return errorf(ErrTypeMismatch, "parameter type mismatch: %s cannot be passed a %s", param.Name, b.val.Type())
+				}
+				// As in QBasic, a number of another type than the
+				// parameter's is passed by value, converted
+				if b.val.Type() == dt {
+					b.ref = ref
+				}
+			}
+		}
+		if b.val == nil {
+			val, err := i.evaluate(arg)
+			if err != nil {
+				return err
+			}
+			b.val = val
+		}
+		if param.DataType == ast.TypeRecord {
+			if err := i.checkRecordParam(param, b.val); err != nil {
+				return err
+			}
+		}
+	}
+
+	for idx, param := range params {
+		switch b := bindings[idx]; {
+		case b.owner == env && strings.EqualFold(b.array, param.Name):
+			// Already bound
+		case b.owner != nil:
+			env.alias(param.Name, b.owner, b.array)
+		case b.ref != nil:
+			env.bind(param.Name, b.ref)
+		case !param.Array:
+			val, err := CoerceValue(b.val, paramType(env, param))
+			if err != nil {
+				return err
+			}
+			env.Declare(param.Name, val)
+		}
+	}
+	return nil
+}
+
+// paramType returns the type of a parameter in the procedure scope env
+func paramType(env *Environment, param ast.Parameter) ast.DataType {
+	if param.DataType == ast.TypeUnknown {
+		return env.inferType(param.Name)
+	}
+	return param.DataType
+}
+
+// checkRecordParam reports an error unless val is a record of the
+// parameter's TYPE
+func (i *Interpreter) checkRecordParam(param ast.Parameter, val Value) error {
+	rt, err := i.recordType(param.TypeName)
+	if err != nil {
+		return err
+	}
+	if rec, ok := val.(*RecordValue); !ok || rec.Def != rt {
+		return errorf(ErrTypeMismatch, "parameter type mismatch: %s must be %s", param.Name, rt.Name)
+	}
+	return nil
+}
+
+// reference returns the storage named by a BYREF argument, or nil if the
+// argument is an expression to pass by value
+func (i *Interpreter) reference(arg ast.Expression) (*reference, error) {
+	switch a := arg.(type) {
+	case *ast.Identifier:
+		if _, ok := i.env.GetArray(a.Name); ok || i.env.isConst(a.Name) {
+			return nil, nil
+		}
+		if _, ok := i.functionCall(strings.ToUpper(a.Name)); ok {
+			return nil, nil
+		}
+		return i.env.reference(a.Name), nil
+
+	case *ast.ArrayAccess:
+		return i.elementReference(a.Name, a.Indices)
+
+	case *ast.CallExpr:
+		if _, ok := i.env.GetArray(a.Function); ok && len(a.Arguments) > 0 {
+			return i.elementReference(a.Function, a.Arguments)
+		}
+
+	case *ast.FieldAccess:
+		rec, idx, err := i.resolveField(a)
+		if err != nil {
+			return nil, err
+		}
+		return &reference{
+			get: func() Value { return rec.Fields[idx] },
+			set: func(val Value) { rec.SetField(idx, val) },
+		}, nil
+	}
+	return nil, nil
+}
+
+// elementReference returns a reference to an array element, whose
+// subscripts are evaluated once when the argument is bound
+func (i *Interpreter) elementReference(name string, indices []ast.Expression) (*reference, error) {
+	arr, ok := i.array(name, len(indices))
+	if !ok {
+		return nil, errorf(ErrSubscriptOutOfRange, "array %s not defined", name)
+	}
+	subscripts, err := i.evaluateSubscripts(indices)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := arr.Get(subscripts); err != nil {
+		return nil, err
+	}
+	return &reference{
+		get: func() Value {
+			val, _ := arr.Get(subscripts)
+			return val
+		},
+		set: func(val Value) { arr.Set(subscripts, val) },
+	}, nil
+}
+
 func (i *Interpreter) evaluateSubscripts(exprs []ast.Expression) ([]int, error) {
 	subscripts := make([]int, len(exprs))
 	for idx, expr := range exprs {
@@ -1691,7 +2625,9 @@ func (i *Interpreter) getInput(prompt string) string {
 	if i.input != nil {
 		return i.input(prompt)
 	}
-	return ""
+	i.print(prompt)
+	line, _ := i.stdinReader().ReadString('\n')
+	return strings.TrimRight(line, "\r\n")
 }
 
 func (i *Interpreter) formatValue(val Value) string {
@@ -1735,28 +2671,6 @@ func parseLineNumber(s string) (int, bool) {
 	return n, err == nil
 }
 
-func pow(base, exp float64) float64 {
-	if exp == 0 {
-		return 1
-	}
-	if exp == 1 {
-		return base
-	}
-	if exp == 2 {
-		return base * base
-	}
-	// Use math.Pow for general case
-	result := 1.0
-	for exp > 0 {
-		if int(exp)%2 == 1 {
-			result *= base
-		}
-		base *= base
-		exp = float64(int(exp) / 2)
-	}
-	return result
-}
-
 // Conversion functions between interpreter and builtins value types
 
 func valueToBuiltin(v Value) builtins.Value {
@@ -1798,32 +2712,43 @@ func (i *Interpreter) executeLineInputFileStatement(s *ast.LineInputFileStmt) er
 	if err != nil {
 		return err
 	}
-	fileNum := int(fileNumVal.ToInt())
+	line, err := i.readFileLine(int(fileNumVal.ToInt()))
+	if err != nil {
+		return err
+	}
 
+	switch target := s.Variable.(type) {
+	case *ast.Identifier:
+		i.env.Set(target.Name, &StringValue{Val: line})
+	case *ast.FieldAccess:
+		return i.inputField(target, line)
+	}
+
+	return nil
+}
+
+// readFileLine reads the next line of file #fileNum for LINE INPUT #
+func (i *Interpreter) readFileLine(fileNum int) (string, error) {
 	fh, exists := i.files[fileNum]
 	if !exists {
-		return fmt.Errorf("file #%d not open", fileNum)
+		return "", errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
 	}
 	if fh.Mode != "INPUT" && fh.Mode != "BINARY" {
-		return fmt.Errorf("file #%d not open for input", fileNum)
+		return "", errorf(ErrBadFileMode, "file #%d not open for input", fileNum)
 	}
 
 	if fh.Reader == nil {
 		fh.Reader = bufio.NewReader(fh.File)
 	}
 
-	// Read entire line
 	line, err := fh.Reader.ReadString('\n')
-	if err != nil && err != io.EOF {
-		return err
+	if err == io.EOF && line == "" {
+		return "", errorf(ErrInputPastEnd, "input past end of file #%d", fileNum)
 	}
-	line = strings.TrimRight(line, "\r\n")
-
-	if id, ok := s.Variable.(*ast.Identifier); ok {
-		i.env.Set(id.Name, &StringValue{Val: line})
+	if err != nil && err != io.EOF {
+		return "", err
 	}
-
-	return nil
+	return strings.TrimRight(line, "\r\n"), nil
 }
 
 func (i *Interpreter) executeGetStatement(s *ast.GetStmt) error {
@@ -1835,30 +2760,51 @@ func (i *Interpreter) executeGetStatement(s *ast.GetStmt) error {
 
 	fh, exists := i.files[fileNum]
 	if !exists {
-		return fmt.Errorf("file #%d not open", fileNum)
+		return errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
 	}
 	if fh.Mode != "BINARY" && fh.Mode != "RANDOM" {
-		return fmt.Errorf("file #%d not open for binary/random access", fileNum)
+		return errorf(ErrBadFileMode, "file #%d not open for binary/random access", fileNum)
 	}
 
-	// Seek to position if specified
-	if s.Position != nil {
-		posVal, err := i.evaluate(s.Position)
-		if err != nil {
-			return err
-		}
-		pos := posVal.ToInt() - 1 // QBasic positions are 1-based
-		if fh.Mode == "RANDOM" {
-			pos = pos * int64(fh.RecLen)
+	if err := i.seekRecord(fh, s.Position); err != nil {
+		return err
+	}
+
+	// A RANDOM file is read a record at a time, into the FIELD buffer when
+	// no variable is given
+	var r io.Reader = fh.File
+	if fh.Mode == "RANDOM" {
+		record := fh.buffer
+		if s.Variable != nil {
+			record = make([]byte, fh.RecLen)
 		}
-		_, err = fh.File.Seek(pos, 0)
-		if err != nil {
+		n, err := io.ReadFull(fh.File, record)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return err
 		}
+		clear(record[n:])
+		if s.Variable == nil {
+			fh.loadFields()
+			return nil
+		}
+		r = bytes.NewReader(record)
 	}
 
 	// Read data based on variable type
 	if s.Variable != nil {
+		if rec, ok := i.recordTarget(s.Variable); ok {
+			size := rec.Def.Size()
+			if fh.Mode == "RANDOM" && size > fh.RecLen {
+				return errorf(ErrBadRecordLength, "bad record length")
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			rec.Decode(buf)
+			return nil
+		}
+
 		switch target := s.Variable.(type) {
 		case *ast.Identifier:
 			dt := i.env.inferType(target.Name)
@@ -1867,27 +2813,27 @@ func (i *Interpreter) executeGetStatement(s *ast.GetStmt) error {
 			switch dt {
 			case ast.TypeInteger:
 				var v int16
-				binary.Read(fh.File, binary.LittleEndian, &v)
+				binary.Read(r, binary.LittleEndian, &v)
 				val = &IntegerValue{Val: v}
 			case ast.TypeLong:
 				var v int32
-				binary.Read(fh.File, binary.LittleEndian, &v)
+				binary.Read(r, binary.LittleEndian, &v)
 				val = &LongValue{Val: v}
 			case ast.TypeSingle:
 				var v float32
-				binary.Read(fh.File, binary.LittleEndian, &v)
+				binary.Read(r, binary.LittleEndian, &v)
 				val = &SingleValue{Val: v}
 			case ast.TypeDouble:
 				var v float64
-				binary.Read(fh.File, binary.LittleEndian, &v)
+				binary.Read(r, binary.LittleEndian, &v)
 				val = &DoubleValue{Val: v}
 			case ast.TypeString:
 				buf := make([]byte, fh.RecLen)
-				n, _ := fh.File.Read(buf)
+				n, _ := r.Read(buf)
 				val = &StringValue{Val: strings.TrimRight(string(buf[:n]), "\x00")}
 			default:
 				var v float64
-				binary.Read(fh.File, binary.LittleEndian, &v)
+				binary.Read(r, binary.LittleEndian, &v)
 				val = &DoubleValue{Val: v}
 			}
 			i.env.Set(target.Name, val)
@@ -1897,6 +2843,28 @@ func (i *Interpreter) executeGetStatement(s *ast.GetStmt) error {
 	return nil
 }
 
+// recordTarget returns the record a GET statement reads into, if the
+// target variable, array element or field holds one
+func (i *Interpreter) recordTarget(target ast.Expression) (*RecordValue, bool) {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		val, ok := i.env.Get(t.Name)
+		if !ok {
+			return nil, false
+		}
+		rec, ok := val.(*RecordValue)
+		return rec, ok
+	case *ast.CallExpr, *ast.ArrayAccess, *ast.FieldAccess:
+		val, err := i.evaluate(t)
+		if err != nil {
+			return nil, false
+		}
+		rec, ok := val.(*RecordValue)
+		return rec, ok
+	}
+	return nil, false
+}
+
 func (i *Interpreter) executePutStatement(s *ast.PutStmt) error {
 	fileNumVal, err := i.evaluate(s.FileNum)
 	if err != nil {
@@ -1906,52 +2874,63 @@ func (i *Interpreter) executePutStatement(s *ast.PutStmt) error {
 
 	fh, exists := i.files[fileNum]
 	if !exists {
-		return fmt.Errorf("file #%d not open", fileNum)
+		return errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
 	}
 	if fh.Mode != "BINARY" && fh.Mode != "RANDOM" {
-		return fmt.Errorf("file #%d not open for binary/random access", fileNum)
+		return errorf(ErrBadFileMode, "file #%d not open for binary/random access", fileNum)
 	}
 
-	// Seek to position if specified
-	if s.Position != nil {
-		posVal, err := i.evaluate(s.Position)
-		if err != nil {
-			return err
-		}
-		pos := posVal.ToInt() - 1 // QBasic positions are 1-based
-		if fh.Mode == "RANDOM" {
-			pos = pos * int64(fh.RecLen)
-		}
-		_, err = fh.File.Seek(pos, 0)
-		if err != nil {
-			return err
-		}
+	if err := i.seekRecord(fh, s.Position); err != nil {
+		return err
+	}
+	if fh.Mode == "RANDOM" && s.Variable == nil {
+		_, err := fh.File.Write(fh.buffer)
+		return err
 	}
 
 	// Write data based on variable type
-	if s.Variable != nil {
-		val, err := i.evaluate(s.Variable)
-		if err != nil {
+	if s.Variable == nil {
+		return nil
+	}
+	val, err := i.evaluate(s.Variable)
+	if err != nil {
+		return err
+	}
+
+	// A RANDOM file is written a record at a time
+	var w io.Writer = fh.File
+	var record bytes.Buffer
+	if fh.Mode == "RANDOM" {
+		w = &record
+	}
+
+	switch v := val.(type) {
+	case *RecordValue:
+		if _, err := w.Write(v.Bytes()); err != nil {
 			return err
 		}
+	case *IntegerValue:
+		binary.Write(w, binary.LittleEndian, v.Val)
+	case *LongValue:
+		binary.Write(w, binary.LittleEndian, v.Val)
+	case *SingleValue:
+		binary.Write(w, binary.LittleEndian, v.Val)
+	case *DoubleValue:
+		binary.Write(w, binary.LittleEndian, v.Val)
+	case *StringValue:
+		buf := make([]byte, fh.RecLen)
+		copy(buf, v.Val)
+		w.Write(buf)
+	}
 
-		switch v := val.(type) {
-		case *IntegerValue:
-			binary.Write(fh.File, binary.LittleEndian, v.Val)
-		case *LongValue:
-			binary.Write(fh.File, binary.LittleEndian, v.Val)
-		case *SingleValue:
-			binary.Write(fh.File, binary.LittleEndian, v.Val)
-		case *DoubleValue:
-			binary.Write(fh.File, binary.LittleEndian, v.Val)
-		case *StringValue:
-			buf := make([]byte, fh.RecLen)
-			copy(buf, v.Val)
-			fh.File.Write(buf)
+	if fh.Mode == "RANDOM" {
+		if record.Len() > fh.RecLen {
+			return errorf(ErrBadRecordLength, "bad record length")
 		}
+		record.Write(make([]byte, fh.RecLen-record.Len()))
+		_, err = fh.File.Write(record.Bytes())
 	}
-
-	return nil
+	return err
 }
 
 func (i *Interpreter) executeSeekStatement(s *ast.SeekStmt) error {
@@ -1963,7 +2942,7 @@ func (i *Interpreter) executeSeekStatement(s *ast.SeekStmt) error {
 
 	fh, exists := i.files[fileNum]
 	if !exists {
-		return fmt.Errorf("file #%d not open", fileNum)
+		return errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
 	}
 
 	posVal, err := i.evaluate(s.Position)
@@ -1992,9 +2971,34 @@ func (i *Interpreter) executeRedimStatement(s *ast.RedimStmt) error {
 				dims[idx] = int(dimVal.ToInt())
 			}
 
+			env, name := i.env.arrayScope(v.Name)
+			v.Name = name
+			if v.DataType == ast.TypeRecord {
+				existingArr, exists := i.env.GetArray(v.Name)
+				if err := i.declareRecord(env, v, dims); err != nil {
+					return err
+				}
+				if s.Preserve && exists {
+					newArr, _ := i.env.GetArray(v.Name)
+					i.copyArrayData(existingArr, newArr)
+				}
+				continue
+			}
+			if v.StringLength != nil {
+				existingArr, exists := i.env.GetArray(v.Name)
+				newArr, err := i.declareFixedString(env, v, dims)
+				if err != nil {
+					return err
+				}
+				if s.Preserve && exists {
+					i.copyArrayData(existingArr, newArr)
+				}
+				continue
+			}
+
 			dt := v.DataType
 			if dt == ast.TypeUnknown {
-				dt = i.env.inferType(v.Name)
+				dt = env.inferType(v.Name)
 			}
 
 			if s.Preserve {
@@ -2002,14 +3006,14 @@ func (i *Interpreter) executeRedimStatement(s *ast.RedimStmt) error {
 				existingArr, exists := i.env.GetArray(v.Name)
 				if exists {
 					// Create new array with new dimensions
-					newArr := i.env.DeclareArray(v.Name, dt, dims)
+					newArr := env.DeclareArray(v.Name, dt, dims)
 					// Copy existing data (up to the smaller dimension)
 					i.copyArrayData(existingArr, newArr)
 				} else {
-					i.env.DeclareArray(v.Name, dt, dims)
+					env.DeclareArray(v.Name, dt, dims)
 				}
 			} else {
-				i.env.DeclareArray(v.Name, dt, dims)
+				env.DeclareArray(v.Name, dt, dims)
 			}
 		}
 	}
@@ -2063,9 +3067,9 @@ func (i *Interpreter) executePrintUsingStatement(s *ast.PrintUsingStmt) error {
 		fileNum := int(fileNumVal.ToInt())
 		fh, exists := i.files[fileNum]
 		if !exists {
-			return fmt.Errorf("file #%d not open", fileNum)
+			return errorf(ErrBadFileNameOrNumber, "file #%d not open", fileNum)
 		}
-		_, err = fh.File.WriteString(output.String())
+		_, err = io.WriteString(fh.File, output.String())
 		return err
 	}
 
@@ -0,0 +1,376 @@
+package interpreter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+// run runs a program with the tree walker and returns what it printed
+func run(t *testing.T, source string) (string, error) {
+	t.Helper()
+	interp, out := newTestInterpreter(t, source)
+	err := interp.Run()
+	return out.String(), err
+}
+
+// runVM runs a program on the bytecode VM and returns what it printed
+func runVM(t *testing.T, source string) (string, error) {
+	t.Helper()
+	interp, out := newTestInterpreter(t, source)
+	bc, err := interp.Compile()
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	err = interp.RunBytecode(bc)
+	return out.String(), err
+}
+
+func newTestInterpreter(t *testing.T, source string) (*Interpreter, *strings.Builder) {
+	t.Helper()
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		t.Fatalf("parse errors: %v", errs)
+	}
+	out := &strings.Builder{}
+	interp := New(program)
+	interp.SetStdin(strings.NewReader(""))
+	interp.SetOutput(func(s string) { out.WriteString(s) })
+	return interp, out
+}
+
+func TestByRefNumericConversion(t *testing.T) {
+	// A number of another type is passed by value, so the SUB sees it
+	// converted and the caller's variable is left alone
+	out, err := run(t, `k! = 1.5
+ShowI k!
+PRINT k!
+j% = 4
+ShowI j%
+PRINT j%
+SUB ShowI (n%)
+  PRINT n%
+  n% = n% * 2
+END SUB
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := " 2\n 1.5\n 4\n 8\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestByRefStringToNumber(t *testing.T) {
+	out, err := run(t, `s$ = "x"
+ShowI s$
+PRINT s$
+SUB ShowI (n%)
+  PRINT n%
+  n% = 0
+END SUB
+`)
+	var rerr *RuntimeError
+	if !errors.As(err, &rerr) || rerr.Code != ErrTypeMismatch {
+		t.Fatalf("got error %v, want parameter type mismatch", err)
+	}
+	if out != "" {
+		t.Errorf("SUB ran with a string for n%%: %q", out)
+	}
+}
+
+func TestFunctionWithoutArguments(t *testing.T) {
+	src := `PRINT NextId
+PRINT NextId
+PRINT NextId() + 10
+FUNCTION NextId
+  SHARED id
+  id = id + 1
+  NextId = id
+  NextId = NextId * 1
+END FUNCTION
+`
+	want := " 1\n 2\n 13\n"
+	for name, runner := range map[string]func(*testing.T, string) (string, error){"tree walker": run, "VM": runVM} {
+		out, err := runner(t, src)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if out != want {
+			t.Errorf("%s printed %q, want %q", name, out, want)
+		}
+	}
+
+	// A STATIC FUNCTION runs on the tree walker only
+	out, err := run(t, `PRINT NextId; NextId
+FUNCTION NextId STATIC
+  id = id + 1
+  NextId = id
+END FUNCTION
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := " 1 2\n"; out != want {
+		t.Errorf("STATIC FUNCTION printed %q, want %q", out, want)
+	}
+}
+
+func TestStaticArray(t *testing.T) {
+	// STATIC a() keeps the array that a later DIM or REDIM dimensions
+	out, err := run(t, `Fill 1
+Fill 2
+Grow 1
+Grow 2
+SUB Fill (n)
+  STATIC arr()
+  IF n = 1 THEN DIM arr(3)
+  arr(n) = n
+  PRINT arr(1); arr(2)
+END SUB
+SUB Grow (n)
+  STATIC arr() AS INTEGER
+  IF n = 1 THEN REDIM arr(3)
+  arr(n) = n * 10
+  PRINT arr(1); arr(2)
+END SUB
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := " 1 0\n 1 2\n 10 0\n 10 20\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestEndInBlock(t *testing.T) {
+	// END and END n inside a block IF or SELECT CASE end the program
+	// rather than the block
+	tests := []struct {
+		src  string
+		out  string
+		code int
+	}{
+		{"x = 1\nIF x THEN\n  PRINT 1\n  END 2\nEND IF\nPRINT 3\n", " 1\n", 2},
+		{"IF 0 THEN\n  PRINT 1\nELSE\n  END\nEND IF\nPRINT 3\n", "", 0},
+		{"SELECT CASE 2\nCASE 1\n  END 1\nCASE 2\n  PRINT 2\n  END 4\nEND SELECT\nPRINT 3\n", " 2\n", 4},
+		{"SELECT CASE 3\nCASE 1\n  PRINT 1\nCASE ELSE\n  END\nEND SELECT\nPRINT 3\n", "", 0},
+	}
+	engines := map[string]func(*Interpreter) error{
+		"tree walker": (*Interpreter).Run,
+		"VM": func(interp *Interpreter) error {
+			bc, err := interp.Compile()
+			if err != nil {
+				return err
+			}
+			return interp.RunBytecode(bc)
+		},
+	}
+	for _, tt := range tests {
+		for name, runProgram := range engines {
+			interp, out := newTestInterpreter(t, tt.src)
+			if err := runProgram(interp); err != nil {
+				t.Fatalf("%s: %q: %v", name, tt.src, err)
+			}
+			if out.String() != tt.out || interp.ExitCode() != tt.code {
+				t.Errorf("%s: %q printed %q and exited %d, want %q and %d",
+					name, tt.src, out.String(), interp.ExitCode(), tt.out, tt.code)
+			}
+		}
+	}
+}
+
+func TestFixedLengthString(t *testing.T) {
+	// A STRING * n variable or array element is padded with spaces or
+	// truncated to n characters, however it is assigned
+	out, err := run(t, `DIM s AS STRING * 3
+PRINT "["; s; "]"
+s = "hello"
+PRINT "["; s; "]"; LEN(s)
+s = "a"
+PRINT "["; s; "]"
+DIM a(2) AS STRING * 2
+a(1) = "xyz"
+PRINT "["; a(0); a(1); "]"
+Fill s
+PRINT "["; s; "]"
+SUB Fill (t$)
+  t$ = "abcdef"
+END SUB
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[   ]\n[hel] 3\n[a  ]\n[  xy]\n[abc]\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+// TestEnginesAgree runs the example programs on the tree walker and the VM
+// and compares what they print
+func TestEnginesAgree(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "examples", "*.bas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no example programs found")
+	}
+	// Run in an empty directory, as some examples write files
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			if filepath.Base(file) == "functions.bas" {
+				t.Skip("prints random numbers and the time")
+			}
+			src, err := os.ReadFile(filepath.Join(wd, file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := parser.New(lexer.New(string(src)))
+			if p.ParseProgram(); len(p.Errors()) > 0 {
+				t.Skip("not a valid program")
+			}
+			tree, treeErr := run(t, string(src))
+			vm, vmErr := runVM(t, string(src))
+			if tree != vm {
+				t.Errorf("the tree walker printed %q, the VM %q", tree, vm)
+			}
+			if (treeErr == nil) != (vmErr == nil) {
+				t.Errorf("the tree walker returned %v, the VM %v", treeErr, vmErr)
+			}
+		})
+	}
+}
+
+func TestUnsupportedByVM(t *testing.T) {
+	tests := []struct {
+		src  string
+		line int
+		what string
+	}{
+		{"X\nSUB X STATIC\nEND SUB\n", 2, "STATIC procedure X"},
+		{"10 FOR I = 1 TO 3\n20 IF I = 2 THEN GOTO 40\n30 PRINT I\n40 NEXT I\n", 2, "jump into a FOR loop at 40"},
+		{"GOTO 50\n", 1, "jump to undefined label 50"},
+	}
+	for _, tt := range tests {
+		interp, _ := newTestInterpreter(t, tt.src)
+		_, err := interp.Compile()
+		var unsupported *UnsupportedError
+		if !errors.As(err, &unsupported) || unsupported.Line != tt.line || unsupported.What != tt.what {
+			t.Errorf("%q: got %v, want line %d: %s", tt.src, err, tt.line, tt.what)
+		}
+	}
+}
+
+func TestWriteInputRoundTrip(t *testing.T) {
+	// INPUT # reads back exactly what WRITE # wrote: quoted commas,
+	// doubled quotes, empty strings and DOUBLEs that need 17 digits
+	path := filepath.Join(t.TempDir(), "data.txt")
+	out, err := run(t, `q$ = CHR$(34)
+a$ = "x, y"
+b$ = "say " + q$ + "hi" + q$
+c$ = ""
+d# = 0.1# + 0.2#
+e# = 1# / 3#
+f! = 1.1
+OPEN "`+path+`" FOR OUTPUT AS #1
+WRITE #1, a$, b$, c$, d#, e#, f!
+CLOSE #1
+OPEN "`+path+`" FOR INPUT AS #1
+INPUT #1, a2$, b2$, c2$, d2#, e2#, f2!
+CLOSE #1
+PRINT a2$ = a$; b2$ = b$; c2$ = c$; d2# = d#; e2# = e#; f2! = f!
+PRINT a2$; "|"; b2$; "|"; c2$; "|"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-1-1-1-1-1-1\nx, y|say \"hi\"||\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\"x, y\",\"say \"\"hi\"\"\",\"\",0.30000000000000004,0.3333333333333333,1.1\n"; string(data) != want {
+		t.Errorf("wrote %q, want %q", data, want)
+	}
+}
+
+func TestFieldRoundTrip(t *testing.T) {
+	// Records built with LSET and RSET in a FIELD buffer come back from the
+	// file unchanged
+	path := filepath.Join(t.TempDir(), "data.dat")
+	out, err := run(t, `OPEN "`+path+`" FOR RANDOM AS #1 LEN = 16
+FIELD #1, 6 AS nm$, 2 AS id$, 8 AS amt$
+LSET nm$ = "Bob"
+LSET id$ = MKI$(42)
+LSET amt$ = MKD$(12.5#)
+PUT #1, 1
+RSET nm$ = "Alexandra"
+LSET id$ = MKI$(-7)
+LSET amt$ = MKD$(0.1#)
+PUT #1, 2
+GET #1, 1
+PRINT "["; nm$; "]"; CVI(id$); CVD(amt$)
+GET #1, 2
+PRINT "["; nm$; "]"; CVI(id$); CVD(amt$)
+RSET nm$ = "Al"
+PRINT "["; nm$; "]"
+CLOSE #1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[Bob   ] 42 12.5\n[Alexan]-7 0.1\n[    Al]\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestArithmeticTypes(t *testing.T) {
+	// An empty out with a code is a program that fails with that error
+	tests := []struct {
+		src  string
+		out  string
+		code int
+	}{
+		{"PRINT 32767 + 1\n", "", ErrOverflow},
+		{"x% = 5\nPRINT x% * 10000\n", "", ErrOverflow},
+		{"x% = 32767\nx% = x% + 1\n", "", ErrOverflow},
+		// LONG arithmetic keeps digits a SINGLE would lose
+		{"PRINT 100000 * 3; 16777217 * 1\n", " 300000 16777217\n", 0},
+		{"PRINT 100000 * 30000\n", "", ErrOverflow},
+		{"PRINT -7 \\ 2; -7 MOD 3; 7 MOD -3; 7.6 \\ 2\n", "-3-1 1 4\n", 0},
+		{"FOR i% = 1 TO 3\n  s% = s% + i%\nNEXT i%\nPRINT s%; i%\n", " 6 4\n", 0},
+		{"FOR i% = 32760 TO 32767\nNEXT i%\n", "", ErrOverflow},
+	}
+	for _, tt := range tests {
+		for name, runner := range map[string]func(*testing.T, string) (string, error){"tree walker": run, "VM": runVM} {
+			out, err := runner(t, tt.src)
+			var rerr *RuntimeError
+			switch {
+			case tt.code == 0 && err != nil:
+				t.Errorf("%s: %q: %v", name, tt.src, err)
+			case tt.code != 0 && (!errors.As(err, &rerr) || rerr.Code != tt.code):
+				t.Errorf("%s: %q returned %v, want error %d", name, tt.src, err, tt.code)
+			case out != tt.out:
+				t.Errorf("%s: %q printed %q, want %q", name, tt.src, out, tt.out)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package interpreter
+
+import "fmt"
+
+// Opcode identifies a VM instruction
+type Opcode uint8
+
+// VM instructions. Array operands refer to a module array when A >= 0 and
+// to local array -(A+1) otherwise.
+const (
+	OpConst         Opcode = iota // push Consts[A]
+	OpPop                         // discard the top of the stack
+	OpLoadGlobal                  // push module variable A
+	OpStoreGlobal                 // pop into module variable A
+	OpLoadLocal                   // push local variable A, looking in callers' scopes if unset
+	OpStoreLocal                  // pop into local variable A
+	OpDefConst                    // pop into module variable A and make it constant
+	OpLoadElem                    // pop B subscripts, push the element of array A
+	OpStoreElem                   // pop B subscripts and a value, store it in array A
+	OpDim                         // pop B upper bounds, declare array A
+	OpBinary                      // pop two operands, push the result of binaryOperators[A]
+	OpUnary                       // pop an operand, push the result of unaryOperators[A]
+	OpJump                        // jump to A
+	OpJumpIfFalse                 // pop a value, jump to A if it is false
+	OpJumpIfTrue                  // pop a value, jump to A if it is true
+	OpForInit                     // pop a FOR limit or STEP value, push it converted to the counter's type A
+	OpForTest                     // pop step, end and counter, jump to A when the loop is done
+	OpForStep                     // pop step and counter, push counter + step
+	OpCaseIs                      // pop a value and the test value, push whether caseOperators[A] holds
+	OpCaseRange                   // pop end, start and the test value, push whether start <= test <= end
+	OpCall                        // call procedure A with B arguments
+	OpReturn                      // return from the current procedure
+	OpCallBuiltin                 // call the built-in function named Consts[A] with B arguments
+	OpCallHostSub                 // call the host SUB named Consts[A] with B arguments
+	OpGosub                       // push the return address and jump to A
+	OpReturnGosub                 // return to the address pushed by GOSUB
+	OpPrint                       // pop a value and append it to the PRINT line
+	OpPrintComma                  // advance the PRINT line to the next 14-column zone
+	OpPrintUsing                  // pop a format and a value and append the formatted value to the PRINT line
+	OpWrite                       // pop a value and append it to the PRINT line as WRITE does, after a comma if A is 1
+	OpPrintEnd                    // write the PRINT line, ending it with a newline if A is 1, to a popped file number if B is 1
+	OpRead                        // push the next DATA item
+	OpRestore                     // set the DATA pointer to A
+	OpRandomize                   // reseed the random number generator, from a popped value if A is 1
+	OpCls                         // clear the screen
+	OpOpen                        // pop [record length if B is 1,] file number and name, open it in mode Consts[A]
+	OpClose                       // pop B file numbers and close them, or close every file if B is 0
+	OpLineInput                   // read a line from the keyboard after prompt Consts[A] and push it
+	OpLineInputFile               // pop a file number, push the next line of the file
+	OpFileFunc                    // pop a file number, push EOF, LOF or LOC as named by Consts[A]
+	OpFreeFile                    // push the next free file number
+	OpSysFunc                     // pop B arguments, push the result of the system function named by Consts[A]
+	OpEnd                         // stop the program, with a popped exit code if A is 1
+)
+
+var opcodeNames = [...]string{
+	OpConst:         "CONST",
+	OpPop:           "POP",
+	OpLoadGlobal:    "LOADG",
+	OpStoreGlobal:   "STOREG",
+	OpLoadLocal:     "LOADL",
+	OpStoreLocal:    "STOREL",
+	OpDefConst:      "DEFCONST",
+	OpLoadElem:      "LOADELEM",
+	OpStoreElem:     "STOREELEM",
+	OpDim:           "DIM",
+	OpBinary:        "BINARY",
+	OpUnary:         "UNARY",
+	OpJump:          "JUMP",
+	OpJumpIfFalse:   "JUMPF",
+	OpJumpIfTrue:    "JUMPT",
+	OpForInit:       "FORINIT",
+	OpForTest:       "FORTEST",
+	OpForStep:       "FORSTEP",
+	OpCaseIs:        "CASEIS",
+	OpCaseRange:     "CASERANGE",
+	OpCall:          "CALL",
+	OpReturn:        "RET",
+	OpCallBuiltin:   "BUILTIN",
+	OpCallHostSub:   "HOSTSUB",
+	OpGosub:         "GOSUB",
+	OpReturnGosub:   "RETGOSUB",
+	OpPrint:         "PRINT",
+	OpPrintComma:    "PRINTCOMMA",
+	OpPrintUsing:    "PRINTUSING",
+	OpWrite:         "WRITE",
+	OpPrintEnd:      "PRINTEND",
+	OpRead:          "READ",
+	OpRestore:       "RESTORE",
+	OpRandomize:     "RANDOMIZE",
+	OpCls:           "CLS",
+	OpOpen:          "OPEN",
+	OpClose:         "CLOSE",
+	OpLineInput:     "LINEINPUT",
+	OpLineInputFile: "LINEINPUTF",
+	OpFileFunc:      "FILEFUNC",
+	OpFreeFile:      "FREEFILE",
+	OpSysFunc:       "SYSFUNC",
+	OpEnd:           "END",
+}
+
+func (op Opcode) String() string {
+	if int(op) < len(opcodeNames) {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("OP(%d)", op)
+}
+
+// Instr is a single VM instruction
+type Instr struct {
+	Op   Opcode
+	A, B int32
+}
+
+func (in Instr) String() string {
+	return fmt.Sprintf("%-10s %d %d", in.Op, in.A, in.B)
+}
+
+// Operator tables indexed by the A operand of OpBinary, OpUnary and OpCaseIs
+var (
+	binaryOperators = []string{"+", "-", "*", "/", "\\", "^", "MOD", "=", "<>", "<", ">", "<=", ">=", "AND", "OR", "XOR", "EQV", "IMP"}
+	unaryOperators  = []string{"-", "NOT"}
+	caseOperators   = []string{"=", "<>", "<", ">", "<=", ">="}
+)
+
+// operatorIndex returns the position of op in table, or -1
+func operatorIndex(table []string, op string) int {
+	for idx, s := range table {
+		if s == op {
+			return idx
+		}
+	}
+	return -1
+}
@@ -0,0 +1,257 @@
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// Shell runs the commands given to SHELL
+type Shell interface {
+	// Run runs command, or an interactive shell when command is empty, in
+	// directory dir with environment env. The command reads stdin and
+	// writes its standard output to stdout and its errors to stderr. Run
+	// returns the command's exit status.
+	Run(command, dir string, env []string, stdin io.Reader, stdout, stderr io.Writer) (int, error)
+}
+
+// OSShell is the Shell of the host operating system: sh -c on Unix and
+// cmd /C on Windows.
+type OSShell struct {
+	// Stdin, if set, is read by commands in place of the program's
+	// standard input. A host that reads a terminal through a buffer sets
+	// it to the terminal: a command given any other reader is only done
+	// once the reader is at its end.
+	Stdin *os.File
+}
+
+// Run runs a command in the host shell
+func (sh OSShell) Run(command, dir string, env []string, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	var cmd *exec.Cmd
+	switch {
+	case runtime.GOOS == "windows" && command == "":
+		cmd = exec.Command("cmd")
+	case runtime.GOOS == "windows":
+		cmd = exec.Command("cmd", "/C", command)
+	case command == "":
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "sh"
+		}
+		cmd = exec.Command(shell)
+	default:
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Dir, cmd.Env = dir, env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	if sh.Stdin != nil {
+		cmd.Stdin = sh.Stdin
+	}
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// printWriter writes a command's output where PRINT goes
+type printWriter struct {
+	i *Interpreter
+}
+
+func (pw printWriter) Write(p []byte) (int, error) {
+	pw.i.print(string(p))
+	return len(p), nil
+}
+
+// systemFunctions are the functions evaluated by systemFunction
+var systemFunctions = map[string]bool{
+	"DIR$": true, "_FILEEXISTS": true, "_DIREXISTS": true,
+	"COMMAND$": true, "_COMMANDCOUNT": true, "ENVIRON$": true, "SHELL": true, "SHELL$": true,
+}
+
+// systemFunction evaluates a function that reads the filesystem, the
+// command line or the environment, or runs a command. It is shared by the
+// tree walker and the VM.
+func (i *Interpreter) systemFunction(name string, args []Value) (Value, error) {
+	switch name {
+	case "DIR$", "_FILEEXISTS", "_DIREXISTS":
+		return i.dirFunction(name, args)
+	case "_COMMANDCOUNT":
+		if len(args) != 0 {
+			return nil, fmt.Errorf("%s takes no arguments", name)
+		}
+		return &IntegerValue{Val: int16(max(len(i.args)-1, 0))}, nil
+	case "COMMAND$":
+		if len(args) == 0 {
+			if len(i.args) < 2 {
+				return &StringValue{Val: ""}, nil
+			}
+			return &StringValue{Val: strings.Join(i.args[1:], " ")}, nil
+		}
+	}
+
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s requires 1 argument", name)
+	}
+	switch name {
+	case "COMMAND$":
+		n, err := i.argIndex(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if n >= len(i.args) {
+			return &StringValue{Val: ""}, nil
+		}
+		return &StringValue{Val: i.args[n]}, nil
+
+	case "ENVIRON$":
+		env := i.environ()
+		if args[0].Type() == ast.TypeString {
+			prefix := args[0].ToString() + "="
+			for _, kv := range env {
+				if strings.HasPrefix(kv, prefix) {
+					return &StringValue{Val: kv[len(prefix):]}, nil
+				}
+			}
+			return &StringValue{Val: ""}, nil
+		}
+		n, err := i.argIndex(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if n < 1 {
+			return nil, errorf(ErrIllegalFunctionCall, "illegal function call: ENVIRON$(%d)", n)
+		}
+		if n > len(env) {
+			return &StringValue{Val: ""}, nil
+		}
+		return &StringValue{Val: env[n-1]}, nil
+	}
+
+	if args[0].Type() != ast.TypeString {
+		return nil, errorf(ErrTypeMismatch, "type mismatch: %s needs a command", name)
+	}
+	if name == "SHELL$" {
+		var out strings.Builder
+		if _, err := i.runShell(args[0].ToString(), &out); err != nil {
+			return nil, err
+		}
+		return &StringValue{Val: strings.TrimRight(out.String(), "\r\n")}, nil
+	}
+	status, err := i.runShell(args[0].ToString(), printWriter{i})
+	if err != nil {
+		return nil, err
+	}
+	return &LongValue{Val: int32(status)}, nil
+}
+
+// argIndex converts a numeric argument to a non-negative index
+func (i *Interpreter) argIndex(v Value) (int, error) {
+	if v.Type() == ast.TypeString {
+		return 0, errorf(ErrTypeMismatch, "type mismatch")
+	}
+	n := int(v.ToInt())
+	if n < 0 {
+		return 0, errorf(ErrIllegalFunctionCall, "illegal function call")
+	}
+	return n, nil
+}
+
+// environ returns the environment of the program, which starts as a copy
+// of the process's own
+func (i *Interpreter) environ() []string {
+	if i.osEnv == nil {
+		i.osEnv = os.Environ()
+	}
+	return i.osEnv
+}
+
+// runShell runs a command in the directory set by CHDIR. It reads the
+// program's standard input, from where INPUT left off unless that is a file
+// read directly, and writes its errors where /dev/stderr goes.
+func (i *Interpreter) runShell(command string, stdout io.Writer) (int, error) {
+	if i.shell == nil {
+		return 0, errorf(ErrAdvancedFeature, "advanced feature unavailable: SHELL is not allowed")
+	}
+	var stdin io.Reader = i.stdinReader()
+	if f, ok := i.stdinRaw.(*os.File); ok {
+		stdin = f
+	}
+	status, err := i.shell.Run(command, i.dir, i.environ(), stdin, stdout, i.stderr)
+	if err != nil {
+		return 0, errorf(ErrIllegalFunctionCall, "cannot run %q: %v", command, err)
+	}
+	return status, nil
+}
+
+func (i *Interpreter) executeShellStatement(s *ast.ShellStmt) error {
+	command := ""
+	if s.Command != nil {
+		val, err := i.evaluate(s.Command)
+		if err != nil {
+			return err
+		}
+		if val.Type() != ast.TypeString {
+			return errorf(ErrTypeMismatch, "type mismatch: SHELL needs a command")
+		}
+		command = val.ToString()
+	}
+	_, err := i.runShell(command, printWriter{i})
+	return err
+}
+
+// executeEnvironStatement sets an environment variable from "name=value",
+// removing it when the value is empty
+func (i *Interpreter) executeEnvironStatement(s *ast.EnvironStmt) error {
+	val, err := i.evaluate(s.Setting)
+	if err != nil {
+		return err
+	}
+	if val.Type() != ast.TypeString {
+		return errorf(ErrTypeMismatch, "type mismatch: ENVIRON needs name=value")
+	}
+	setting := val.ToString()
+	eq := strings.IndexByte(setting, '=')
+	if eq < 1 {
+		return errorf(ErrIllegalFunctionCall, "illegal function call: ENVIRON %q", setting)
+	}
+
+	prefix := setting[:eq+1]
+	env := make([]string, 0, len(i.environ())+1)
+	for _, kv := range i.environ() {
+		if !strings.HasPrefix(kv, prefix) {
+			env = append(env, kv)
+		}
+	}
+	if eq < len(setting)-1 {
+		env = append(env, setting)
+	}
+	i.osEnv = env
+	return nil
+}
+
+// executeEndStatement ends the program, setting the exit code of END n or
+// SYSTEM n
+func (i *Interpreter) executeEndStatement(s *ast.EndStmt) error {
+	if s.Code != nil {
+		val, err := i.evaluate(s.Code)
+		if err != nil {
+			return err
+		}
+		if val.Type() == ast.TypeString {
+			return errorf(ErrTypeMismatch, "type mismatch: %s needs a number", s.TokenLiteral())
+		}
+		i.exitCode = int(val.ToInt())
+	}
+	i.state.Running = false
+	return &endSignal{}
+}
@@ -0,0 +1,312 @@
+package interpreter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// RecordType is the resolved layout of a user-defined TYPE
+type RecordType struct {
+	Name   string
+	Fields []RecordField
+	size   int
+}
+
+// RecordField is a field of a RecordType
+type RecordField struct {
+	Name     string // upper-cased, without type suffix
+	DataType ast.DataType
+	Record   *RecordType // nested type when DataType is TypeRecord
+	Length   int         // byte length of a fixed-length string
+	Offset   int         // byte offset within the record
+}
+
+// Size returns the length of the record in bytes, as used by LEN, GET and PUT
+func (rt *RecordType) Size() int {
+	return rt.size
+}
+
+// FieldIndex finds a field by name. A type suffix on name is ignored but
+// must agree with the field's type.
+func (rt *RecordType) FieldIndex(name string) (int, error) {
+	key := strings.ToUpper(name)
+	suffix := ast.DataTypeFromSuffix(key[len(key)-1:])
+	if suffix != ast.TypeUnknown {
+		key = key[:len(key)-1]
+	}
+
+	for idx, f := range rt.Fields {
+		if f.Name == key {
+			if suffix != ast.TypeUnknown && suffix != f.DataType {
+				return 0, errorf(ErrTypeMismatch, "type mismatch: %s.%s is %s", rt.Name, f.Name, f.DataType)
+			}
+			return idx, nil
+		}
+	}
+	return 0, fmt.Errorf("element not defined: %s has no field %s", rt.Name, name)
+}
+
+// RecordValue is an instance of a user-defined TYPE
+type RecordValue struct {
+	Def    *RecordType
+	Fields []Value
+}
+
+// NewRecord creates a record with every field set to its default value
+func NewRecord(rt *RecordType) *RecordValue {
+	rec := &RecordValue{Def: rt, Fields: make([]Value, len(rt.Fields))}
+	for idx, f := range rt.Fields {
+		switch {
+		case f.Record != nil:
+			rec.Fields[idx] = NewRecord(f.Record)
+		case f.Length > 0:
+			rec.Fields[idx] = &StringValue{Val: strings.Repeat(" ", f.Length)}
+		default:
+			rec.Fields[idx] = DefaultValue(f.DataType)
+		}
+	}
+	return rec
+}
+
+func (rv *RecordValue) Type() ast.DataType { return ast.TypeRecord }
+func (rv *RecordValue) String() string     { return rv.Def.Name }
+func (rv *RecordValue) ToFloat() float64   { return 0 }
+func (rv *RecordValue) ToInt() int64       { return 0 }
+func (rv *RecordValue) ToBool() bool       { return false }
+func (rv *RecordValue) ToString() string   { return rv.Def.Name }
+
+// Clone returns a deep copy of the record
+func (rv *RecordValue) Clone() Value {
+	fields := make([]Value, len(rv.Fields))
+	for idx, f := range rv.Fields {
+		fields[idx] = f.Clone()
+	}
+	return &RecordValue{Def: rv.Def, Fields: fields}
+}
+
+// SetField assigns a field, converting the value to the field's type and
+// padding or truncating fixed-length strings
+func (rv *RecordValue) SetField(idx int, val Value) error {
+	f := rv.Def.Fields[idx]
+
+	if f.Record != nil {
+		src, ok := val.(*RecordValue)
+		if !ok || src.Def != f.Record {
+			return errorf(ErrTypeMismatch, "type mismatch: %s.%s is %s", rv.Def.Name, f.Name, f.Record.Name)
+		}
+		rv.Fields[idx] = src.Clone()
+		return nil
+	}
+
+	if (val.Type() == ast.TypeString) != (f.DataType == ast.TypeString) || val.Type() == ast.TypeRecord {
+		return errorf(ErrTypeMismatch, "type mismatch: %s.%s is %s", rv.Def.Name, f.Name, f.DataType)
+	}
+
+	if f.Length > 0 {
+		rv.Fields[idx] = &StringValue{Val: fixedString(val.ToString(), f.Length)}
+		return nil
+	}
+	val, err := CoerceValue(val, f.DataType)
+	if err != nil {
+		return err
+	}
+	rv.Fields[idx] = val
+	return nil
+}
+
+// Bytes encodes the record using its fixed binary layout
+func (rv *RecordValue) Bytes() []byte {
+	buf := make([]byte, rv.Def.size)
+	rv.encode(buf)
+	return buf
+}
+
+func (rv *RecordValue) encode(buf []byte) {
+	for idx, f := range rv.Def.Fields {
+		b := buf[f.Offset:]
+		switch v := rv.Fields[idx].(type) {
+		case *RecordValue:
+			v.encode(b)
+		case *StringValue:
+			copy(b[:f.Length], fixedString(v.Val, f.Length))
+		case *IntegerValue:
+			binary.LittleEndian.PutUint16(b, uint16(v.Val))
+		case *LongValue:
+			binary.LittleEndian.PutUint32(b, uint32(v.Val))
+		case *SingleValue:
+			binary.LittleEndian.PutUint32(b, math.Float32bits(v.Val))
+		case *DoubleValue:
+			binary.LittleEndian.PutUint64(b, math.Float64bits(v.Val))
+		}
+	}
+}
+
+// Decode sets the record's fields from its fixed binary layout
+func (rv *RecordValue) Decode(buf []byte) {
+	for idx, f := range rv.Def.Fields {
+		b := buf[f.Offset:]
+		switch f.DataType {
+		case ast.TypeRecord:
+			rv.Fields[idx].(*RecordValue).Decode(b)
+		case ast.TypeString:
+			rv.Fields[idx] = &StringValue{Val: string(b[:f.Length])}
+		case ast.TypeInteger:
+			rv.Fields[idx] = &IntegerValue{Val: int16(binary.LittleEndian.Uint16(b))}
+		case ast.TypeLong:
+			rv.Fields[idx] = &LongValue{Val: int32(binary.LittleEndian.Uint32(b))}
+		case ast.TypeSingle:
+			rv.Fields[idx] = &SingleValue{Val: math.Float32frombits(binary.LittleEndian.Uint32(b))}
+		case ast.TypeDouble:
+			rv.Fields[idx] = &DoubleValue{Val: math.Float64frombits(binary.LittleEndian.Uint64(b))}
+		}
+	}
+}
+
+// fixedString pads s with spaces or truncates it to n bytes
+func fixedString(s string, n int) string {
+	if len(s) >= n {
+		return s[:n]
+	}
+	return s + strings.Repeat(" ", n-len(s))
+}
+
+// fieldSize returns the number of bytes a scalar field occupies
+func fieldSize(dt ast.DataType) int {
+	switch dt {
+	case ast.TypeInteger:
+		return 2
+	case ast.TypeLong, ast.TypeSingle:
+		return 4
+	case ast.TypeDouble:
+		return 8
+	}
+	return 0
+}
+
+// recordType resolves a user-defined TYPE by name, computing its layout on
+// first use. String lengths may refer to CONSTs defined before the first use.
+func (i *Interpreter) recordType(name string) (*RecordType, error) {
+	key := strings.ToUpper(name)
+	if rt, ok := i.types[key]; ok {
+		if rt == nil {
+			return nil, fmt.Errorf("TYPE %s contains itself", name)
+		}
+		return rt, nil
+	}
+
+	def, ok := i.program.Types[key]
+	if !ok {
+		return nil, fmt.Errorf("TYPE not defined: %s", name)
+	}
+
+	i.types[key] = nil // mark in progress to detect recursive types
+	rt := &RecordType{Name: def.Name}
+	for _, fd := range def.Fields {
+		f := RecordField{
+			Name:     strings.TrimRight(strings.ToUpper(fd.Name), "%&!#$"),
+			DataType: fd.DataType,
+			Offset:   rt.size,
+		}
+
+		switch fd.DataType {
+		case ast.TypeRecord:
+			nested, err := i.recordType(fd.TypeName)
+			if err != nil {
+				delete(i.types, key)
+				return nil, err
+			}
+			f.Record = nested
+			rt.size += nested.size
+		case ast.TypeString:
+			n, err := i.evaluate(fd.StringLength)
+			if err != nil {
+				delete(i.types, key)
+				return nil, err
+			}
+			f.Length = int(n.ToInt())
+			if f.Length < 1 || f.Length > 32767 {
+				delete(i.types, key)
+				return nil, fmt.Errorf("illegal string length %d for %s.%s", f.Length, def.Name, fd.Name)
+			}
+			rt.size += f.Length
+		default:
+			rt.size += fieldSize(fd.DataType)
+		}
+
+		rt.Fields = append(rt.Fields, f)
+	}
+
+	i.types[key] = rt
+	return rt, nil
+}
+
+// resolveField evaluates the record part of a field reference and returns
+// the record together with the index of the field
+func (i *Interpreter) resolveField(fa *ast.FieldAccess) (*RecordValue, int, error) {
+	val, err := i.evaluate(fa.Record)
+	if err != nil {
+		return nil, 0, err
+	}
+	rec, ok := val.(*RecordValue)
+	if !ok {
+		return nil, 0, errorf(ErrTypeMismatch, "type mismatch: %s is not a record", fa.Record)
+	}
+	idx, err := rec.Def.FieldIndex(fa.Field)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rec, idx, nil
+}
+
+// evaluateFieldAccess returns the value of a record field
+func (i *Interpreter) evaluateFieldAccess(fa *ast.FieldAccess) (Value, error) {
+	rec, idx, err := i.resolveField(fa)
+	if err != nil {
+		return nil, err
+	}
+	return rec.Fields[idx], nil
+}
+
+// declareRecord creates a record variable or an array of records in env
+func (i *Interpreter) declareRecord(env *Environment, v ast.DimVariable, dims []int) error {
+	rt, err := i.recordType(v.TypeName)
+	if err != nil {
+		return err
+	}
+	if dims == nil {
+		env.Declare(v.Name, NewRecord(rt))
+		return nil
+	}
+	arr := env.DeclareArray(v.Name, ast.TypeRecord, dims)
+	arr.Record = rt
+	for idx := range arr.Data {
+		arr.Data[idx] = NewRecord(rt)
+	}
+	return nil
+}
+
+// declareFixedString creates a STRING * n variable or array in env
+func (i *Interpreter) declareFixedString(env *Environment, v ast.DimVariable, dims []int) (*Array, error) {
+	val, err := i.evaluate(v.StringLength)
+	if err != nil {
+		return nil, err
+	}
+	n := int(val.ToInt())
+	if n < 1 || n > 32767 {
+		return nil, fmt.Errorf("illegal string length %d for %s", n, v.Name)
+	}
+	if dims == nil {
+		env.declareFixed(v.Name, n)
+		return nil, nil
+	}
+	arr := env.DeclareArray(v.Name, ast.TypeString, dims)
+	arr.Length = n
+	for idx := range arr.Data {
+		arr.Data[idx] = &StringValue{Val: strings.Repeat(" ", n)}
+	}
+	return arr, nil
+}
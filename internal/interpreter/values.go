@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/builtins"
 )
 
 // Value represents a runtime value
@@ -52,12 +53,12 @@ type SingleValue struct {
 }
 
 func (sv *SingleValue) Type() ast.DataType { return ast.TypeSingle }
-func (sv *SingleValue) String() string     { return formatFloat(float64(sv.Val)) }
+func (sv *SingleValue) String() string     { return builtins.FormatFloat(float64(sv.Val), 7) }
 func (sv *SingleValue) Clone() Value       { return &SingleValue{Val: sv.Val} }
 func (sv *SingleValue) ToFloat() float64   { return float64(sv.Val) }
 func (sv *SingleValue) ToInt() int64       { return int64(sv.Val) }
 func (sv *SingleValue) ToBool() bool       { return sv.Val != 0 }
-func (sv *SingleValue) ToString() string   { return formatFloat(float64(sv.Val)) }
+func (sv *SingleValue) ToString() string   { return builtins.FormatFloat(float64(sv.Val), 7) }
 
 // DoubleValue represents a 64-bit float (DOUBLE / #)
 type DoubleValue struct {
@@ -65,12 +66,12 @@ type DoubleValue struct {
 }
 
 func (dv *DoubleValue) Type() ast.DataType { return ast.TypeDouble }
-func (dv *DoubleValue) String() string     { return formatFloat(dv.Val) }
+func (dv *DoubleValue) String() string     { return builtins.FormatFloat(dv.Val, 16) }
 func (dv *DoubleValue) Clone() Value       { return &DoubleValue{Val: dv.Val} }
 func (dv *DoubleValue) ToFloat() float64   { return dv.Val }
 func (dv *DoubleValue) ToInt() int64       { return int64(dv.Val) }
 func (dv *DoubleValue) ToBool() bool       { return dv.Val != 0 }
-func (dv *DoubleValue) ToString() string   { return formatFloat(dv.Val) }
+func (dv *DoubleValue) ToString() string   { return builtins.FormatFloat(dv.Val, 16) }
 
 // StringValue represents a string (STRING / $)
 type StringValue struct {
@@ -96,6 +97,8 @@ type Array struct {
 	DataType   ast.DataType
 	Dimensions []ArrayDimension
 	Data       []Value
+	Record     *RecordType // element type of an array of records
+	Length     int         // length of the elements of a STRING * n array
 }
 
 // ArrayDimension represents array bounds
@@ -129,7 +132,7 @@ func NewArray(dt ast.DataType, dims []ArrayDimension) *Array {
 // GetIndex calculates the linear index from subscripts
 func (a *Array) GetIndex(subscripts []int) (int, error) {
 	if len(subscripts) != len(a.Dimensions) {
-		return 0, fmt.Errorf("wrong number of dimensions: expected %d, got %d",
+		return 0, errorf(ErrSubscriptOutOfRange, "wrong number of dimensions: expected %d, got %d",
 			len(a.Dimensions), len(subscripts))
 	}
 
@@ -141,7 +144,7 @@ func (a *Array) GetIndex(subscripts []int) (int, error) {
 		dim := a.Dimensions[i]
 
 		if sub < dim.Lower || sub > dim.Upper {
-			return 0, fmt.Errorf("subscript out of range: %d not in [%d, %d]",
+			return 0, errorf(ErrSubscriptOutOfRange, "subscript out of range: %d not in [%d, %d]",
 				sub, dim.Lower, dim.Upper)
 		}
 
@@ -167,6 +170,14 @@ func (a *Array) Set(subscripts []int, value Value) error {
 	if err != nil {
 		return err
 	}
+	if a.Record == nil {
+		if value, err = CoerceValue(value, a.DataType); err != nil {
+			return err
+		}
+	}
+	if a.Length > 0 {
+		value = &StringValue{Val: fixedString(value.ToString(), a.Length)}
+	}
 	a.Data[index] = value
 	return nil
 }
@@ -191,6 +202,19 @@ func DefaultValue(dt ast.DataType) Value {
 	}
 }
 
+// literalValue returns the value of a numeric literal of type dt
+func literalValue(dt ast.DataType, f float64) Value {
+	switch dt {
+	case ast.TypeInteger:
+		return &IntegerValue{Val: int16(f)}
+	case ast.TypeLong:
+		return &LongValue{Val: int32(f)}
+	case ast.TypeSingle:
+		return &SingleValue{Val: float32(f)}
+	}
+	return &DoubleValue{Val: f}
+}
+
 // NewValue creates a new value of the given type from a Go value
 func NewValue(dt ast.DataType, val interface{}) Value {
 	switch dt {
@@ -238,26 +262,43 @@ func NewValue(dt ast.DataType, val interface{}) Value {
 	return DefaultValue(dt)
 }
 
-// CoerceValue converts a value to the target type
-func CoerceValue(val Value, targetType ast.DataType) Value {
-	if val.Type() == targetType {
-		return val
+// CoerceValue converts a value to the target type, as when it is assigned
+// to a variable of that type. INTEGER and LONG round to the nearest whole
+// number, halves to even, and a value out of range of the target type is
+// an Overflow. Numbers and strings do not convert to each other.
+func CoerceValue(val Value, targetType ast.DataType) (Value, error) {
+	vt := val.Type()
+	if vt == targetType || vt == ast.TypeRecord || targetType == ast.TypeUnknown || targetType == ast.TypeRecord {
+		return val, nil
+	}
+	if (vt == ast.TypeString) != (targetType == ast.TypeString) {
+		return nil, errorf(ErrTypeMismatch, "type mismatch: cannot assign %s to %s", vt, targetType)
 	}
 
+	f := val.ToFloat()
 	switch targetType {
 	case ast.TypeInteger:
-		return &IntegerValue{Val: int16(val.ToInt())}
+		f = math.RoundToEven(f)
+		if f < math.MinInt16 || f > math.MaxInt16 {
+			return nil, errorf(ErrOverflow, "overflow")
+		}
+		return &IntegerValue{Val: int16(f)}, nil
 	case ast.TypeLong:
-		return &LongValue{Val: int32(val.ToInt())}
+		f = math.RoundToEven(f)
+		if f < math.MinInt32 || f > math.MaxInt32 {
+			return nil, errorf(ErrOverflow, "overflow")
+		}
+		return &LongValue{Val: int32(f)}, nil
 	case ast.TypeSingle:
-		return &SingleValue{Val: float32(val.ToFloat())}
+		if math.Abs(f) > math.MaxFloat32 {
+			return nil, errorf(ErrOverflow, "overflow")
+		}
+		return &SingleValue{Val: float32(f)}, nil
 	case ast.TypeDouble:
-		return &DoubleValue{Val: val.ToFloat()}
-	case ast.TypeString:
-		return &StringValue{Val: val.ToString()}
+		return &DoubleValue{Val: f}, nil
 	}
 
-	return val
+	return val, nil
 }
 
 // PromoteType returns the wider of two numeric types
@@ -267,27 +308,19 @@ func PromoteType(t1, t2 ast.DataType) ast.DataType {
 		return ast.TypeString
 	}
 
-	// Promotion order: INTEGER < LONG < SINGLE < DOUBLE
-	order := map[ast.DataType]int{
-		ast.TypeInteger: 1,
-		ast.TypeLong:    2,
-		ast.TypeSingle:  3,
-		ast.TypeDouble:  4,
-	}
-
-	if order[t1] > order[t2] {
+	// Promotion order: INTEGER < LONG < SINGLE < DOUBLE, which is the
+	// order the types are declared in
+	if numericRank(t1) > numericRank(t2) {
 		return t1
 	}
 	return t2
 }
 
-// formatFloat formats a float for QBasic-style output
-func formatFloat(f float64) string {
-	if f == float64(int64(f)) && math.Abs(f) < 1e15 {
-		return fmt.Sprintf("%d", int64(f))
+func numericRank(t ast.DataType) int {
+	if t >= ast.TypeInteger && t <= ast.TypeDouble {
+		return int(t)
 	}
-	s := strconv.FormatFloat(f, 'G', -1, 64)
-	return s
+	return 0
 }
 
 // IsNumeric returns true if the value is a numeric type
@@ -0,0 +1,513 @@
+package interpreter
+
+import (
+	"io"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/builtins"
+)
+
+// frame holds the variables of the module or of a running procedure
+type frame struct {
+	proc   *procedure // nil for the module
+	scope  *scope
+	vars   []Value
+	arrays []*Array
+	ret    int // return address
+
+	line strings.Builder // PRINT line being built
+	col  int
+}
+
+func newFrame(proc *procedure, sc *scope) *frame {
+	return &frame{
+		proc:   proc,
+		scope:  sc,
+		vars:   make([]Value, len(sc.vars)),
+		arrays: make([]*Array, len(sc.arrays)),
+	}
+}
+
+type vm struct {
+	i      *Interpreter
+	bc     *Bytecode
+	pc     int
+	stack  []Value
+	frames []*frame
+	gosubs []int
+	consts []bool // module variables defined by CONST
+}
+
+// RunBytecode runs a program compiled by Compile. Variables set with
+// SetVariable are visible to the program, and module-level variables are
+// copied back to the interpreter when it stops.
+func (i *Interpreter) RunBytecode(bc *Bytecode) error {
+	i.begin()
+
+	m := &vm{
+		i:      i,
+		bc:     bc,
+		frames: []*frame{newFrame(nil, bc.module)},
+		consts: make([]bool, len(bc.module.vars)),
+	}
+	module := m.frames[0]
+	for slot, name := range bc.module.vars {
+		if val, ok := i.env.Get(name); ok && name != "" {
+			module.vars[slot] = val
+		}
+	}
+	for slot, name := range bc.module.arrays {
+		if arr, ok := i.env.GetArray(name); ok {
+			module.arrays[slot] = arr
+		}
+	}
+
+	err := m.run()
+
+	for slot, name := range bc.module.vars {
+		switch {
+		case name == "" || module.vars[slot] == nil:
+		case m.consts[slot]:
+			i.env.DefineConst(name, module.vars[slot])
+		default:
+			i.env.Set(name, module.vars[slot])
+		}
+	}
+	for slot, name := range bc.module.arrays {
+		if module.arrays[slot] != nil {
+			i.env.SetArray(name, module.arrays[slot])
+		}
+	}
+	return err
+}
+
+func (m *vm) push(v Value) {
+	m.stack = append(m.stack, v)
+}
+
+func (m *vm) pop() Value {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
+}
+
+// popN removes the top n values, returning them in the order pushed
+func (m *vm) popN(n int) []Value {
+	vals := make([]Value, n)
+	copy(vals, m.stack[len(m.stack)-n:])
+	m.stack = m.stack[:len(m.stack)-n]
+	return vals
+}
+
+// popSubscripts removes n subscripts from the stack
+func (m *vm) popSubscripts(n int) []int {
+	subscripts := make([]int, n)
+	for idx, v := range m.popN(n) {
+		subscripts[idx] = int(v.ToInt())
+	}
+	return subscripts
+}
+
+func (m *vm) top() *frame {
+	return m.frames[len(m.frames)-1]
+}
+
+// loadLocal reads a procedure variable, creating it with its default
+// value if the procedure has not set it
+func (m *vm) loadLocal(slot int) Value {
+	f := m.top()
+	if v := f.vars[slot]; v != nil {
+		return v
+	}
+	v := DefaultValue(f.scope.varTypes[slot])
+	f.vars[slot] = v
+	return v
+}
+
+func (m *vm) loadGlobal(slot int) Value {
+	module := m.frames[0]
+	if v := module.vars[slot]; v != nil {
+		return v
+	}
+	v := DefaultValue(module.scope.varTypes[slot])
+	module.vars[slot] = v
+	return v
+}
+
+// array resolves an array operand
+func (m *vm) array(ref int) (*Array, error) {
+	f, slot := m.frames[0], ref
+	if ref < 0 {
+		f, slot = m.top(), -(ref + 1)
+	}
+	if arr := f.arrays[slot]; arr != nil {
+		return arr, nil
+	}
+	return nil, errorf(ErrSubscriptOutOfRange, "array %s not defined", f.scope.arrays[slot])
+}
+
+func (m *vm) setArray(ref int, arr *Array) {
+	if ref < 0 {
+		m.top().arrays[-(ref + 1)] = arr
+		return
+	}
+	m.frames[0].arrays[ref] = arr
+}
+
+func (m *vm) run() error {
+	i := m.i
+	code := m.bc.Code
+
+	for i.state.Running {
+		in := code[m.pc]
+		m.pc++
+
+		switch in.Op {
+		case OpConst:
+			m.push(m.bc.Consts[in.A])
+
+		case OpPop:
+			m.pop()
+
+		case OpLoadGlobal:
+			m.push(m.loadGlobal(int(in.A)))
+
+		case OpStoreGlobal:
+			v, err := CoerceValue(m.pop(), m.bc.module.varTypes[in.A])
+			if err != nil {
+				return err
+			}
+			if !m.consts[in.A] {
+				m.frames[0].vars[in.A] = v
+			}
+
+		case OpLoadLocal:
+			m.push(m.loadLocal(int(in.A)))
+
+		case OpStoreLocal:
+			f := m.top()
+			v, err := CoerceValue(m.pop(), f.scope.varTypes[in.A])
+			if err != nil {
+				return err
+			}
+			f.vars[in.A] = v
+
+		case OpDefConst:
+			v := m.pop()
+			if m.consts[in.A] {
+				return errorf(ErrDuplicateDefinition, "constant %s already defined", m.bc.module.vars[in.A])
+			}
+			m.frames[0].vars[in.A] = v
+			m.consts[in.A] = true
+
+		case OpLoadElem:
+			subscripts := m.popSubscripts(int(in.B))
+			arr, err := m.array(int(in.A))
+			if err != nil {
+				return err
+			}
+			v, err := arr.Get(subscripts)
+			if err != nil {
+				return err
+			}
+			m.push(v)
+
+		case OpStoreElem:
+			subscripts := m.popSubscripts(int(in.B))
+			v := m.pop()
+			arr, err := m.array(int(in.A))
+			if err != nil {
+				return err
+			}
+			if err := arr.Set(subscripts, v); err != nil {
+				return err
+			}
+
+		case OpDim:
+			dims := m.popSubscripts(int(in.B))
+			elem := m.pop()
+			m.setArray(int(in.A), NewArray(elem.Type(), upperBounds(dims)))
+
+		case OpBinary:
+			right := m.pop()
+			left := m.pop()
+			v, err := binaryOp(binaryOperators[in.A], left, right)
+			if err != nil {
+				return err
+			}
+			m.push(v)
+
+		case OpUnary:
+			v, err := unaryOp(unaryOperators[in.A], m.pop())
+			if err != nil {
+				return err
+			}
+			m.push(v)
+
+		case OpJump:
+			if err := i.checkContext(); err != nil {
+				return err
+			}
+			m.pc = int(in.A)
+
+		case OpJumpIfFalse:
+			if !m.pop().ToBool() {
+				m.pc = int(in.A)
+			}
+
+		case OpJumpIfTrue:
+			if m.pop().ToBool() {
+				m.pc = int(in.A)
+			}
+
+		case OpForInit:
+			v, err := CoerceValue(m.pop(), ast.DataType(in.A))
+			if err != nil {
+				return err
+			}
+			m.push(v)
+
+		case OpForTest:
+			step := m.pop().ToFloat()
+			end := m.pop().ToFloat()
+			curr := m.pop().ToFloat()
+			if (step >= 0 && curr > end) || (step < 0 && curr < end) {
+				m.pc = int(in.A)
+			}
+
+		case OpForStep:
+			step := m.pop()
+			v, err := binaryOp("+", m.pop(), step)
+			if err != nil {
+				return err
+			}
+			m.push(v)
+
+		case OpCaseIs:
+			v := m.pop()
+			cmp := Compare(m.pop(), v)
+			var matched bool
+			switch caseOperators[in.A] {
+			case "=":
+				matched = cmp == 0
+			case "<>":
+				matched = cmp != 0
+			case "<":
+				matched = cmp < 0
+			case ">":
+				matched = cmp > 0
+			case "<=":
+				matched = cmp <= 0
+			case ">=":
+				matched = cmp >= 0
+			}
+			m.push(boolToValue(matched))
+
+		case OpCaseRange:
+			end := m.pop()
+			start := m.pop()
+			test := m.pop()
+			m.push(boolToValue(Compare(test, start) >= 0 && Compare(test, end) <= 0))
+
+		case OpCall:
+			if err := i.checkContext(); err != nil {
+				return err
+			}
+			proc := m.bc.procs[in.A]
+			args := m.popN(int(in.B))
+			f := newFrame(proc, proc.scope)
+			for idx, slot := range proc.params {
+				if idx < len(args) {
+					v, err := CoerceValue(args[idx], proc.scope.varTypes[slot])
+					if err != nil {
+						return err
+					}
+					f.vars[slot] = v
+				} else {
+					f.vars[slot] = DefaultValue(proc.paramTypes[idx])
+				}
+			}
+			if proc.isFunc {
+				f.vars[proc.result] = DefaultValue(proc.resultType)
+			}
+			f.ret = m.pc
+			m.frames = append(m.frames, f)
+			m.pc = proc.entry
+
+		case OpReturn:
+			f := m.top()
+			m.frames = m.frames[:len(m.frames)-1]
+			if f.proc.isFunc {
+				v := f.vars[f.proc.result]
+				if v == nil {
+					v = DefaultValue(f.proc.resultType)
+				}
+				m.push(v)
+			}
+			m.pc = f.ret
+
+		case OpCallBuiltin:
+			name := m.bc.Consts[in.A].ToString()
+			var args []builtins.Value
+			if in.B > 0 {
+				args = make([]builtins.Value, in.B)
+				for idx, v := range m.popN(int(in.B)) {
+					args[idx] = valueToBuiltin(v)
+				}
+			}
+			result, err := i.builtins.Call(name, args)
+			if err != nil {
+				return err
+			}
+			m.push(builtinToValue(result))
+
+		case OpCallHostSub:
+			name := m.bc.Consts[in.A].ToString()
+			args := make([]builtins.Value, in.B)
+			for idx, v := range m.popN(int(in.B)) {
+				args[idx] = valueToBuiltin(v)
+			}
+			if err := i.builtins.CallSub(name, args); err != nil {
+				return err
+			}
+
+		case OpGosub:
+			m.gosubs = append(m.gosubs, m.pc)
+			m.pc = int(in.A)
+
+		case OpReturnGosub:
+			if len(m.gosubs) == 0 {
+				return errorf(ErrReturnWithoutGosub, "RETURN without GOSUB")
+			}
+			m.pc = m.gosubs[len(m.gosubs)-1]
+			m.gosubs = m.gosubs[:len(m.gosubs)-1]
+
+		case OpPrint:
+			f := m.top()
+			s := i.formatValue(m.pop())
+			f.line.WriteString(s)
+			f.col += len(s)
+
+		case OpPrintComma:
+			f := m.top()
+			spaces := 14 - (f.col % 14)
+			f.line.WriteString(strings.Repeat(" ", spaces))
+			f.col += spaces
+
+		case OpPrintUsing:
+			format := m.pop().ToString()
+			m.top().line.WriteString(i.formatWithTemplate(format, m.pop()))
+
+		case OpWrite:
+			f := m.top()
+			if in.A == 1 {
+				f.line.WriteString(",")
+			}
+			f.line.WriteString(writeValue(m.pop()))
+
+		case OpPrintEnd:
+			f := m.top()
+			if in.A == 1 {
+				f.line.WriteString("\n")
+			}
+			out := f.line.String()
+			f.line.Reset()
+			f.col = 0
+			if in.B == 0 {
+				i.print(out)
+				break
+			}
+			fh, err := i.outputFile(int(m.pop().ToInt()))
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(fh.File, out); err != nil {
+				return err
+			}
+
+		case OpCls:
+			if i.screen != nil {
+				i.screen.Clear()
+			}
+
+		case OpOpen:
+			recLen := 128
+			if in.B == 1 {
+				recLen = int(m.pop().ToInt())
+			}
+			fileNum := int(m.pop().ToInt())
+			name := m.pop().ToString()
+			if err := i.openFile(name, fileNum, m.bc.Consts[in.A].ToString(), recLen); err != nil {
+				return err
+			}
+
+		case OpClose:
+			if in.B == 0 {
+				i.closeAllFiles()
+				break
+			}
+			for _, v := range m.popN(int(in.B)) {
+				if err := i.closeFile(int(v.ToInt())); err != nil {
+					return err
+				}
+			}
+
+		case OpLineInput:
+			m.push(&StringValue{Val: i.getInput(m.bc.Consts[in.A].ToString())})
+
+		case OpLineInputFile:
+			line, err := i.readFileLine(int(m.pop().ToInt()))
+			if err != nil {
+				return err
+			}
+			m.push(&StringValue{Val: line})
+
+		case OpFileFunc:
+			v, err := i.fileFunction(m.bc.Consts[in.A].ToString(), int(m.pop().ToInt()))
+			if err != nil {
+				return err
+			}
+			m.push(v)
+
+		case OpFreeFile:
+			m.push(&IntegerValue{Val: int16(i.GetNextFreeFile())})
+
+		case OpSysFunc:
+			v, err := i.systemFunction(m.bc.Consts[in.A].ToString(), m.popN(int(in.B)))
+			if err != nil {
+				return err
+			}
+			m.push(v)
+
+		case OpRead:
+			if i.state.DataPointer >= len(m.bc.Data) {
+				return errorf(ErrOutOfData, "out of DATA")
+			}
+			m.push(m.bc.Data[i.state.DataPointer])
+			i.state.DataPointer++
+
+		case OpRestore:
+			i.state.DataPointer = int(in.A)
+
+		case OpRandomize:
+			if in.A == 1 {
+				i.builtins.SetRandomSeed(m.pop().ToInt())
+			} else {
+				i.builtins.RandomizeSeed()
+			}
+
+		case OpEnd:
+			if in.A == 1 {
+				v := m.pop()
+				if v.Type() == ast.TypeString {
+					return errorf(ErrTypeMismatch, "type mismatch: END needs a number")
+				}
+				i.exitCode = int(v.ToInt())
+			}
+			i.state.Running = false
+		}
+	}
+
+	return nil
+}
@@ -14,6 +14,7 @@ type Lexer struct {
 	line         int  // current line number
 	column       int  // current column number
 	lineStart    bool // true if at start of line (for line numbers)
+	dialect      Dialect
 }
 
 // New creates a new Lexer
@@ -38,7 +39,7 @@ func New(input string) *Lexer {
 		if l.ch == '\n' {
 			l.readChar()
 		}
-		l.line = 1
+		l.line = 2
 		l.column = 1
 		l.lineStart = true
 	}
@@ -46,6 +47,17 @@ func New(input string) *Lexer {
 	return l
 }
 
+// SetDialect sets the BASIC dialect of the source. It must be called
+// before the first token is read.
+func (l *Lexer) SetDialect(d Dialect) {
+	l.dialect = d
+}
+
+// Dialect returns the BASIC dialect of the source
+func (l *Lexer) Dialect() Dialect {
+	return l.dialect
+}
+
 func (l *Lexer) readChar() {
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
@@ -116,6 +128,11 @@ func (l *Lexer) NextToken() Token {
 		tok = l.newToken(TOKEN_AMPERSAND, string(l.ch))
 	case '!':
 		tok = l.newToken(TOKEN_BANG, string(l.ch))
+	case '.':
+		if isDigit(l.peekChar()) {
+			return l.readNumber()
+		}
+		tok = l.newToken(TOKEN_DOT, string(l.ch))
 	case '?':
 		// ? is shorthand for PRINT
 		tok = l.newToken(TOKEN_PRINT, "?")
@@ -123,11 +140,11 @@ func (l *Lexer) NextToken() Token {
 		if l.peekChar() == '=' {
 			ch := l.ch
 			l.readChar()
-			tok = l.newToken(TOKEN_LE, string(ch)+string(l.ch))
+			tok = Token{Type: TOKEN_LE, Literal: string(ch) + string(l.ch), Line: l.line, Column: tok.Column}
 		} else if l.peekChar() == '>' {
 			ch := l.ch
 			l.readChar()
-			tok = l.newToken(TOKEN_NE, string(ch)+string(l.ch))
+			tok = Token{Type: TOKEN_NE, Literal: string(ch) + string(l.ch), Line: l.line, Column: tok.Column}
 		} else {
 			tok = l.newToken(TOKEN_LT, string(l.ch))
 		}
@@ -135,11 +152,11 @@ func (l *Lexer) NextToken() Token {
 		if l.peekChar() == '=' {
 			ch := l.ch
 			l.readChar()
-			tok = l.newToken(TOKEN_GE, string(ch)+string(l.ch))
+			tok = Token{Type: TOKEN_GE, Literal: string(ch) + string(l.ch), Line: l.line, Column: tok.Column}
 		} else if l.peekChar() == '<' {
 			ch := l.ch
 			l.readChar()
-			tok = l.newToken(TOKEN_NE, string(ch)+string(l.ch))
+			tok = Token{Type: TOKEN_NE, Literal: string(ch) + string(l.ch), Line: l.line, Column: tok.Column}
 		} else {
 			tok = l.newToken(TOKEN_GT, string(l.ch))
 		}
@@ -151,6 +168,7 @@ func (l *Lexer) NextToken() Token {
 	case '\'':
 		// Comment - skip to end of line
 		tok.Type = TOKEN_REM
+		l.readChar()
 		tok.Literal = l.readComment()
 		tok.Line = l.line
 		return tok
@@ -179,7 +197,8 @@ func (l *Lexer) NextToken() Token {
 	default:
 		if isDigit(l.ch) {
 			return l.readNumber()
-		} else if isLetter(l.ch) {
+		} else if isLetter(l.ch) || l.ch == '_' && isLetter(l.peekChar()) {
+			// A leading underscore marks QB64 names such as _FILEEXISTS
 			return l.readIdentifier()
 		} else {
 			tok = l.newToken(TOKEN_ILLEGAL, string(l.ch))
@@ -217,9 +236,9 @@ func (l *Lexer) readString() string {
 	return result.String()
 }
 
+// readComment reads the rest of the line
 func (l *Lexer) readComment() string {
 	var result strings.Builder
-	l.readChar() // skip the '
 
 	for l.ch != '\n' && l.ch != '\r' && l.ch != 0 {
 		result.WriteByte(l.ch)
@@ -337,14 +356,17 @@ func (l *Lexer) readIdentifier() Token {
 
 	// Check if it's a keyword (without type suffix)
 	if typeSuffix == "" {
-		if keywordType := LookupIdent(lookupName); keywordType != TOKEN_IDENT {
+		keywordType := LookupIdent(lookupName)
+		if l.dialect == GWBASIC && qbasicKeywords[keywordType] {
+			keywordType = TOKEN_IDENT
+		}
+		if keywordType != TOKEN_IDENT {
 			tok.Type = keywordType
 
 			// Handle REM specially - read rest of line as comment
 			if keywordType == TOKEN_REM {
 				l.skipWhitespace()
-				comment := l.readComment()
-				tok.Literal = literal + " " + comment
+				tok.Literal = l.readComment()
 			}
 		} else {
 			tok.Type = TOKEN_IDENT
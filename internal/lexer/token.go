@@ -1,6 +1,9 @@
 package lexer
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // TokenType represents the type of a token
 type TokenType int
@@ -42,6 +45,8 @@ const (
 	TOKEN_RETURN
 	TOKEN_EXIT
 	TOKEN_ON
+	TOKEN_ERROR
+	TOKEN_RESUME
 
 	// Keywords - Declarations
 	TOKEN_DIM
@@ -54,6 +59,7 @@ const (
 	TOKEN_TYPE
 	TOKEN_LET
 	TOKEN_DECLARE
+	TOKEN_IMPORT
 	TOKEN_BYVAL
 	TOKEN_BYREF
 
@@ -97,19 +103,35 @@ const (
 	TOKEN_OPTION
 	TOKEN_BASE
 	TOKEN_DEF
+	TOKEN_DEFINT
+	TOKEN_DEFLNG
+	TOKEN_DEFSNG
+	TOKEN_DEFDBL
+	TOKEN_DEFSTR
 	TOKEN_SEG
 	TOKEN_CALL
 	TOKEN_SLEEP
 	TOKEN_SYSTEM
 	TOKEN_SHELL
+	TOKEN_ENVIRON
 	TOKEN_SWAP
 	TOKEN_RANDOMIZE
 	TOKEN_REDIM
 	TOKEN_PRESERVE
+	TOKEN_ERASE
 	TOKEN_GET
 	TOKEN_PUT
 	TOKEN_SEEK
 	TOKEN_LEN_KW // LEN keyword for OPEN ... LEN = n
+	TOKEN_KILL
+	TOKEN_NAME
+	TOKEN_MKDIR
+	TOKEN_RMDIR
+	TOKEN_CHDIR
+	TOKEN_FILES
+	TOKEN_FIELD
+	TOKEN_LSET
+	TOKEN_RSET
 
 	// Keywords - Graphics
 	TOKEN_PSET
@@ -152,6 +174,7 @@ const (
 	TOKEN_AMPERSAND // & (long type suffix)
 	TOKEN_BANG      // ! (single type suffix)
 	TOKEN_QUESTION  // ?
+	TOKEN_DOT       // . (record field access)
 )
 
 var tokenNames = map[TokenType]string{
@@ -184,6 +207,8 @@ var tokenNames = map[TokenType]string{
 	TOKEN_RETURN:       "RETURN",
 	TOKEN_EXIT:         "EXIT",
 	TOKEN_ON:           "ON",
+	TOKEN_ERROR:        "ERROR",
+	TOKEN_RESUME:       "RESUME",
 	TOKEN_DIM:          "DIM",
 	TOKEN_AS:           "AS",
 	TOKEN_SUB:          "SUB",
@@ -194,6 +219,7 @@ var tokenNames = map[TokenType]string{
 	TOKEN_TYPE:         "TYPE",
 	TOKEN_LET:          "LET",
 	TOKEN_DECLARE:      "DECLARE",
+	TOKEN_IMPORT:       "IMPORT",
 	TOKEN_BYVAL:        "BYVAL",
 	TOKEN_BYREF:        "BYREF",
 	TOKEN_INTEGER_TYPE: "INTEGER_TYPE",
@@ -227,19 +253,35 @@ var tokenNames = map[TokenType]string{
 	TOKEN_OPTION:       "OPTION",
 	TOKEN_BASE:         "BASE",
 	TOKEN_DEF:          "DEF",
+	TOKEN_DEFINT:       "DEFINT",
+	TOKEN_DEFLNG:       "DEFLNG",
+	TOKEN_DEFSNG:       "DEFSNG",
+	TOKEN_DEFDBL:       "DEFDBL",
+	TOKEN_DEFSTR:       "DEFSTR",
 	TOKEN_SEG:          "SEG",
 	TOKEN_CALL:         "CALL",
 	TOKEN_SLEEP:        "SLEEP",
 	TOKEN_SYSTEM:       "SYSTEM",
 	TOKEN_SHELL:        "SHELL",
+	TOKEN_ENVIRON:      "ENVIRON",
 	TOKEN_SWAP:         "SWAP",
 	TOKEN_RANDOMIZE:    "RANDOMIZE",
 	TOKEN_REDIM:        "REDIM",
 	TOKEN_PRESERVE:     "PRESERVE",
+	TOKEN_ERASE:        "ERASE",
 	TOKEN_GET:          "GET",
 	TOKEN_PUT:          "PUT",
 	TOKEN_SEEK:         "SEEK",
 	TOKEN_LEN_KW:       "LEN_KW",
+	TOKEN_KILL:         "KILL",
+	TOKEN_NAME:         "NAME",
+	TOKEN_MKDIR:        "MKDIR",
+	TOKEN_RMDIR:        "RMDIR",
+	TOKEN_CHDIR:        "CHDIR",
+	TOKEN_FILES:        "FILES",
+	TOKEN_FIELD:        "FIELD",
+	TOKEN_LSET:         "LSET",
+	TOKEN_RSET:         "RSET",
 	TOKEN_PSET:         "PSET",
 	TOKEN_CIRCLE:       "CIRCLE",
 	TOKEN_PLUS:         "PLUS",
@@ -272,6 +314,7 @@ var tokenNames = map[TokenType]string{
 	TOKEN_AMPERSAND:    "AMPERSAND",
 	TOKEN_BANG:         "BANG",
 	TOKEN_QUESTION:     "QUESTION",
+	TOKEN_DOT:          "DOT",
 }
 
 func (t TokenType) String() string {
@@ -316,6 +359,8 @@ var Keywords = map[string]TokenType{
 	"RETURN":    TOKEN_RETURN,
 	"EXIT":      TOKEN_EXIT,
 	"ON":        TOKEN_ON,
+	"ERROR":     TOKEN_ERROR,
+	"RESUME":    TOKEN_RESUME,
 	"DIM":       TOKEN_DIM,
 	"AS":        TOKEN_AS,
 	"SUB":       TOKEN_SUB,
@@ -326,6 +371,7 @@ var Keywords = map[string]TokenType{
 	"TYPE":      TOKEN_TYPE,
 	"LET":       TOKEN_LET,
 	"DECLARE":   TOKEN_DECLARE,
+	"IMPORT":    TOKEN_IMPORT,
 	"BYVAL":     TOKEN_BYVAL,
 	"BYREF":     TOKEN_BYREF,
 	"INTEGER":   TOKEN_INTEGER_TYPE,
@@ -359,18 +405,34 @@ var Keywords = map[string]TokenType{
 	"OPTION":    TOKEN_OPTION,
 	"BASE":      TOKEN_BASE,
 	"DEF":       TOKEN_DEF,
+	"DEFINT":    TOKEN_DEFINT,
+	"DEFLNG":    TOKEN_DEFLNG,
+	"DEFSNG":    TOKEN_DEFSNG,
+	"DEFDBL":    TOKEN_DEFDBL,
+	"DEFSTR":    TOKEN_DEFSTR,
 	"SEG":       TOKEN_SEG,
 	"CALL":      TOKEN_CALL,
 	"SLEEP":     TOKEN_SLEEP,
 	"SYSTEM":    TOKEN_SYSTEM,
 	"SHELL":     TOKEN_SHELL,
+	"ENVIRON":   TOKEN_ENVIRON,
 	"SWAP":      TOKEN_SWAP,
 	"RANDOMIZE": TOKEN_RANDOMIZE,
 	"REDIM":     TOKEN_REDIM,
 	"PRESERVE":  TOKEN_PRESERVE,
+	"ERASE":     TOKEN_ERASE,
 	"GET":       TOKEN_GET,
 	"PUT":       TOKEN_PUT,
 	"SEEK":      TOKEN_SEEK,
+	"KILL":      TOKEN_KILL,
+	"NAME":      TOKEN_NAME,
+	"MKDIR":     TOKEN_MKDIR,
+	"RMDIR":     TOKEN_RMDIR,
+	"CHDIR":     TOKEN_CHDIR,
+	"FILES":     TOKEN_FILES,
+	"FIELD":     TOKEN_FIELD,
+	"LSET":      TOKEN_LSET,
+	"RSET":      TOKEN_RSET,
 	"PSET":      TOKEN_PSET,
 	"CIRCLE":    TOKEN_CIRCLE,
 	"MOD":       TOKEN_MOD,
@@ -389,3 +451,63 @@ func LookupIdent(ident string) TokenType {
 	}
 	return TOKEN_IDENT
 }
+
+// qbasicKeywords are the keywords GW-BASIC does not have, which GW-BASIC
+// programs are free to use as variable names
+var qbasicKeywords = map[TokenType]bool{
+	TOKEN_ELSEIF:       true,
+	TOKEN_DO:           true,
+	TOKEN_LOOP:         true,
+	TOKEN_UNTIL:        true,
+	TOKEN_SELECT:       true,
+	TOKEN_CASE:         true,
+	TOKEN_EXIT:         true,
+	TOKEN_SUB:          true,
+	TOKEN_FUNCTION:     true,
+	TOKEN_STATIC:       true,
+	TOKEN_SHARED:       true,
+	TOKEN_CONST:        true,
+	TOKEN_TYPE:         true,
+	TOKEN_DECLARE:      true,
+	TOKEN_IMPORT:       true,
+	TOKEN_BYVAL:        true,
+	TOKEN_BYREF:        true,
+	TOKEN_INTEGER_TYPE: true,
+	TOKEN_LONG_TYPE:    true,
+	TOKEN_SINGLE_TYPE:  true,
+	TOKEN_DOUBLE_TYPE:  true,
+	TOKEN_STRING_TYPE:  true,
+	TOKEN_BINARY:       true,
+	TOKEN_REDIM:        true,
+	TOKEN_PRESERVE:     true,
+	TOKEN_SLEEP:        true,
+	TOKEN_SEEK:         true,
+}
+
+// Dialect is the variant of BASIC a program is written in
+type Dialect int
+
+const (
+	QBasic  Dialect = iota // QBasic and QuickBASIC
+	GWBASIC                // GW-BASIC and BASICA
+)
+
+var dialectNames = map[Dialect]string{
+	QBasic:  "qbasic",
+	GWBASIC: "gwbasic",
+}
+
+func (d Dialect) String() string {
+	return dialectNames[d]
+}
+
+// ParseDialect returns the dialect with the given name, as used by the
+// -dialect flag
+func ParseDialect(name string) (Dialect, bool) {
+	for d, n := range dialectNames {
+		if strings.EqualFold(n, name) {
+			return d, true
+		}
+	}
+	return QBasic, false
+}
@@ -0,0 +1,407 @@
+// Package lsp implements a Language Server Protocol server for BASIC
+// source files: diagnostics, document symbols, go-to-definition, hover and
+// completion of built-in function names.
+//
+// Documents are synchronised in full on every change and reparsed each
+// time; BASIC programs are small enough that this is instant.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/builtins"
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+// Server is a language server for one client
+type Server struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*document
+	builtins []string // sorted
+}
+
+// document is an open source file and its parse
+type document struct {
+	lines   []string
+	program *ast.Program
+	errors  []*parser.Error
+}
+
+// NewServer creates a server that reads messages from in and writes
+// responses and notifications to out
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:       bufio.NewReader(in),
+		out:      out,
+		docs:     make(map[string]*document),
+		builtins: builtins.NewRegistry().Names(),
+	}
+}
+
+// Serve handles messages until the client sends exit or closes the input
+func (s *Server) Serve() error {
+	for {
+		body, err := readMessage(s.in)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return fmt.Errorf("lsp: %v", err)
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+
+		result, err := s.handle(&msg)
+		if msg.ID == nil {
+			continue // notification
+		}
+		var resp any = &responseMessage{JSONRPC: "2.0", ID: msg.ID, Result: result}
+		if err != nil {
+			rerr, ok := err.(*responseError)
+			if !ok {
+				rerr = &responseError{Code: codeInternalError, Message: err.Error()}
+			}
+			resp = &errorMessage{JSONRPC: "2.0", ID: msg.ID, Error: rerr}
+		}
+		if err := writeMessage(s.out, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *responseError) Error() string {
+	return e.Message
+}
+
+// handle runs a request or notification and returns its result
+func (s *Server) handle(msg *message) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       syncFull,
+				"documentSymbolProvider": true,
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string]any{},
+			},
+			"serverInfo": map[string]any{"name": "xbasic"},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := decode(msg, &params); err != nil {
+			return nil, err
+		}
+		s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := decode(msg, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			s.update(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := decode(msg, &params); err != nil {
+			return nil, err
+		}
+		delete(s.docs, params.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []diagnostic{}})
+	case "textDocument/documentSymbol":
+		var params documentSymbolParams
+		if err := decode(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			return doc.symbols(), nil
+		}
+		return []documentSymbol{}, nil
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := decode(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			if r, ok := doc.definition(params.Position); ok {
+				return location{URI: params.TextDocument.URI, Range: r}, nil
+			}
+		}
+		return nil, nil
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := decode(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc := s.docs[params.TextDocument.URI]; doc != nil {
+			return s.hover(doc, params.Position), nil
+		}
+		return nil, nil
+	case "textDocument/completion":
+		return s.completion(), nil
+	default:
+		if msg.ID != nil && !strings.HasPrefix(msg.Method, "$/") {
+			return nil, &responseError{Code: codeMethodNotFound, Message: "method not supported: " + msg.Method}
+		}
+	}
+	return nil, nil
+}
+
+func decode(msg *message, params any) error {
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		return &responseError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) notify(method string, params any) {
+	writeMessage(s.out, &notificationMessage{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// update reparses a document and publishes its syntax errors
+func (s *Server) update(uri, text string) {
+	p := parser.New(lexer.New(text))
+	doc := &document{
+		lines:   strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n"),
+		program: p.ParseProgram(),
+		errors:  p.ErrorList(),
+	}
+	s.docs[uri] = doc
+
+	diags := make([]diagnostic, 0, len(doc.errors))
+	for _, e := range doc.errors {
+		pos := position{Line: max(e.Line-1, 0), Character: max(e.Column-1, 0)}
+		diags = append(diags, diagnostic{
+			Range:    textRange{Start: pos, End: pos},
+			Severity: severityError,
+			Source:   "xbasic",
+			Message:  e.Message,
+		})
+	}
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: diags})
+}
+
+// endPattern matches the END SUB or END FUNCTION closing a procedure
+var endPattern = regexp.MustCompile(`(?i)^\s*(\d+\s+)?END\s+(SUB|FUNCTION)\b`)
+
+// symbols lists the program's SUBs, FUNCTIONs, DEF FNs and labels in
+// source order
+func (doc *document) symbols() []documentSymbol {
+	var syms []documentSymbol
+	for _, sub := range doc.program.Subs {
+		syms = append(syms, doc.procedureSymbol(sub.Name, "SUB", sub.Line, sub.Parameters))
+	}
+	for _, fn := range doc.program.Functions {
+		syms = append(syms, doc.procedureSymbol(fn.Name, "FUNCTION", fn.Line, fn.Parameters))
+	}
+	for _, fn := range doc.program.DefFns {
+		sel := doc.nameRange(fn.Line, fn.Name)
+		line := sel.Start.Line
+		syms = append(syms, documentSymbol{
+			Name:           fn.Name,
+			Detail:         signature("DEF", fn.Name, fn.Parameters),
+			Kind:           symbolFunction,
+			Range:          textRange{Start: position{Line: line}, End: position{Line: line, Character: len(doc.lines[line])}},
+			SelectionRange: sel,
+		})
+	}
+	for name, idx := range doc.program.Labels {
+		label := doc.program.Statements[idx].(*ast.LabelStmt)
+		r := doc.nameRange(label.Line, name)
+		syms = append(syms, documentSymbol{Name: label.Name, Kind: symbolKey, Range: r, SelectionRange: r})
+	}
+	sort.Slice(syms, func(a, b int) bool { return syms[a].Range.Start.Line < syms[b].Range.Start.Line })
+	return syms
+}
+
+// procedureSymbol describes a SUB or FUNCTION, spanning its definition up
+// to the END SUB or END FUNCTION
+func (doc *document) procedureSymbol(name, kind string, line int, params []ast.Parameter) documentSymbol {
+	sel := doc.nameRange(line, name)
+	end := len(doc.lines) - 1
+	for n := line; n < len(doc.lines); n++ {
+		if endPattern.MatchString(doc.lines[n]) {
+			end = n
+			break
+		}
+	}
+	return documentSymbol{
+		Name:           name,
+		Detail:         signature(kind, name, params),
+		Kind:           symbolFunction,
+		Range:          textRange{Start: position{Line: line - 1}, End: position{Line: end, Character: len(doc.lines[end])}},
+		SelectionRange: sel,
+	}
+}
+
+// signature formats a SUB or FUNCTION header
+func signature(kind, name string, params []ast.Parameter) string {
+	parts := make([]string, len(params))
+	for k, p := range params {
+		parts[k] = p.Name
+		if p.ByVal {
+			parts[k] = "BYVAL " + parts[k]
+		}
+		if p.Array {
+			parts[k] += "()"
+		}
+		if p.TypeName != "" {
+			parts[k] += " AS " + p.TypeName
+		} else if p.DataType != ast.TypeUnknown && ast.DataTypeFromSuffix(p.Name[len(p.Name)-1:]) == ast.TypeUnknown {
+			parts[k] += " AS " + p.DataType.String()
+		}
+	}
+	return fmt.Sprintf("%s %s (%s)", kind, name, strings.Join(parts, ", "))
+}
+
+// nameRange finds name on a source line, falling back to the whole line
+func (doc *document) nameRange(line int, name string) textRange {
+	if line < 1 || line > len(doc.lines) {
+		return textRange{}
+	}
+	text := doc.lines[line-1]
+	for _, tok := range lexer.Tokenize(text) {
+		if strings.EqualFold(tok.Literal, name) {
+			start := position{Line: line - 1, Character: tok.Column - 1}
+			return textRange{Start: start, End: position{Line: line - 1, Character: tok.Column - 1 + len(tok.Literal)}}
+		}
+	}
+	return textRange{Start: position{Line: line - 1}, End: position{Line: line - 1, Character: len(text)}}
+}
+
+// tokenAt returns the token under a position
+func (doc *document) tokenAt(pos position) (lexer.Token, textRange, bool) {
+	if pos.Line < 0 || pos.Line >= len(doc.lines) {
+		return lexer.Token{}, textRange{}, false
+	}
+	for _, tok := range lexer.Tokenize(doc.lines[pos.Line]) {
+		start, end := tok.Column-1, tok.Column-1+len(tok.Literal)
+		if tok.Type != lexer.TOKEN_EOF && pos.Character >= start && pos.Character <= end {
+			return tok, textRange{Start: position{Line: pos.Line, Character: start}, End: position{Line: pos.Line, Character: end}}, true
+		}
+	}
+	return lexer.Token{}, textRange{}, false
+}
+
+// definition finds where the SUB, FUNCTION, label or line number under a
+// position is defined
+func (doc *document) definition(pos position) (textRange, bool) {
+	tok, _, ok := doc.tokenAt(pos)
+	if !ok {
+		return textRange{}, false
+	}
+
+	switch tok.Type {
+	case lexer.TOKEN_IDENT:
+		name := strings.ToUpper(tok.Literal)
+		if sub, ok := doc.program.Subs[name]; ok {
+			return doc.nameRange(sub.Line, sub.Name), true
+		}
+		if fn, ok := doc.lookupFunction(name); ok {
+			return doc.nameRange(fn.Line, fn.Name), true
+		}
+		if fn, ok := doc.program.DefFns[name]; ok {
+			return doc.nameRange(fn.Line, fn.Name), true
+		}
+		if idx, ok := doc.program.Labels[name]; ok {
+			return doc.nameRange(ast.SourceLine(doc.program.Statements[idx]), tok.Literal), true
+		}
+	case lexer.TOKEN_INTEGER:
+		n, err := strconv.Atoi(tok.Literal)
+		if err != nil {
+			break
+		}
+		if idx, ok := doc.program.LineNumbers[n]; ok {
+			stmt := doc.program.Statements[idx]
+			return doc.nameRange(ast.SourceLine(stmt), tok.Literal), true
+		}
+	}
+	return textRange{}, false
+}
+
+// lookupFunction finds a FUNCTION by name, with or without its type suffix
+func (doc *document) lookupFunction(name string) (*ast.FuncStatement, bool) {
+	if fn, ok := doc.program.Functions[name]; ok {
+		return fn, true
+	}
+	for key, fn := range doc.program.Functions {
+		if strings.TrimRight(key, "%&!#$") == strings.TrimRight(name, "%&!#$") {
+			return fn, true
+		}
+	}
+	return nil, false
+}
+
+// hover describes the identifier under a position: the signature of a
+// procedure, or the type of a variable as implied by its name suffix
+func (s *Server) hover(doc *document, pos position) *hover {
+	tok, r, ok := doc.tokenAt(pos)
+	if !ok || tok.Type != lexer.TOKEN_IDENT {
+		return nil
+	}
+
+	name := strings.ToUpper(tok.Literal)
+	var text string
+	switch {
+	case doc.program.Subs[name] != nil:
+		sub := doc.program.Subs[name]
+		text = signature("SUB", sub.Name, sub.Parameters)
+	case doc.program.Functions[name] != nil:
+		fn := doc.program.Functions[name]
+		text = signature("FUNCTION", fn.Name, fn.Parameters) + " AS " + suffixType(fn.Name).String()
+	case doc.program.DefFns[name] != nil:
+		fn := doc.program.DefFns[name]
+		text = signature("DEF", fn.Name, fn.Parameters) + " AS " + suffixType(fn.Name).String()
+	case s.isBuiltin(name):
+		text = "built-in function " + name
+	default:
+		if _, ok := doc.program.Labels[name]; ok {
+			text = "label " + tok.Literal
+		} else {
+			text = tok.Literal + " AS " + suffixType(name).String()
+		}
+	}
+	return &hover{Contents: markupContent{Kind: "markdown", Value: "```basic\n" + text + "\n```"}, Range: &r}
+}
+
+func (s *Server) isBuiltin(name string) bool {
+	k := sort.SearchStrings(s.builtins, name)
+	return k < len(s.builtins) && s.builtins[k] == name
+}
+
+// suffixType infers a DataType from a name's suffix, SINGLE when there is
+// none
+func suffixType(name string) ast.DataType {
+	if dt := ast.DataTypeFromSuffix(name[len(name)-1:]); dt != ast.TypeUnknown {
+		return dt
+	}
+	return ast.TypeSingle
+}
+
+// completion offers the built-in function names
+func (s *Server) completion() []completionItem {
+	items := make([]completionItem, len(s.builtins))
+	for k, name := range s.builtins {
+		items[k] = completionItem{Label: name, Kind: completionFunction, Detail: "built-in function"}
+	}
+	return items
+}
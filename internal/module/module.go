@@ -0,0 +1,212 @@
+// Package module adds the libraries a program IMPORTs to it.
+//
+// A library is a source file holding only SUBs, FUNCTIONs, TYPEs, DECLAREs,
+// IMPORTs and comments. Its procedures are renamed library.procedure,
+// after the name the IMPORT statement gives the library, so that two
+// libraries may each define a procedure of the same name:
+//
+//	IMPORT "strings.bas" AS Str
+//	PRINT Str.Reverse$("abc")
+//
+// Calls between the procedures of a library are renamed to match, and the
+// libraries a library imports are renamed in turn, as Str.Util.Trim$.
+// TYPEs are not renamed, so a TYPE defined by a library and by the program
+// must be the same.
+package module
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/include"
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+// Error is a problem with an IMPORT or with the library it names
+type Error struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+}
+
+// ErrorList is every problem found linking a program
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for k, err := range l {
+		msgs[k] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Link adds the libraries imported by program, which was parsed from src,
+// to it and checks its DECLAREs of library procedures. Libraries are found
+// like $INCLUDE files: next to the importing file, then in the directories
+// of path. The error, if any, is an ErrorList.
+func Link(program *ast.Program, src *include.Source, path []string) error {
+	l := &linker{path: path, active: make(map[string]bool), chain: []string{src.Name}}
+	if abs, err := filepath.Abs(src.Name); err == nil {
+		l.active[abs] = true
+	}
+	l.link(program, src)
+	if len(l.errs) > 0 {
+		return l.errs
+	}
+	return nil
+}
+
+type linker struct {
+	path   []string
+	active map[string]bool // absolute paths of the files being linked
+	chain  []string        // the same files, as named, outermost first
+	errs   ErrorList
+}
+
+// report records a problem on a line of src
+func (l *linker) report(src *include.Source, line int, format string, args ...interface{}) {
+	at := src.Origin(line)
+	l.errs = append(l.errs, &Error{File: at.File, Line: at.Line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linker) link(program *ast.Program, src *include.Source) {
+	for _, stmt := range program.Statements {
+		if imp, ok := stmt.(*ast.ImportStmt); ok {
+			l.load(program, src, imp)
+		}
+	}
+	for _, err := range parser.CheckDeclares(program, true) {
+		l.report(src, err.Line, "%s", err.Message)
+	}
+}
+
+// load parses the library imp names and adds its procedures and TYPEs to
+// program, which was parsed from src
+func (l *linker) load(program *ast.Program, src *include.Source, imp *ast.ImportStmt) {
+	file, ok := include.Find(src.Origin(imp.Line).File, imp.Path, l.path)
+	if !ok {
+		l.report(src, imp.Line, "cannot find library %q", imp.Path)
+		return
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+	if l.active[abs] {
+		l.report(src, imp.Line, "import cycle: %s", strings.Join(append(l.chain, file), " imports "))
+		return
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		l.report(src, imp.Line, "%v", err)
+		return
+	}
+	libSrc, err := include.Expand(file, string(data), l.path)
+	if err != nil {
+		if ierr, ok := err.(*include.Error); ok {
+			l.errs = append(l.errs, &Error{File: ierr.File, Line: ierr.Line, Message: ierr.Message})
+		} else {
+			l.report(src, imp.Line, "%v", err)
+		}
+		return
+	}
+	lx := lexer.New(libSrc.Text)
+	lx.SetDialect(program.Dialect)
+	p := parser.New(lx)
+	lib := p.ParseProgram()
+	if errs := p.ErrorList(); len(errs) > 0 {
+		for _, err := range errs {
+			l.report(libSrc, err.Line, "%s", err.Message)
+		}
+		return
+	}
+
+	for _, stmt := range lib.Statements {
+		switch stmt.(type) {
+		case *ast.SubStatement, *ast.FuncStatement, *ast.TypeStmt, *ast.DeclareStmt, *ast.ImportStmt,
+			*ast.RemStmt:
+		default:
+			l.report(libSrc, ast.SourceLine(stmt), "a library may only define SUBs, FUNCTIONs and TYPEs, not %s",
+				stmt.TokenLiteral())
+			return
+		}
+	}
+
+	l.active[abs] = true
+	l.chain = append(l.chain, file)
+	l.link(lib, libSrc)
+	delete(l.active, abs)
+	l.chain = l.chain[:len(l.chain)-1]
+
+	rename(lib, imp.Name)
+	for _, stmt := range lib.Statements {
+		switch s := stmt.(type) {
+		case *ast.SubStatement:
+			if s.Library == "" {
+				s.Library = file
+			}
+			program.Subs[strings.ToUpper(s.Name)] = s
+			program.Statements = append(program.Statements, s)
+		case *ast.FuncStatement:
+			if s.Library == "" {
+				s.Library = file
+			}
+			program.Functions[strings.ToUpper(s.Name)] = s
+			program.Statements = append(program.Statements, s)
+		}
+	}
+	for name, t := range lib.Types {
+		if own, ok := program.Types[name]; ok && own.String() != t.String() {
+			l.report(src, imp.Line, "TYPE %s of library %s differs from the one defined here", t.Name, imp.Name)
+			continue
+		}
+		program.Types[name] = t
+	}
+}
+
+// rename prefixes the names of the procedures of lib, and every reference
+// to them, with the library name
+func rename(lib *ast.Program, library string) {
+	procs := make(map[string]bool)
+	for name := range lib.Subs {
+		procs[name] = true
+	}
+	for name := range lib.Functions {
+		procs[name] = true
+	}
+	qualify := func(name *string) {
+		if procs[strings.ToUpper(*name)] {
+			*name = library + "." + *name
+		}
+	}
+
+	ast.Inspect(lib, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.SubStatement:
+			qualify(&s.Name)
+		case *ast.FuncStatement:
+			qualify(&s.Name)
+		case *ast.DeclareStmt:
+			qualify(&s.Name)
+		case *ast.SubCallStmt:
+			qualify(&s.Name)
+		case *ast.CallStmt:
+			qualify(&s.Name)
+		case *ast.CallExpr:
+			qualify(&s.Function)
+		case *ast.Identifier:
+			// A FUNCTION called without arguments, or its return value
+			qualify(&s.Name)
+		}
+		return true
+	})
+}
@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// CheckDeclares reports DECLARE statements whose SUB or FUNCTION is not
+// defined, or whose parameters differ from the definition's. Procedures
+// of imported libraries, named library.procedure, are only checked when
+// libraries is set, after the libraries have been added to the program.
+func CheckDeclares(program *ast.Program, libraries bool) []*Error {
+	var errs []*Error
+	report := func(d *ast.DeclareStmt, format string, args ...interface{}) {
+		errs = append(errs, &Error{Line: d.Line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for _, stmt := range program.Statements {
+		d, ok := stmt.(*ast.DeclareStmt)
+		if !ok || strings.Contains(d.Name, ".") != libraries {
+			continue
+		}
+		kind := "SUB"
+		if d.Function {
+			kind = "FUNCTION"
+		}
+
+		upper := strings.ToUpper(d.Name)
+		var params []ast.Parameter
+		if sub, ok := program.Subs[upper]; ok {
+			if d.Function {
+				report(d, "%s is declared as a FUNCTION but defined as a SUB", d.Name)
+				continue
+			}
+			params = sub.Parameters
+		} else if fn, ok := program.Functions[upper]; ok {
+			if !d.Function {
+				report(d, "%s is declared as a SUB but defined as a FUNCTION", d.Name)
+				continue
+			}
+			params = fn.Parameters
+		} else {
+			report(d, "%s %s is declared but not defined", kind, d.Name)
+			continue
+		}
+
+		if !d.HasParams {
+			continue
+		}
+		if len(d.Parameters) != len(params) {
+			report(d, "DECLARE %s %s has %d parameters but its definition has %d",
+				kind, d.Name, len(d.Parameters), len(params))
+			continue
+		}
+		for k := range params {
+			if want, got := paramType(d.Parameters[k]), paramType(params[k]); want != got {
+				report(d, "parameter %d of DECLARE %s %s is %s but its definition has %s",
+					k+1, kind, d.Name, want, got)
+			}
+		}
+	}
+	return errs
+}
+
+// paramType describes the type of a parameter, such as INTEGER or
+// STRING() for an array of strings
+func paramType(p ast.Parameter) string {
+	t := strings.ToUpper(p.TypeName)
+	if t == "" {
+		dt := p.DataType
+		if dt == ast.TypeUnknown {
+			dt = ast.TypeSingle
+		}
+		t = dt.String()
+	}
+	if p.Array {
+		t += "()"
+	}
+	return t
+}
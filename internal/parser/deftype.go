@@ -0,0 +1,148 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// applyDefTypes gives each name without a type suffix the suffix that the
+// DEFINT, DEFLNG, DEFSNG, DEFDBL and DEFSTR statements before it assign to
+// its first letter, so that after DEFINT I-N the names I and I% are the
+// same variable. CONSTs, functions and names declared AS a type keep
+// their names, as do calls that are not of a known array.
+func applyDefTypes(program *ast.Program) {
+	keep := make(map[string]bool)
+	arrays := make(map[string]bool)
+	for name := range builtinNames {
+		keep[name] = true
+	}
+	for name := range program.Functions {
+		keep[name] = true
+	}
+	for name := range program.DefFns {
+		keep[name] = true
+	}
+	declared := func(name string, dt ast.DataType, array bool) {
+		if array {
+			arrays[strings.ToUpper(name)] = true
+		}
+		if dt != ast.TypeUnknown && !hasSuffix(name) {
+			keep[strings.ToUpper(name)] = true
+		}
+	}
+	params := func(list []ast.Parameter) {
+		for _, param := range list {
+			declared(param.Name, param.DataType, param.Array)
+		}
+	}
+	ast.Inspect(program, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.ConstStmt:
+			keep[strings.ToUpper(s.Name)] = true
+		case *ast.DimStmt:
+			for _, v := range s.Variables {
+				declared(v.Name, v.DataType, v.Array)
+			}
+		case *ast.RedimStmt:
+			for _, v := range s.Variables {
+				declared(v.Name, v.DataType, true)
+			}
+		case *ast.SharedStmt:
+			for _, v := range s.Variables {
+				declared(v.Name, v.DataType, v.Array)
+			}
+		case *ast.SubStatement:
+			params(s.Parameters)
+		case *ast.FuncStatement:
+			params(s.Parameters)
+		case *ast.DefFnStmt:
+			params(s.Parameters)
+		case *ast.ArrayAccess:
+			arrays[strings.ToUpper(s.Name)] = true
+		case *ast.EraseStmt:
+			for _, name := range s.Arrays {
+				arrays[strings.ToUpper(name)] = true
+			}
+		}
+		for _, target := range ast.Targets(n) {
+			if call, ok := target.(*ast.CallExpr); ok {
+				arrays[strings.ToUpper(call.Function)] = true
+			}
+		}
+		return true
+	})
+
+	// The statements are visited in source order, so each DEFtype applies
+	// to the names after it
+	var types [26]ast.DataType
+	rename := func(name string) string {
+		if name == "" || hasSuffix(name) || keep[strings.ToUpper(name)] {
+			return name
+		}
+		letter := strings.ToUpper(name[:1])[0]
+		if letter < 'A' || letter > 'Z' || types[letter-'A'] == ast.TypeUnknown {
+			return name
+		}
+		return name + types[letter-'A'].Suffix()
+	}
+	renameParams := func(list []ast.Parameter) {
+		for k := range list {
+			list[k].Name = rename(list[k].Name)
+			if list[k].DataType == ast.TypeUnknown {
+				list[k].DataType = ast.DataTypeFromSuffix(list[k].Name[len(list[k].Name)-1:])
+			}
+		}
+	}
+	ast.Inspect(program, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.DefTypeStmt:
+			for _, r := range s.Ranges {
+				for letter := r.From; letter <= r.To; letter++ {
+					types[letter-'A'] = s.DataType
+				}
+			}
+		case *ast.Identifier:
+			s.Name = rename(s.Name)
+			s.TypeHint = ast.DataTypeFromSuffix(s.Name[len(s.Name)-1:])
+		case *ast.ArrayAccess:
+			s.Name = rename(s.Name)
+		case *ast.CallExpr:
+			if arrays[strings.ToUpper(s.Function)] {
+				s.Function = rename(s.Function)
+			}
+		case *ast.DimStmt:
+			for k := range s.Variables {
+				s.Variables[k].Name = rename(s.Variables[k].Name)
+			}
+		case *ast.RedimStmt:
+			for k := range s.Variables {
+				s.Variables[k].Name = rename(s.Variables[k].Name)
+			}
+		case *ast.SharedStmt:
+			for k := range s.Variables {
+				s.Variables[k].Name = rename(s.Variables[k].Name)
+			}
+		case *ast.EraseStmt:
+			for k := range s.Arrays {
+				s.Arrays[k] = rename(s.Arrays[k])
+			}
+		case *ast.ForStmt:
+			if s.NextVar != nil {
+				s.NextVar.Name = rename(s.NextVar.Name)
+			}
+		case *ast.SubStatement:
+			renameParams(s.Parameters)
+		case *ast.FuncStatement:
+			renameParams(s.Parameters)
+		case *ast.DefFnStmt:
+			renameParams(s.Parameters)
+		}
+		return true
+	})
+}
+
+// hasSuffix reports whether a name ends in a type suffix
+func hasSuffix(name string) bool {
+	return name != "" && ast.DataTypeFromSuffix(name[len(name)-1:]) != ast.TypeUnknown
+}
@@ -0,0 +1,151 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+)
+
+// Names the interpreter reads as built-in functions without parentheses
+var builtinNames = map[string]bool{
+	"RND": true, "TIMER": true, "DATE$": true, "TIME$": true, "INKEY$": true,
+	"_PI": true, "PI": true, "FREEFILE": true, "ERR": true, "ERL": true,
+	"DIR$": true, "COMMAND$": true, "_COMMANDCOUNT": true,
+}
+
+// checkDeclarations reports variables used before a DIM, REDIM, CONST or
+// parameter declares them. The main program sees its own declarations in
+// source order. A SUB or FUNCTION sees its parameters, its own
+// declarations including SHARED, and the main program's CONSTs and DIM
+// SHARED variables. The name of a FUNCTION defined in the program, or
+// DECLAREd for an imported library, is declared everywhere: without
+// arguments it calls the FUNCTION, or in its own body is the return value.
+// Problems are reported in line order.
+func (p *Parser) checkDeclarations(program *ast.Program) {
+	first := len(p.errors)
+	defer func() {
+		found := p.errors[first:]
+		sort.SliceStable(found, func(a, b int) bool { return found[a].Line < found[b].Line })
+	}()
+
+	global := make(map[string]bool)
+	main := make(map[string]bool)
+	for name := range program.Functions {
+		global[name], main[name] = true, true
+	}
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.DeclareStmt:
+			if s.Function {
+				global[strings.ToUpper(s.Name)], main[strings.ToUpper(s.Name)] = true, true
+			}
+		case *ast.ConstStmt:
+			global[strings.ToUpper(s.Name)] = true
+		case *ast.DimStmt:
+			if s.Shared {
+				for _, v := range s.Variables {
+					global[strings.ToUpper(v.Name)] = true
+				}
+			}
+		}
+	}
+
+	p.checkScope(program.Statements, main)
+	for _, stmt := range program.Statements {
+		declared := make(map[string]bool)
+		for name := range global {
+			declared[name] = true
+		}
+		switch s := stmt.(type) {
+		case *ast.SubStatement:
+			declareParams(declared, s.Parameters)
+			p.checkScope(s.Body, declared)
+		case *ast.FuncStatement:
+			declareParams(declared, s.Parameters)
+			declared[strings.ToUpper(s.Name)] = true
+			p.checkScope(s.Body, declared)
+		}
+	}
+}
+
+func declareParams(declared map[string]bool, params []ast.Parameter) {
+	for _, param := range params {
+		declared[strings.ToUpper(param.Name)] = true
+	}
+}
+
+// checkScope checks the statements of one scope in source order, reporting
+// each undeclared name once
+func (p *Parser) checkScope(stmts []ast.Statement, declared map[string]bool) {
+	reported := make(map[string]bool)
+	var visit func(n ast.Node) bool
+	visit = func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.SubStatement, *ast.FuncStatement:
+			return false
+		case *ast.DimStmt:
+			for _, v := range s.Variables {
+				for _, d := range v.Dimensions {
+					ast.Inspect(d, visit)
+				}
+				declared[strings.ToUpper(v.Name)] = true
+			}
+			return false
+		case *ast.RedimStmt:
+			for _, v := range s.Variables {
+				for _, d := range v.Dimensions {
+					ast.Inspect(d, visit)
+				}
+				declared[strings.ToUpper(v.Name)] = true
+			}
+			return false
+		case *ast.ConstStmt:
+			ast.Inspect(s.Value, visit)
+			declared[strings.ToUpper(s.Name)] = true
+			return false
+		case *ast.SharedStmt:
+			for _, v := range s.Variables {
+				declared[strings.ToUpper(v.Name)] = true
+			}
+			return false
+		case *ast.DefFnStmt:
+			// The body sees the parameters as well as the enclosing scope
+			declared[strings.ToUpper(s.Name)] = true
+			inner := make(map[string]bool)
+			for name := range declared {
+				inner[name] = true
+			}
+			declareParams(inner, s.Parameters)
+			outer := declared
+			declared = inner
+			ast.Inspect(s.Body, visit)
+			declared = outer
+			return false
+		case *ast.Identifier:
+			name := strings.ToUpper(s.Name)
+			if !declared[name] && !builtinNames[name] && !reported[name] {
+				reported[name] = true
+				p.errors = append(p.errors, &Error{
+					Line:    s.Line,
+					Message: "variable " + s.Name + " is not declared",
+				})
+			}
+		case *ast.ArrayAccess:
+			name := strings.ToUpper(s.Name)
+			if !declared[name] && !reported[name] {
+				reported[name] = true
+				p.errors = append(p.errors, &Error{
+					Line:    s.Line,
+					Message: "array " + s.Name + " is not declared",
+				})
+			}
+		}
+		// The names of CallExprs are arrays or functions, which are
+		// resolved at run time
+		return true
+	}
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, visit)
+	}
+}
@@ -0,0 +1,35 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xbasic/xbasic/internal/lexer"
+)
+
+func TestCheckDeclarations(t *testing.T) {
+	src := `OPTION EXPLICIT
+DIM a
+a = Seven + b
+CALL Show
+c = 1
+SUB Show
+  PRINT Seven; d
+END SUB
+FUNCTION Seven
+  Seven = 7
+  e = 1
+END FUNCTION
+`
+	p := New(lexer.New(src))
+	p.ParseProgram()
+	want := []string{
+		"line 3: variable b is not declared",
+		"line 5: variable c is not declared",
+		"line 7: variable d is not declared",
+		"line 11: variable e is not declared",
+	}
+	if got := p.Errors(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -2,8 +2,11 @@ package parser
 
 import (
 	"fmt"
+	"math"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/xbasic/xbasic/internal/ast"
 	"github.com/xbasic/xbasic/internal/lexer"
@@ -11,9 +14,14 @@ import (
 
 // Parser parses QBasic source code into an AST
 type Parser struct {
-	l      *lexer.Lexer
-	errors []string
+	l        *lexer.Lexer
+	errors   []*Error
+	explicit bool // check declarations even without OPTION EXPLICIT
+	defTypes bool // a DEFtype statement has been parsed
 
+	libraries map[string]bool // names given to libraries by IMPORT
+
+	prevToken lexer.Token
 	curToken  lexer.Token
 	peekToken lexer.Token
 
@@ -29,8 +37,9 @@ type (
 // New creates a new Parser
 func New(l *lexer.Lexer) *Parser {
 	p := &Parser{
-		l:      l,
-		errors: []string{},
+		l:         l,
+		errors:    []*Error{},
+		libraries: make(map[string]bool),
 	}
 
 	// Register prefix parse functions
@@ -42,6 +51,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(lexer.TOKEN_MINUS, p.parsePrefixExpression)
 	p.registerPrefix(lexer.TOKEN_NOT, p.parsePrefixExpression)
 	p.registerPrefix(lexer.TOKEN_LPAREN, p.parseGroupedExpression)
+	p.registerPrefix(lexer.TOKEN_SHELL, p.parseShellFunction)
 
 	// Register infix parse functions
 	p.infixParseFns = make(map[lexer.TokenType]infixParseFn)
@@ -64,10 +74,13 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(lexer.TOKEN_EQV, p.parseInfixExpression)
 	p.registerInfix(lexer.TOKEN_IMP, p.parseInfixExpression)
 	p.registerInfix(lexer.TOKEN_LPAREN, p.parseCallExpression)
+	p.registerInfix(lexer.TOKEN_DOT, p.parseFieldAccess)
 
-	// Read two tokens, so curToken and peekToken are both set
+	// Read two tokens, so curToken and peekToken are both set; the first
+	// token starts a line
 	p.nextToken()
 	p.nextToken()
+	p.prevToken = lexer.Token{Type: lexer.TOKEN_NEWLINE}
 
 	return p
 }
@@ -81,8 +94,24 @@ func (p *Parser) registerInfix(tokenType lexer.TokenType, fn infixParseFn) {
 }
 
 func (p *Parser) nextToken() {
+	p.prevToken = p.curToken
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+
+	// A procedure of an imported library is read as one name,
+	// library.procedure, or library.inner.procedure for a procedure of a
+	// library it imports
+	if p.curToken.Type != lexer.TOKEN_IDENT || !p.libraries[strings.ToUpper(p.curToken.Literal)] {
+		return
+	}
+	for p.peekToken.Type == lexer.TOKEN_DOT {
+		name := p.l.NextToken()
+		if name.Type != lexer.TOKEN_IDENT {
+			p.addError(name, "expected a procedure name after %s., got %s", p.curToken.Literal, name.Type)
+		}
+		p.curToken.Literal += "." + name.Literal
+		p.peekToken = p.l.NextToken()
+	}
 }
 
 func (p *Parser) curTokenIs(t lexer.TokenType) bool {
@@ -102,21 +131,51 @@ func (p *Parser) expectPeek(t lexer.TokenType) bool {
 	return false
 }
 
+// Error describes a syntax error at a position in the source
+type Error struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// SetExplicit makes every program require declarations, as if it began
+// with OPTION EXPLICIT
+func (p *Parser) SetExplicit(explicit bool) {
+	p.explicit = explicit
+}
+
 // Errors returns the parser errors
 func (p *Parser) Errors() []string {
+	msgs := make([]string, len(p.errors))
+	for i, err := range p.errors {
+		msgs[i] = err.Error()
+	}
+	return msgs
+}
+
+// ErrorList returns the parser errors with their source positions
+func (p *Parser) ErrorList() []*Error {
 	return p.errors
 }
 
+func (p *Parser) addError(tok lexer.Token, format string, args ...interface{}) {
+	p.errors = append(p.errors, &Error{
+		Line:    tok.Line,
+		Column:  tok.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
 func (p *Parser) peekError(t lexer.TokenType) {
-	msg := fmt.Sprintf("line %d: expected next token to be %s, got %s instead",
-		p.peekToken.Line, t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.addError(p.peekToken, "expected next token to be %s, got %s instead", t, p.peekToken.Type)
 }
 
 func (p *Parser) noPrefixParseFnError(t lexer.TokenType) {
-	msg := fmt.Sprintf("line %d: no prefix parse function for %s found",
-		p.curToken.Line, t)
-	p.errors = append(p.errors, msg)
+	p.addError(p.curToken, "no prefix parse function for %s found", t)
 }
 
 func (p *Parser) peekPrecedence() int {
@@ -150,14 +209,32 @@ func (p *Parser) ParseProgram() *ast.Program {
 				program.Subs[strings.ToUpper(s.Name)] = s
 			case *ast.FuncStatement:
 				program.Functions[strings.ToUpper(s.Name)] = s
+			case *ast.TypeStmt:
+				program.Types[strings.ToUpper(s.Name)] = s
+			case *ast.DefFnStmt:
+				program.DefFns[strings.ToUpper(s.Name)] = s
 			case *ast.DataStmt:
 				program.DataItems = append(program.DataItems, s.Values...)
+			case *ast.OptionStmt:
+				program.Explicit = true
 			}
 			program.Statements = append(program.Statements, stmt)
 		}
 		p.nextToken()
 	}
 
+	program.Dialect = p.l.Dialect()
+	if p.defTypes {
+		applyDefTypes(program)
+	}
+	if p.explicit {
+		program.Explicit = true
+	}
+	if program.Explicit {
+		p.checkDeclarations(program)
+	}
+	p.errors = append(p.errors, CheckDeclares(program, false)...)
+
 	return program
 }
 
@@ -174,19 +251,8 @@ func (p *Parser) parseStatement() ast.Statement {
 	// Handle line numbers
 	if p.curTokenIs(lexer.TOKEN_LINE_NUMBER) {
 		lineNum, _ := strconv.Atoi(p.curToken.Literal)
-		stmt := &ast.LineNumberStmt{Line: p.curToken.Line, Number: lineNum}
-		if p.peekTokenIs(lexer.TOKEN_NEWLINE) || p.peekTokenIs(lexer.TOKEN_EOF) {
-			return stmt
-		}
-		p.nextToken()
-		// Continue parsing the statement after the line number
-		// For now, return just the line number marker
-		nextStmt := p.parseStatement()
-		if nextStmt != nil {
-			// We'll handle this in the interpreter
-			return stmt
-		}
-		return stmt
+		// The statement after the line number is parsed as the next one
+		return &ast.LineNumberStmt{Line: p.curToken.Line, Number: lineNum}
 	}
 
 	switch p.curToken.Type {
@@ -196,8 +262,12 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parsePrintStatement()
 	case lexer.TOKEN_INPUT:
 		return p.parseInputStatement()
-	case lexer.TOKEN_DIM:
+	case lexer.TOKEN_WRITE:
+		return p.parseWriteStatement()
+	case lexer.TOKEN_DIM, lexer.TOKEN_STATIC:
 		return p.parseDimStatement()
+	case lexer.TOKEN_SHARED:
+		return p.parseSharedStatement()
 	case lexer.TOKEN_IF:
 		return p.parseIfStatement()
 	case lexer.TOKEN_FOR:
@@ -220,6 +290,8 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseSubStatement()
 	case lexer.TOKEN_FUNCTION:
 		return p.parseFunctionStatement()
+	case lexer.TOKEN_TYPE:
+		return p.parseTypeStatement()
 	case lexer.TOKEN_DATA:
 		return p.parseDataStatement()
 	case lexer.TOKEN_READ:
@@ -250,22 +322,52 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseRandomizeStatement()
 	case lexer.TOKEN_CONST:
 		return p.parseConstStatement()
+	case lexer.TOKEN_OPTION:
+		return p.parseOptionStatement()
 	case lexer.TOKEN_OPEN:
 		return p.parseOpenStatement()
 	case lexer.TOKEN_CLOSE:
 		return p.parseCloseStatement()
+	case lexer.TOKEN_KILL, lexer.TOKEN_MKDIR, lexer.TOKEN_RMDIR, lexer.TOKEN_CHDIR, lexer.TOKEN_FILES:
+		return p.parseFileCommandStatement()
+	case lexer.TOKEN_NAME:
+		return p.parseNameStatement()
+	case lexer.TOKEN_SYSTEM:
+		return p.parseEndStatement()
+	case lexer.TOKEN_SHELL:
+		return p.parseShellStatement()
+	case lexer.TOKEN_ENVIRON:
+		return p.parseEnvironStatement()
 	case lexer.TOKEN_LINE:
 		return p.parseLineStatement()
 	case lexer.TOKEN_ON:
 		return p.parseOnStatement()
+	case lexer.TOKEN_RESUME:
+		return p.parseResumeStatement()
+	case lexer.TOKEN_ERROR:
+		return p.parseErrorStatement()
 	case lexer.TOKEN_REDIM:
 		return p.parseRedimStatement()
+	case lexer.TOKEN_ERASE:
+		return p.parseEraseStatement()
+	case lexer.TOKEN_DEF:
+		return p.parseDefStatement()
+	case lexer.TOKEN_DECLARE:
+		return p.parseDeclareStatement()
+	case lexer.TOKEN_IMPORT:
+		return p.parseImportStatement()
+	case lexer.TOKEN_DEFINT, lexer.TOKEN_DEFLNG, lexer.TOKEN_DEFSNG, lexer.TOKEN_DEFDBL, lexer.TOKEN_DEFSTR:
+		return p.parseDefTypeStatement()
 	case lexer.TOKEN_GET:
 		return p.parseGetStatement()
 	case lexer.TOKEN_PUT:
 		return p.parsePutStatement()
 	case lexer.TOKEN_SEEK:
 		return p.parseSeekStatement()
+	case lexer.TOKEN_FIELD:
+		return p.parseFieldStatement()
+	case lexer.TOKEN_LSET, lexer.TOKEN_RSET:
+		return p.parseJustifyStatement()
 	case lexer.TOKEN_PSET:
 		return p.parsePsetStatement()
 	case lexer.TOKEN_CIRCLE:
@@ -282,11 +384,21 @@ func (p *Parser) parseIdentifierStatement() ast.Statement {
 	line := p.curToken.Line
 	name := p.curToken.Literal
 
+	// Record field assignment: emp.name = ...
+	if p.peekTokenIs(lexer.TOKEN_DOT) {
+		return p.parseFieldAssignment(line, p.parseIdentifier())
+	}
+
 	// Check if this is an array access or assignment
 	if p.peekTokenIs(lexer.TOKEN_LPAREN) {
 		// Could be array assignment or function call as statement
 		ident := p.parseIdentifier()
 
+		// Field of an array element: emps(i).name = ...
+		if p.peekTokenIs(lexer.TOKEN_DOT) {
+			return p.parseFieldAssignment(line, ident)
+		}
+
 		if p.peekTokenIs(lexer.TOKEN_EQ) {
 			// Array assignment
 			p.nextToken() // move to =
@@ -296,7 +408,18 @@ func (p *Parser) parseIdentifierStatement() ast.Statement {
 		}
 		// It's a sub call with parentheses
 		if call, ok := ident.(*ast.CallExpr); ok {
-			return &ast.SubCallStmt{Line: line, Name: call.Function, Arguments: call.Arguments}
+			// As in QBasic, Name (x) and Name (x), y put the first
+			// argument in parentheses, which passes it by value
+			if len(call.Arguments) != 1 || isWholeArray(call.Arguments[0]) {
+				return &ast.SubCallStmt{Line: line, Name: call.Function, Arguments: call.Arguments}
+			}
+			args := []ast.Expression{&ast.GroupedExpr{Line: line, Expression: call.Arguments[0]}}
+			if p.peekTokenIs(lexer.TOKEN_COMMA) {
+				p.nextToken()
+				p.nextToken()
+				args = append(args, p.parseCallArguments()...)
+			}
+			return &ast.SubCallStmt{Line: line, Name: call.Function, Arguments: args}
 		}
 	}
 
@@ -312,16 +435,52 @@ func (p *Parser) parseIdentifierStatement() ast.Statement {
 		}
 	}
 
-	// Check if it's a label (identifier followed by colon)
-	if p.peekTokenIs(lexer.TOKEN_COLON) {
+	// Check if it's a label (identifier followed by colon). After a colon
+	// that separates statements, Name: is a SUB call instead.
+	if p.peekTokenIs(lexer.TOKEN_COLON) && p.atLineStart() {
 		p.nextToken() // consume colon
 		return &ast.LabelStmt{Line: line, Name: name}
 	}
 
 	// It's a sub call without parentheses
 	p.nextToken()
+	return &ast.SubCallStmt{Line: line, Name: name, Arguments: p.parseCallArguments()}
+}
+
+// atLineStart reports whether the current token starts a physical line,
+// after any line number
+func (p *Parser) atLineStart() bool {
+	switch p.prevToken.Type {
+	case lexer.TOKEN_NEWLINE, lexer.TOKEN_LINE_NUMBER:
+		return true
+	}
+	return false
+}
+
+// atStatementEnd reports whether the current token ends a statement
+func (p *Parser) atStatementEnd() bool {
+	switch p.curToken.Type {
+	case lexer.TOKEN_NEWLINE, lexer.TOKEN_EOF, lexer.TOKEN_COLON, lexer.TOKEN_ELSE, lexer.TOKEN_REM:
+		return true
+	}
+	return false
+}
+
+// peekStatementEnd reports whether the next token ends a statement, which
+// leaves out an optional argument
+func (p *Parser) peekStatementEnd() bool {
+	switch p.peekToken.Type {
+	case lexer.TOKEN_NEWLINE, lexer.TOKEN_EOF, lexer.TOKEN_COLON, lexer.TOKEN_ELSE, lexer.TOKEN_REM:
+		return true
+	}
+	return false
+}
+
+// parseCallArguments parses the comma-separated arguments of a SUB call
+// without CALL, starting at the current token
+func (p *Parser) parseCallArguments() []ast.Expression {
 	var args []ast.Expression
-	for !p.curTokenIs(lexer.TOKEN_NEWLINE) && !p.curTokenIs(lexer.TOKEN_EOF) && !p.curTokenIs(lexer.TOKEN_COLON) {
+	for !p.atStatementEnd() {
 		expr := p.parseExpression(LOWEST)
 		if expr != nil {
 			args = append(args, expr)
@@ -333,14 +492,41 @@ func (p *Parser) parseIdentifierStatement() ast.Statement {
 			break
 		}
 	}
-	return &ast.SubCallStmt{Line: line, Name: name, Arguments: args}
+	return args
+}
+
+// isWholeArray reports whether expr is an array argument written name()
+func isWholeArray(expr ast.Expression) bool {
+	call, ok := expr.(*ast.CallExpr)
+	return ok && len(call.Arguments) == 0
+}
+
+// parseFieldAssignment parses the rest of a record field assignment such
+// as emp.name = "x" or emps(i).addr.city = "y"
+func (p *Parser) parseFieldAssignment(line int, target ast.Expression) ast.Statement {
+	for p.peekTokenIs(lexer.TOKEN_DOT) {
+		p.nextToken()
+		target = p.parseFieldAccess(target)
+		if target == nil {
+			return nil
+		}
+	}
+
+	if !p.expectPeek(lexer.TOKEN_EQ) {
+		return nil
+	}
+	p.nextToken()
+	value := p.parseExpression(LOWEST)
+
+	return &ast.LetStmt{Line: line, Name: target, Value: value}
 }
 
 func (p *Parser) parseLetStatement() ast.Statement {
 	line := p.curToken.Line
 	p.nextToken() // skip LET
 
-	name := p.parseExpression(LOWEST)
+	// Parse the target above comparison precedence so = is not consumed
+	name := p.parseExpression(COMPARISON)
 
 	if !p.expectPeek(lexer.TOKEN_EQ) {
 		return nil
@@ -389,6 +575,39 @@ func (p *Parser) parsePrintStatement() ast.Statement {
 	return stmt
 }
 
+// parseWriteStatement parses WRITE [#n,] [expr, ...]
+func (p *Parser) parseWriteStatement() ast.Statement {
+	stmt := &ast.WriteStmt{Line: p.curToken.Line}
+	if p.peekTokenIs(lexer.TOKEN_HASH) {
+		p.nextToken()
+		p.nextToken()
+		stmt.FileNum = p.parseExpression(LOWEST)
+		if stmt.FileNum == nil {
+			return nil
+		}
+		if p.peekStatementEnd() {
+			return stmt
+		}
+		if !p.expectPeek(lexer.TOKEN_COMMA) {
+			return nil
+		}
+	}
+
+	for !p.peekStatementEnd() {
+		p.nextToken()
+		expr := p.parseExpression(LOWEST)
+		if expr == nil {
+			return nil
+		}
+		stmt.Items = append(stmt.Items, expr)
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+	return stmt
+}
+
 func (p *Parser) parsePrintUsingRest(line int, fileNum ast.Expression) ast.Statement {
 	stmt := &ast.PrintUsingStmt{Line: line, FileNum: fileNum}
 
@@ -402,7 +621,7 @@ func (p *Parser) parsePrintUsingRest(line int, fileNum ast.Expression) ast.State
 	p.nextToken()
 
 	// Parse items
-	for !p.curTokenIs(lexer.TOKEN_NEWLINE) && !p.curTokenIs(lexer.TOKEN_EOF) && !p.curTokenIs(lexer.TOKEN_COLON) {
+	for !p.atStatementEnd() {
 		if p.curTokenIs(lexer.TOKEN_SEMICOLON) {
 			if len(stmt.Items) > 0 {
 				stmt.Items[len(stmt.Items)-1].Separator = ";"
@@ -435,7 +654,7 @@ func (p *Parser) parsePrintItems() ([]ast.PrintItem, bool) {
 	var items []ast.PrintItem
 	noNewline := false
 
-	for !p.curTokenIs(lexer.TOKEN_NEWLINE) && !p.curTokenIs(lexer.TOKEN_EOF) && !p.curTokenIs(lexer.TOKEN_COLON) {
+	for !p.atStatementEnd() {
 		if p.curTokenIs(lexer.TOKEN_SEMICOLON) {
 			if len(items) > 0 {
 				items[len(items)-1].Separator = ";"
@@ -521,8 +740,9 @@ func (p *Parser) parseInputStatement() ast.Statement {
 	return stmt
 }
 
+// parseDimStatement parses DIM, and STATIC, which declares like DIM
 func (p *Parser) parseDimStatement() ast.Statement {
-	stmt := &ast.DimStmt{Line: p.curToken.Line}
+	stmt := &ast.DimStmt{Line: p.curToken.Line, Static: p.curTokenIs(lexer.TOKEN_STATIC)}
 
 	p.nextToken()
 
@@ -544,6 +764,7 @@ func (p *Parser) parseDimStatement() ast.Statement {
 		if p.peekTokenIs(lexer.TOKEN_LPAREN) {
 			p.nextToken() // move to (
 			p.nextToken() // move past (
+			dimVar.Array = true
 			for !p.curTokenIs(lexer.TOKEN_RPAREN) {
 				dim := p.parseExpression(LOWEST)
 				dimVar.Dimensions = append(dimVar.Dimensions, dim)
@@ -558,7 +779,7 @@ func (p *Parser) parseDimStatement() ast.Statement {
 		if p.peekTokenIs(lexer.TOKEN_AS) {
 			p.nextToken() // move to AS
 			p.nextToken() // move to type
-			dimVar.DataType = p.parseDataType()
+			dimVar.DataType, dimVar.TypeName, dimVar.StringLength = p.parseTypeSpec()
 		}
 
 		stmt.Variables = append(stmt.Variables, dimVar)
@@ -573,6 +794,38 @@ func (p *Parser) parseDimStatement() ast.Statement {
 	return stmt
 }
 
+// parseSharedStatement parses SHARED a, b() AS INTEGER
+func (p *Parser) parseSharedStatement() ast.Statement {
+	stmt := &ast.SharedStmt{Line: p.curToken.Line}
+
+	for {
+		if !p.expectPeek(lexer.TOKEN_IDENT) {
+			return nil
+		}
+		v := ast.SharedVariable{Name: p.curToken.Literal}
+		if p.peekTokenIs(lexer.TOKEN_LPAREN) {
+			p.nextToken() // move to (
+			if !p.expectPeek(lexer.TOKEN_RPAREN) {
+				return nil
+			}
+			v.Array = true
+		}
+		if p.peekTokenIs(lexer.TOKEN_AS) {
+			p.nextToken() // move to AS
+			p.nextToken() // move to type
+			v.DataType, v.TypeName, _ = p.parseTypeSpec()
+		}
+		stmt.Variables = append(stmt.Variables, v)
+
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			break
+		}
+		p.nextToken() // move to comma
+	}
+
+	return stmt
+}
+
 func (p *Parser) parseDataType() ast.DataType {
 	switch p.curToken.Type {
 	case lexer.TOKEN_INTEGER_TYPE:
@@ -590,13 +843,97 @@ func (p *Parser) parseDataType() ast.DataType {
 	}
 }
 
+// parseTypeSpec parses the type after AS: a built-in type, STRING * n, or
+// the name of a user-defined TYPE
+func (p *Parser) parseTypeSpec() (ast.DataType, string, ast.Expression) {
+	if p.curTokenIs(lexer.TOKEN_IDENT) {
+		return ast.TypeRecord, p.curToken.Literal, nil
+	}
+
+	dt := p.parseDataType()
+	if dt == ast.TypeString && p.peekTokenIs(lexer.TOKEN_ASTERISK) {
+		p.nextToken() // move to *
+		p.nextToken() // move to length
+		return dt, "", p.parseExpression(PRODUCT)
+	}
+	return dt, "", nil
+}
+
+// parseTypeStatement parses a TYPE ... END TYPE block
+func (p *Parser) parseTypeStatement() ast.Statement {
+	stmt := &ast.TypeStmt{Line: p.curToken.Line}
+
+	if !p.expectPeek(lexer.TOKEN_IDENT) {
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+	p.nextToken()
+
+	for !p.curTokenIs(lexer.TOKEN_EOF) {
+		if p.curTokenIs(lexer.TOKEN_END) && p.peekTokenIs(lexer.TOKEN_TYPE) {
+			p.nextToken() // leave curToken on TYPE
+			return stmt
+		}
+
+		switch p.curToken.Type {
+		case lexer.TOKEN_NEWLINE, lexer.TOKEN_COLON, lexer.TOKEN_REM:
+			p.nextToken()
+			continue
+		}
+
+		if !isWord(p.curToken) {
+			p.addError(p.curToken, "expected field name in TYPE %s, got %s", stmt.Name, p.curToken.Type)
+			p.skipToEndType()
+			return nil
+		}
+		field := ast.TypeField{Name: p.curToken.Literal}
+
+		if !p.expectPeek(lexer.TOKEN_AS) {
+			p.skipToEndType()
+			return nil
+		}
+		p.nextToken()
+		field.DataType, field.TypeName, field.StringLength = p.parseTypeSpec()
+
+		switch {
+		case field.DataType == ast.TypeUnknown:
+			p.addError(p.curToken, "expected type for field %s, got %s", field.Name, p.curToken.Type)
+			p.skipToEndType()
+			return nil
+		case field.DataType == ast.TypeString && field.StringLength == nil:
+			p.addError(p.curToken, "field %s must be a fixed-length STRING * n", field.Name)
+			p.skipToEndType()
+			return nil
+		}
+
+		stmt.Fields = append(stmt.Fields, field)
+		p.nextToken()
+	}
+
+	p.addError(p.curToken, "TYPE %s without END TYPE", stmt.Name)
+	return nil
+}
+
+// skipToEndType skips the rest of a malformed TYPE block so that its
+// fields are not reported again as statements
+func (p *Parser) skipToEndType() {
+	for !p.curTokenIs(lexer.TOKEN_EOF) {
+		if p.curTokenIs(lexer.TOKEN_END) && p.peekTokenIs(lexer.TOKEN_TYPE) {
+			p.nextToken()
+			return
+		}
+		p.nextToken()
+	}
+}
+
 func (p *Parser) parseIfStatement() ast.Statement {
 	stmt := &ast.IfStmt{Line: p.curToken.Line}
 
 	p.nextToken() // skip IF
 	stmt.Condition = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(lexer.TOKEN_THEN) {
+	// IF cond GOTO target needs no THEN
+	if !p.peekTokenIs(lexer.TOKEN_GOTO) && !p.expectPeek(lexer.TOKEN_THEN) {
 		return nil
 	}
 
@@ -604,12 +941,7 @@ func (p *Parser) parseIfStatement() ast.Statement {
 	if !p.peekTokenIs(lexer.TOKEN_NEWLINE) && !p.peekTokenIs(lexer.TOKEN_EOF) {
 		stmt.SingleLine = true
 		p.nextToken()
-
-		// Parse consequence
-		conseq := p.parseStatement()
-		if conseq != nil {
-			stmt.Consequence = append(stmt.Consequence, conseq)
-		}
+		stmt.Consequence = p.parseLineStatements()
 
 		// Check for ELSE
 		if p.curTokenIs(lexer.TOKEN_ELSE) || p.peekTokenIs(lexer.TOKEN_ELSE) {
@@ -617,10 +949,7 @@ func (p *Parser) parseIfStatement() ast.Statement {
 				p.nextToken()
 			}
 			p.nextToken()
-			alt := p.parseStatement()
-			if alt != nil {
-				stmt.Alternative = append(stmt.Alternative, alt)
-			}
+			stmt.Alternative = p.parseLineStatements()
 		}
 
 		return stmt
@@ -632,7 +961,12 @@ func (p *Parser) parseIfStatement() ast.Statement {
 
 	// Parse consequence block
 	for !p.curTokenIs(lexer.TOKEN_ELSE) && !p.curTokenIs(lexer.TOKEN_ELSEIF) &&
-		!p.curTokenIs(lexer.TOKEN_END) && !p.curTokenIs(lexer.TOKEN_EOF) {
+		!p.isEndIf() && !p.curTokenIs(lexer.TOKEN_EOF) {
+		// Skip empty lines
+		if p.curTokenIs(lexer.TOKEN_NEWLINE) {
+			p.nextToken()
+			continue
+		}
 		s := p.parseStatement()
 		if s != nil {
 			stmt.Consequence = append(stmt.Consequence, s)
@@ -656,7 +990,11 @@ func (p *Parser) parseIfStatement() ast.Statement {
 			p.nextToken()
 		}
 
-		for !p.curTokenIs(lexer.TOKEN_END) && !p.curTokenIs(lexer.TOKEN_EOF) {
+		for !p.isEndIf() && !p.curTokenIs(lexer.TOKEN_EOF) {
+			if p.curTokenIs(lexer.TOKEN_NEWLINE) {
+				p.nextToken()
+				continue
+			}
 			s := p.parseStatement()
 			if s != nil {
 				stmt.Alternative = append(stmt.Alternative, s)
@@ -666,14 +1004,43 @@ func (p *Parser) parseIfStatement() ast.Statement {
 	}
 
 	// Expect END IF
-	if p.curTokenIs(lexer.TOKEN_END) {
-		p.nextToken() // move past END
-		// IF is optional after END
+	if p.isEndIf() {
+		p.nextToken() // move to IF
 	}
 
 	return stmt
 }
 
+// parseLineStatements parses the colon-separated statements of a
+// single-line IF, up to the end of the line or an ELSE. A line number on
+// its own, as in THEN 100, is a GOTO.
+func (p *Parser) parseLineStatements() []ast.Statement {
+	var stmts []ast.Statement
+	for {
+		var s ast.Statement
+		if p.curTokenIs(lexer.TOKEN_INTEGER) || p.curTokenIs(lexer.TOKEN_LINE_NUMBER) {
+			s = &ast.GotoStmt{Line: p.curToken.Line, Target: p.curToken.Literal}
+		} else if !p.curTokenIs(lexer.TOKEN_COLON) {
+			s = p.parseStatement()
+		}
+		if s != nil {
+			stmts = append(stmts, s)
+		}
+
+		// Statements end on their last token or on the colon after it
+		if !p.curTokenIs(lexer.TOKEN_COLON) {
+			if !p.peekTokenIs(lexer.TOKEN_COLON) {
+				return stmts
+			}
+			p.nextToken()
+		}
+		if p.peekTokenIs(lexer.TOKEN_NEWLINE) || p.peekTokenIs(lexer.TOKEN_EOF) || p.peekTokenIs(lexer.TOKEN_ELSE) {
+			return stmts
+		}
+		p.nextToken()
+	}
+}
+
 func (p *Parser) parseForStatement() ast.Statement {
 	stmt := &ast.ForStmt{Line: p.curToken.Line}
 
@@ -726,9 +1093,10 @@ func (p *Parser) parseForStatement() ast.Statement {
 		}
 	}
 
-	// Skip optional variable name after NEXT (e.g., NEXT i)
+	// Optional variable name after NEXT (e.g., NEXT i)
 	if p.peekTokenIs(lexer.TOKEN_IDENT) {
 		p.nextToken()
+		stmt.NextVar = &ast.Identifier{Line: p.curToken.Line, Name: p.curToken.Literal}
 	}
 
 	return stmt
@@ -856,7 +1224,11 @@ func (p *Parser) parseSelectCaseStatement() ast.Statement {
 				p.nextToken()
 			}
 			// Parse CASE ELSE body
-			for !p.curTokenIs(lexer.TOKEN_END) && !p.curTokenIs(lexer.TOKEN_CASE) && !p.curTokenIs(lexer.TOKEN_EOF) {
+			for !p.isEndSelect() && !p.curTokenIs(lexer.TOKEN_CASE) && !p.curTokenIs(lexer.TOKEN_EOF) {
+				if p.curTokenIs(lexer.TOKEN_NEWLINE) {
+					p.nextToken()
+					continue
+				}
 				s := p.parseStatement()
 				if s != nil {
 					stmt.CaseElse = append(stmt.CaseElse, s)
@@ -886,7 +1258,11 @@ func (p *Parser) parseSelectCaseStatement() ast.Statement {
 		p.nextToken()
 
 		// Parse CASE body
-		for !p.curTokenIs(lexer.TOKEN_CASE) && !p.curTokenIs(lexer.TOKEN_END) && !p.curTokenIs(lexer.TOKEN_EOF) {
+		for !p.curTokenIs(lexer.TOKEN_CASE) && !p.isEndSelect() && !p.curTokenIs(lexer.TOKEN_EOF) {
+			if p.curTokenIs(lexer.TOKEN_NEWLINE) {
+				p.nextToken()
+				continue
+			}
 			s := p.parseStatement()
 			if s != nil {
 				clause.Body = append(clause.Body, s)
@@ -898,9 +1274,8 @@ func (p *Parser) parseSelectCaseStatement() ast.Statement {
 	}
 
 	// Expect END SELECT
-	if p.curTokenIs(lexer.TOKEN_END) {
-		p.nextToken() // skip END
-		// SELECT is optional
+	if p.isEndSelect() {
+		p.nextToken() // move to SELECT
 	}
 
 	return stmt
@@ -908,12 +1283,13 @@ func (p *Parser) parseSelectCaseStatement() ast.Statement {
 
 func (p *Parser) parseCaseValue() ast.CaseValue {
 	// Check for IS operator
-	if p.curToken.Literal == "IS" || p.curTokenIs(lexer.TOKEN_LT) || p.curTokenIs(lexer.TOKEN_GT) ||
+	isKeyword := p.curTokenIs(lexer.TOKEN_IDENT) && strings.EqualFold(p.curToken.Literal, "IS")
+	if isKeyword || p.curTokenIs(lexer.TOKEN_LT) || p.curTokenIs(lexer.TOKEN_GT) ||
 		p.curTokenIs(lexer.TOKEN_LE) || p.curTokenIs(lexer.TOKEN_GE) || p.curTokenIs(lexer.TOKEN_EQ) ||
 		p.curTokenIs(lexer.TOKEN_NE) {
 
 		var op string
-		if p.curToken.Literal == "IS" {
+		if isKeyword {
 			p.nextToken()
 			op = tokenToOperator[p.curToken.Type]
 			p.nextToken()
@@ -998,6 +1374,11 @@ func (p *Parser) parseSubStatement() ast.Statement {
 
 	// Parse body until END SUB
 	for !p.isEndSub() && !p.curTokenIs(lexer.TOKEN_EOF) {
+		// Skip empty lines
+		if p.curTokenIs(lexer.TOKEN_NEWLINE) {
+			p.nextToken()
+			continue
+		}
 		s := p.parseStatement()
 		if s != nil {
 			stmt.Body = append(stmt.Body, s)
@@ -1013,6 +1394,16 @@ func (p *Parser) parseSubStatement() ast.Statement {
 	return stmt
 }
 
+// isEndIf reports whether the current token starts END IF, so that a
+// bare END or END n inside the block ends the program
+func (p *Parser) isEndIf() bool {
+	return p.curTokenIs(lexer.TOKEN_END) && p.peekTokenIs(lexer.TOKEN_IF)
+}
+
+func (p *Parser) isEndSelect() bool {
+	return p.curTokenIs(lexer.TOKEN_END) && p.peekTokenIs(lexer.TOKEN_SELECT)
+}
+
 func (p *Parser) isEndSub() bool {
 	return p.curTokenIs(lexer.TOKEN_END) && p.peekTokenIs(lexer.TOKEN_SUB)
 }
@@ -1062,6 +1453,11 @@ func (p *Parser) parseFunctionStatement() ast.Statement {
 
 	// Parse body until END FUNCTION
 	for !p.isEndFunction() && !p.curTokenIs(lexer.TOKEN_EOF) {
+		// Skip empty lines
+		if p.curTokenIs(lexer.TOKEN_NEWLINE) {
+			p.nextToken()
+			continue
+		}
 		s := p.parseStatement()
 		if s != nil {
 			stmt.Body = append(stmt.Body, s)
@@ -1103,10 +1499,19 @@ func (p *Parser) parseParameters() []ast.Parameter {
 			}
 		}
 
+		// An array parameter is written name()
+		if p.peekTokenIs(lexer.TOKEN_LPAREN) {
+			p.nextToken()
+			if !p.expectPeek(lexer.TOKEN_RPAREN) {
+				return params
+			}
+			param.Array = true
+		}
+
 		if p.peekTokenIs(lexer.TOKEN_AS) {
 			p.nextToken()
 			p.nextToken()
-			param.DataType = p.parseDataType()
+			param.DataType, param.TypeName, _ = p.parseTypeSpec()
 		}
 
 		params = append(params, param)
@@ -1221,7 +1626,59 @@ func (p *Parser) parseEndStatement() ast.Statement {
 		p.peekTokenIs(lexer.TOKEN_FUNCTION) || p.peekTokenIs(lexer.TOKEN_SELECT) {
 		return nil // handled by other parsers
 	}
-	return &ast.EndStmt{Line: p.curToken.Line}
+	stmt := &ast.EndStmt{Line: p.curToken.Line, System: p.curTokenIs(lexer.TOKEN_SYSTEM)}
+	if !p.peekStatementEnd() {
+		p.nextToken()
+		stmt.Code = p.parseExpression(LOWEST)
+		if stmt.Code == nil {
+			return nil
+		}
+	}
+	return stmt
+}
+
+// parseShellStatement parses SHELL [command]
+func (p *Parser) parseShellStatement() ast.Statement {
+	stmt := &ast.ShellStmt{Line: p.curToken.Line}
+	if !p.peekStatementEnd() {
+		p.nextToken()
+		stmt.Command = p.parseExpression(LOWEST)
+		if stmt.Command == nil {
+			return nil
+		}
+	}
+	return stmt
+}
+
+// parseEnvironStatement parses ENVIRON "name=value"
+func (p *Parser) parseEnvironStatement() ast.Statement {
+	stmt := &ast.EnvironStmt{Line: p.curToken.Line}
+	p.nextToken()
+	stmt.Setting = p.parseExpression(LOWEST)
+	if stmt.Setting == nil {
+		return nil
+	}
+	return stmt
+}
+
+// parseShellFunction parses SHELL(command) in an expression
+func (p *Parser) parseShellFunction() ast.Expression {
+	if !p.peekTokenIs(lexer.TOKEN_LPAREN) {
+		p.addError(p.curToken, "SHELL in an expression needs a command in parentheses")
+		return nil
+	}
+	return p.parseIdentifier()
+}
+
+func (p *Parser) parseOptionStatement() ast.Statement {
+	stmt := &ast.OptionStmt{Line: p.curToken.Line}
+	p.nextToken()
+	if !p.curTokenIs(lexer.TOKEN_IDENT) || !strings.EqualFold(p.curToken.Literal, "EXPLICIT") {
+		p.addError(p.curToken, "expected EXPLICIT after OPTION, got %q", p.curToken.Literal)
+		return nil
+	}
+	stmt.Option = "EXPLICIT"
+	return stmt
 }
 
 func (p *Parser) parseRemStatement() ast.Statement {
@@ -1338,6 +1795,16 @@ func (p *Parser) parseOpenStatement() ast.Statement {
 		stmt.FileNum = p.parseExpression(LOWEST)
 	}
 
+	// LEN = reclen
+	if p.peekTokenIs(lexer.TOKEN_IDENT) && strings.EqualFold(p.peekToken.Literal, "LEN") {
+		p.nextToken()
+		if !p.expectPeek(lexer.TOKEN_EQ) {
+			return nil
+		}
+		p.nextToken()
+		stmt.RecLen = p.parseExpression(LOWEST)
+	}
+
 	return stmt
 }
 
@@ -1356,6 +1823,37 @@ func (p *Parser) parseCloseStatement() ast.Statement {
 	return stmt
 }
 
+// parseFileCommandStatement parses KILL, MKDIR, RMDIR and CHDIR, which take
+// a path, and FILES, whose file spec is optional
+func (p *Parser) parseFileCommandStatement() ast.Statement {
+	stmt := &ast.FileCommandStmt{Line: p.curToken.Line, Command: p.curToken.Type.String()}
+	if stmt.Command == "FILES" && p.peekStatementEnd() {
+		return stmt
+	}
+	p.nextToken()
+	stmt.Path = p.parseExpression(LOWEST)
+	if stmt.Path == nil {
+		return nil
+	}
+	return stmt
+}
+
+// parseNameStatement parses NAME old AS new
+func (p *Parser) parseNameStatement() ast.Statement {
+	stmt := &ast.NameStmt{Line: p.curToken.Line}
+	p.nextToken()
+	stmt.OldName = p.parseExpression(LOWEST)
+	if stmt.OldName == nil || !p.expectPeek(lexer.TOKEN_AS) {
+		return nil
+	}
+	p.nextToken()
+	stmt.NewName = p.parseExpression(LOWEST)
+	if stmt.NewName == nil {
+		return nil
+	}
+	return stmt
+}
+
 func (p *Parser) parseLineStatement() ast.Statement {
 	line := p.curToken.Line
 
@@ -1454,6 +1952,15 @@ func (p *Parser) parseLineStatement() ast.Statement {
 func (p *Parser) parseOnStatement() ast.Statement {
 	line := p.curToken.Line
 
+	if p.peekTokenIs(lexer.TOKEN_ERROR) {
+		p.nextToken()
+		if !p.expectPeek(lexer.TOKEN_GOTO) {
+			return nil
+		}
+		p.nextToken()
+		return &ast.OnErrorStmt{Line: line, Target: p.curToken.Literal}
+	}
+
 	p.nextToken() // skip ON
 	expr := p.parseExpression(LOWEST)
 
@@ -1461,35 +1968,60 @@ func (p *Parser) parseOnStatement() ast.Statement {
 
 	if p.curTokenIs(lexer.TOKEN_GOTO) {
 		stmt := &ast.OnGotoStmt{Line: line, Expression: expr}
-		p.nextToken()
-		for !p.curTokenIs(lexer.TOKEN_NEWLINE) && !p.curTokenIs(lexer.TOKEN_EOF) {
-			stmt.Targets = append(stmt.Targets, p.curToken.Literal)
-			if p.peekTokenIs(lexer.TOKEN_COMMA) {
-				p.nextToken()
-			}
-			p.nextToken()
-		}
+		stmt.Targets = p.parseTargets()
 		return stmt
 	}
 
 	if p.curTokenIs(lexer.TOKEN_GOSUB) {
 		stmt := &ast.OnGosubStmt{Line: line, Expression: expr}
-		p.nextToken()
-		for !p.curTokenIs(lexer.TOKEN_NEWLINE) && !p.curTokenIs(lexer.TOKEN_EOF) {
-			stmt.Targets = append(stmt.Targets, p.curToken.Literal)
-			if p.peekTokenIs(lexer.TOKEN_COMMA) {
-				p.nextToken()
-			}
-			p.nextToken()
-		}
+		stmt.Targets = p.parseTargets()
 		return stmt
 	}
 
 	return nil
 }
 
+// parseTargets parses the comma-separated labels or line numbers after ON
+// GOTO or ON GOSUB, leaving the last one as the current token
+func (p *Parser) parseTargets() []string {
+	var targets []string
+	for {
+		p.nextToken()
+		targets = append(targets, p.curToken.Literal)
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			return targets
+		}
+		p.nextToken()
+	}
+}
+
 // Expression parsing
 
+func (p *Parser) parseResumeStatement() ast.Statement {
+	stmt := &ast.ResumeStmt{Line: p.curToken.Line}
+
+	switch {
+	case p.peekTokenIs(lexer.TOKEN_NEXT):
+		p.nextToken()
+		stmt.Next = true
+	case p.peekTokenIs(lexer.TOKEN_IDENT), p.peekTokenIs(lexer.TOKEN_INTEGER), p.peekTokenIs(lexer.TOKEN_LINE_NUMBER):
+		p.nextToken()
+		stmt.Target = p.curToken.Literal
+	}
+
+	return stmt
+}
+
+func (p *Parser) parseErrorStatement() ast.Statement {
+	stmt := &ast.ErrorStmt{Line: p.curToken.Line}
+	p.nextToken()
+	stmt.Code = p.parseExpression(LOWEST)
+	if stmt.Code == nil {
+		return nil
+	}
+	return stmt
+}
+
 func (p *Parser) parseExpression(precedence int) ast.Expression {
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
@@ -1555,32 +2087,55 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 
 	value, err := strconv.ParseInt(numStr, 10, 64)
 	if err != nil {
-		msg := fmt.Sprintf("line %d: could not parse %q as integer", p.curToken.Line, p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken, "could not parse %q as integer", p.curToken.Literal)
 		return nil
 	}
 
 	lit.Value = value
+	lit.Type = ast.DataTypeFromSuffix(p.curToken.Literal[len(numStr):])
+	switch {
+	case lit.Type == ast.TypeInteger && value > math.MaxInt16,
+		lit.Type == ast.TypeLong && value > math.MaxInt32:
+		p.addError(p.curToken, "%s overflows %s", p.curToken.Literal, lit.Type)
+	case lit.Type != ast.TypeUnknown:
+	case value <= math.MaxInt16:
+		lit.Type = ast.TypeInteger
+	case value <= math.MaxInt32:
+		lit.Type = ast.TypeLong
+	default:
+		lit.Type = ast.TypeDouble
+	}
 	return lit
 }
 
+// parseFloatLiteral parses a number with a decimal point or exponent. It is
+// SINGLE unless it has a # suffix, a D exponent or more than 7 digits.
 func (p *Parser) parseFloatLiteral() ast.Expression {
 	lit := &ast.FloatLiteral{Line: p.curToken.Line}
 
 	// Remove any type suffix and normalize D notation
 	numStr := p.curToken.Literal
 	numStr = strings.TrimRight(numStr, "!#")
+	suffix := p.curToken.Literal[len(numStr):]
+	double := strings.ContainsAny(numStr, "Dd")
 	numStr = strings.Replace(numStr, "D", "E", 1)
 	numStr = strings.Replace(numStr, "d", "e", 1)
 
 	value, err := strconv.ParseFloat(numStr, 64)
 	if err != nil {
-		msg := fmt.Sprintf("line %d: could not parse %q as float", p.curToken.Line, p.curToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.addError(p.curToken, "could not parse %q as float", p.curToken.Literal)
 		return nil
 	}
 
 	lit.Value = value
+	lit.Type = ast.DataTypeFromSuffix(suffix)
+	if lit.Type == ast.TypeUnknown {
+		mantissa := strings.TrimLeft(strings.Replace(strings.SplitN(strings.ToUpper(numStr), "E", 2)[0], ".", "", 1), "0")
+		lit.Type = ast.TypeSingle
+		if double || len(mantissa) > 7 || math.Abs(value) > math.MaxFloat32 {
+			lit.Type = ast.TypeDouble
+		}
+	}
 	return lit
 }
 
@@ -1643,6 +2198,29 @@ func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	return exp
 }
 
+// parseFieldAccess parses the field name after a '.' in a record reference
+func (p *Parser) parseFieldAccess(record ast.Expression) ast.Expression {
+	exp := &ast.FieldAccess{Line: p.curToken.Line, Record: record}
+
+	p.nextToken()
+	if !isWord(p.curToken) {
+		p.addError(p.curToken, "expected field name after '.', got %s", p.curToken.Type)
+		return nil
+	}
+	exp.Field = p.curToken.Literal
+
+	return exp
+}
+
+// isWord reports whether tok is an identifier or keyword. Field names may
+// be keywords, as in rec.type.
+func isWord(tok lexer.Token) bool {
+	if tok.Type == lexer.TOKEN_IDENT {
+		return true
+	}
+	return tok.Literal != "" && unicode.IsLetter(rune(tok.Literal[0])) && tok.Type != lexer.TOKEN_REM
+}
+
 func (p *Parser) parseExpressionList(end lexer.TokenType) []ast.Expression {
 	var list []ast.Expression
 
@@ -1667,6 +2245,174 @@ func (p *Parser) parseExpressionList(end lexer.TokenType) []ast.Expression {
 	return list
 }
 
+// parseEraseStatement parses ERASE array[()], ...
+func (p *Parser) parseEraseStatement() ast.Statement {
+	stmt := &ast.EraseStmt{Line: p.curToken.Line}
+
+	for {
+		if !p.expectPeek(lexer.TOKEN_IDENT) {
+			return nil
+		}
+		stmt.Arrays = append(stmt.Arrays, p.curToken.Literal)
+		if p.peekTokenIs(lexer.TOKEN_LPAREN) {
+			p.nextToken()
+			if !p.expectPeek(lexer.TOKEN_RPAREN) {
+				return nil
+			}
+		}
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			return stmt
+		}
+		p.nextToken()
+	}
+}
+
+// parseDefStatement parses DEF FNname[(parameters)] = expression
+func (p *Parser) parseDefStatement() ast.Statement {
+	stmt := &ast.DefFnStmt{Line: p.curToken.Line}
+
+	if !p.expectPeek(lexer.TOKEN_IDENT) {
+		return nil
+	}
+	if !strings.HasPrefix(strings.ToUpper(p.curToken.Literal), "FN") {
+		p.addError(p.curToken, "expected a function name beginning with FN, got %s", p.curToken.Literal)
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+
+	if p.peekTokenIs(lexer.TOKEN_LPAREN) {
+		p.nextToken()
+		stmt.Parameters = p.parseParameters()
+	}
+
+	if !p.expectPeek(lexer.TOKEN_EQ) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Body = p.parseExpression(LOWEST)
+
+	return stmt
+}
+
+// parseDeclareStatement parses DECLARE SUB|FUNCTION name [(parameters)]
+func (p *Parser) parseDeclareStatement() ast.Statement {
+	stmt := &ast.DeclareStmt{Line: p.curToken.Line}
+
+	switch p.peekToken.Type {
+	case lexer.TOKEN_SUB:
+	case lexer.TOKEN_FUNCTION:
+		stmt.Function = true
+	default:
+		p.addError(p.peekToken, "expected SUB or FUNCTION after DECLARE, got %s", p.peekToken.Type)
+		return nil
+	}
+	p.nextToken()
+	if !p.expectPeek(lexer.TOKEN_IDENT) {
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+
+	if p.peekTokenIs(lexer.TOKEN_LPAREN) {
+		p.nextToken()
+		stmt.Parameters = p.parseParameters()
+		stmt.HasParams = true
+	}
+	return stmt
+}
+
+// parseImportStatement parses IMPORT "file" [AS name]. Without AS the
+// library is named after its file.
+func (p *Parser) parseImportStatement() ast.Statement {
+	stmt := &ast.ImportStmt{Line: p.curToken.Line}
+
+	if !p.expectPeek(lexer.TOKEN_STRING) {
+		return nil
+	}
+	stmt.Path = p.curToken.Literal
+
+	if p.peekTokenIs(lexer.TOKEN_AS) {
+		p.nextToken()
+		if !p.expectPeek(lexer.TOKEN_IDENT) {
+			return nil
+		}
+		stmt.Name = p.curToken.Literal
+	} else {
+		base := filepath.Base(stmt.Path)
+		stmt.Name = strings.TrimSuffix(base, filepath.Ext(base))
+		if !isName(stmt.Name) {
+			p.addError(p.curToken, "%q is not a valid library name, use IMPORT \"%s\" AS name", stmt.Name, stmt.Path)
+			return nil
+		}
+	}
+
+	upper := strings.ToUpper(stmt.Name)
+	if p.libraries[upper] {
+		p.addError(p.curToken, "a library named %s is already imported", stmt.Name)
+		return nil
+	}
+	p.libraries[upper] = true
+	return stmt
+}
+
+// isName reports whether s can be used as a name: a letter followed by
+// letters, digits and underscores that is not a keyword
+func isName(s string) bool {
+	for k, r := range s {
+		if !unicode.IsLetter(r) && (k == 0 || !unicode.IsDigit(r) && r != '_') {
+			return false
+		}
+	}
+	return s != "" && lexer.LookupIdent(strings.ToUpper(s)) == lexer.TOKEN_IDENT
+}
+
+// defTypes are the types set by the DEFtype statements
+var defTypes = map[lexer.TokenType]ast.DataType{
+	lexer.TOKEN_DEFINT: ast.TypeInteger,
+	lexer.TOKEN_DEFLNG: ast.TypeLong,
+	lexer.TOKEN_DEFSNG: ast.TypeSingle,
+	lexer.TOKEN_DEFDBL: ast.TypeDouble,
+	lexer.TOKEN_DEFSTR: ast.TypeString,
+}
+
+// parseDefTypeStatement parses DEFINT, DEFLNG, DEFSNG, DEFDBL or DEFSTR
+// with letter ranges such as A-C, X
+func (p *Parser) parseDefTypeStatement() ast.Statement {
+	stmt := &ast.DefTypeStmt{Line: p.curToken.Line, DataType: defTypes[p.curToken.Type]}
+
+	for {
+		from, ok := p.expectLetter()
+		if !ok {
+			return nil
+		}
+		r := ast.LetterRange{From: from, To: from}
+		if p.peekTokenIs(lexer.TOKEN_MINUS) {
+			p.nextToken()
+			if r.To, ok = p.expectLetter(); !ok {
+				return nil
+			}
+		}
+		stmt.Ranges = append(stmt.Ranges, r)
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+
+	p.defTypes = true
+	return stmt
+}
+
+// expectLetter advances to a single letter and returns it in upper case
+func (p *Parser) expectLetter() (byte, bool) {
+	p.nextToken()
+	letter := strings.ToUpper(p.curToken.Literal)
+	if !p.curTokenIs(lexer.TOKEN_IDENT) || len(letter) != 1 || letter[0] < 'A' || letter[0] > 'Z' {
+		p.addError(p.curToken, "expected a letter, got %s", p.curToken.Literal)
+		return 0, false
+	}
+	return letter[0], true
+}
+
 // parseRedimStatement parses REDIM [PRESERVE] array(newsize)
 func (p *Parser) parseRedimStatement() ast.Statement {
 	stmt := &ast.RedimStmt{Line: p.curToken.Line}
@@ -1701,7 +2447,7 @@ func (p *Parser) parseRedimStatement() ast.Statement {
 		if p.peekTokenIs(lexer.TOKEN_AS) {
 			p.nextToken() // move to AS
 			p.nextToken() // move to type
-			dimVar.DataType = p.parseDataType()
+			dimVar.DataType, dimVar.TypeName, dimVar.StringLength = p.parseTypeSpec()
 		}
 
 		stmt.Variables = append(stmt.Variables, dimVar)
@@ -1727,6 +2473,11 @@ func (p *Parser) parseGetStatement() ast.Statement {
 	p.nextToken()
 	stmt.FileNum = p.parseExpression(LOWEST)
 
+	// The next record of a RANDOM file moves through the FIELD buffer
+	if p.peekStatementEnd() {
+		return stmt
+	}
+
 	// Expect comma
 	if !p.expectPeek(lexer.TOKEN_COMMA) {
 		return nil
@@ -1761,6 +2512,11 @@ func (p *Parser) parsePutStatement() ast.Statement {
 	p.nextToken()
 	stmt.FileNum = p.parseExpression(LOWEST)
 
+	// The next record of a RANDOM file moves through the FIELD buffer
+	if p.peekStatementEnd() {
+		return stmt
+	}
+
 	// Expect comma
 	if !p.expectPeek(lexer.TOKEN_COMMA) {
 		return nil
@@ -1784,6 +2540,55 @@ func (p *Parser) parsePutStatement() ast.Statement {
 	return stmt
 }
 
+// parseFieldStatement parses FIELD #n, width AS var$, ...
+func (p *Parser) parseFieldStatement() ast.Statement {
+	stmt := &ast.FieldStmt{Line: p.curToken.Line}
+	if p.peekTokenIs(lexer.TOKEN_HASH) {
+		p.nextToken()
+	}
+	p.nextToken()
+	stmt.FileNum = p.parseExpression(LOWEST)
+	if stmt.FileNum == nil || !p.expectPeek(lexer.TOKEN_COMMA) {
+		return nil
+	}
+
+	for {
+		p.nextToken()
+		width := p.parseExpression(LOWEST)
+		if width == nil || !p.expectPeek(lexer.TOKEN_AS) {
+			return nil
+		}
+		p.nextToken()
+		variable := p.parseExpression(LOWEST)
+		if variable == nil {
+			return nil
+		}
+		stmt.Fields = append(stmt.Fields, ast.FieldSpec{Width: width, Variable: variable})
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			return stmt
+		}
+		p.nextToken()
+	}
+}
+
+// parseJustifyStatement parses LSET var$ = value or RSET var$ = value
+func (p *Parser) parseJustifyStatement() ast.Statement {
+	stmt := &ast.JustifyStmt{Line: p.curToken.Line, Right: p.curTokenIs(lexer.TOKEN_RSET)}
+	p.nextToken()
+
+	// Parse the target above comparison precedence so = is not consumed
+	stmt.Name = p.parseExpression(COMPARISON)
+	if stmt.Name == nil || !p.expectPeek(lexer.TOKEN_EQ) {
+		return nil
+	}
+	p.nextToken()
+	stmt.Value = p.parseExpression(LOWEST)
+	if stmt.Value == nil {
+		return nil
+	}
+	return stmt
+}
+
 // parseSeekStatement parses SEEK #n, position
 func (p *Parser) parseSeekStatement() ast.Statement {
 	stmt := &ast.SeekStmt{Line: p.curToken.Line}
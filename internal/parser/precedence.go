@@ -43,6 +43,7 @@ var precedences = map[lexer.TokenType]int{
 	lexer.TOKEN_SLASH:     PRODUCT,
 	lexer.TOKEN_CARET:     POWER,
 	lexer.TOKEN_LPAREN:    CALL,
+	lexer.TOKEN_DOT:       CALL,
 }
 
 // tokenToOperator maps token types to operator strings
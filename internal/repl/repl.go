@@ -0,0 +1,498 @@
+// Package repl implements the interactive xbasic prompt. Lines starting
+// with a line number are stored in a program buffer; anything else is a
+// command or runs immediately.
+package repl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/interpreter"
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+// Errors reported for commands, worded as GW-BASIC does
+var (
+	errSyntax        = errors.New("Syntax error")
+	errIllegalCall   = errors.New("Illegal function call")
+	errUndefinedLine = errors.New("Undefined line number")
+	errBadFileName   = errors.New("Bad file name")
+	errFileNotFound  = errors.New("File not found")
+	errFileAccess    = errors.New("Path/File access error")
+	errBreak         = errors.New("Break")
+)
+
+// REPL is an interactive session with a program buffer and variables that
+// persist between commands
+type REPL struct {
+	in     *bufio.Reader
+	out    io.Writer
+	interp *interpreter.Interpreter
+
+	lines   map[int]string // program buffer: line number -> statement text
+	program *ast.Program   // parsed buffer, nil when it has been edited
+	errs    []string       // parse errors of the buffer
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // stops the running program
+}
+
+// New creates a REPL reading commands from in and writing to out. Programs
+// run by the REPL read INPUT from the same stream.
+func New(in io.Reader, out io.Writer) *REPL {
+	r := &REPL{
+		in:    bufio.NewReader(in),
+		out:   out,
+		lines: make(map[int]string),
+	}
+	r.interp = interpreter.New(ast.NewProgram())
+	r.interp.SetStdin(r.in)
+	if f, ok := in.(*os.File); ok {
+		r.interp.SetShell(interpreter.OSShell{Stdin: f})
+	}
+	r.interp.SetOutput(func(s string) {
+		io.WriteString(r.out, s)
+	})
+	r.interp.SetInput(func(prompt string) string {
+		io.WriteString(r.out, prompt)
+		line, _ := r.in.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	})
+	return r
+}
+
+// Interrupt stops the running program, if any, as Ctrl+Break does
+func (r *REPL) Interrupt() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Run reads and executes lines until SYSTEM or the end of input
+func (r *REPL) Run() error {
+	fmt.Fprintln(r.out, "xbasic - type SYSTEM to quit")
+	fmt.Fprintln(r.out, "Ok")
+	for {
+		line, err := r.in.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		quit, cmdErr := r.Execute(line)
+		if quit {
+			return nil
+		}
+		if cmdErr != nil {
+			fmt.Fprintln(r.out, cmdErr)
+		}
+		if !isLineNumber(line) {
+			fmt.Fprintln(r.out, "Ok")
+		}
+	}
+}
+
+// Execute handles one line typed at the prompt. It reports whether the
+// line asked to leave the REPL.
+func (r *REPL) Execute(line string) (bool, error) {
+	if isLineNumber(line) {
+		r.editLine(line)
+		return false, nil
+	}
+
+	cmd, arg := splitCommand(line)
+	switch cmd {
+	case "SYSTEM", "QUIT", "EXIT":
+		return true, nil
+	case "LIST":
+		return false, r.list(arg)
+	case "RUN":
+		return false, r.run(arg)
+	case "NEW":
+		r.lines = make(map[int]string)
+		r.program = nil
+		r.interp.Reset()
+		return false, nil
+	case "CLEAR":
+		r.interp.Reset()
+		return false, nil
+	case "LOAD":
+		return false, r.load(arg)
+	case "SAVE":
+		return false, r.save(arg)
+	case "DELETE":
+		return false, r.delete(arg)
+	case "RENUM":
+		return false, r.renum(arg)
+	}
+	return false, r.immediate(line)
+}
+
+// isLineNumber reports whether line starts with a line number
+func isLineNumber(line string) bool {
+	return line != "" && line[0] >= '0' && line[0] <= '9'
+}
+
+// splitCommand returns the upper-cased first word of line and the rest
+func splitCommand(line string) (string, string) {
+	end := strings.IndexAny(line, " \t\"")
+	if end < 0 {
+		return strings.ToUpper(line), ""
+	}
+	return strings.ToUpper(line[:end]), strings.TrimSpace(line[end:])
+}
+
+// editLine stores, replaces or, when only the number is given, deletes a
+// line of the program buffer
+func (r *REPL) editLine(line string) {
+	end := 0
+	for end < len(line) && line[end] >= '0' && line[end] <= '9' {
+		end++
+	}
+	num, _ := strconv.Atoi(line[:end])
+	text := strings.TrimSpace(line[end:])
+	if text == "" {
+		delete(r.lines, num)
+	} else {
+		r.lines[num] = text
+	}
+	r.program = nil
+}
+
+// numbers returns the line numbers of the buffer in order
+func (r *REPL) numbers() []int {
+	nums := make([]int, 0, len(r.lines))
+	for n := range r.lines {
+		nums = append(nums, n)
+	}
+	sort.Ints(nums)
+	return nums
+}
+
+// source returns the program buffer as BASIC source text
+func (r *REPL) source() string {
+	var out strings.Builder
+	for _, n := range r.numbers() {
+		fmt.Fprintf(&out, "%d %s\n", n, r.lines[n])
+	}
+	return out.String()
+}
+
+// parse parses the program buffer, reusing the previous parse while the
+// buffer is unchanged
+func (r *REPL) parse() (*ast.Program, []string) {
+	if r.program == nil {
+		p := parser.New(lexer.New(r.source()))
+		r.program = p.ParseProgram()
+		r.errs = p.Errors()
+	}
+	return r.program, r.errs
+}
+
+// parseRange parses a line range such as "10", "10-50", "-50" or "10-"
+func parseRange(arg string) (int, int, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return 0, int(^uint(0) >> 1), nil
+	}
+	from, to, isRange := strings.Cut(arg, "-")
+	lo, hi := 0, int(^uint(0)>>1)
+	var err error
+	if from = strings.TrimSpace(from); from != "" {
+		if lo, err = strconv.Atoi(from); err != nil {
+			return 0, 0, errSyntax
+		}
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	if to = strings.TrimSpace(to); to != "" {
+		if hi, err = strconv.Atoi(to); err != nil {
+			return 0, 0, errSyntax
+		}
+	}
+	return lo, hi, nil
+}
+
+func (r *REPL) list(arg string) error {
+	lo, hi, err := parseRange(arg)
+	if err != nil {
+		return err
+	}
+	for _, n := range r.numbers() {
+		if n >= lo && n <= hi {
+			fmt.Fprintf(r.out, "%d %s\n", n, r.lines[n])
+		}
+	}
+	return nil
+}
+
+func (r *REPL) delete(arg string) error {
+	if arg == "" {
+		return errIllegalCall
+	}
+	lo, hi, err := parseRange(arg)
+	if err != nil {
+		return err
+	}
+	for n := range r.lines {
+		if n >= lo && n <= hi {
+			delete(r.lines, n)
+		}
+	}
+	r.program = nil
+	return nil
+}
+
+// fileName returns the file name argument of LOAD, SAVE or RUN, adding the
+// .bas extension when there is none
+func fileName(arg string) (string, error) {
+	name := strings.Trim(strings.TrimSpace(arg), "\"")
+	if name == "" {
+		return "", errBadFileName
+	}
+	if !strings.Contains(name[strings.LastIndexAny(name, `/\`)+1:], ".") {
+		name += ".bas"
+	}
+	return name, nil
+}
+
+// load replaces the program buffer with a file. Lines without a line
+// number are numbered in steps of 10 so they can be edited.
+func (r *REPL) load(arg string) error {
+	name, err := fileName(arg)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return errFileNotFound
+	}
+
+	lines := make(map[int]string)
+	last := 0
+	for _, text := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(text, "#!") {
+			continue
+		}
+		if isLineNumber(text) {
+			end := 0
+			for end < len(text) && text[end] >= '0' && text[end] <= '9' {
+				end++
+			}
+			last, _ = strconv.Atoi(text[:end])
+			if body := strings.TrimSpace(text[end:]); body != "" {
+				lines[last] = body
+			}
+			continue
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		last += 10
+		lines[last] = strings.TrimRight(text, " \t")
+	}
+
+	r.lines = lines
+	r.program = nil
+	r.interp.Reset()
+	return nil
+}
+
+func (r *REPL) save(arg string) error {
+	name, err := fileName(arg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name, []byte(r.source()), 0644); err != nil {
+		return errFileAccess
+	}
+	return nil
+}
+
+// run clears the variables and runs the program buffer, from a given
+// line if one is given. RUN "file" loads the file first.
+func (r *REPL) run(arg string) error {
+	start := 0
+	if strings.HasPrefix(arg, "\"") {
+		if err := r.load(arg); err != nil {
+			return err
+		}
+	} else if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return errSyntax
+		}
+		start = -n
+	}
+
+	program, errs := r.parse()
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	if start < 0 {
+		idx, ok := program.LineNumbers[-start]
+		if !ok {
+			return errUndefinedLine
+		}
+		start = idx
+	}
+
+	r.interp.Reset()
+	r.interp.SetProgram(program)
+	return r.exec(start)
+}
+
+// immediate runs a statement typed without a line number. It runs after
+// the program buffer so that it can call its SUBs and FUNCTIONs and GOTO
+// its lines without clearing variables.
+func (r *REPL) immediate(line string) error {
+	p := parser.New(lexer.New(line))
+	stmts := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return errSyntax
+	}
+
+	program, errs := r.parse()
+	if len(errs) > 0 {
+		program = ast.NewProgram()
+	}
+	combined := *program
+	start := len(program.Statements) + 1
+	combined.Statements = append(program.Statements[:len(program.Statements):len(program.Statements)], &ast.EndStmt{})
+	combined.Statements = append(combined.Statements, stmts.Statements...)
+
+	r.interp.SetProgram(&combined)
+	return r.exec(start)
+}
+
+// exec runs the current program from a statement index so that Interrupt
+// can stop it
+func (r *REPL) exec(start int) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.cancel = cancel
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.cancel = nil
+		r.mu.Unlock()
+		cancel()
+	}()
+
+	r.interp.SetContext(ctx)
+	err := r.interp.RunFrom(start)
+	if err == context.Canceled {
+		return errBreak
+	}
+	return err
+}
+
+// renum renumbers the program as RENUM [new][, [old][, increment]],
+// updating the targets of GOTO, GOSUB, THEN, ELSE, RESTORE and RESUME
+func (r *REPL) renum(arg string) error {
+	params := []int{10, 0, 10}
+	if arg != "" {
+		for idx, field := range strings.Split(arg, ",") {
+			if idx >= len(params) {
+				return errSyntax
+			}
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 {
+				return errIllegalCall
+			}
+			params[idx] = n
+		}
+	}
+	newStart, oldStart, step := params[0], params[1], params[2]
+	if step == 0 {
+		return errIllegalCall
+	}
+
+	mapping := make(map[int]int)
+	next := newStart
+	for _, n := range r.numbers() {
+		if n < oldStart {
+			if n >= newStart {
+				return errIllegalCall
+			}
+			continue
+		}
+		mapping[n] = next
+		next += step
+	}
+
+	lines := make(map[int]string)
+	for n, text := range r.lines {
+		num := n
+		if m, ok := mapping[n]; ok {
+			num = m
+		}
+		lines[num] = renumberRefs(text, mapping)
+	}
+	r.lines = lines
+	r.program = nil
+	return nil
+}
+
+// renumberRefs rewrites the line numbers referred to by jump statements
+func renumberRefs(text string, mapping map[int]int) string {
+	type edit struct {
+		pos, end int
+		num      string
+	}
+	var edits []edit
+
+	l := lexer.New(text)
+	refs := false // the previous tokens started a list of line numbers
+	for tok := l.NextToken(); tok.Type != lexer.TOKEN_EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case lexer.TOKEN_GOTO, lexer.TOKEN_GOSUB, lexer.TOKEN_THEN, lexer.TOKEN_ELSE,
+			lexer.TOKEN_RESTORE, lexer.TOKEN_RESUME:
+			refs = true
+			continue
+		case lexer.TOKEN_INTEGER, lexer.TOKEN_LINE_NUMBER:
+			if !refs {
+				continue
+			}
+			if n, err := strconv.Atoi(tok.Literal); err == nil {
+				if m, ok := mapping[n]; ok {
+					pos := tok.Column - 1
+					edits = append(edits, edit{pos, pos + len(tok.Literal), strconv.Itoa(m)})
+				}
+			}
+			continue
+		case lexer.TOKEN_COMMA:
+			// ON n GOTO 10, 20, 30
+			continue
+		}
+		refs = false
+	}
+
+	for k := len(edits) - 1; k >= 0; k-- {
+		e := edits[k]
+		text = text[:e.pos] + e.num + text[e.end:]
+	}
+	return text
+}
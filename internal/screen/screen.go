@@ -203,6 +203,47 @@ func (s *Screen) PollEvent() tcell.Event {
 	return ev
 }
 
+// ReadLine prints a prompt and reads a line of input, echoing typed characters
+func (s *Screen) ReadLine(prompt string) string {
+	s.Print(prompt)
+	var line []rune
+
+	for {
+		ev, ok := s.tcell.PollEvent().(*tcell.EventKey)
+		if !ok {
+			continue
+		}
+
+		switch ev.Key() {
+		case tcell.KeyEnter:
+			s.Print("\n")
+			return string(line)
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+			if len(line) > 0 && s.cursorX > 0 {
+				line = line[:len(line)-1]
+				s.cursorX--
+				s.tcell.SetContent(s.cursorX, s.cursorY, ' ', nil, s.style)
+				s.tcell.Show()
+			}
+		case tcell.KeyCtrlC, tcell.KeyCtrlD:
+			s.Print("\n")
+			return string(line)
+		case tcell.KeyRune:
+			line = append(line, ev.Rune())
+			s.Print(string(ev.Rune()))
+		}
+	}
+}
+
+// WaitKey blocks until a key is pressed
+func (s *Screen) WaitKey() {
+	for {
+		if _, ok := s.tcell.PollEvent().(*tcell.EventKey); ok {
+			return
+		}
+	}
+}
+
 // Sync synchronizes the screen
 func (s *Screen) Sync() {
 	s.tcell.Sync()
@@ -0,0 +1,594 @@
+// Package vet reports suspicious constructs in BASIC programs that parse
+// but are likely to fail or misbehave at run time.
+package vet
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/builtins"
+	"github.com/xbasic/xbasic/internal/lexer"
+)
+
+// Names of the checks, as reported in Diagnostic.Check
+const (
+	CheckTarget      = "target"      // GOTO, GOSUB and similar to a missing label or line
+	CheckUndefined   = "undefined"   // call of an undefined SUB, FUNCTION or array
+	CheckNext        = "next"        // NEXT naming a different variable than its FOR
+	CheckUnreachable = "unreachable" // code after END or GOTO that nothing jumps to
+	CheckOnce        = "once"        // variable that appears only once
+	CheckSuffix      = "suffix"      // variables differing only in type suffix
+	CheckDim         = "dim"         // array used before its DIM
+	CheckConst       = "const"       // assignment to a CONST
+	CheckUnused      = "unused"      // SUB that is never called
+)
+
+// Diagnostic is one problem found in a program
+type Diagnostic struct {
+	Line    int    `json:"line"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("line %d: %s", d.Line, d.Message)
+}
+
+// Functions the interpreter provides itself rather than through the
+// built-in registry, and values read through bare names
+var interpreterFunctions = []string{
+	"EOF", "LOF", "LOC", "FREEFILE", "INKEY$", "ERR", "ERL",
+	"DIR$", "_FILEEXISTS", "_DIREXISTS", "COMMAND$", "_COMMANDCOUNT", "ENVIRON$", "SHELL", "SHELL$",
+}
+
+type checker struct {
+	program   *ast.Program
+	functions map[string]bool // built-in function names
+	arrays    map[string]bool // names given dimensions by DIM or REDIM
+	implicit  map[string]bool // GW-BASIC arrays created by assigning to an element
+	consts    map[string]bool
+	params    map[string]bool // SUB and FUNCTION parameter names
+	diags     []Diagnostic
+}
+
+// Check runs every check over a program and returns the problems found in
+// line order
+func Check(program *ast.Program) []Diagnostic {
+	// The procedures of IMPORTed libraries are known, but only the
+	// program's own statements are checked
+	own := *program
+	own.Statements = nil
+	for _, stmt := range program.Statements {
+		if !imported(stmt) {
+			own.Statements = append(own.Statements, stmt)
+		}
+	}
+	program = &own
+
+	c := &checker{
+		program:   program,
+		functions: make(map[string]bool),
+		arrays:    make(map[string]bool),
+		implicit:  make(map[string]bool),
+		consts:    make(map[string]bool),
+		params:    make(map[string]bool),
+	}
+	for _, name := range builtins.NewRegistry().Names() {
+		c.functions[name] = true
+	}
+	for _, name := range interpreterFunctions {
+		c.functions[name] = true
+	}
+	ast.Inspect(program, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.DimStmt:
+			c.declareArrays(s.Variables)
+		case *ast.RedimStmt:
+			c.declareArrays(s.Variables)
+		case *ast.ConstStmt:
+			c.consts[strings.ToUpper(s.Name)] = true
+		case *ast.SubStatement:
+			c.declareParams(s.Parameters)
+		case *ast.FuncStatement:
+			c.declareParams(s.Parameters)
+		case *ast.DefFnStmt:
+			c.declareParams(s.Parameters)
+		}
+		if program.Dialect == lexer.GWBASIC {
+			for _, target := range ast.Targets(n) {
+				if call, ok := target.(*ast.CallExpr); ok {
+					c.implicit[strings.ToUpper(call.Function)] = true
+				}
+			}
+		}
+		return true
+	})
+
+	c.checkTargets()
+	c.checkCalls()
+	c.checkNext()
+	c.checkUnreachable()
+	c.checkVariables()
+	c.checkDim()
+	c.checkConst()
+	c.checkUnused()
+
+	sort.SliceStable(c.diags, func(a, b int) bool {
+		return c.diags[a].Line < c.diags[b].Line
+	})
+	return c.diags
+}
+
+// imported reports whether stmt is a procedure of an IMPORTed library
+func imported(stmt ast.Statement) bool {
+	switch s := stmt.(type) {
+	case *ast.SubStatement:
+		return s.Library != ""
+	case *ast.FuncStatement:
+		return s.Library != ""
+	}
+	return false
+}
+
+func (c *checker) declareArrays(vars []ast.DimVariable) {
+	for _, v := range vars {
+		if v.Array {
+			c.arrays[strings.ToUpper(v.Name)] = true
+		}
+	}
+}
+
+func (c *checker) declareParams(params []ast.Parameter) {
+	for _, p := range params {
+		c.params[strings.ToUpper(p.Name)] = true
+		if p.Array {
+			c.arrays[strings.ToUpper(p.Name)] = true
+		}
+	}
+}
+
+func (c *checker) report(line int, check, format string, args ...interface{}) {
+	c.diags = append(c.diags, Diagnostic{Line: line, Check: check, Message: fmt.Sprintf(format, args...)})
+}
+
+// jumps calls f for every label or line number a statement refers to
+func jumps(n ast.Node, f func(keyword, target string)) {
+	switch s := n.(type) {
+	case *ast.GotoStmt:
+		f("GOTO", s.Target)
+	case *ast.GosubStmt:
+		f("GOSUB", s.Target)
+	case *ast.OnGotoStmt:
+		for _, t := range s.Targets {
+			f("ON GOTO", t)
+		}
+	case *ast.OnGosubStmt:
+		for _, t := range s.Targets {
+			f("ON GOSUB", t)
+		}
+	case *ast.OnErrorStmt:
+		if s.Target != "0" {
+			f("ON ERROR GOTO", s.Target)
+		}
+	case *ast.RestoreStmt:
+		if s.Target != "" {
+			f("RESTORE", s.Target)
+		}
+	case *ast.ResumeStmt:
+		if s.Target != "" && s.Target != "0" {
+			f("RESUME", s.Target)
+		}
+	}
+}
+
+// defined reports whether a jump target names a line number or label
+func (c *checker) defined(target string) bool {
+	if n, err := strconv.Atoi(target); err == nil {
+		if _, ok := c.program.LineNumbers[n]; ok {
+			return true
+		}
+	}
+	_, ok := c.program.Labels[strings.ToUpper(target)]
+	return ok
+}
+
+// checkTargets reports jumps to labels and line numbers that do not exist.
+// GOTO and GOSUB jump within the main program or the procedure they are
+// in, including into blocks; the other targets are in the main program.
+func (c *checker) checkTargets() {
+	check := func(stmts []ast.Statement) {
+		local := unitLabels(stmts)
+		for _, stmt := range stmts {
+			ast.Inspect(stmt, func(n ast.Node) bool {
+				switch n.(type) {
+				case *ast.SubStatement, *ast.FuncStatement:
+					return false
+				}
+				jumps(n, func(keyword, target string) {
+					ok := c.defined(target)
+					switch keyword {
+					case "GOTO", "GOSUB", "ON GOTO", "ON GOSUB":
+						ok = local[targetKey(target)]
+					}
+					if !ok {
+						c.report(ast.SourceLine(n), CheckTarget, "%s target %s is not a label or line number", keyword, target)
+					}
+				})
+				return true
+			})
+		}
+	}
+
+	check(c.program.Statements)
+	for _, stmt := range c.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.SubStatement:
+			check(s.Body)
+		case *ast.FuncStatement:
+			check(s.Body)
+		}
+	}
+}
+
+// unitLabels returns the labels and line numbers anywhere in the main
+// program or a procedure body, keyed by targetKey
+func unitLabels(stmts []ast.Statement) map[string]bool {
+	labels := make(map[string]bool)
+	for _, stmt := range stmts {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch s := n.(type) {
+			case *ast.SubStatement, *ast.FuncStatement:
+				return false
+			case *ast.LineNumberStmt:
+				labels[strconv.Itoa(s.Number)] = true
+			case *ast.LabelStmt:
+				labels[strings.ToUpper(s.Name)] = true
+			}
+			return true
+		})
+	}
+	return labels
+}
+
+// targetKey normalizes a jump target so that line numbers such as 010 and
+// 10 match
+func targetKey(target string) string {
+	if n, err := strconv.Atoi(target); err == nil {
+		return strconv.Itoa(n)
+	}
+	return strings.ToUpper(target)
+}
+
+// checkCalls reports calls of SUBs, FUNCTIONs and arrays that are not
+// defined anywhere
+func (c *checker) checkCalls() {
+	ast.Inspect(c.program, func(n ast.Node) bool {
+		var name string
+		switch s := n.(type) {
+		case *ast.SubCallStmt:
+			name = s.Name
+		case *ast.CallStmt:
+			name = s.Name
+		case *ast.CallExpr:
+			upper := strings.ToUpper(s.Function)
+			_, fn := c.program.Functions[upper]
+			_, defFn := c.program.DefFns[upper]
+			if !fn && !defFn && !c.arrays[upper] && !c.implicit[upper] && !c.functions[upper] {
+				c.report(s.Line, CheckUndefined, "%s is not a FUNCTION or array", s.Function)
+			}
+			return true
+		default:
+			return true
+		}
+		if _, ok := c.program.Subs[strings.ToUpper(name)]; !ok {
+			c.report(ast.SourceLine(n), CheckUndefined, "SUB %s is not defined", name)
+		}
+		return true
+	})
+}
+
+// checkNext reports NEXT statements naming a different variable than the
+// FOR they close
+func (c *checker) checkNext() {
+	ast.Inspect(c.program, func(n ast.Node) bool {
+		if s, ok := n.(*ast.ForStmt); ok && s.NextVar != nil && s.Variable != nil {
+			if !strings.EqualFold(s.NextVar.Name, s.Variable.Name) {
+				c.report(s.NextVar.Line, CheckNext, "NEXT %s does not match FOR %s on line %d",
+					s.NextVar.Name, s.Variable.Name, s.Line)
+			}
+		}
+		return true
+	})
+}
+
+// checkUnreachable reports the first statement after an END or GOTO that
+// no jump leads back to
+func (c *checker) checkUnreachable() {
+	labels := make(map[string]bool)
+	lines := make(map[int]bool)
+	ast.Inspect(c.program, func(n ast.Node) bool {
+		jumps(n, func(_, target string) {
+			if num, err := strconv.Atoi(target); err == nil {
+				lines[num] = true
+			}
+			labels[strings.ToUpper(target)] = true
+		})
+		return true
+	})
+
+	// enters reports whether a jump leads into a block of stmt
+	enters := func(stmt ast.Statement) bool {
+		found := false
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch s := n.(type) {
+			case *ast.LabelStmt:
+				found = found || labels[strings.ToUpper(s.Name)]
+			case *ast.LineNumberStmt:
+				found = found || lines[s.Number]
+			}
+			return !found
+		})
+		return found
+	}
+
+	check := func(stmts []ast.Statement) {
+		dead, reported := false, false
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *ast.EndStmt, *ast.GotoStmt:
+				if !dead {
+					dead, reported = true, false
+					continue
+				}
+			case *ast.LabelStmt:
+				if labels[strings.ToUpper(s.Name)] {
+					dead = false
+				}
+				continue
+			case *ast.LineNumberStmt:
+				if lines[s.Number] {
+					dead = false
+				}
+				continue
+			case *ast.SubStatement, *ast.FuncStatement, *ast.TypeStmt, *ast.DataStmt, *ast.RemStmt:
+				continue
+			}
+			if dead && enters(stmt) {
+				dead = false
+			}
+			if dead && !reported {
+				c.report(ast.SourceLine(stmt), CheckUnreachable, "unreachable code")
+				reported = true
+			}
+		}
+	}
+
+	check(c.program.Statements)
+	ast.Inspect(c.program, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.IfStmt:
+			check(s.Consequence)
+			check(s.Alternative)
+		case *ast.ForStmt:
+			check(s.Body)
+		case *ast.WhileStmt:
+			check(s.Body)
+		case *ast.DoLoopStmt:
+			check(s.Body)
+		case *ast.SelectCaseStmt:
+			for _, cc := range s.Cases {
+				check(cc.Body)
+			}
+			check(s.CaseElse)
+		case *ast.SubStatement:
+			check(s.Body)
+		case *ast.FuncStatement:
+			check(s.Body)
+		}
+		return true
+	})
+}
+
+// variable is every appearance of one variable name
+type variable struct {
+	name  string // as first written
+	line  int    // of the first appearance
+	count int
+}
+
+// checkVariables reports variables that appear only once, and variables
+// whose names differ only in their type suffix
+func (c *checker) checkVariables() {
+	var order []string
+	vars := make(map[string]*variable)
+	use := func(name string, line int) {
+		upper := strings.ToUpper(name)
+		if c.functions[upper] || c.consts[upper] || c.params[upper] {
+			return
+		}
+		if _, ok := c.program.Functions[upper]; ok {
+			return
+		}
+		if _, ok := c.program.DefFns[upper]; ok {
+			return
+		}
+		v, ok := vars[upper]
+		if !ok {
+			v = &variable{name: name, line: line}
+			vars[upper] = v
+			order = append(order, upper)
+		}
+		v.count++
+	}
+
+	ast.Inspect(c.program, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.Identifier:
+			use(s.Name, s.Line)
+		case *ast.CallExpr:
+			if c.arrays[strings.ToUpper(s.Function)] {
+				use(s.Function, s.Line)
+			}
+		case *ast.ArrayAccess:
+			use(s.Name, s.Line)
+		case *ast.ForStmt:
+			// A mismatched NEXT is reported by checkNext
+			if s.NextVar != nil && s.Variable != nil && strings.EqualFold(s.NextVar.Name, s.Variable.Name) {
+				use(s.NextVar.Name, s.NextVar.Line)
+			}
+		case *ast.DimStmt:
+			for _, v := range s.Variables {
+				use(v.Name, s.Line)
+			}
+		case *ast.SharedStmt:
+			for _, v := range s.Variables {
+				use(v.Name, s.Line)
+			}
+		}
+		return true
+	})
+
+	bases := make(map[string]string) // base name -> first variable with it
+	for _, upper := range order {
+		v := vars[upper]
+		if v.count == 1 && !c.arrays[upper] {
+			c.report(v.line, CheckOnce, "%s is used only once", v.name)
+		}
+		base := strings.TrimRight(upper, "%&!#$")
+		if first, ok := bases[base]; ok {
+			c.report(v.line, CheckSuffix, "%s and %s are different variables", v.name, vars[first].name)
+		} else {
+			bases[base] = upper
+		}
+	}
+}
+
+// checkDim reports arrays used before the DIM that creates them. The main
+// program is checked in source order; SUB and FUNCTION bodies may also use
+// any array the main program dimensions, and their array parameters.
+// GW-BASIC arrays that are assigned to without a DIM are not reported.
+func (c *checker) checkDim() {
+	check := func(stmts []ast.Statement, dimmed map[string]bool) {
+		reported := make(map[string]bool)
+		for _, stmt := range stmts {
+			ast.Inspect(stmt, func(n ast.Node) bool {
+				var name string
+				var line int
+				switch s := n.(type) {
+				case *ast.SubStatement, *ast.FuncStatement:
+					return false
+				case *ast.DimStmt:
+					for _, v := range s.Variables {
+						dimmed[strings.ToUpper(v.Name)] = true
+					}
+					return true
+				case *ast.RedimStmt:
+					for _, v := range s.Variables {
+						dimmed[strings.ToUpper(v.Name)] = true
+					}
+					return true
+				case *ast.CallExpr:
+					name, line = s.Function, s.Line
+				case *ast.ArrayAccess:
+					name, line = s.Name, s.Line
+				default:
+					return true
+				}
+				upper := strings.ToUpper(name)
+				if c.arrays[upper] && !dimmed[upper] && !c.implicit[upper] && !reported[upper] {
+					reported[upper] = true
+					c.report(line, CheckDim, "array %s is used before DIM", name)
+				}
+				return true
+			})
+		}
+	}
+
+	main := make(map[string]bool)
+	check(c.program.Statements, main)
+
+	for _, stmt := range c.program.Statements {
+		var body []ast.Statement
+		var params []ast.Parameter
+		switch s := stmt.(type) {
+		case *ast.SubStatement:
+			body, params = s.Body, s.Parameters
+		case *ast.FuncStatement:
+			body, params = s.Body, s.Parameters
+		default:
+			continue
+		}
+		dimmed := make(map[string]bool)
+		for name := range main {
+			dimmed[name] = true
+		}
+		for _, p := range params {
+			if p.Array {
+				dimmed[strings.ToUpper(p.Name)] = true
+			}
+		}
+		check(body, dimmed)
+	}
+}
+
+// checkConst reports statements that assign to a CONST, which leave its
+// value unchanged
+func (c *checker) checkConst() {
+	assign := func(target ast.Expression) {
+		if id, ok := target.(*ast.Identifier); ok && c.consts[strings.ToUpper(id.Name)] {
+			c.report(id.Line, CheckConst, "assignment to constant %s", id.Name)
+		}
+	}
+	ast.Inspect(c.program, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.LetStmt:
+			assign(s.Name)
+		case *ast.ForStmt:
+			if s.Variable != nil {
+				assign(s.Variable)
+			}
+		case *ast.InputStmt:
+			for _, v := range s.Variables {
+				assign(v)
+			}
+		case *ast.InputFileStmt:
+			for _, v := range s.Variables {
+				assign(v)
+			}
+		case *ast.ReadStmt:
+			for _, v := range s.Variables {
+				assign(v)
+			}
+		case *ast.LineInputStmt:
+			assign(s.Variable)
+		case *ast.LineInputFileStmt:
+			assign(s.Variable)
+		case *ast.SwapStmt:
+			assign(s.Var1)
+			assign(s.Var2)
+		}
+		return true
+	})
+}
+
+// checkUnused reports SUBs that are never called
+func (c *checker) checkUnused() {
+	called := make(map[string]bool)
+	ast.Inspect(c.program, func(n ast.Node) bool {
+		switch s := n.(type) {
+		case *ast.SubCallStmt:
+			called[strings.ToUpper(s.Name)] = true
+		case *ast.CallStmt:
+			called[strings.ToUpper(s.Name)] = true
+		}
+		return true
+	})
+	for name, sub := range c.program.Subs {
+		if !called[name] && sub.Library == "" {
+			c.report(sub.Line, CheckUnused, "SUB %s is never called", sub.Name)
+		}
+	}
+}
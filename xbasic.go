@@ -0,0 +1,302 @@
+// Package xbasic embeds the xBasic interpreter in Go programs.
+//
+// A program is compiled once with Compile and can then be run any number of
+// times with Run, each run getting its own variables, files and I/O streams:
+//
+//	prog, diags := xbasic.Compile(source)
+//	if len(diags) > 0 {
+//		// report diags
+//	}
+//	err := xbasic.Run(ctx, prog, xbasic.Options{
+//		Stdout:  &buf,
+//		Globals: map[string]interface{}{"price#": 9.99},
+//	})
+package xbasic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/xbasic/xbasic/internal/ast"
+	"github.com/xbasic/xbasic/internal/builtins"
+	"github.com/xbasic/xbasic/internal/interpreter"
+	"github.com/xbasic/xbasic/internal/lexer"
+	"github.com/xbasic/xbasic/internal/parser"
+)
+
+// FileSystem is the filesystem used by OPEN and the file and directory
+// statements. See OSFileSystem.
+type FileSystem = interpreter.FileSystem
+
+// File is an open file returned by a FileSystem
+type File = interpreter.File
+
+// OSFileSystem is the FileSystem backed by the host operating system
+type OSFileSystem = interpreter.OSFileSystem
+
+// Shell runs the commands of SHELL. See OSShell.
+type Shell = interpreter.Shell
+
+// OSShell is the Shell of the host operating system
+type OSShell = interpreter.OSShell
+
+// Screen is the display used by CLS, LOCATE, COLOR and graphics statements
+type Screen = interpreter.Screen
+
+// RuntimeError is a run-time error with its QBasic error number. Run returns
+// one for errors not handled by ON ERROR, and host functions may return one
+// to raise a specific error number.
+type RuntimeError = interpreter.RuntimeError
+
+// DataType is a BASIC data type
+type DataType = ast.DataType
+
+// BASIC data types used in function and SUB signatures
+const (
+	Integer = ast.TypeInteger
+	Long    = ast.TypeLong
+	Single  = ast.TypeSingle
+	Double  = ast.TypeDouble
+	String  = ast.TypeString
+)
+
+// Value is a BASIC value passed to or returned from a host function
+type Value = builtins.Value
+
+// Concrete BASIC values
+type (
+	IntegerValue = builtins.IntegerValue
+	LongValue    = builtins.LongValue
+	SingleValue  = builtins.SingleValue
+	DoubleValue  = builtins.DoubleValue
+	StringValue  = builtins.StringValue
+)
+
+// Function is a Go function callable from BASIC. Arguments are checked
+// against Params and converted to the declared types before Fn is called;
+// the result is converted to Result.
+type Function struct {
+	Params []DataType
+	Result DataType
+	Fn     func(args []Value) (Value, error)
+}
+
+// Sub is a Go function callable from BASIC as a SUB
+type Sub struct {
+	Params []DataType
+	Fn     func(args []Value) error
+}
+
+// Program is a compiled BASIC program
+type Program struct {
+	program *ast.Program
+}
+
+// Diagnostic describes a problem found while compiling a program
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message)
+}
+
+// Compile parses BASIC source code. If the source has syntax errors the
+// returned program is nil and the diagnostics describe each error.
+func Compile(source string) (*Program, []Diagnostic) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+
+	var diags []Diagnostic
+	for _, err := range p.ErrorList() {
+		diags = append(diags, Diagnostic{Line: err.Line, Column: err.Column, Message: err.Message})
+	}
+	if len(diags) > 0 {
+		return nil, diags
+	}
+	return &Program{program: program}, nil
+}
+
+// Options configures a single run of a program
+type Options struct {
+	// Stdin is read by INPUT, LINE INPUT, file #0, the KYBD: and
+	// /dev/stdin devices and SHELL commands. Defaults to empty input.
+	Stdin io.Reader
+
+	// Stdout receives PRINT output. Defaults to the Screen if one is set,
+	// otherwise output is discarded. The CONS:, SCRN: and /dev/stdout
+	// devices write here too.
+	Stdout io.Writer
+
+	// Stderr receives output to the /dev/stderr device and the errors of
+	// SHELL commands. Defaults to discarding it.
+	Stderr io.Writer
+
+	// FileSystem is used by OPEN, KILL, NAME, FILES and the other file
+	// statements. Defaults to the host filesystem.
+	FileSystem FileSystem
+
+	// Screen is used for CLS, LOCATE, COLOR and graphics.
+	Screen Screen
+
+	// Shell runs the commands of SHELL. When nil, SHELL fails with
+	// "Advanced feature unavailable"; set it to OSShell{} to let the
+	// program run commands on the host.
+	Shell Shell
+
+	// Args are the program's arguments, read by COMMAND$ and
+	// _COMMANDCOUNT. COMMAND$(0) is empty.
+	Args []string
+
+	// Environ is the environment read by ENVIRON$ and passed to SHELL
+	// commands, as "name=value" strings. Defaults to the host environment.
+	Environ []string
+
+	// Globals are assigned to module-level variables before the program
+	// starts. Values may be Go integers, floats, strings or bools; they are
+	// converted to the type implied by the variable's suffix. A module-level
+	// DIM of a global, which OPTION EXPLICIT requires, keeps its value and
+	// converts it to the declared type.
+	Globals map[string]interface{}
+
+	// Functions are host functions callable from BASIC expressions, keyed
+	// by name including any type suffix (for example "LOOKUPPRICE#").
+	Functions map[string]Function
+
+	// Subs are host SUBs callable with CALL or as statements
+	Subs map[string]Sub
+}
+
+// Run executes a compiled program. It returns when the program ends, fails
+// with a runtime error, or ctx is cancelled.
+func Run(ctx context.Context, prog *Program, opts Options) error {
+	if prog == nil {
+		return fmt.Errorf("xbasic: nil program")
+	}
+
+	interp := interpreter.New(prog.program)
+	interp.SetContext(ctx)
+
+	if opts.Stdin != nil {
+		interp.SetStdin(opts.Stdin)
+	} else {
+		interp.SetStdin(strings.NewReader(""))
+	}
+
+	if opts.Stdout != nil {
+		out := opts.Stdout
+		interp.SetOutput(func(s string) {
+			io.WriteString(out, s)
+		})
+	} else if opts.Screen == nil {
+		interp.SetOutput(func(string) {})
+	}
+
+	if opts.Stderr != nil {
+		interp.SetStderr(opts.Stderr)
+	} else {
+		interp.SetStderr(io.Discard)
+	}
+
+	if opts.Screen != nil {
+		interp.SetScreen(opts.Screen)
+	}
+	if opts.FileSystem != nil {
+		interp.SetFileSystem(opts.FileSystem)
+	}
+	interp.SetShell(opts.Shell)
+	interp.SetArgs(append([]string{""}, opts.Args...))
+	if opts.Environ != nil {
+		interp.SetEnviron(opts.Environ)
+	}
+
+	for name, f := range opts.Functions {
+		if err := interp.RegisterFunction(name, f.Params, f.Result, f.Fn); err != nil {
+			return fmt.Errorf("xbasic: %v", err)
+		}
+	}
+	for name, sub := range opts.Subs {
+		if err := interp.RegisterSub(name, sub.Params, sub.Fn); err != nil {
+			return fmt.Errorf("xbasic: %v", err)
+		}
+	}
+
+	for name, v := range opts.Globals {
+		val, err := toValue(name, v)
+		if err != nil {
+			return err
+		}
+		interp.SetVariable(name, val)
+	}
+
+	if err := interp.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+	if code := interp.ExitCode(); code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
+
+// ExitError is returned by Run when the program ends with END n or
+// SYSTEM n and n is not zero
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("xbasic: exit status %d", e.Code)
+}
+
+// toValue converts a Go value to a BASIC value of the type implied by the
+// variable name's suffix (SINGLE when there is no suffix).
+func toValue(name string, v interface{}) (interpreter.Value, error) {
+	dt := ast.TypeSingle
+	if name != "" {
+		if t := ast.DataTypeFromSuffix(name[len(name)-1:]); t != ast.TypeUnknown {
+			dt = t
+		}
+	}
+
+	var val interpreter.Value
+	switch x := v.(type) {
+	case string:
+		val = &interpreter.StringValue{Val: x}
+	case bool:
+		if x {
+			val = &interpreter.IntegerValue{Val: -1}
+		} else {
+			val = &interpreter.IntegerValue{Val: 0}
+		}
+	case int:
+		val = &interpreter.DoubleValue{Val: float64(x)}
+	case int16:
+		val = &interpreter.DoubleValue{Val: float64(x)}
+	case int32:
+		val = &interpreter.DoubleValue{Val: float64(x)}
+	case int64:
+		val = &interpreter.DoubleValue{Val: float64(x)}
+	case float32:
+		val = &interpreter.DoubleValue{Val: float64(x)}
+	case float64:
+		val = &interpreter.DoubleValue{Val: x}
+	default:
+		return nil, fmt.Errorf("xbasic: unsupported type %T for global %s", v, name)
+	}
+
+	if (dt == ast.TypeString) != (val.Type() == ast.TypeString) {
+		return nil, fmt.Errorf("xbasic: type mismatch for global %s", name)
+	}
+	val, err := interpreter.CoerceValue(val, dt)
+	if err != nil {
+		return nil, fmt.Errorf("xbasic: value out of range for global %s", name)
+	}
+	return val, nil
+}
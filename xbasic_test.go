@@ -0,0 +1,35 @@
+package xbasic
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGlobalsKeptByDim(t *testing.T) {
+	prog, diags := Compile(`OPTION EXPLICIT
+DIM SHARED v AS INTEGER
+DIM w%, s$
+PRINT v; w%; s$
+Show
+SUB Show
+  DIM v
+  PRINT v
+END SUB
+`)
+	if len(diags) > 0 {
+		t.Fatalf("compile: %v", diags)
+	}
+	var out strings.Builder
+	err := Run(context.Background(), prog, Options{
+		Stdout:  &out,
+		Globals: map[string]interface{}{"v": 2.6, "w%": 7, "s$": "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A DIM inside a SUB declares a new local variable
+	if want := " 3 7x\n 0\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+}